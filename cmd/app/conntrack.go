@@ -1,7 +1,9 @@
 package app
 
 import (
-	"k8s.io/kubernetes/pkg/util/sysctl"
+	"io/ioutil"
+	"path"
+	"strconv"
 
 	"github.com/golang/glog"
 )
@@ -15,15 +17,15 @@ type realConntracker struct{}
 
 func (realConntracker) EnableAcct() error {
 	glog.Infof("Enabling nf_conntrack_acct.")
-	return sysctl.New().SetSysctl("net/netfilter/nf_conntrack_acct", 1)
+	return setSysctl("net/netfilter/nf_conntrack_acct", 1)
 }
 
 func (realConntracker) EnableTimestamp() error {
 	glog.Infof("Enabling nf_conntrack_timestamp.")
-	return sysctl.New().SetSysctl("net/netfilter/nf_conntrack_timestamp", 1)
+	return setSysctl("net/netfilter/nf_conntrack_timestamp", 1)
 }
 
-func (realConntracker) SetSocketReadBuffer(desiredBufferSize int) error {
-	glog.Infof("Changing rmem_default to %d", desiredBufferSize)
-	return sysctl.New().SetSysctl("net/core/rmem_default", desiredBufferSize)
+// setSysctl sets the sysctl at path under /proc/sys, e.g. net/netfilter/nf_conntrack_acct.
+func setSysctl(sysctl string, value int) error {
+	return ioutil.WriteFile(path.Join("/proc/sys", sysctl), []byte(strconv.Itoa(value)), 0640)
 }
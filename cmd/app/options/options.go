@@ -1,6 +1,10 @@
 package options
 
 import (
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+
 	"github.com/spf13/pflag"
 )
 
@@ -13,12 +17,55 @@ type K8sConntrackConfig struct {
 
 	EnableConnectionCounter bool
 	EnableFlowCollector     bool
-	SocketBufferSize        string
+	EnableTableMonitor      bool
+	// How far back the fill level of the conntrack table is kept to predict its exhaustion.
+	TableMonitorWindow time.Duration
+	// Delete the UDP conntrack entries of removed endpoints.
+	FlushStaleUDP bool
+	// File holding the token that authorizes quarantine requests. Quarantine is off if empty.
+	QuarantineTokenFile string
+	// Certificate and key the server is served over HTTPS with. Plain HTTP if empty.
+	TLSCertFile       string
+	TLSPrivateKeyFile string
+	// Measure flows from counters reset by every dump instead of diffing consecutive dumps.
+	ZeroCounters bool
+	// Receive buffer size of the conntrack event socket, in bytes.
+	EventSocketBufferSize int
+
+	// Path or PID of the network namespace to monitor instead of our own.
+	NetNS string
+	// Also monitor the network namespaces of the pods on the node.
+	PodNetNS bool
+	// Where the /proc of the node is mounted, to find the network namespaces of the pods.
+	ProcDir string
+	// Name of the node, whose pods are looked up for their network namespaces. Defaults to the
+	// hostname, like the kubelet's.
+	NodeName string
+	// Where the conntrack table is read from: netlink, procfs or auto.
+	Source string
+
+	// Layer 4 protocols to track, by name.
+	Protocols []string
+	// Only track connections whose mark, masked with MarkMask, equals Mark. Off when MarkMask is 0.
+	Mark     uint32
+	MarkMask uint32
+	// Only track connections of these conntrack zones. All zones if empty.
+	Zones []int
+	// Only track connections with an address in one of these networks. All if empty.
+	CIDRs []string
+	// Have the kernel drop the events the filters above reject.
+	EventBPFFilter bool
+
+	// File the conntrack messages read and the endpoints handed to the collectors are recorded to,
+	// for cmd/replay. Off if empty.
+	RecordFile string
 }
 
 func NewK8sConntrackConfig() *K8sConntrackConfig {
 	return &K8sConntrackConfig{
 		ConntrackBindAddress: "0.0.0.0",
+		ProcDir:              "/proc",
+		Source:               conntrack.SourceAuto,
 	}
 }
 
@@ -30,5 +77,24 @@ func (s *K8sConntrackConfig) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&s.ConntrackPort, "conntrack-port", "2222", "The port to bind the k8sconntrack server.")
 	fs.BoolVar(&s.EnableConnectionCounter, "enable-connection-counter", true, "If set false, explicitly disable connection connector.")
 	fs.BoolVar(&s.EnableFlowCollector, "enable-flow-collector", true, "If set false, explicitly disable flow collector.")
-	fs.StringVar(&s.SocketBufferSize, "buffer-size", "", "Set the buffer size when communicating with kernel. Can set small, medium, large.")
+	fs.BoolVar(&s.EnableTableMonitor, "enable-table-monitor", true, "If set false, explicitly disable conntrack table monitor.")
+	fs.DurationVar(&s.TableMonitorWindow, "table-monitor-window", 10*time.Minute, "How far back the fill level of the conntrack table is used to predict when it will be full.")
+	fs.BoolVar(&s.FlushStaleUDP, "flush-stale-udp", false, "If set true, delete the UDP conntrack entries of endpoints that were removed, so that clients get NATed to a live endpoint.")
+	fs.StringVar(&s.QuarantineTokenFile, "quarantine-token-file", s.QuarantineTokenFile, "Path to a file holding the bearer token required to cut the connections of a pod through /conntrack/quarantine. Quarantine is disabled if not set. Unless --conntrack-bind-address is a loopback address, it needs --tls-cert-file and --tls-private-key-file, so that the token isn't sent in clear.")
+	fs.StringVar(&s.TLSCertFile, "tls-cert-file", s.TLSCertFile, "Path to the x509 certificate, followed by its intermediate ones, the k8sconntrack server is served over HTTPS with. Plain HTTP if not set.")
+	fs.StringVar(&s.TLSPrivateKeyFile, "tls-private-key-file", s.TLSPrivateKeyFile, "Path to the private key of --tls-cert-file.")
+	fs.BoolVar(&s.ZeroCounters, "zero-counters", false, "If set true, the flow collector has the kernel reset the conntrack counters at every dump, so flows are measured exactly, including connections that ended between two dumps. The counters are reset for every other reader of the conntrack table too.")
+	fs.IntVar(&s.EventSocketBufferSize, "event-socket-buffer-size", 8*1024*1024, "Receive buffer size in bytes of the socket conntrack events are read from. Events overflowing it are lost and the table is dumped again. 0 keeps the kernel default.")
+	fs.StringVar(&s.NetNS, "netns", s.NetNS, "Path, e.g. /var/run/netns/<name>, or PID of a process of the network namespace whose conntrack table is monitored. Defaults to the one of k8sconntrack.")
+	fs.BoolVar(&s.PodNetNS, "pod-netns", false, "If set true, also monitor the conntrack tables of the network namespaces of the pods on the node, for CNIs tracking pod traffic there. Their connections are served by /conntrack/pods only, the connection counter and the flow collector keep reading the table of --netns.")
+	fs.StringVar(&s.ProcDir, "proc-dir", s.ProcDir, "Where the /proc of the node is mounted, to find the network namespaces of the pods with --pod-netns.")
+	fs.StringVar(&s.NodeName, "node-name", s.NodeName, "Name of the node, to only ask the API server for the pods of the node with --pod-netns. Defaults to the hostname.")
+	fs.StringVar(&s.Source, "source", s.Source, "Where the conntrack table is read from: netlink, or procfs (/proc/net/nf_conntrack) on nodes denying netfilter netlink sockets. procfs has no events, so connections are listed when polled, and can't reset counters for --zero-counters. auto uses netlink if it works.")
+	fs.StringSliceVar(&s.Protocols, "protocols", []string{"tcp", "udp", "sctp", "icmp", "icmpv6"}, "Layer 4 protocols to track. Can set tcp, udp, sctp, icmp, icmpv6 or a protocol number. Conntrack dumps are only filtered by protocol in the kernel when a single one is set; otherwise the entries of the other protocols are read and dropped.")
+	fs.Uint32Var(&s.Mark, "mark", 0, "Only track connections whose conntrack mark, masked with --mark-mask, equals this value.")
+	fs.IntSliceVar(&s.Zones, "zones", s.Zones, "Only track connections of these conntrack zones, e.g. 0,3. All zones are tracked if not set.")
+	fs.Uint32Var(&s.MarkMask, "mark-mask", 0, "Mask applied to the conntrack mark before comparing it with --mark. 0 disables mark filtering.")
+	fs.StringSliceVar(&s.CIDRs, "cidrs", s.CIDRs, "Only track connections with an address, before or after NAT, in one of these networks, e.g. 10.0.0.0/8,fd00::/8. All connections are tracked if not set.")
+	fs.BoolVar(&s.EventBPFFilter, "event-bpf-filter", true, "If set true, the protocols, states and --cidrs tracked are compiled into a BPF program attached to the conntrack event socket, so the kernel drops the other events before they are read.")
+	fs.StringVar(&s.RecordFile, "record-file", s.RecordFile, "Path to a file the conntrack dumps and events read by the connection counter and the flow collector are recorded to, with the endpoints they get, so that they can be replayed offline with cmd/replay. Needs the netlink --source. Nothing is recorded if not set.")
 }
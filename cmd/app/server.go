@@ -2,16 +2,26 @@ package app
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"k8s.io/kubernetes/pkg/api"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+	"k8s.io/kubernetes/pkg/fields"
 	proxyconfig "k8s.io/kubernetes/pkg/proxy/config"
 
 	"github.com/dongyiyang/k8sconnection/cmd/app/options"
+	"github.com/dongyiyang/k8sconnection/pkg/cleaner"
 	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
 	"github.com/dongyiyang/k8sconnection/pkg/flowcollector"
+	"github.com/dongyiyang/k8sconnection/pkg/podnetns"
+	"github.com/dongyiyang/k8sconnection/pkg/replay"
 	"github.com/dongyiyang/k8sconnection/pkg/server"
+	"github.com/dongyiyang/k8sconnection/pkg/tablemonitor"
 	"github.com/dongyiyang/k8sconnection/pkg/transactioncounter"
 
 	"github.com/golang/glog"
@@ -19,8 +29,13 @@ import (
 
 type K8sConntrackServer struct {
 	config             *options.K8sConntrackConfig
+	conntrack          *conntrack.ConnTrack
 	transactionCounter *transactioncounter.TransactionCounter
 	flowCollector      *flowcollector.FlowCollector
+	tableMonitor       *tablemonitor.TableMonitor
+	quarantine         *cleaner.Quarantine
+	podMonitor         *podnetns.Monitor
+	recorder           *replay.Recorder
 }
 
 func NewK8sConntrackServer(config *options.K8sConntrackConfig) (*K8sConntrackServer, error) {
@@ -32,10 +47,6 @@ func NewK8sConntrackServer(config *options.K8sConntrackConfig) (*K8sConntrackSer
 	if err := conntracker.EnableTimestamp(); err != nil {
 		return nil, fmt.Errorf("Error setting netfilter_conntrack_timestamp: %++v", err)
 	}
-	switch config.SocketBufferSize {
-	case "medium":
-		conntracker.SetSocketReadBuffer(33554432)
-	}
 
 	if config.Kubeconfig == "" && config.Master == "" {
 		return nil, fmt.Errorf("Neither --kubeconfig nor --master was specified.  Using default API client.  This might not work.")
@@ -57,24 +68,170 @@ func NewK8sConntrackServer(config *options.K8sConntrackConfig) (*K8sConntrackSer
 		return nil, fmt.Errorf("Invalid API configuration: %v", err)
 	}
 
-	c, err := conntrack.New(conntrack.DefaultFilter)
+	var protos []int
+	for _, name := range config.Protocols {
+		proto, err := conntrack.ProtocolNumber(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --protocols: %v", err)
+		}
+		protos = append(protos, proto)
+	}
+
+	filters := []conntrack.FilterFunc{conntrack.ProtocolFilter(protos...)}
+	if config.MarkMask != 0 {
+		filters = append(filters, conntrack.MarkFilter(config.Mark, config.MarkMask))
+	}
+	var zones []uint16
+	for _, zone := range config.Zones {
+		if zone < 0 || zone > 0xffff {
+			return nil, fmt.Errorf("Invalid --zones: %d isn't a conntrack zone", zone)
+		}
+		zones = append(zones, uint16(zone))
+	}
+	if len(zones) > 0 {
+		filters = append(filters, conntrack.ZoneFilter(zones...))
+	}
+	var cidrs []*net.IPNet
+	for _, s := range config.CIDRs {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --cidrs: %v", err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	if len(cidrs) > 0 {
+		filters = append(filters, conntrack.CIDRFilter(cidrs...))
+	}
+	// Destroy events are kept for their counters, whatever DefaultFilter says.
+	destroyFilter := conntrack.AllOf(filters...)
+	filters = append(filters, conntrack.DefaultFilter)
+
+	// Let the kernel drop what it can before the dump reaches us. It only matches a single
+	// protocol and zone; with several, as by default, they are filtered after the dump.
+	dumpFilter := &conntrack.DumpFilter{Mark: config.Mark, MarkMask: config.MarkMask}
+	if len(protos) == 1 {
+		dumpFilter.L4Proto = uint8(protos[0])
+	}
+	if len(zones) == 1 {
+		dumpFilter.Zone = zones[0]
+	}
+	// And the events: DefaultFilter only passes updates of established connections, which have seen
+	// a reply.
+	var eventFilter *conntrack.EventFilter
+	if config.EventBPFFilter {
+		eventFilter = &conntrack.EventFilter{
+			Events:    conntrack.NfctMsgUpdate,
+			TCPStates: []conntrack.TCPState{conntrack.TCPState_ESTABLISHED},
+			Status:    conntrack.IpsSeenReply,
+			CIDRs:     cidrs,
+		}
+		for _, proto := range protos {
+			eventFilter.L4Protos = append(eventFilter.L4Protos, uint8(proto))
+		}
+	}
+
+	netns := config.NetNS
+	if pid, err := strconv.Atoi(netns); err == nil {
+		netns = podnetns.NetNSPath(config.ProcDir, pid)
+	}
+
+	var recorder *conntrack.Recorder
+	if config.RecordFile != "" {
+		f, err := os.Create(config.RecordFile)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --record-file: %v", err)
+		}
+		recorder = conntrack.NewRecorder(f)
+	}
+
+	c, err := conntrack.NewWithConfig(conntrack.Config{
+		FilterFunc:        conntrack.AllOf(filters...),
+		DumpFilter:        dumpFilter,
+		EventFilter:       eventFilter,
+		ReceiveBufferSize: config.EventSocketBufferSize,
+		// Only the flow collector reads the counters.
+		ZeroCounters:      config.ZeroCounters && config.EnableFlowCollector,
+		DestroyFilterFunc: destroyFilter,
+		NetNS:             netns,
+		Source:            config.Source,
+		Recorder:          recorder,
+	})
 	if err != nil {
 		panic(err)
 	}
 
+	var podMonitor *podnetns.Monitor
+	if config.PodNetNS {
+		glog.V(3).Infof("Pod Network Namespace Monitoring Enabled.")
+		nodeName := config.NodeName
+		if nodeName == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("Error getting hostname for --node-name: %v", err)
+			}
+			// The kubelet names its node after the hostname this way.
+			nodeName = strings.ToLower(strings.TrimSpace(hostname))
+		}
+		// Pods see much less traffic than the node, the default event buffer does.
+		podMonitor = podnetns.NewMonitor(config.ProcDir, conntrack.Config{
+			FilterFunc:  conntrack.AllOf(filters...),
+			DumpFilter:  dumpFilter,
+			EventFilter: eventFilter,
+			Source:      c.Source(),
+		}, podFunc(kubeClient, nodeName))
+	}
+
 	endpointsConfig := proxyconfig.NewEndpointsConfig()
 
+	// The endpoints of the collectors are recorded along with what they read.
+	var collectors []proxyconfig.EndpointsConfigHandler
 	var transactionCounter *transactioncounter.TransactionCounter
 	if config.EnableConnectionCounter {
 		glog.V(3).Infof("Connection Counter Enabled.")
 		transactionCounter = transactioncounter.NewTransactionCounter(c)
-		endpointsConfig.RegisterHandler(transactionCounter)
+		collectors = append(collectors, transactionCounter)
 	}
 	var flowCollector *flowcollector.FlowCollector
 	if config.EnableFlowCollector {
 		glog.V(3).Infof("Flow Collector Enabled.")
 		flowCollector = flowcollector.NewFlowCollector(c)
-		endpointsConfig.RegisterHandler(flowCollector)
+		collectors = append(collectors, flowCollector)
+	}
+	var replayRecorder *replay.Recorder
+	if recorder != nil {
+		glog.V(3).Infof("Recording to %s.", config.RecordFile)
+		replayRecorder = replay.NewRecorder(recorder, collectors...)
+		endpointsConfig.RegisterHandler(replayRecorder)
+	} else {
+		for _, collector := range collectors {
+			endpointsConfig.RegisterHandler(collector)
+		}
+	}
+	var tableMonitor *tablemonitor.TableMonitor
+	if config.EnableTableMonitor {
+		glog.V(3).Infof("Table Monitor Enabled.")
+		if transactionCounter == nil {
+			glog.Warningf("Conntrack entries aren't attributed to pods without the connection counter.")
+		}
+		tableMonitor = tablemonitor.NewTableMonitor(c, transactionCounter, config.TableMonitorWindow)
+	}
+	if config.FlushStaleUDP {
+		glog.V(3).Infof("Stale UDP Cleaner Enabled.")
+		endpointsConfig.RegisterHandler(cleaner.NewStaleUDPCleaner(c))
+	}
+	var quarantine *cleaner.Quarantine
+	if (config.TLSCertFile == "") != (config.TLSPrivateKeyFile == "") {
+		return nil, fmt.Errorf("--tls-cert-file and --tls-private-key-file go together")
+	}
+	if config.QuarantineTokenFile != "" {
+		glog.V(3).Infof("Quarantine Enabled.")
+		if config.TLSCertFile == "" && !isLoopback(config.ConntrackBindAddress) {
+			return nil, fmt.Errorf("Quarantine tokens would be sent in clear to %s: set --tls-cert-file and --tls-private-key-file, or a loopback --conntrack-bind-address", config.ConntrackBindAddress)
+		}
+		quarantine, err = cleaner.NewQuarantine(c, podIPFunc(kubeClient), config.QuarantineTokenFile)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	proxyconfig.NewSourceAPI(
@@ -85,27 +242,103 @@ func NewK8sConntrackServer(config *options.K8sConntrackConfig) (*K8sConntrackSer
 
 	return &K8sConntrackServer{
 		config,
+		c,
 		transactionCounter,
 		flowCollector,
+		tableMonitor,
+		quarantine,
+		podMonitor,
+		replayRecorder,
 	}, nil
 }
 
+// podFunc returns a podnetns.PodFunc asking the API server for the pod with a UID among the pods
+// of node nodeName.
+func podFunc(kubeClient *client.Client, nodeName string) podnetns.PodFunc {
+	selector := fields.OneTermEqualSelector(api.PodHostField, nodeName)
+	return func(uid string) (string, string, error) {
+		pods, err := kubeClient.Pods(api.NamespaceAll).List(api.ListOptions{FieldSelector: selector})
+		if err != nil {
+			return "", "", err
+		}
+		for _, pod := range pods.Items {
+			if string(pod.UID) == uid {
+				return pod.Namespace, pod.Name, nil
+			}
+		}
+		return "", "", fmt.Errorf("No pod of node %s has UID %s", nodeName, uid)
+	}
+}
+
+// isLoopback tells if the server bound to address is only reachable from the node.
+func isLoopback(address string) bool {
+	if address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
+// podIPFunc returns a cleaner.PodIPFunc asking the API server for the IP of a pod.
+func podIPFunc(kubeClient *client.Client) cleaner.PodIPFunc {
+	return func(namespace, name string) (net.IP, error) {
+		pod, err := kubeClient.Pods(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if sc := pod.Spec.SecurityContext; sc != nil && sc.HostNetwork {
+			// Its IP is the one of the node.
+			return nil, fmt.Errorf("Pod %s/%s uses the host network", namespace, name)
+		}
+		ip := net.ParseIP(pod.Status.PodIP)
+		if ip == nil {
+			return nil, fmt.Errorf("Pod %s/%s has no IP", namespace, name)
+		}
+		return ip, nil
+	}
+}
+
+// How often the network namespaces of new pods are looked for.
+const podNetNSSyncPeriod = 10 * time.Second
+
 func (this *K8sConntrackServer) Run() {
-	go server.ListenAndServeProxyServer(this.config.ConntrackBindAddress, this.config.ConntrackPort, this.transactionCounter, this.flowCollector)
+	go server.ListenAndServeProxyServer(this.config.ConntrackBindAddress, this.config.ConntrackPort, this.config.TLSCertFile, this.config.TLSPrivateKeyFile, this.conntrack, this.transactionCounter, this.flowCollector, this.tableMonitor, this.quarantine, this.podMonitor)
+
+	if this.podMonitor != nil {
+		go func() {
+			for range time.Tick(podNetNSSyncPeriod) {
+				if err := this.podMonitor.Sync(); err != nil {
+					glog.Errorf("%v", err)
+				}
+			}
+		}()
+	}
 
 	// Collect transaction and flow information every second.
 	for range time.Tick(1 * time.Second) {
-
-		if this.transactionCounter != nil {
-			glog.V(3).Infof("~~~~~~~~~~~~~~~~   Transaction Counter	~~~~~~~~~~~~~~~~~~~~")
-			this.transactionCounter.ProcessConntrackConnections()
+		if this.recorder != nil {
+			this.recorder.Round(this.collect)
+		} else {
+			this.collect()
 		}
 
-		if this.flowCollector != nil {
-			glog.V(3).Infof("----------------   Flow Collector	------------------------")
-			this.flowCollector.TrackFlow()
+		if this.tableMonitor != nil {
+			this.tableMonitor.Sample()
 		}
 		glog.V(3).Infof("##########################################################")
 		fmt.Println()
 	}
 }
+
+// collect polls the collectors.
+func (this *K8sConntrackServer) collect() {
+	if this.transactionCounter != nil {
+		glog.V(3).Infof("~~~~~~~~~~~~~~~~   Transaction Counter	~~~~~~~~~~~~~~~~~~~~")
+		this.transactionCounter.ProcessConntrackConnections()
+	}
+
+	if this.flowCollector != nil {
+		glog.V(3).Infof("----------------   Flow Collector	------------------------")
+		this.flowCollector.TrackFlow()
+	}
+}
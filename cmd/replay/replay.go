@@ -0,0 +1,93 @@
+// Command replay replays a recording of the agent, made with --record-file, through the
+// transaction counter and the flow collector, and prints what they measured at every poll of the
+// recording, one JSON object a line.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/flowcollector"
+	"github.com/dongyiyang/k8sconnection/pkg/replay"
+	"github.com/dongyiyang/k8sconnection/pkg/transactioncounter"
+
+	"k8s.io/kubernetes/pkg/util/flag"
+	"k8s.io/kubernetes/pkg/util/logs"
+
+	"github.com/spf13/pflag"
+)
+
+// round is what the collectors measured at a poll.
+type round struct {
+	Time         time.Time                         `json:"time"`
+	Transactions []*transactioncounter.Transaction `json:"transactions"`
+	Flows        []*flowcollector.Flow             `json:"flows"`
+}
+
+func main() {
+	var protocols []string
+	pflag.CommandLine.StringSliceVar(&protocols, "protocols", []string{"tcp", "udp", "sctp", "icmp", "icmpv6"}, "Layer 4 protocols to track, as the --protocols of the agent recording.")
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <recording>\n", os.Args[0])
+		pflag.PrintDefaults()
+	}
+
+	flag.InitFlags()
+	logs.InitLogs()
+	defer logs.FlushLogs()
+
+	if pflag.NArg() != 1 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+	if err := run(pflag.Arg(0), protocols); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path string, protocols []string) error {
+	var protos []int
+	for _, name := range protocols {
+		proto, err := conntrack.ProtocolNumber(name)
+		if err != nil {
+			return fmt.Errorf("Invalid --protocols: %v", err)
+		}
+		protos = append(protos, proto)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	protoFilter := conntrack.ProtocolFilter(protos...)
+	player, err := replay.NewPlayer(f, conntrack.AllOf(protoFilter, conntrack.DefaultFilter), protoFilter)
+	if err != nil {
+		return err
+	}
+	defer player.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	var encodeErr error
+	err = player.Play(func() {
+		// As the agent serves them: transactions since the previous poll, flows since the last one.
+		r := round{
+			Time:         player.Now(),
+			Transactions: player.TransactionCounter().GetAllTransactions(),
+			Flows:        player.FlowCollector().GetAllFlows(),
+		}
+		player.TransactionCounter().Reset()
+		player.FlowCollector().Reset()
+		if encodeErr == nil {
+			encodeErr = encoder.Encode(r)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return encodeErr
+}
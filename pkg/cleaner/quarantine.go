@@ -0,0 +1,64 @@
+package cleaner
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+
+	"github.com/golang/glog"
+)
+
+// PodIPFunc returns the IP of a pod. It fails for pods using the network of the node.
+type PodIPFunc func(namespace, name string) (net.IP, error)
+
+// Quarantine cuts all the connections of a pod by deleting their conntrack entries. Their next
+// packets go through the firewall as new connections, so e.g. a network policy isolating the pod
+// applies to them too.
+type Quarantine struct {
+	conntrack *conntrack.ConnTrack
+	podIP     PodIPFunc
+
+	// Callers must present it to cut connections.
+	token string
+}
+
+// NewQuarantine returns a Quarantine that only cuts connections for callers presenting the token
+// in tokenFile.
+func NewQuarantine(c *conntrack.ConnTrack, podIP PodIPFunc, tokenFile string) (*Quarantine, error) {
+	b, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading quarantine token: %v", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return nil, fmt.Errorf("Quarantine token file %s is empty", tokenFile)
+	}
+	return &Quarantine{
+		conntrack: c,
+		podIP:     podIP,
+		token:     token,
+	}, nil
+}
+
+// Authorized tells if token is the quarantine token. It takes the same time whatever the token.
+func (q *Quarantine) Authorized(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(q.token)) == 1
+}
+
+// CutPod deletes the conntrack entries of a pod and returns how many were deleted.
+func (q *Quarantine) CutPod(namespace, name string) (int, error) {
+	ip, err := q.podIP(namespace, name)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := q.conntrack.DeleteIP(ip)
+	if err != nil {
+		return deleted, err
+	}
+	glog.Infof("Quarantined pod %s/%s (%s): deleted %d conntrack entries", namespace, name, ip, deleted)
+	return deleted, nil
+}
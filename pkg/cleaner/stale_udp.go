@@ -0,0 +1,97 @@
+package cleaner
+
+import (
+	"sync"
+	"syscall"
+
+	"k8s.io/kubernetes/pkg/api"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/util"
+
+	"github.com/golang/glog"
+)
+
+// StaleUDPCleaner deletes the UDP conntrack entries of endpoints that were removed.
+// UDP has no teardown, so as long as a client keeps sending, the entry NATing the service address
+// to the removed endpoint stays and the traffic goes nowhere. Once the entry is deleted, the next
+// packet is NATed to a live endpoint.
+type StaleUDPCleaner struct {
+	conntrack *conntrack.ConnTrack
+
+	// Protects endpointIPs.
+	mu sync.Mutex
+
+	// IPs of the endpoints serving UDP at the last update, nil before the first one.
+	endpointIPs map[string]bool
+}
+
+func NewStaleUDPCleaner(c *conntrack.ConnTrack) *StaleUDPCleaner {
+	return &StaleUDPCleaner{
+		conntrack: c,
+	}
+}
+
+// Implement k8s.io/pkg/proxy/config/EndpointsConfigHandler Interface.
+func (this *StaleUDPCleaner) OnEndpointsUpdate(allEndpoints []api.Endpoints) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	current := udpEndpointIPs(allEndpoints)
+	previous := this.endpointIPs
+	this.endpointIPs = current
+	if previous == nil {
+		// Nothing to compare with yet.
+		return
+	}
+
+	removed := make(map[string]bool)
+	for ip := range previous {
+		if !current[ip] {
+			removed[ip] = true
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	deleted, err := this.conntrack.DeleteMatching(staleUDPFilter(removed))
+	if err != nil {
+		glog.Errorf("Error deleting UDP conntrack entries of removed endpoints: %v", err)
+		return
+	}
+	glog.V(3).Infof("Deleted %d UDP conntrack entries of %d removed endpoints", deleted, len(removed))
+}
+
+// udpEndpointIPs returns the IPs of the endpoints serving a UDP port.
+func udpEndpointIPs(allEndpoints []api.Endpoints) map[string]bool {
+	ips := make(map[string]bool)
+	for i := range allEndpoints {
+		endpoints := &allEndpoints[i]
+		for j := range endpoints.Subsets {
+			ss := &endpoints.Subsets[j]
+			udp := false
+			for k := range ss.Ports {
+				if ss.Ports[k].Protocol == api.ProtocolUDP {
+					udp = true
+					break
+				}
+			}
+			if !udp {
+				continue
+			}
+			for k := range ss.Addresses {
+				ips[util.CanonicalIP(ss.Addresses[k].IP)] = true
+			}
+		}
+	}
+	return ips
+}
+
+// staleUDPFilter returns a FilterFunc passing UDP connections served by one of the removed endpoints.
+func staleUDPFilter(removed map[string]bool) conntrack.FilterFunc {
+	return func(c conntrack.ConntrackInfo) bool {
+		// The server is the source of the reply tuple, after DNAT.
+		return c.Proto == syscall.IPPROTO_UDP && removed[c.Server().String()]
+	}
+}
@@ -0,0 +1,85 @@
+package cleaner
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+func TestUDPEndpointIPs(t *testing.T) {
+	allEndpoints := []api.Endpoints{
+		{
+			Subsets: []api.EndpointSubset{
+				{
+					Addresses: []api.EndpointAddress{{IP: "10.0.0.3"}, {IP: "10.0.0.4"}},
+					Ports:     []api.EndpointPort{{Port: 53, Protocol: api.ProtocolTCP}, {Port: 53, Protocol: api.ProtocolUDP}},
+				},
+				{
+					Addresses: []api.EndpointAddress{{IP: "10.0.0.5"}},
+					Ports:     []api.EndpointPort{{Port: 80, Protocol: api.ProtocolTCP}},
+				},
+			},
+		},
+		{
+			Subsets: []api.EndpointSubset{
+				{
+					Addresses: []api.EndpointAddress{{IP: "fd00:0::6"}},
+					Ports:     []api.EndpointPort{{Port: 514, Protocol: api.ProtocolUDP}},
+				},
+			},
+		},
+	}
+	expected := map[string]bool{"10.0.0.3": true, "10.0.0.4": true, "fd00::6": true}
+
+	ips := udpEndpointIPs(allEndpoints)
+	if !reflect.DeepEqual(ips, expected) {
+		t.Errorf("Expected UDP endpoints %v, got %v", expected, ips)
+	}
+}
+
+func TestStaleUDPFilter(t *testing.T) {
+	removed := map[string]bool{"10.0.0.3": true}
+
+	tests := []struct {
+		Proto                int
+		OrigDst              net.IP
+		ReplySrc             net.IP
+		ExpectedFilterResult bool
+	}{
+		{
+			// Through the service address, DNATed to the removed endpoint.
+			Proto:                syscall.IPPROTO_UDP,
+			OrigDst:              net.ParseIP("10.96.0.10"),
+			ReplySrc:             net.ParseIP("10.0.0.3"),
+			ExpectedFilterResult: true,
+		},
+		{
+			Proto:                syscall.IPPROTO_TCP,
+			OrigDst:              net.ParseIP("10.96.0.10"),
+			ReplySrc:             net.ParseIP("10.0.0.3"),
+			ExpectedFilterResult: false,
+		},
+		{
+			Proto:                syscall.IPPROTO_UDP,
+			OrigDst:              net.ParseIP("10.96.0.10"),
+			ReplySrc:             net.ParseIP("10.0.0.4"),
+			ExpectedFilterResult: false,
+		},
+	}
+
+	for i, test := range tests {
+		info := conntrack.ConntrackInfo{
+			Proto: test.Proto,
+			Orig:  conntrack.Tuple{Src: net.ParseIP("10.0.0.9"), Dst: test.OrigDst},
+			Reply: conntrack.Tuple{Src: test.ReplySrc, Dst: net.ParseIP("10.0.0.9")},
+		}
+		if result := staleUDPFilter(removed)(info); result != test.ExpectedFilterResult {
+			t.Errorf("Test %d: expected filter result %t, got %t", i, test.ExpectedFilterResult, result)
+		}
+	}
+}
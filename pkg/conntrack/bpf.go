@@ -0,0 +1,113 @@
+package conntrack
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Ancillary loads finding netlink attributes, #defined in linux/filter.h. Loading from
+// skfAdOff+skfAdNlattr sets A to the offset of the attribute of type X among the attributes starting
+// at offset A, skfAdOff+skfAdNlattrNest to the one of type X nested in the attribute at offset A.
+// Both set A to 0 if there is no such attribute.
+const (
+	skfAdOff        = -0x1000
+	skfAdNlattr     = 12
+	skfAdNlattrNest = 16
+)
+
+// bpfProgram assembles a classic BPF program, as run by socket filters. Jumps go to labels, which
+// are resolved by assemble.
+type bpfProgram struct {
+	insns []syscall.SockFilter
+	// labels are the indexes of the instructions they were put before.
+	labels map[string]int
+	// jumps are the conditional jumps, to resolve once all labels are known.
+	jumps []bpfJump
+	// nLabels numbers the labels of newLabel.
+	nLabels int
+}
+
+type bpfJump struct {
+	insn int
+	// Labels jumped to if the condition holds or not, "" for the next instruction.
+	jt, jf string
+}
+
+func newBPFProgram() *bpfProgram {
+	return &bpfProgram{labels: make(map[string]int)}
+}
+
+// newLabel returns a label not used yet.
+func (p *bpfProgram) newLabel() string {
+	p.nLabels++
+	return fmt.Sprintf("L%d", p.nLabels)
+}
+
+// label puts label before the next instruction.
+func (p *bpfProgram) label(label string) {
+	p.labels[label] = len(p.insns)
+}
+
+func (p *bpfProgram) stmt(code uint16, k uint32) {
+	p.insns = append(p.insns, syscall.SockFilter{Code: code, K: k})
+}
+
+// jump is a conditional jump to jt if the condition holds, jf otherwise. Its targets are limited to
+// the next 255 instructions, ja goes farther.
+func (p *bpfProgram) jump(code uint16, k uint32, jt, jf string) {
+	p.jumps = append(p.jumps, bpfJump{insn: len(p.insns), jt: jt, jf: jf})
+	p.stmt(syscall.BPF_JMP|code|syscall.BPF_K, k)
+}
+
+// ja jumps to label unconditionally.
+func (p *bpfProgram) ja(label string) {
+	p.jumps = append(p.jumps, bpfJump{insn: len(p.insns), jt: label})
+	p.stmt(syscall.BPF_JMP|syscall.BPF_JA, 0)
+}
+
+// ret ends the program, keeping the first k bytes of the packet. 0 drops it.
+func (p *bpfProgram) ret(k uint32) {
+	p.stmt(syscall.BPF_RET|syscall.BPF_K, k)
+}
+
+// assemble resolves the jumps and returns the instructions.
+func (p *bpfProgram) assemble() ([]syscall.SockFilter, error) {
+	if len(p.insns) > syscall.BPF_MAXINSNS {
+		return nil, fmt.Errorf("BPF program has %d instructions, at most %d are allowed", len(p.insns), syscall.BPF_MAXINSNS)
+	}
+	insns := make([]syscall.SockFilter, len(p.insns))
+	copy(insns, p.insns)
+	offset := func(from int, label string) (int, error) {
+		if label == "" {
+			return 0, nil
+		}
+		to, ok := p.labels[label]
+		if !ok {
+			return 0, fmt.Errorf("undefined BPF label %s", label)
+		}
+		// Jumps are relative to the next instruction, and only go forward.
+		if to <= from {
+			return 0, fmt.Errorf("BPF label %s is not after its jump", label)
+		}
+		return to - from - 1, nil
+	}
+	for _, j := range p.jumps {
+		jt, err := offset(j.insn, j.jt)
+		if err != nil {
+			return nil, err
+		}
+		if insns[j.insn].Code == syscall.BPF_JMP|syscall.BPF_JA {
+			insns[j.insn].K = uint32(jt)
+			continue
+		}
+		jf, err := offset(j.insn, j.jf)
+		if err != nil {
+			return nil, err
+		}
+		if jt > 0xff || jf > 0xff {
+			return nil, fmt.Errorf("BPF jump from instruction %d is too far", j.insn)
+		}
+		insns[j.insn].Jt, insns[j.insn].Jf = uint8(jt), uint8(jf)
+	}
+	return insns, nil
+}
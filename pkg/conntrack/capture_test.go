@@ -0,0 +1,116 @@
+package conntrack
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestCapture writes what the kernel sends about the conntrack table of the network namespace it
+// runs in, so that testdata comes from a real kernel:
+//
+//	go test -c && ./conntrack.test -test.run TestCapture -capture /tmp/capture -capture-events 30s
+//
+// It follows the events for -capture-events, while the traffic to capture is made, then dumps the
+// expectations and the table and copies /proc/net/nf_conntrack right after. Every message goes to
+// a file of its own, named after the order it was read in, what it is and its protocol. The ones
+// worth keeping are copied to testdata under a meaningful name, and their .golden written with
+// -update. Needs CAP_NET_ADMIN, and a ruleset using conntrack for the kernel to track anything.
+var (
+	capture       = flag.String("capture", "", "Directory TestCapture writes the conntrack messages of the kernel to. TestCapture is skipped if not set.")
+	captureEvents = flag.Duration("capture-events", 0, "How long TestCapture follows the conntrack events before dumping the table.")
+)
+
+func TestCapture(t *testing.T) {
+	if *capture == "" {
+		t.Skip("-capture not set")
+	}
+	if err := os.MkdirAll(*capture, 0755); err != nil {
+		t.Fatalf("Error creating %s: %v", *capture, err)
+	}
+	var n int
+	write := func(kind string, msg syscall.NetlinkMessage) error {
+		n++
+		name := fmt.Sprintf("%03d_%s", n, kind)
+		if parsed, err := parseAny(msg); err != nil {
+			t.Errorf("Error parsing message %d: %v", n, err)
+		} else if conn, ok := parsed.(*ConntrackInfo); ok {
+			if kind == "event" {
+				name = fmt.Sprintf("%03d_%s", n, eventKinds[conn.MsgType])
+			}
+			name += "_" + ProtocolName(conn.Proto)
+		}
+		return ioutil.WriteFile(filepath.Join(*capture, name+".nl"), messageBytes(msg), 0644)
+	}
+
+	requests := newRequestSockets("", nil)
+	defer requests.close()
+	if *captureEvents > 0 {
+		captureEventMessages(t, requests, *captureEvents, write)
+	}
+
+	request := buildSubsysRequest(NFNL_SUBSYS_CTNETLINK_EXP, uint8(IpctnlMsgExpGet), syscall.NLM_F_DUMP, syscall.AF_UNSPEC, nil)
+	err := requests.request(request, NFNL_SUBSYS_CTNETLINK_EXP, func(msg syscall.NetlinkMessage) error {
+		return write("expectation", msg)
+	})
+	if err != nil {
+		t.Fatalf("Error dumping expectations: %v", err)
+	}
+	err = requests.request(buildConntrackListRequest(IpctnlMsgCtGet, syscall.AF_UNSPEC, nil), NFNL_SUBSYS_CTNETLINK, func(msg syscall.NetlinkMessage) error {
+		return write("dump", msg)
+	})
+	if err != nil {
+		t.Fatalf("Error dumping the table: %v", err)
+	}
+	procfs, err := ioutil.ReadFile(procfsConntrackPath)
+	if err != nil {
+		t.Fatalf("Error reading %s: %v", procfsConntrackPath, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*capture, "nf_conntrack"), procfs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Wrote %d messages to %s", n, *capture)
+}
+
+var eventKinds = map[NfConntrackEventType]string{
+	NfctMsgNew:     "new",
+	NfctMsgUpdate:  "update",
+	NfctMsgDestroy: "destroy",
+}
+
+// captureEventMessages passes the event messages read for d to write.
+func captureEventMessages(t *testing.T, requests *requestSockets, d time.Duration, write func(string, syscall.NetlinkMessage) error) {
+	events, err := requests.dial(NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_UPDATE | NF_NETLINK_CONNTRACK_DESTROY)
+	if err != nil {
+		t.Fatalf("Error following events: %v", err)
+	}
+	defer events.Close()
+	if err := events.SetReceiveTimeout(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, receiveBufferLen)
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		nr, err := events.Receive(b)
+		if errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error reading events: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(b[:nr])
+		if err != nil {
+			t.Fatalf("Error parsing events: %v", err)
+		}
+		for _, msg := range msgs {
+			if err := write("event", msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
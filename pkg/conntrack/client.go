@@ -3,11 +3,29 @@ package conntrack
 import (
 	"fmt"
 	"syscall"
-	"unsafe"
+	"time"
+
+	"github.com/golang/glog"
 )
 
-func connectNetfilter(groups uint32) (int, *syscall.SockaddrNetlink, error) {
-	s, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_NETFILTER)
+// Layer 4 protocols we know how to parse. Entries of other protocols are dropped.
+var supportedProtocols = map[int]bool{
+	syscall.IPPROTO_TCP:    true,
+	syscall.IPPROTO_UDP:    true,
+	syscall.IPPROTO_SCTP:   true,
+	syscall.IPPROTO_ICMP:   true,
+	syscall.IPPROTO_ICMPV6: true,
+}
+
+// connectNetfilter opens a netfilter socket in the network namespace at netns, our own if empty,
+// subscribed to the multicast groups.
+func connectNetfilter(netns string, groups uint32) (int, *syscall.SockaddrNetlink, error) {
+	var s int
+	err := inNetNS(netns, func() error {
+		var err error
+		s, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_NETFILTER)
+		return err
+	})
 	if err != nil {
 		return 0, nil, err
 	}
@@ -16,120 +34,174 @@ func connectNetfilter(groups uint32) (int, *syscall.SockaddrNetlink, error) {
 		Groups: groups,
 	}
 	if err := syscall.Bind(s, lsa); err != nil {
+		syscall.Close(s)
 		return 0, nil, err
 	}
 	return s, lsa, nil
 }
 
-// Read from Netfilter and parse the result into ConntrackInfo object.
-// The resulting ConntrackInfo object is then passed into callback for further processing.
-func readMessagesFromNetfilter(s int, callback func(ConntrackInfo)) error {
+// kernelDialer is the Dialer of the sockets of the kernel.
+type kernelDialer struct{}
+
+func (kernelDialer) Dial(netns string, groups uint32) (Socket, error) {
+	s, _, err := connectNetfilter(netns, groups)
+	if err != nil {
+		return nil, err
+	}
+	return netlinkSocket(s), nil
+}
+
+// netlinkSocket is a Socket of the kernel.
+type netlinkSocket int
+
+func (s netlinkSocket) Send(p []byte) error {
+	// The kernel is the default destination of an unconnected netlink socket.
+	_, err := syscall.Write(int(s), p)
+	return err
+}
+
+func (s netlinkSocket) Receive(b []byte) (int, error) {
+	n, _, err := syscall.Recvfrom(int(s), b, 0)
+	return n, err
+}
+
+// SetReceiveBufferSize uses SO_RCVBUFFORCE, which can go beyond net.core.rmem_max but needs
+// CAP_NET_ADMIN, and falls back to SO_RCVBUF.
+func (s netlinkSocket) SetReceiveBufferSize(size int) error {
+	if err := syscall.SetsockoptInt(int(s), syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, size); err == nil {
+		return nil
+	}
+	if err := syscall.SetsockoptInt(int(s), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size); err != nil {
+		return fmt.Errorf("Error setting receive buffer size to %d: %v", size, err)
+	}
+	return nil
+}
+
+func (s netlinkSocket) SetReceiveTimeout(d time.Duration) error {
+	tv := syscall.NsecToTimeval(int64(d))
+	return syscall.SetsockoptTimeval(int(s), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+}
+
+func (s netlinkSocket) AttachFilter(prog []syscall.SockFilter) error {
+	return syscall.AttachLsf(int(s), prog)
+}
+
+func (s netlinkSocket) Close() {
+	syscall.Close(int(s))
+}
+
+// readNetlinkMessages reads the replies to a request from s, which must come from subsystem subsys,
+// and passes them to callback, until the kernel says it is done. It returns nil once a dump is complete or the request acknowledged, and the
+// first error the kernel or callback reported otherwise.
+// An interrupted dump is still read to the end, then ErrDumpInterrupted is returned.
+func readNetlinkMessages(s Socket, subsys uint8, callback func(syscall.NetlinkMessage) error) error {
+	_, err := readReply(s, subsys, callback)
+	return err
+}
+
+// readReply is readNetlinkMessages, and also tells whether the reply was read to its end, a
+// NLMSG_DONE or NLMSG_ERROR. If not, e.g. because callback failed in the middle of a dump, the rest
+// of it is still queued on s.
+func readReply(s Socket, subsys uint8, callback func(syscall.NetlinkMessage) error) (bool, error) {
+	bp := receiveBuffers.Get().(*[]byte)
+	defer receiveBuffers.Put(bp)
+	rb := *bp
+
+	var interrupted bool
 	for {
-		rb := make([]byte, syscall.Getpagesize())
-		nr, _, err := syscall.Recvfrom(s, rb, 0)
+		nr, err := s.Receive(rb)
 		if err != nil {
-			return fmt.Errorf("Error Recvfrom netfilter: %v", err)
+			return false, fmt.Errorf("Error Recvfrom netfilter: %w", err)
 		}
 
 		msgs, err := syscall.ParseNetlinkMessage(rb[:nr])
 		if err != nil {
-			return fmt.Errorf("Error parsing netlink message: %s", err)
+			return false, fmt.Errorf("Error parsing netlink message: %s", err)
 		}
 		for _, msg := range msgs {
-			if err := nfnlIsError(msg.Header); err != nil {
-				return fmt.Errorf("Got an error message: %s\n", err)
+			if msg.Header.Flags&NLM_F_DUMP_INTR != 0 {
+				interrupted = true
 			}
-			if nfnlSubsysID(msg.Header.Type) != NFNL_SUBSYS_CTNETLINK {
-				return fmt.Errorf("Unexpected subsys_id: %d\n",
-					nfnlSubsysID(msg.Header.Type))
-			}
-
-			// Now we can parse the raw message got from Netfilter.
-			conn, err := parsePayload(msg.Data[sizeofGenmsg:])
-			if err != nil {
-				return fmt.Errorf("Error parsing payload: %v", err)
+			if err := nfnlIsError(msg); err == errDone {
+				if interrupted {
+					return true, ErrDumpInterrupted
+				}
+				return true, nil
+			} else if err != nil {
+				return true, err
 			}
-
-			if conn.Proto != syscall.IPPROTO_TCP {
-				// NOTE: We only process tcp connection right now.
-				continue
+			if nfnlSubsysID(msg.Header.Type) != subsys {
+				return false, fmt.Errorf("Unexpected subsys_id: %d\n",
+					nfnlSubsysID(msg.Header.Type))
 			}
-
-			// Set connection type: Taken from conntrack/parse.c:__parse_message_type.
-			switch CntlMsgTypes(nflnMsgType(msg.Header.Type)) {
-			case IpctnlMsgCtNew:
-				conn.MsgType = NfctMsgUpdate
-				if msg.Header.Flags&(syscall.NLM_F_CREATE|syscall.NLM_F_EXCL) > 0 {
-					conn.MsgType = NfctMsgNew
-				}
-			case IpctnlMsgCtDelete:
-				conn.MsgType = NfctMsgDestroy
+			if err := callback(msg); err != nil {
+				return false, err
 			}
-
-			callback(*conn)
 		}
 	}
 }
 
-type nfgenmsg struct {
-	Family  uint8  /* AF_xxx */
-	Version uint8  /* nfnetlink version */
-	ResID   uint16 /* resource id */
+// Read from Netfilter and parse the result into ConntrackInfo object.
+// The resulting ConntrackInfo object is then passed into callback for further processing.
+// It returns nil once a dump is complete, and an error if the kernel or callback reported one.
+// An interrupted dump is still read to the end, then ErrDumpInterrupted is returned.
+// Malformed messages are logged and skipped, so one bad entry doesn't stop a dump or the events.
+func readMessagesFromNetfilter(s Socket, callback func(ConntrackInfo) error) error {
+	return readNetlinkMessages(s, NFNL_SUBSYS_CTNETLINK, conntrackMessages(callback))
 }
 
-const (
-	sizeofGenmsg = uint32(unsafe.Sizeof(nfgenmsg{})) // TODO
-)
+// conntrackMessages returns a callback for readNetlinkMessages parsing connections and passing them
+// to callback, like readMessagesFromNetfilter.
+func conntrackMessages(callback func(ConntrackInfo) error) func(syscall.NetlinkMessage) error {
+	return func(msg syscall.NetlinkMessage) error {
+		// Now we can parse the raw message got from Netfilter.
+		var conn ConntrackInfo
+		if err := parseMessageInto(msg, &conn); err != nil {
+			glog.Errorf("Error parsing payload, skipping message: %v", err)
+			return nil
+		}
 
-type ConntrackListReq struct {
-	Header syscall.NlMsghdr
-	Body   nfgenmsg
+		if !supportedProtocols[conn.Proto] {
+			return nil
+		}
+
+		return callback(conn)
+	}
 }
 
-func (c *ConntrackListReq) toWireFormat() []byte {
-	// adapted from syscall/NetlinkRouteRequest.toWireFormat
-	b := make([]byte, c.Header.Len)
-	*(*uint32)(unsafe.Pointer(&b[0:4][0])) = c.Header.Len
-	*(*uint16)(unsafe.Pointer(&b[4:6][0])) = c.Header.Type
-	*(*uint16)(unsafe.Pointer(&b[6:8][0])) = c.Header.Flags
-	*(*uint32)(unsafe.Pointer(&b[8:12][0])) = c.Header.Seq
-	*(*uint32)(unsafe.Pointer(&b[12:16][0])) = c.Header.Pid
-	b[16] = byte(c.Body.Family)
-	b[17] = byte(c.Body.Version)
-	*(*uint16)(unsafe.Pointer(&b[18:20][0])) = c.Body.ResID
-	return b
+// buildConntrackListRequest builds a dump request for the given address family.
+// msgType is IpctnlMsgCtGet, or IpctnlMsgCtGetCtrzero to also reset the counters of the dumped entries.
+// AF_UNSPEC asks the kernel for the entries of every family.
+// The attributes of filter, if any, make the kernel skip the entries that don't match.
+func buildConntrackListRequest(msgType CntlMsgTypes, family uint8, filter *DumpFilter) []byte {
+	var attrs []byte
+	if filter != nil {
+		attrs = filter.attrs()
+	}
+	return buildRequest(msgType, syscall.NLM_F_DUMP, family, attrs)
 }
 
-func buildConntrackListRequest() []byte {
-	// build the request.
-	msg := ConntrackListReq{
+// buildRequest builds a ctnetlink request of type msgType with the given flags, besides
+// NLM_F_REQUEST, and attributes.
+func buildRequest(msgType CntlMsgTypes, flags uint16, family uint8, attrs []byte) []byte {
+	return buildSubsysRequest(NFNL_SUBSYS_CTNETLINK, uint8(msgType), flags, family, attrs)
+}
+
+// buildSubsysRequest builds a request of type msgType to the nfnetlink subsystem subsys.
+func buildSubsysRequest(subsys, msgType uint8, flags uint16, family uint8, attrs []byte) []byte {
+	msg := nfnlRequest{
 		Header: syscall.NlMsghdr{
-			Len:   syscall.NLMSG_HDRLEN + sizeofGenmsg,
-			Type:  (NFNL_SUBSYS_CTNETLINK << 8) | uint16(IpctnlMsgCtGet),
-			Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+			Type:  uint16(subsys)<<8 | uint16(msgType),
+			Flags: syscall.NLM_F_REQUEST | flags,
 			Pid:   0,
 			Seq:   0,
 		},
 		Body: nfgenmsg{
-			Family:  syscall.AF_INET,
+			Family:  family,
 			Version: NFNETLINK_V0,
 			ResID:   0,
 		},
+		Attrs: attrs,
 	}
 	return msg.toWireFormat()
-
-}
-
-func sendRequestToNetfilter() (int, error) {
-	fd, sa, err := connectNetfilter(0)
-	if err != nil {
-		return -1, fmt.Errorf("Error connecting Netfilter: %s", err)
-	}
-
-	p := buildConntrackListRequest()
-
-	if err := syscall.Sendto(fd, p, 0, sa); err != nil {
-		return -1, err
-	}
-	return fd, nil
 }
@@ -0,0 +1,172 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scriptedSocket returns its datagrams from Receive, in order, then EAGAIN.
+type scriptedSocket struct {
+	datagrams [][]byte
+}
+
+func (s *scriptedSocket) Send(p []byte) error { return nil }
+
+func (s *scriptedSocket) Receive(b []byte) (int, error) {
+	if len(s.datagrams) == 0 {
+		return 0, syscall.EAGAIN
+	}
+	n := copy(b, s.datagrams[0])
+	s.datagrams = s.datagrams[1:]
+	return n, nil
+}
+
+func (s *scriptedSocket) SetReceiveBufferSize(int) error               { return nil }
+func (s *scriptedSocket) SetReceiveTimeout(time.Duration) error        { return nil }
+func (s *scriptedSocket) AttachFilter(prog []syscall.SockFilter) error { return nil }
+func (s *scriptedSocket) Close()                                       {}
+
+// errorMessage returns a NLMSG_ERROR reporting errno, an acknowledgement if 0.
+func errorMessage(errno syscall.Errno) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN+4+syscall.NLMSG_HDRLEN)
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], syscall.NLMSG_ERROR)
+	binary.NativeEndian.PutUint32(b[syscall.NLMSG_HDRLEN:], uint32(-int32(errno)))
+	return b
+}
+
+func TestNfnlIsError(t *testing.T) {
+	parse := func(b []byte) syscall.NetlinkMessage {
+		msgs, err := syscall.ParseNetlinkMessage(b)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Error parsing message: %d messages, %v", len(msgs), err)
+		}
+		return msgs[0]
+	}
+	truncated := parse(errorMessage(syscall.EPERM))
+	truncated.Data = truncated.Data[:3]
+	tests := []struct {
+		Name          string
+		Msg           syscall.NetlinkMessage
+		ExpectedErrno syscall.Errno
+		ExpectedErr   error
+	}{
+		{Name: "done", Msg: parse(doneMessage()), ExpectedErr: errDone},
+		{Name: "acknowledgement", Msg: parse(errorMessage(0)), ExpectedErr: errDone},
+		{Name: "ENOENT", Msg: parse(errorMessage(syscall.ENOENT)), ExpectedErrno: syscall.ENOENT},
+		{Name: "EPERM", Msg: parse(errorMessage(syscall.EPERM)), ExpectedErrno: syscall.EPERM},
+		{Name: "entry", Msg: parse(dumpEntry(t))},
+	}
+	for _, test := range tests {
+		err := nfnlIsError(test.Msg)
+		if test.ExpectedErrno != 0 {
+			var netlinkErr *NetlinkError
+			if !errors.As(err, &netlinkErr) || netlinkErr.Errno != test.ExpectedErrno {
+				t.Errorf("%s: expected errno %v, got %v", test.Name, test.ExpectedErrno, err)
+			}
+			if !errors.Is(err, test.ExpectedErrno) {
+				t.Errorf("%s: expected %v to be %v", test.Name, err, test.ExpectedErrno)
+			}
+			continue
+		}
+		if err != test.ExpectedErr {
+			t.Errorf("%s: expected %v, got %v", test.Name, test.ExpectedErr, err)
+		}
+	}
+	if err := nfnlIsError(truncated); err == nil || err == errDone {
+		t.Errorf("truncated: expected an error, got %v", err)
+	}
+}
+
+func TestReadNetlinkMessages(t *testing.T) {
+	entry := dumpEntry(t)
+	interrupted := append([]byte(nil), entry...)
+	binary.NativeEndian.PutUint16(interrupted[6:8], syscall.NLM_F_MULTI|NLM_F_DUMP_INTR)
+	expectation := append([]byte(nil), entry...)
+	binary.NativeEndian.PutUint16(expectation[4:6], NFNL_SUBSYS_CTNETLINK_EXP<<8)
+	join := func(msgs ...[]byte) []byte {
+		return bytes.Join(msgs, nil)
+	}
+	tests := []struct {
+		Name            string
+		Datagrams       [][]byte
+		ExpectedEntries int
+		ExpectedErr     error
+		ExpectedErrno   syscall.Errno
+		ExpectedAnyErr  bool
+	}{
+		{
+			Name:            "complete dump",
+			Datagrams:       [][]byte{join(entry, entry), join(entry, doneMessage())},
+			ExpectedEntries: 3,
+		},
+		{
+			Name:            "done alone",
+			Datagrams:       [][]byte{join(entry, entry), doneMessage()},
+			ExpectedEntries: 2,
+		},
+		{
+			Name:      "empty dump",
+			Datagrams: [][]byte{doneMessage()},
+		},
+		{
+			Name:      "acknowledgement",
+			Datagrams: [][]byte{errorMessage(0)},
+		},
+		{
+			Name:            "interrupted dump is read to the end",
+			Datagrams:       [][]byte{join(entry, interrupted), join(entry, doneMessage())},
+			ExpectedEntries: 3,
+			ExpectedErr:     ErrDumpInterrupted,
+		},
+		{
+			Name:          "kernel error",
+			Datagrams:     [][]byte{errorMessage(syscall.ENOENT)},
+			ExpectedErrno: syscall.ENOENT,
+		},
+		{
+			Name:            "kernel error in a dump",
+			Datagrams:       [][]byte{join(entry, errorMessage(syscall.EINTR))},
+			ExpectedEntries: 1,
+			ExpectedErrno:   syscall.EINTR,
+		},
+		{
+			Name:           "other subsystem",
+			Datagrams:      [][]byte{join(expectation, doneMessage())},
+			ExpectedAnyErr: true,
+		},
+		{
+			Name:            "no done",
+			Datagrams:       [][]byte{entry},
+			ExpectedEntries: 1,
+			ExpectedAnyErr:  true,
+		},
+	}
+	for _, test := range tests {
+		var entries int
+		err := readMessagesFromNetfilter(&scriptedSocket{datagrams: test.Datagrams}, func(ConntrackInfo) error {
+			entries++
+			return nil
+		})
+		switch {
+		case test.ExpectedErrno != 0:
+			var netlinkErr *NetlinkError
+			if !errors.As(err, &netlinkErr) || netlinkErr.Errno != test.ExpectedErrno {
+				t.Errorf("%s: expected errno %v, got %v", test.Name, test.ExpectedErrno, err)
+			}
+		case test.ExpectedAnyErr:
+			if err == nil {
+				t.Errorf("%s: expected an error", test.Name)
+			}
+		case err != test.ExpectedErr:
+			t.Errorf("%s: expected %v, got %v", test.Name, test.ExpectedErr, err)
+		}
+		if entries != test.ExpectedEntries {
+			t.Errorf("%s: expected %d entries, got %d", test.Name, test.ExpectedEntries, entries)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package conntrack
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -16,30 +19,188 @@ func DefaultFilter(c ConntrackInfo) bool {
 		glog.V(4).Infof("Message isn't an update: %d\n", c.MsgType)
 		return false
 	}
-	// As for updated info, we only care about ESTABLISHED for now.
-	if c.TCPState != TCPState_ESTABLISHED {
-		glog.V(4).Infof("State isn't in ESTABLISHED: %s\n", c.TCPState)
+	// As for updated info, we only care about ESTABLISHED tcp/sctp and replied udp/icmp for now.
+	if !c.Established() {
+		glog.V(4).Infof("Connection isn't established: %s, state=%s, status=%#x\n", ProtocolName(c.Proto), c.TCPState, uint32(c.Status))
 		return false
 	}
-	glog.V(4).Infof("Established TCP connection is %++v \n", c)
+	glog.V(4).Infof("Established %s connection is %++v \n", ProtocolName(c.Proto), c)
 	return true
 }
 
+// ProtocolFilter returns a FilterFunc passing connections of the given layer 4 protocols only.
+func ProtocolFilter(protos ...int) FilterFunc {
+	wanted := make(map[int]bool, len(protos))
+	for _, p := range protos {
+		wanted[p] = true
+	}
+	return func(c ConntrackInfo) bool {
+		return wanted[c.Proto]
+	}
+}
+
+// StatusFilter returns a FilterFunc passing connections that have all the given status bits set,
+// e.g. IpsSeenReply to ignore unreplied entries.
+func StatusFilter(flags ConntrackStatus) FilterFunc {
+	return func(c ConntrackInfo) bool {
+		return c.Status.Has(flags)
+	}
+}
+
+// MarkFilter returns a FilterFunc passing connections whose mark, masked with mask, equals mark.
+func MarkFilter(mark, mask uint32) FilterFunc {
+	return func(c ConntrackInfo) bool {
+		return c.Mark&mask == mark
+	}
+}
+
+// ZoneFilter returns a FilterFunc passing connections of the given conntrack zones only.
+func ZoneFilter(zones ...uint16) FilterFunc {
+	wanted := make(map[uint16]bool, len(zones))
+	for _, z := range zones {
+		wanted[z] = true
+	}
+	return func(c ConntrackInfo) bool {
+		return wanted[c.Zone]
+	}
+}
+
+// AllOf returns a FilterFunc passing connections that pass every given filter.
+func AllOf(filters ...FilterFunc) FilterFunc {
+	return func(c ConntrackInfo) bool {
+		for _, f := range filters {
+			if !f(c) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Config holds the settings of a ConnTrack.
+type Config struct {
+	FilterFunc FilterFunc
+	// DumpFilter, if set, is applied by the kernel to the dumps of ListConntrackInfos, before
+	// FilterFunc. It should let through at least everything FilterFunc passes.
+	DumpFilter *DumpFilter
+	// EventFilter, if set, is applied by the kernel to the events of Follow, before FilterFunc. It
+	// should let through at least everything FilterFunc passes. Destroy events pass it with
+	// ZeroCounters, which needs them all.
+	EventFilter *EventFilter
+
+	// ReceiveBufferSize is the size in bytes of the receive buffer of the event socket. Bursts of
+	// events bigger than the buffer overflow it and are lost. 0 keeps the kernel default,
+	// net.core.rmem_default.
+	ReceiveBufferSize int
+
+	// ZeroCounters keeps the final counters of the connections destroyed between two calls of
+	// ListAndZeroConntrackInfos, which returns them along with the dump. Set it if the counters are
+	// read through ListAndZeroConntrackInfos, so the traffic of short connections isn't lost.
+	ZeroCounters bool
+	// DestroyFilterFunc is applied instead of FilterFunc to the destroy events kept for
+	// ZeroCounters, which FilterFunc usually drops, see DefaultFilter. It should be FilterFunc
+	// without the checks of the message type and state. All destroy events are kept if nil.
+	DestroyFilterFunc FilterFunc
+
+	// NetNS is the path of the network namespace whose table is monitored, e.g. /proc/<pid>/ns/net
+	// or /var/run/netns/<name>. Our own namespace is monitored if empty.
+	NetNS string
+
+	// Source is where the table is read from: SourceNetlink, SourceProcfs or SourceAuto. Netlink if
+	// empty. Without events, ConnectionEvents returns the connections established it didn't return
+	// last time, and without counter resets ZeroCounters is ignored.
+	Source string
+
+	// Recorder, if set, records the dumps and events read from the table, see ReplaySource. It
+	// needs the netlink source.
+	Recorder *Recorder
+
+	// Dialer opens the netlink sockets, the kernel's if nil. Tests set a conntracktest.FakeKernel.
+	Dialer Dialer
+}
+
+// EventStats tells how often the event socket overflowed and the tracked state was rebuilt.
+type EventStats struct {
+	// Overflows is the number of times the kernel reported ENOBUFS on the event socket.
+	// Each of them lost at least one event; the kernel doesn't say how many.
+	Overflows uint64 `json:"overflows"`
+	// Resyncs is the number of times the table was dumped again to recover from overflows.
+	Resyncs uint64 `json:"resyncs"`
+	// LastResync is when the last resync happened, zero if none did.
+	LastResync time.Time `json:"lastResync,omitempty"`
+}
+
 // ConnTrack monitors the network connections.
 type ConnTrack struct {
 	connReq chan chan []ConntrackInfo
 	quit    chan struct{}
 
 	filterFunc FilterFunc
+	config     Config
+	requests   *requestSockets
+	source     Source
+
+	// Protects stats.
+	statsMu sync.Mutex
+	stats   EventStats
+
+	// Protects destroyed.
+	destroyedMu sync.Mutex
+	// Connections destroyed since the last ListAndZeroConntrackInfos, with Config.ZeroCounters.
+	destroyed []ConntrackInfo
 }
 
 // New returns a ConnTrack.
 func New(filterFunc FilterFunc) (*ConnTrack, error) {
-	c := ConnTrack{
+	return NewWithConfig(Config{FilterFunc: filterFunc})
+}
+
+// NewWithConfig returns a ConnTrack set up according to config.
+func NewWithConfig(config Config) (*ConnTrack, error) {
+	requests := newRequestSockets(config.NetNS, config.Dialer)
+	source, err := newSource(config.Source, config.NetNS, requests)
+	if err != nil {
+		requests.close()
+		return nil, err
+	}
+	if config.ZeroCounters && source.Name() == SourceProcfs {
+		glog.Warningf("Conntrack counters can't be reset through %s, diffing them instead", procfsConntrackPath)
+		config.ZeroCounters = false
+	}
+	if config.Recorder != nil {
+		netlink, ok := source.(*netlinkSource)
+		if !ok {
+			requests.close()
+			return nil, fmt.Errorf("Error recording conntrack: the %s source has no ctnetlink messages", source.Name())
+		}
+		if err := config.Recorder.start(config); err != nil {
+			requests.close()
+			return nil, err
+		}
+		source = &recordingSource{netlinkSource: netlink, recorder: config.Recorder}
+	}
+	return newWithSource(config, source, requests), nil
+}
+
+// NewWithSource returns a ConnTrack reading the table from source, e.g. a ReplaySource, instead of
+// the one config.Source names. config.Recorder is ignored. The ConnTrack closes source.
+func NewWithSource(config Config, source Source) (*ConnTrack, error) {
+	config.Source = source.Name()
+	config.Recorder = nil
+	return newWithSource(config, source, newRequestSockets(config.NetNS, config.Dialer)), nil
+}
+
+// newWithSource returns a ConnTrack reading the table from source, and making the other requests
+// on requests.
+func newWithSource(config Config, source Source, requests *requestSockets) *ConnTrack {
+	c := &ConnTrack{
 		connReq: make(chan chan []ConntrackInfo),
 		quit:    make(chan struct{}),
 
-		filterFunc: filterFunc,
+		filterFunc: config.FilterFunc,
+		config:     config,
+		requests:   requests,
+		source:     source,
 	}
 	go func() {
 		err := c.track()
@@ -53,32 +214,134 @@ func New(filterFunc FilterFunc) (*ConnTrack, error) {
 		}
 	}()
 
-	return &c, nil
+	return c
 }
 
 // Close stops all monitoring and executables.
-func (c ConnTrack) Close() {
+func (c *ConnTrack) Close() {
 	close(c.quit)
+	c.source.Close()
+	c.requests.close()
+}
+
+// Source returns the name of the source the table is read from, e.g. SourceNetlink.
+func (c *ConnTrack) Source() string {
+	return c.source.Name()
+}
+
+// clockSource is implemented by the sources with a time of their own, see ConnTrack.Now.
+type clockSource interface {
+	now() time.Time
+}
+
+// Now returns the current time as the source sees it: the time of its clock if it has one, e.g.
+// the time of the recording for a ReplaySource, the time of the Dialer if it is a Clock, time.Now
+// otherwise. The collectors measure the intervals of their rates with it, so replays measure the
+// intervals that were recorded.
+func (c *ConnTrack) Now() time.Time {
+	if s, ok := c.source.(clockSource); ok {
+		return s.now()
+	}
+	if clock, ok := c.config.Dialer.(Clock); ok {
+		return clock.Now()
+	}
+	return time.Now()
+}
+
+// ZeroCounters tells if the ConnTrack keeps the counters of destroyed connections for
+// ListAndZeroConntrackInfos, see Config.ZeroCounters.
+func (c *ConnTrack) ZeroCounters() bool {
+	return c.config.ZeroCounters
+}
+
+// NetNS returns the path of the network namespace the ConnTrack monitors, empty for our own.
+func (c *ConnTrack) NetNS() string {
+	return c.config.NetNS
+}
+
+// EventStats returns how often events were lost and the state rebuilt so far.
+func (c *ConnTrack) EventStats() EventStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.stats
 }
 
 // track is the main loop
 func (c *ConnTrack) track() error {
 	// We use Follow() to keep track of conn state changes, but it doesn't give
 	// us the initial state.
-	events, stop, err := c.Follow()
+	events, stop, err := c.follow()
+	if err == ErrNoEvents {
+		glog.Warningf("Conntrack source %s has no events, connections are listed when asked for", c.source.Name())
+		return c.poll()
+	}
 	if err != nil {
 		return err
 	}
 
-	// Use ListTCPConnections to get current established tcp connections.
-	establishedConns, err := c.ListConntrackInfos()
-	if err != nil {
-		return fmt.Errorf("Error listing existing ESTABLISHED connections: %++v.", err)
+	established := map[string]ConntrackInfo{}
+	// The events read while the table is dumped. Reading them goes on meanwhile, or the socket
+	// would overflow again during the dumps made to recover from overflows.
+	var pending []followed
+	drain := func() {
+		for {
+			select {
+			case item, ok := <-events:
+				if !ok {
+					return
+				}
+				pending = append(pending, item)
+			default:
+				return
+			}
+		}
 	}
 
-	established := map[string]ConntrackInfo{}
-	for _, c := range establishedConns {
-		established[c.String()] = c
+	var handle func(item followed)
+
+	// dump adds the established connections of the table, then handles the events read meanwhile.
+	dump := func() error {
+		err := c.addEstablished(established, drain)
+		read := pending
+		pending = nil
+		for _, item := range read {
+			handle(item)
+		}
+		return err
+	}
+
+	handle = func(item followed) {
+		e := item.info
+		switch {
+
+		default:
+			// not interested
+
+		case item.overflow:
+			// Events were lost; whatever got established meanwhile is still in the table. Every
+			// loss gets a dump of its own, so that replays dump when the recording did.
+			glog.Warningf("Conntrack events were lost, dumping the table again")
+			if err := dump(); err != nil {
+				glog.Errorf("Error resyncing ESTABLISHED connections: %v", err)
+				return
+			}
+			c.statsMu.Lock()
+			c.stats.Resyncs++
+			c.stats.LastResync = c.Now()
+			c.statsMu.Unlock()
+
+		case c.config.ZeroCounters && e.MsgType == NfctMsgDestroy:
+			c.addDestroyed(e)
+
+		case e.Established():
+			established[e.Key()] = e
+			glog.V(4).Infof("track() - Established Connection payload is %++v", e)
+		}
+	}
+
+	// Use ListConntrackInfos to get current established connections.
+	if err := dump(); err != nil {
+		return fmt.Errorf("Error listing existing ESTABLISHED connections: %++v.", err)
 	}
 
 	for {
@@ -88,21 +351,25 @@ func (c *ConnTrack) track() error {
 			stop()
 			return nil
 
-		case e, ok := <-events:
+		case item, ok := <-events:
 			if !ok {
 				return nil
 			}
-			switch {
-
-			default:
-				// not interested
-
-			case e.TCPState == TCPState_ESTABLISHED:
-				established[e.String()] = e
-				glog.V(4).Infof("track() - Established Connection payload is %++v", e)
-			}
+			handle(item)
 
 		case r := <-c.connReq:
+			// The events read before the call count for it.
+			for unread := true; unread; {
+				select {
+				case item, ok := <-events:
+					if !ok {
+						return nil
+					}
+					handle(item)
+				default:
+					unread = false
+				}
+			}
 			cs := make([]ConntrackInfo, 0, len(established))
 			for _, c := range established {
 				cs = append(cs, c)
@@ -113,54 +380,325 @@ func (c *ConnTrack) track() error {
 	}
 }
 
+// poll is the main loop of sources without events: the table is dumped for every
+// ConnectionEvents, which gets the connections established since the previous one, like those of
+// the events would be. The first one gets those established at the time.
+func (c *ConnTrack) poll() error {
+	// The connections of the previous dump.
+	seen := map[string]bool{}
+	for {
+		select {
+
+		case <-c.quit:
+			return nil
+
+		case r := <-c.connReq:
+			established := map[string]ConntrackInfo{}
+			err := c.addEstablished(established, nil)
+			if err != nil {
+				glog.Errorf("Error listing ESTABLISHED connections: %v", err)
+			}
+			cs := make([]ConntrackInfo, 0, len(established))
+			for key, c := range established {
+				if !seen[key] {
+					cs = append(cs, c)
+				}
+			}
+			r <- cs
+			// A failed dump may have missed connections still there, they stay seen.
+			if err == nil {
+				seen = make(map[string]bool, len(established))
+			}
+			for key := range established {
+				seen[key] = true
+			}
+		}
+	}
+}
+
+// addEstablished dumps the table and adds the established connections to established. read, if
+// not nil, is called after every entry.
+func (c *ConnTrack) addEstablished(established map[string]ConntrackInfo, read func()) error {
+	var err error
+	for i := 0; i <= maxDumpRetries; i++ {
+		// Adding a connection twice is harmless, so an interrupted dump is simply done again.
+		err = c.sourceDump(dumpTrack, c.config.DumpFilter, false, func(conn ConntrackInfo) error {
+			if c.filterFunc(conn) {
+				established[conn.Key()] = conn
+			}
+			if read != nil {
+				read()
+			}
+			return nil
+		})
+		if err != ErrDumpInterrupted {
+			return err
+		}
+	}
+	return err
+}
+
+// At most this many destroyed connections are kept between two ListAndZeroConntrackInfos.
+const maxDestroyed = 65536
+
+// addDestroyed keeps the final counters of a destroyed connection for ListAndZeroConntrackInfos.
+func (c *ConnTrack) addDestroyed(e ConntrackInfo) {
+	c.destroyedMu.Lock()
+	defer c.destroyedMu.Unlock()
+	if len(c.destroyed) >= maxDestroyed {
+		glog.V(3).Infof("Too many destroyed connections kept, dropping %s", e)
+		return
+	}
+	c.destroyed = append(c.destroyed, e)
+}
+
+// How many times a dump interrupted by table changes is restarted before giving up.
+const maxDumpRetries = 3
+
+// ListConntrackInfos dumps the conntrack table and returns the entries passing the filters.
 func (c *ConnTrack) ListConntrackInfos() ([]ConntrackInfo, error) {
-	s, err := sendRequestToNetfilter()
-	defer syscall.Close(s)
+	return c.dump(dumpList, c.config.DumpFilter, c.filterFunc)
+}
+
+// ListFilteredConntrackInfos dumps the entries matching the kernel-side filter and returns the ones
+// passing the filter function. A nil filter dumps the whole table.
+// A dump the kernel flags as interrupted is retried up to maxDumpRetries times.
+func (c *ConnTrack) ListFilteredConntrackInfos(filter *DumpFilter) ([]ConntrackInfo, error) {
+	return c.dump(dumpOther, filter, c.filterFunc)
+}
 
+// ListAllConntrackInfos dumps the whole table, regardless of the filters.
+func (c *ConnTrack) ListAllConntrackInfos() ([]ConntrackInfo, error) {
+	return c.dump(dumpOther, nil, func(ConntrackInfo) bool { return true })
+}
+
+// DumpConntrackInfos dumps the entries matching the kernel-side filter and passes the ones passing
+// the filter function to callback as they are read, without collecting the table in memory. A nil
+// filter dumps the whole table. The dump stops at the first error callback returns, which is
+// returned.
+// A dump the kernel flags as interrupted is read to the end and ErrDumpInterrupted returned, it
+// isn't retried as callback already got some of the entries.
+// callback may make other requests, e.g. Delete, but should be quick: the kernel holds the rest
+// of the dump meanwhile.
+func (c *ConnTrack) DumpConntrackInfos(filter *DumpFilter, callback func(ConntrackInfo) error) error {
+	return c.source.Dump(filter, false, func(conntrackInfo ConntrackInfo) error {
+		if !c.filterFunc(conntrackInfo) {
+			return nil
+		}
+		return callback(conntrackInfo)
+	})
+}
+
+// DumpAllConntrackInfos is DumpConntrackInfos of the whole table, regardless of the filters.
+func (c *ConnTrack) DumpAllConntrackInfos(callback func(ConntrackInfo) error) error {
+	return c.source.Dump(nil, false, callback)
+}
+
+// dump returns the entries matching filter that pass, retrying interrupted dumps. origin is what
+// the dump is for.
+func (c *ConnTrack) dump(origin dumpOrigin, filter *DumpFilter, pass FilterFunc) ([]ConntrackInfo, error) {
+	var err error
+	for i := 0; i <= maxDumpRetries; i++ {
+		var conns []ConntrackInfo
+		if conns, err = c.list(origin, filter, false, pass); err != ErrDumpInterrupted {
+			return conns, err
+		}
+		glog.V(3).Infof("Conntrack dump was interrupted, retrying")
+	}
+	return nil, err
+}
+
+// ListAndZeroConntrackInfos dumps the table like ListConntrackInfos and has the kernel reset the
+// counters of the dumped entries, so that every call returns the traffic since the previous one.
+// With Config.ZeroCounters, the connections destroyed since the previous call are returned too,
+// with their final counters and MsgType NfctMsgDestroy; they go through Config.DestroyFilterFunc.
+// Other readers of the conntrack counters see them reset as well.
+func (c *ConnTrack) ListAndZeroConntrackInfos() ([]ConntrackInfo, error) {
+	conns, err := c.list(dumpZero, c.config.DumpFilter, true, c.filterFunc)
+	if err == ErrDumpInterrupted {
+		// Don't retry, the entries read so far are zeroed already. Those the dump missed keep
+		// their counters for the next call.
+		glog.V(3).Infof("Conntrack dump was interrupted, some entries are left for the next one")
+		err = nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	var conns []ConntrackInfo
 
-	readMessagesFromNetfilter(s, func(conntrackInfo ConntrackInfo) {
-		if pass := c.filterFunc(conntrackInfo); pass {
+	c.destroyedMu.Lock()
+	conns = append(conns, c.destroyed...)
+	c.destroyed = nil
+	c.destroyedMu.Unlock()
+	return conns, nil
+}
+
+// list returns the entries of a dump of the source that pass. If the dump is interrupted,
+// ErrDumpInterrupted is returned with all the entries read.
+func (c *ConnTrack) list(origin dumpOrigin, filter *DumpFilter, zero bool, pass FilterFunc) ([]ConntrackInfo, error) {
+	var conns []ConntrackInfo
+	err := c.sourceDump(origin, filter, zero, func(conntrackInfo ConntrackInfo) error {
+		if pass(conntrackInfo) {
 			conns = append(conns, conntrackInfo)
 		}
-
+		return nil
 	})
-	return conns, nil
+	if err != nil && err != ErrDumpInterrupted {
+		return nil, err
+	}
+	return conns, err
+}
+
+// sourceDump dumps the source like Source.Dump, telling the sources that record or replay dumps
+// what it is for.
+func (c *ConnTrack) sourceDump(origin dumpOrigin, filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	if s, ok := c.source.(originSource); ok {
+		return s.dumpFor(origin, filter, zero, callback)
+	}
+	return c.source.Dump(filter, zero, callback)
+}
+
+// dumpConntrackInfos sends a dump request of type msgType for every family of filter on one of
+// requests and passes the entries to callback as they are read. It stops at the first error
+// callback returns. If a dump is interrupted, the others still happen and ErrDumpInterrupted is
+// returned.
+func dumpConntrackInfos(requests *requestSockets, msgType CntlMsgTypes, filter *DumpFilter, callback func(ConntrackInfo) error) error {
+	return dumpConntrackMessages(requests, msgType, filter, conntrackMessages(callback))
+}
+
+// dumpConntrackMessages is dumpConntrackInfos passing the messages read to callback as they are.
+func dumpConntrackMessages(requests *requestSockets, msgType CntlMsgTypes, filter *DumpFilter, callback func(syscall.NetlinkMessage) error) error {
+	var interrupted bool
+	for _, family := range filter.families() {
+		err := requests.request(buildConntrackListRequest(msgType, family, filter), NFNL_SUBSYS_CTNETLINK, callback)
+		if err == ErrDumpInterrupted {
+			interrupted = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if interrupted {
+		return ErrDumpInterrupted
+	}
+	return nil
 }
 
 // Connections gets the list of all connection track events seen since last time you
 // called it and return them as a list of ConntrackInfo.
 func (c *ConnTrack) ConnectionEvents() []ConntrackInfo {
+	if s, ok := c.source.(connectionEventsSource); ok {
+		return s.connectionEvents(c.connectionEvents)
+	}
+	return c.connectionEvents()
+}
+
+func (c *ConnTrack) connectionEvents() []ConntrackInfo {
 	r := make(chan []ConntrackInfo)
 	c.connReq <- r
 	return <-r
 }
 
+// passDestroyed tells if conntrackInfo is a destroy event to keep for Config.ZeroCounters.
+func (c *ConnTrack) passDestroyed(conntrackInfo ConntrackInfo) bool {
+	if !c.config.ZeroCounters || conntrackInfo.MsgType != NfctMsgDestroy {
+		return false
+	}
+	return c.config.DestroyFilterFunc == nil || c.config.DestroyFilterFunc(conntrackInfo)
+}
+
 // Follow returns a channel with all changes.
-// NOTE: currently we only return connection is ESTABLISHED state.
+// NOTE: currently we only return connection is ESTABLISHED state, and with Config.ZeroCounters
+// the destroyed ones passing Config.DestroyFilterFunc.
+// When the socket overflows the lost events are counted; reading goes on.
+// It returns ErrNoEvents if the source of the ConnTrack has none.
 func (c *ConnTrack) Follow() (<-chan ConntrackInfo, func(), error) {
-	s, _, err := connectNetfilter(NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_UPDATE | NF_NETLINK_CONNTRACK_DESTROY)
-	stop := func() {
-		syscall.Close(s)
-	}
+	items, stopItems, err := c.follow()
 	if err != nil {
-		return nil, stop, err
+		return nil, stopItems, err
+	}
+	var once sync.Once
+	stopped := make(chan struct{})
+	stop := func() {
+		once.Do(func() {
+			close(stopped)
+			stopItems()
+		})
 	}
 
 	res := make(chan ConntrackInfo, 1)
 	go func() {
-		defer syscall.Close(s)
-		err := readMessagesFromNetfilter(s, func(conntrackInfo ConntrackInfo) {
-			if c.filterFunc(conntrackInfo) {
-				res <- conntrackInfo
+		for item := range items {
+			if item.overflow {
+				continue
+			}
+			select {
+			case res <- item.info:
+			case <-stopped:
+				return
 			}
+		}
+	}()
+	return res, stop, nil
+}
+
+// followed is an event of follow, or a loss of events where it happened.
+type followed struct {
+	info     ConntrackInfo
+	overflow bool
+}
+
+// follow is Follow telling where events were lost. The channel is closed once reading stopped.
+func (c *ConnTrack) follow() (<-chan followed, func(), error) {
+	events, err := c.source.Follow(c.config.EventFilter, c.config.ZeroCounters, c.config.ReceiveBufferSize)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	// Only the reader closes events, once it sees stopped: closing a socket doesn't wake up a
+	// read blocked on it, and its descriptor could be reused meanwhile.
+	var once sync.Once
+	stopped := make(chan struct{})
+	stop := func() {
+		once.Do(func() {
+			close(stopped)
 		})
-		if err != nil {
-			glog.Fatalf("Error reading message from Netfilter: %++v", err)
-			panic(err)
+	}
+
+	res := make(chan followed, 1)
+	send := func(item followed) {
+		select {
+		case res <- item:
+		case <-stopped:
+		}
+	}
+	go func() {
+		defer close(res)
+		defer events.Close()
+		for {
+			err := events.Read(func(conntrackInfo ConntrackInfo) error {
+				if c.filterFunc(conntrackInfo) || c.passDestroyed(conntrackInfo) {
+					send(followed{info: conntrackInfo})
+				}
+				return nil
+			})
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			if errors.Is(err, syscall.EAGAIN) {
+				continue
+			}
+			if errors.Is(err, syscall.ENOBUFS) {
+				c.statsMu.Lock()
+				c.stats.Overflows++
+				c.statsMu.Unlock()
+				send(followed{overflow: true})
+				continue
+			}
+			if err != nil {
+				glog.Fatalf("Error reading message from Netfilter: %++v", err)
+			}
 		}
 	}()
 	return res, stop, nil
@@ -1,26 +1,216 @@
 package conntrack
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math/bits"
 	"net"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+// Tuple is one direction of a connection, as conntrack sees it.
+type Tuple struct {
+	Src     net.IP
+	SrcPort uint16
+	Dst     net.IP
+	DstPort uint16
+
+	// ICMP and ICMPv6 entries have no ports; they are identified by the echo id instead.
+	// Only queries (echo, timestamp...) get entries of their own. Error messages such as
+	// destination unreachable are only marked related to the connection that caused them: they
+	// get no entry, no event and aren't counted, so the table can't attribute them.
+	IcmpId   uint16
+	IcmpType uint8
+	IcmpCode uint8
+}
+
+// Counters are the packets and bytes seen in one direction of a connection. They are only
+// maintained while nf_conntrack_acct is on.
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
 // Struct for storing retreived conntrack information. The fields are chosen according the output of nf_conntrack.
 type ConntrackInfo struct {
-	MsgType        NfConntrackEventType
-	Proto          int
-	Src            net.IP
-	SrcPort        uint16
-	Dst            net.IP
-	DstPort        uint16
-	Packets        uint64
-	Bytes          uint64
+	MsgType NfConntrackEventType
+	Proto   int
+	// Orig is the tuple of the packet that opened the connection: the client and the address it
+	// dialed, e.g. a ClusterIP or a NodePort.
+	Orig Tuple
+	// Reply is the tuple reply packets are expected to have, i.e. Orig reversed and with NAT
+	// applied: its source is the server that actually answers (the pod behind a service) and its
+	// destination is the client, or the address the client was masqueraded to.
+	Reply Tuple
+	// OrigCounters count the request direction, from the client to the server.
+	OrigCounters Counters
+	// ReplyCounters count the response direction, from the server to the client.
+	ReplyCounters Counters
+	// StartTimestamp and StopTimestamp are in nanoseconds since the epoch. They are only
+	// maintained while nf_conntrack_timestamp is on, and StopTimestamp is only set on destroy events.
 	StartTimestamp uint64
-	DeltaTime      uint64
+	StopTimestamp  uint64
 	TCPState       TCPState
+	SCTPState      SCTPState
+	Status         ConntrackStatus
+	// Mark is the connection mark (ctmark), as set by iptables CONNMARK or nft "ct mark set".
+	Mark uint32
+	// Zone separates otherwise identical tuples, e.g. of different tenants.
+	Zone uint16
+	// Id is the kernel's id for the entry. It is unique among live entries only.
+	Id uint32
+	// Timeout is the number of seconds left before the entry expires.
+	Timeout uint32
+	// Use is the reference count of the entry.
+	Use uint32
+	// Labels is the connlabel bitmap as the kernel sends it: an array of unsigned longs in host
+	// byte order, bit N of the array being label N as in /etc/xtables/connlabel.conf. Use HasLabel.
+	Labels []byte
+	// Master is the original tuple of the connection this one was expected by, e.g. the FTP
+	// control connection of a data connection, and MasterProto its protocol. nil for
+	// connections not created from an expectation.
+	Master      *Tuple
+	MasterProto int
+}
+
+// HasLabel returns true if connlabel bit is set. Like the kernel's test_bit, it looks at bit
+// bit%UintSize of the unsigned long bit/UintSize.
+func (c ConntrackInfo) HasLabel(bit int) bool {
+	const wordSize = bits.UintSize / 8
+	word := bit / bits.UintSize
+	if bit < 0 || (word+1)*wordSize > len(c.Labels) {
+		return false
+	}
+	w := c.Labels[word*wordSize : (word+1)*wordSize]
+	var v uint64
+	if wordSize == 8 {
+		v = binary.NativeEndian.Uint64(w)
+	} else {
+		v = uint64(binary.NativeEndian.Uint32(w))
+	}
+	return v&(1<<uint(bit%bits.UintSize)) != 0
+}
+
+// Start returns the time the connection was created. It is the zero time if timestamps are off.
+func (c ConntrackInfo) Start() time.Time {
+	if c.StartTimestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(c.StartTimestamp))
+}
+
+// Duration returns how long a stopped connection lasted, e.g. the one of a destroy event.
+// It is 0 for connections still alive, or if timestamps are off.
+func (c ConntrackInfo) Duration() time.Duration {
+	if c.StartTimestamp == 0 || c.StopTimestamp < c.StartTimestamp {
+		return 0
+	}
+	return time.Duration(c.StopTimestamp - c.StartTimestamp)
+}
+
+// Age returns how long the connection has been alive at now, or its Duration once it is stopped.
+// It is 0 if timestamps are off.
+func (c ConntrackInfo) Age(now time.Time) time.Duration {
+	if c.StartTimestamp == 0 {
+		return 0
+	}
+	if c.StopTimestamp != 0 {
+		return c.Duration()
+	}
+	if age := now.Sub(c.Start()); age > 0 {
+		return age
+	}
+	return 0
+}
+
+// Client returns the address the connection was opened from.
+func (c ConntrackInfo) Client() net.IP {
+	return c.Orig.Src
+}
+
+// Server returns the address serving the connection, after destination NAT.
+func (c ConntrackInfo) Server() net.IP {
+	return c.Reply.Src
+}
+
+// IsDNAT returns true if the client dialed an address that was translated, e.g. a ClusterIP.
+func (c ConntrackInfo) IsDNAT() bool {
+	return !c.Orig.Dst.Equal(c.Reply.Src) || c.Orig.DstPort != c.Reply.SrcPort
+}
+
+// IsSNAT returns true if the client address was translated on the way out, e.g. masqueraded to the
+// node address. Reply.Dst is then the address used for egress.
+func (c ConntrackInfo) IsSNAT() bool {
+	return !c.Orig.Src.Equal(c.Reply.Dst) || c.Orig.SrcPort != c.Reply.DstPort
+}
+
+// Established returns true if the connection is live, i.e. traffic has been seen in both directions.
+// TCP and SCTP connections are live in their ESTABLISHED state. UDP and ICMP have no states, so
+// they are live once the reply direction has seen a packet.
+func (c ConntrackInfo) Established() bool {
+	switch c.Proto {
+	case syscall.IPPROTO_TCP:
+		return c.TCPState == TCPState_ESTABLISHED
+	case syscall.IPPROTO_SCTP:
+		return c.SCTPState == SCTPState_ESTABLISHED
+	case syscall.IPPROTO_UDP, syscall.IPPROTO_ICMP, syscall.IPPROTO_ICMPV6:
+		return c.Status.Has(IpsSeenReply)
+	}
+	return false
+}
+
+// IsICMP returns true for ICMP and ICMPv6 entries.
+func (c ConntrackInfo) IsICMP() bool {
+	return isICMP(c.Proto)
+}
+
+func isICMP(proto int) bool {
+	return proto == syscall.IPPROTO_ICMP || proto == syscall.IPPROTO_ICMPV6
+}
+
+// Key identifies the connection among the live ones, whatever its state and counters: the kernel
+// keeps a single entry per original tuple and zone.
+func (c ConntrackInfo) Key() string {
+	return connKey(c.Proto, c.Orig, c.Zone)
+}
+
+// MasterKey is the Key of the master connection, empty if there is none. A master is in the zone of
+// the connections it expects.
+func (c ConntrackInfo) MasterKey() string {
+	if c.Master == nil {
+		return ""
+	}
+	return connKey(c.MasterProto, *c.Master, c.Zone)
+}
+
+// connKey is the Key of the connection of protocol proto with the original tuple orig in zone.
+func connKey(proto int, orig Tuple, zone uint16) string {
+	return fmt.Sprintf("%s %s zone=%d", ProtocolName(proto), orig.format(isICMP(proto)), zone)
 }
 
 func (c ConntrackInfo) String() string {
-	return fmt.Sprintf("%s:%d->%s:%d, packets=%d, bytes=%d, start_time=%d, delta_time=%d",
-		c.Src, c.SrcPort, c.Dst, c.DstPort, c.Packets, c.Bytes, c.StartTimestamp, c.DeltaTime)
+	s := fmt.Sprintf("%s orig=%s packets=%d bytes=%d, reply=%s packets=%d bytes=%d, status=%s, mark=%d, zone=%d, start_time=%d, stop_time=%d",
+		ProtocolName(c.Proto),
+		c.Orig.format(c.IsICMP()), c.OrigCounters.Packets, c.OrigCounters.Bytes,
+		c.Reply.format(c.IsICMP()), c.ReplyCounters.Packets, c.ReplyCounters.Bytes,
+		c.Status, c.Mark, c.Zone, c.StartTimestamp, c.StopTimestamp)
+	if c.Master != nil {
+		s += fmt.Sprintf(", master=%s %s", ProtocolName(c.MasterProto), c.Master.format(isICMP(c.MasterProto)))
+	}
+	return s
+}
+
+func (t Tuple) format(icmp bool) string {
+	if icmp {
+		return fmt.Sprintf("%s->%s(type=%d,code=%d,id=%d)", t.Src, t.Dst, t.IcmpType, t.IcmpCode, t.IcmpId)
+	}
+	return HostPort(t.Src, t.SrcPort) + "->" + HostPort(t.Dst, t.DstPort)
+}
+
+// HostPort formats an address and port the same way for both families,
+// e.g. 10.0.0.1:80 or [fd00::1]:80.
+func HostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
 }
@@ -0,0 +1,271 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stubSource is a Source with an empty table, whose events are handed over by the test.
+type stubSource struct {
+	events chan ConntrackInfo
+	// read gets a value once every event was passed to the callback.
+	read   chan struct{}
+	closed chan struct{}
+}
+
+func newStubSource() *stubSource {
+	return &stubSource{events: make(chan ConntrackInfo), read: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// stubConn returns an established TCP connection from port.
+func stubConn(msgType NfConntrackEventType, port uint16) ConntrackInfo {
+	return ConntrackInfo{
+		MsgType:  msgType,
+		Proto:    syscall.IPPROTO_TCP,
+		Orig:     Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: port, Dst: net.IP{10, 0, 0, 6}, DstPort: 6379},
+		Reply:    Tuple{Src: net.IP{10, 0, 0, 6}, SrcPort: 6379, Dst: net.IP{10, 0, 0, 5}, DstPort: port},
+		Status:   IpsSeenReply | IpsAssured | IpsConfirmed,
+		TCPState: TCPState_ESTABLISHED,
+	}
+}
+
+func (s *stubSource) Name() string {
+	return "stub"
+}
+
+func (s *stubSource) Dump(*DumpFilter, bool, func(ConntrackInfo) error) error {
+	return nil
+}
+
+func (s *stubSource) Follow(*EventFilter, bool, int) (EventReader, error) {
+	return s, nil
+}
+
+func (s *stubSource) Read(callback func(ConntrackInfo) error) error {
+	select {
+	case e := <-s.events:
+		err := callback(e)
+		s.read <- struct{}{}
+		return err
+	case <-s.closed:
+		return syscall.EAGAIN
+	}
+}
+
+func (s *stubSource) Close() {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+// The events read before ConnectionEvents is called count for it, even if the main loop didn't
+// get to them yet.
+func TestConnectionEventsReadsPendingEvents(t *testing.T) {
+	s := newStubSource()
+	c, err := NewWithSource(Config{FilterFunc: DefaultFilter}, s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	for port := uint16(1000); port < 1020; port++ {
+		s.events <- stubConn(NfctMsgUpdate, port)
+		<-s.read
+		conns := c.ConnectionEvents()
+		if len(conns) != 1 || conns[0].Orig.SrcPort != port {
+			t.Fatalf("expected the connection from %d, got %v", port, conns)
+		}
+	}
+}
+
+// clockedSource is a stubSource with a clock.
+type clockedSource struct {
+	*stubSource
+	time time.Time
+}
+
+func (s *clockedSource) now() time.Time {
+	return s.time
+}
+
+func TestNow(t *testing.T) {
+	start := time.Unix(1792307624, 0)
+	c, err := NewWithSource(Config{FilterFunc: DefaultFilter}, &clockedSource{newStubSource(), start})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+	if now := c.Now(); !now.Equal(start) {
+		t.Errorf("expected the time of the source %v, got %v", start, now)
+	}
+
+	if c, err = NewWithSource(Config{FilterFunc: DefaultFilter}, newStubSource()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+	before := time.Now()
+	if now := c.Now(); now.Before(before) || now.After(time.Now()) {
+		t.Errorf("expected the current time, got %v", now)
+	}
+}
+
+// slowDumpSource is a Source whose dumps wait for an event to be read before every entry, as a
+// busy table does. Its events are handed over one at a time, as by a socket with room for one.
+type slowDumpSource struct {
+	entries int
+	events  chan *ConntrackInfo
+	// dumped gets the error of every dump.
+	dumped chan error
+	dumps  int
+	closed chan struct{}
+}
+
+func newSlowDumpSource(entries int) *slowDumpSource {
+	return &slowDumpSource{
+		entries: entries,
+		events:  make(chan *ConntrackInfo),
+		dumped:  make(chan error, 2),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (s *slowDumpSource) Name() string {
+	return "slow"
+}
+
+// Dump passes the entries 2000+10*n+i of the nth dump, after the events 1000+10*n+i.
+func (s *slowDumpSource) Dump(filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	var err error
+	for i := 0; i < s.entries && err == nil; i++ {
+		port := uint16(10*s.dumps + i)
+		e := stubConn(NfctMsgUpdate, 1000+port)
+		select {
+		case s.events <- &e:
+			err = callback(stubConn(NfctMsgUpdate, 2000+port))
+		case <-time.After(time.Second):
+			err = fmt.Errorf("event %d not read during the dump", 1000+port)
+		}
+	}
+	s.dumps++
+	s.dumped <- err
+	return err
+}
+
+func (s *slowDumpSource) Follow(*EventFilter, bool, int) (EventReader, error) {
+	return s, nil
+}
+
+// Read returns ENOBUFS for a nil event.
+func (s *slowDumpSource) Read(callback func(ConntrackInfo) error) error {
+	select {
+	case e := <-s.events:
+		if e == nil {
+			return syscall.ENOBUFS
+		}
+		return callback(*e)
+	case <-s.closed:
+		return syscall.EAGAIN
+	}
+}
+
+func (s *slowDumpSource) Close() {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+// The events are read while the table is dumped, as it starts and after losses.
+func TestTrackReadsEventsWhileDumping(t *testing.T) {
+	s := newSlowDumpSource(3)
+	c, err := NewWithSource(Config{FilterFunc: DefaultFilter}, s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	if err := <-s.dumped; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, expected := ports(c.ConnectionEvents()), []int{1000, 1001, 1002, 2000, 2001, 2002}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	s.events <- nil
+	if err := <-s.dumped; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, expected := ports(c.ConnectionEvents()), []int{1010, 1011, 1012, 2010, 2011, 2012}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if stats := c.EventStats(); stats.Overflows != 1 || stats.Resyncs != 1 {
+		t.Errorf("expected an overflow and a resync, got %+v", stats)
+	}
+}
+
+// readingSource is a Source with an empty table and no events, whose reads last until woken up.
+type readingSource struct {
+	stubSource
+	// reading gets a value as a read starts.
+	reading chan struct{}
+	wake    chan struct{}
+	// eventsClosed gets whether a read was going on when the events were closed.
+	eventsClosed chan bool
+	mu           sync.Mutex
+	inRead       bool
+}
+
+func (s *readingSource) Follow(*EventFilter, bool, int) (EventReader, error) {
+	return s, nil
+}
+
+func (s *readingSource) Read(func(ConntrackInfo) error) error {
+	s.mu.Lock()
+	s.inRead = true
+	s.mu.Unlock()
+	s.reading <- struct{}{}
+	<-s.wake
+	s.mu.Lock()
+	s.inRead = false
+	s.mu.Unlock()
+	return syscall.EAGAIN
+}
+
+func (s *readingSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventsClosed <- s.inRead
+}
+
+// Stopping Follow leaves the events to the reader, which closes them once its read returned.
+func TestFollowStopClosesAfterRead(t *testing.T) {
+	s := &readingSource{
+		reading:      make(chan struct{}, 1),
+		wake:         make(chan struct{}),
+		eventsClosed: make(chan bool, 1),
+	}
+	c := &ConnTrack{config: Config{FilterFunc: DefaultFilter}, filterFunc: DefaultFilter, source: s}
+	_, stop, err := c.Follow()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-s.reading
+	stop()
+	select {
+	case <-s.eventsClosed:
+		t.Fatalf("expected the events to stay open during the read")
+	default:
+	}
+	close(s.wake)
+	if inRead := <-s.eventsClosed; inRead {
+		t.Errorf("expected the events closed after the read")
+	}
+}
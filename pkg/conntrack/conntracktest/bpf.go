@@ -0,0 +1,246 @@
+package conntracktest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+// Ancillary loads finding netlink attributes, #defined in linux/filter.h, see conntrack.EventFilter.
+const (
+	skfAdOff        = -0x1000
+	skfAdNlattr     = 12
+	skfAdNlattrNest = 16
+)
+
+// The size of the scratch memory of BPF programs, BPF_MEMWORDS.
+const bpfMemWords = 16
+
+// ALU operations syscall lacks, #defined in linux/bpf_common.h.
+const (
+	bpfMod = 0x90
+	bpfXor = 0xa0
+)
+
+// checkBPF checks prog like the kernel does when it is attached, see bpf_check_classic, for the
+// instructions runBPF knows.
+func checkBPF(prog []syscall.SockFilter) error {
+	if len(prog) == 0 || len(prog) > syscall.BPF_MAXINSNS {
+		return fmt.Errorf("BPF program has %d instructions", len(prog))
+	}
+	for pc, insn := range prog {
+		switch insn.Code & 0x07 {
+		case syscall.BPF_LD, syscall.BPF_LDX:
+			if insn.Code&0xe0 == syscall.BPF_MEM && insn.K >= bpfMemWords {
+				return fmt.Errorf("BPF instruction %d loads scratch word %d", pc, insn.K)
+			}
+			if insn.Code == syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS && int32(insn.K) < 0 &&
+				int32(insn.K) != skfAdOff+skfAdNlattr && int32(insn.K) != skfAdOff+skfAdNlattrNest {
+				return fmt.Errorf("BPF instruction %d loads unknown ancillary data %d", pc, int32(insn.K))
+			}
+		case syscall.BPF_ST, syscall.BPF_STX:
+			if insn.K >= bpfMemWords {
+				return fmt.Errorf("BPF instruction %d stores scratch word %d", pc, insn.K)
+			}
+		case syscall.BPF_ALU:
+			switch insn.Code & 0xf0 {
+			case syscall.BPF_ADD, syscall.BPF_SUB, syscall.BPF_MUL, syscall.BPF_DIV, bpfMod, syscall.BPF_AND,
+				syscall.BPF_OR, bpfXor, syscall.BPF_LSH, syscall.BPF_RSH, syscall.BPF_NEG:
+			default:
+				return fmt.Errorf("BPF instruction %d has unknown code %#x", pc, insn.Code)
+			}
+		case syscall.BPF_JMP:
+			next := pc + 1
+			if insn.Code&0xf0 == syscall.BPF_JA {
+				if next+int(insn.K) >= len(prog) {
+					return fmt.Errorf("BPF instruction %d jumps out of the program", pc)
+				}
+			} else if next+int(insn.Jt) >= len(prog) || next+int(insn.Jf) >= len(prog) {
+				return fmt.Errorf("BPF instruction %d jumps out of the program", pc)
+			}
+			switch insn.Code & 0xf0 {
+			case syscall.BPF_JA, syscall.BPF_JEQ, syscall.BPF_JGT, syscall.BPF_JGE, syscall.BPF_JSET:
+			default:
+				return fmt.Errorf("BPF instruction %d has unknown code %#x", pc, insn.Code)
+			}
+		}
+	}
+	if prog[len(prog)-1].Code&0x07 != syscall.BPF_RET {
+		return fmt.Errorf("BPF program doesn't end with a return")
+	}
+	return nil
+}
+
+// runBPF runs prog, checked by checkBPF, on packet the way the kernel runs socket filters, and
+// returns how many bytes of packet to keep, 0 to drop it.
+func runBPF(prog []syscall.SockFilter, packet []byte) uint32 {
+	var a, x uint32
+	var mem [bpfMemWords]uint32
+	for pc := 0; pc < len(prog); pc++ {
+		insn := prog[pc]
+		src := insn.K
+		if insn.Code&syscall.BPF_X != 0 {
+			src = x
+		}
+		switch insn.Code & 0x07 {
+		case syscall.BPF_LD, syscall.BPF_LDX:
+			var v uint32
+			switch insn.Code & 0xe0 {
+			case syscall.BPF_IMM:
+				v = insn.K
+			case syscall.BPF_MEM:
+				v = mem[insn.K]
+			case syscall.BPF_LEN:
+				v = uint32(len(packet))
+			case syscall.BPF_ABS, syscall.BPF_IND:
+				off := insn.K
+				if insn.Code&0xe0 == syscall.BPF_IND {
+					off += x
+				}
+				if insn.Code&0xe0 == syscall.BPF_ABS && int32(off) < 0 {
+					v = bpfNlattr(packet, int32(off), a, x)
+					break
+				}
+				var ok bool
+				if v, ok = bpfLoad(packet, off, insn.Code&0x18); !ok {
+					// Out of the packet, the kernel drops it.
+					return 0
+				}
+			case syscall.BPF_MSH:
+				if int(insn.K) >= len(packet) {
+					return 0
+				}
+				v = 4 * uint32(packet[insn.K]&0xf)
+			}
+			if insn.Code&0x07 == syscall.BPF_LD {
+				a = v
+			} else {
+				x = v
+			}
+		case syscall.BPF_ST:
+			mem[insn.K] = a
+		case syscall.BPF_STX:
+			mem[insn.K] = x
+		case syscall.BPF_ALU:
+			switch insn.Code & 0xf0 {
+			case syscall.BPF_ADD:
+				a += src
+			case syscall.BPF_SUB:
+				a -= src
+			case syscall.BPF_MUL:
+				a *= src
+			case syscall.BPF_DIV, bpfMod:
+				if src == 0 {
+					return 0
+				}
+				if insn.Code&0xf0 == syscall.BPF_DIV {
+					a /= src
+				} else {
+					a %= src
+				}
+			case syscall.BPF_AND:
+				a &= src
+			case syscall.BPF_OR:
+				a |= src
+			case bpfXor:
+				a ^= src
+			case syscall.BPF_LSH:
+				a <<= src
+			case syscall.BPF_RSH:
+				a >>= src
+			case syscall.BPF_NEG:
+				a = -a
+			}
+		case syscall.BPF_JMP:
+			var cond bool
+			switch insn.Code & 0xf0 {
+			case syscall.BPF_JA:
+				pc += int(insn.K)
+				continue
+			case syscall.BPF_JEQ:
+				cond = a == src
+			case syscall.BPF_JGT:
+				cond = a > src
+			case syscall.BPF_JGE:
+				cond = a >= src
+			case syscall.BPF_JSET:
+				cond = a&src != 0
+			}
+			if cond {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		case syscall.BPF_RET:
+			if insn.Code&0x18 == syscall.BPF_A {
+				return a
+			}
+			return insn.K
+		case syscall.BPF_MISC:
+			if insn.Code&0xf8 == syscall.BPF_TAX {
+				x = a
+			} else {
+				a = x
+			}
+		}
+	}
+	return 0
+}
+
+// bpfLoad loads the big endian word, half word or byte at off of packet.
+func bpfLoad(packet []byte, off uint32, size uint16) (uint32, bool) {
+	n := uint64(1)
+	switch size {
+	case syscall.BPF_W:
+		n = 4
+	case syscall.BPF_H:
+		n = 2
+	}
+	if uint64(off)+n > uint64(len(packet)) {
+		return 0, false
+	}
+	switch n {
+	case 4:
+		return binary.BigEndian.Uint32(packet[off:]), true
+	case 2:
+		return uint32(binary.BigEndian.Uint16(packet[off:])), true
+	}
+	return uint32(packet[off]), true
+}
+
+// bpfNlattr runs the ancillary load at off, with the registers a and x, see bpf_skb_get_nlattr
+// and bpf_skb_get_nlattr_nest.
+func bpfNlattr(packet []byte, off int32, a, x uint32) uint32 {
+	l := uint64(len(packet))
+	if l < attrHdrLength || uint64(a) > l-attrHdrLength {
+		return 0
+	}
+	if off == skfAdOff+skfAdNlattr {
+		return nlaFind(packet, int(a), len(packet)-int(a), x)
+	}
+	nlaLen := int(binary.NativeEndian.Uint16(packet[a:]))
+	if nlaLen > len(packet)-int(a) {
+		return 0
+	}
+	return nlaFind(packet, int(a)+attrHdrLength, nlaLen-attrHdrLength, x)
+}
+
+// nlaFind returns the offset of the attribute of type typ among the rem bytes of attributes at off
+// of packet, 0 if there is none, like nla_find.
+func nlaFind(packet []byte, off, rem int, typ uint32) uint32 {
+	for rem >= attrHdrLength {
+		l := int(binary.NativeEndian.Uint16(packet[off:]))
+		if l < attrHdrLength || l > rem {
+			break
+		}
+		if uint32(binary.NativeEndian.Uint16(packet[off+2:])&conntrack.NLA_TYPE_MASK) == typ {
+			return uint32(off)
+		}
+		next := align(l)
+		off += next
+		rem -= next
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package conntracktest
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+// attachedFilter returns the filter a ConnTrack configured with f attaches to its events socket.
+func attachedFilter(t *testing.T, f *conntrack.EventFilter) []syscall.SockFilter {
+	k := NewFakeKernel(start)
+	c := newConnTrack(t, k, conntrack.Config{EventFilter: f})
+	defer c.Close()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, s := range k.sockets {
+		if s.filter != nil {
+			return s.filter
+		}
+	}
+	t.Fatalf("no filter attached for %+v", f)
+	return nil
+}
+
+// kernelPasses tells if msg gets through prog attached by the kernel to a socket.
+func kernelPasses(t *testing.T, prog []syscall.SockFilter, msg []byte) bool {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("Error creating socket pair: %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	if err := syscall.AttachLsf(fds[1], prog); err != nil {
+		t.Fatalf("Error attaching filter: %v", err)
+	}
+	if _, err := syscall.Write(fds[0], msg); err != nil {
+		t.Fatalf("Error writing message: %v", err)
+	}
+	b := make([]byte, len(msg))
+	_, _, err = syscall.Recvfrom(fds[1], b, syscall.MSG_DONTWAIT)
+	if err == syscall.EAGAIN {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("Error reading message: %v", err)
+	}
+	return true
+}
+
+// The filters run by the fake kernel pass the events the kernel passes.
+func TestRunBPF(t *testing.T) {
+	udp := tcpConn(conntrack.NfctMsgUpdate, 53, 0)
+	udp.Proto = syscall.IPPROTO_UDP
+	unreplied := udp
+	unreplied.Status = conntrack.IpsConfirmed
+	v6 := tcpConn(conntrack.NfctMsgUpdate, 1003, conntrack.TCPState_ESTABLISHED)
+	v6.Orig.Src, v6.Orig.Dst = net.ParseIP("fd00::5"), net.ParseIP("fd00::6")
+	v6.Reply.Src, v6.Reply.Dst = v6.Orig.Dst, v6.Orig.Src
+	icmp := conntrack.ConntrackInfo{
+		MsgType: conntrack.NfctMsgNew,
+		Proto:   syscall.IPPROTO_ICMP,
+		Orig:    conntrack.Tuple{Src: net.IP{10, 0, 0, 5}, Dst: net.IP{192, 168, 0, 1}, IcmpId: 7, IcmpType: 8},
+		Reply:   conntrack.Tuple{Src: net.IP{192, 168, 0, 1}, Dst: net.IP{10, 0, 0, 5}, IcmpId: 7},
+		Status:  conntrack.IpsConfirmed,
+	}
+	events := []conntrack.ConntrackInfo{
+		tcpConn(conntrack.NfctMsgNew, 1001, conntrack.TCPState_SYN_SENT),
+		tcpConn(conntrack.NfctMsgUpdate, 1001, conntrack.TCPState_ESTABLISHED),
+		tcpConn(conntrack.NfctMsgUpdate, 1001, conntrack.TCPState_FIN_WAIT),
+		tcpConn(conntrack.NfctMsgDestroy, 1001, conntrack.TCPState_CLOSE),
+		udp, unreplied, v6, icmp,
+	}
+	filters := []*conntrack.EventFilter{
+		{},
+		{Events: conntrack.NfctMsgUpdate},
+		{Events: conntrack.NfctMsgNew | conntrack.NfctMsgDestroy},
+		{L4Protos: []uint8{syscall.IPPROTO_UDP, syscall.IPPROTO_ICMP}},
+		{Status: conntrack.IpsSeenReply},
+		{TCPStates: []conntrack.TCPState{conntrack.TCPState_ESTABLISHED}},
+		{CIDRs: []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(24, 32)}}},
+		{CIDRs: []*net.IPNet{{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(64, 128)}}},
+	}
+	for _, f := range filters {
+		prog := attachedFilter(t, f)
+		if err := checkBPF(prog); err != nil {
+			t.Errorf("%+v: unexpected error: %v", f, err)
+			continue
+		}
+		for _, event := range events {
+			typ, flags := conntrack.IpctnlMsgCtNew, uint16(0)
+			if event.MsgType == conntrack.NfctMsgDestroy {
+				typ = conntrack.IpctnlMsgCtDelete
+			} else if event.MsgType == conntrack.NfctMsgNew {
+				flags = syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+			}
+			msg := conntrackMessage(typ, flags, event)
+			if expected, got := kernelPasses(t, prog, msg), runBPF(prog, msg) != 0; got != expected {
+				t.Errorf("%+v: expected %s to pass %v, got %v", f, event, expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,639 @@
+// Package conntracktest provides a fake kernel, so that code using a conntrack.ConnTrack can be
+// tested without root nor a conntrack table.
+package conntracktest
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+// FakeKernel is an in-memory ctnetlink peer: set it as conntrack.Config.Dialer. It holds a table,
+// answers the dumps, lookups, deletes and stats requests of its sockets like the kernel, and sends
+// the changes made through Event to the sockets following events, through their BPF filters.
+// Failures of the kernel can be scripted with Overflow, FailRequest, InterruptDump and
+// EndDumpAfter. Expectations are in a table of their own, see AddExpectations and
+// ExpectationEvent. Stats per CPU are dumped empty.
+// It has a clock of its own, which the ConnTrack uses too, see conntrack.Clock: it only moves on
+// Advance.
+type FakeKernel struct {
+	// Protects the fields below, and those of the sockets.
+	mu sync.Mutex
+	// changed is broadcast when a socket gets a message, waits for one, or is closed.
+	changed *sync.Cond
+	now     time.Time
+	// The entries, in the order they are dumped.
+	table []conntrack.ConntrackInfo
+	// The expectations, in the order they are dumped.
+	expectations []conntrack.Expectation
+	sockets      []*fakeSocket
+	// maxEntries is the size of the table stats requests report.
+	maxEntries uint32
+	// Errors the next requests fail with, first first.
+	requestErrors []syscall.Errno
+	// Changes to the next dumps, first first.
+	dumpFaults []dumpFault
+}
+
+type dumpFault struct {
+	interrupt bool
+	// entries is how many entries are dumped at most, all if negative.
+	entries int
+}
+
+// MaxEntries is the size of the table of a FakeKernel, as net.netfilter.nf_conntrack_max.
+const MaxEntries = 262144
+
+// The size of the datagrams of dumps, as the kernel fills the 32KiB buffers conntrack reads into.
+const datagramLen = 32 * 1024
+
+// NewFakeKernel returns a FakeKernel with an empty table, whose clock is at start.
+func NewFakeKernel(start time.Time) *FakeKernel {
+	k := &FakeKernel{maxEntries: MaxEntries, now: start}
+	k.changed = sync.NewCond(&k.mu)
+	return k
+}
+
+// Dial opens a socket whose peer is k, whatever netns.
+func (k *FakeKernel) Dial(netns string, groups uint32) (conntrack.Socket, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s := &fakeSocket{k: k, groups: groups}
+	k.sockets = append(k.sockets, s)
+	return s, nil
+}
+
+// Now returns the time of the clock of k.
+func (k *FakeKernel) Now() time.Time {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.now
+}
+
+// Advance moves the clock of k by d.
+func (k *FakeKernel) Advance(d time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.now = k.now.Add(d)
+}
+
+// Add puts conns in the table, replacing the entries with the same Key, without events, as if they
+// were there already, or their counters changed. Their MsgType is ignored.
+func (k *FakeKernel) Add(conns ...conntrack.ConntrackInfo) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, conn := range conns {
+		conn.MsgType = 0
+		k.put(conn)
+	}
+}
+
+// Table returns the entries of the table.
+func (k *FakeKernel) Table() []conntrack.ConntrackInfo {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]conntrack.ConntrackInfo(nil), k.table...)
+}
+
+// Event makes the changes conns are to the table and sends them to the sockets following events:
+// with MsgType NfctMsgNew or NfctMsgUpdate the connection is added or replaces the entry with the
+// same Key, with NfctMsgDestroy it is removed.
+func (k *FakeKernel) Event(conns ...conntrack.ConntrackInfo) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, conn := range conns {
+		k.apply(conn)
+		k.send(conn)
+	}
+	k.changed.Broadcast()
+}
+
+// Overflow makes the changes of conns like Event, but their events are lost: the sockets following
+// events fail their next read with ENOBUFS instead.
+func (k *FakeKernel) Overflow(conns ...conntrack.ConntrackInfo) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, conn := range conns {
+		k.apply(conn)
+	}
+	k.overflow(conntrack.NF_NETLINK_CONNTRACK_NEW | conntrack.NF_NETLINK_CONNTRACK_UPDATE | conntrack.NF_NETLINK_CONNTRACK_DESTROY)
+}
+
+// AddExpectations puts exps in the expectation table, replacing those with the same expected
+// tuple, without events. Their MsgType is ignored.
+func (k *FakeKernel) AddExpectations(exps ...conntrack.Expectation) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, e := range exps {
+		e.MsgType = 0
+		k.putExpectation(e)
+	}
+}
+
+// ExpectationEvent is Event for expectations: it makes the changes exps are to the expectation
+// table and sends them to the sockets following expectation events.
+func (k *FakeKernel) ExpectationEvent(exps ...conntrack.Expectation) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, e := range exps {
+		k.applyExpectation(e)
+		k.sendExpectation(e)
+	}
+	k.changed.Broadcast()
+}
+
+// ExpectationOverflow is Overflow for expectations.
+func (k *FakeKernel) ExpectationOverflow(exps ...conntrack.Expectation) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, e := range exps {
+		k.applyExpectation(e)
+	}
+	k.overflow(conntrack.NF_NETLINK_CONNTRACK_EXP_NEW | conntrack.NF_NETLINK_CONNTRACK_EXP_UPDATE | conntrack.NF_NETLINK_CONNTRACK_EXP_DESTROY)
+}
+
+// overflow has the sockets following any of groups fail their next read with ENOBUFS.
+func (k *FakeKernel) overflow(groups uint32) {
+	for _, s := range k.sockets {
+		if s.groups&groups != 0 {
+			s.overflowed = true
+		}
+	}
+	k.changed.Broadcast()
+}
+
+// WaitEventsRead waits until the sockets following events have read all the events sent, and
+// wait for more. The next ConnectionEvents of a ConnTrack then accounts for them.
+func (k *FakeKernel) WaitEventsRead() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for !k.eventsRead() {
+		k.changed.Wait()
+	}
+}
+
+func (k *FakeKernel) eventsRead() bool {
+	for _, s := range k.sockets {
+		if s.groups != 0 && (len(s.queue) > 0 || s.overflowed || !s.waiting) {
+			return false
+		}
+	}
+	return true
+}
+
+// FailRequest has the next request answered with an NLMSG_ERROR of errno.
+func (k *FakeKernel) FailRequest(errno syscall.Errno) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.requestErrors = append(k.requestErrors, errno)
+}
+
+// InterruptDump flags the next dump with NLM_F_DUMP_INTR, as if the table changed meanwhile.
+func (k *FakeKernel) InterruptDump() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.dumpFaults = append(k.dumpFaults, dumpFault{interrupt: true, entries: -1})
+}
+
+// EndDumpAfter ends the next dump with NLMSG_DONE once entries entries were dumped, as if the
+// others were gone.
+func (k *FakeKernel) EndDumpAfter(entries int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.dumpFaults = append(k.dumpFaults, dumpFault{entries: entries})
+}
+
+// find returns the index in the table of the connection of protocol proto whose tuple of direction
+// is t, in zone, -1 if there is none.
+func (k *FakeKernel) find(direction conntrack.CtattrType, proto int, t conntrack.Tuple, zone uint16) int {
+	for i, conn := range k.table {
+		tuple := conn.Orig
+		if direction == conntrack.CtaTupleReply {
+			tuple = conn.Reply
+		}
+		if conn.Proto == proto && conn.Zone == zone && tupleEqual(tuple, t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// put adds conn to the table, or replaces the entry with the same original tuple.
+func (k *FakeKernel) put(conn conntrack.ConntrackInfo) {
+	if i := k.find(conntrack.CtaTupleOrig, conn.Proto, conn.Orig, conn.Zone); i >= 0 {
+		k.table[i] = conn
+		return
+	}
+	k.table = append(k.table, conn)
+}
+
+func (k *FakeKernel) remove(i int) {
+	k.table = append(k.table[:i], k.table[i+1:]...)
+}
+
+// apply makes the change of the event conn to the table.
+func (k *FakeKernel) apply(conn conntrack.ConntrackInfo) {
+	if conn.MsgType != conntrack.NfctMsgDestroy {
+		k.put(conn)
+	} else if i := k.find(conntrack.CtaTupleOrig, conn.Proto, conn.Orig, conn.Zone); i >= 0 {
+		k.remove(i)
+	}
+}
+
+// findExpectation returns the index of the expectation of e in the expectation table, -1 if there
+// is none.
+func (k *FakeKernel) findExpectation(e conntrack.Expectation) int {
+	for i, exp := range k.expectations {
+		if exp.Proto == e.Proto && exp.Zone == e.Zone && tupleEqual(exp.Tuple, e.Tuple) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (k *FakeKernel) putExpectation(e conntrack.Expectation) {
+	if i := k.findExpectation(e); i >= 0 {
+		k.expectations[i] = e
+		return
+	}
+	k.expectations = append(k.expectations, e)
+}
+
+// applyExpectation makes the change of the event e to the expectation table.
+func (k *FakeKernel) applyExpectation(e conntrack.Expectation) {
+	if e.MsgType != conntrack.NfctMsgDestroy {
+		k.putExpectation(e)
+	} else if i := k.findExpectation(e); i >= 0 {
+		k.expectations = append(k.expectations[:i], k.expectations[i+1:]...)
+	}
+}
+
+// sendExpectation queues the event e on the sockets following its group.
+func (k *FakeKernel) sendExpectation(e conntrack.Expectation) {
+	typ, flags, group := conntrack.IpctnlMsgExpNew, uint16(0), uint32(conntrack.NF_NETLINK_CONNTRACK_EXP_UPDATE)
+	switch e.MsgType {
+	case conntrack.NfctMsgNew:
+		flags, group = syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, conntrack.NF_NETLINK_CONNTRACK_EXP_NEW
+	case conntrack.NfctMsgDestroy:
+		typ, group = conntrack.IpctnlMsgExpDelete, conntrack.NF_NETLINK_CONNTRACK_EXP_DESTROY
+	}
+	msg := expectationMessage(typ, flags, e)
+	for _, s := range k.sockets {
+		if s.groups&group == 0 {
+			continue
+		}
+		if s.bufferSize > 0 && s.queued+len(msg) > s.bufferSize {
+			s.overflowed = true
+			continue
+		}
+		s.queue = append(s.queue, msg)
+		s.queued += len(msg)
+	}
+}
+
+// send queues the event conn on the sockets following its group that their filter passes.
+func (k *FakeKernel) send(conn conntrack.ConntrackInfo) {
+	typ, flags, group := conntrack.IpctnlMsgCtNew, uint16(0), uint32(conntrack.NF_NETLINK_CONNTRACK_UPDATE)
+	switch conn.MsgType {
+	case conntrack.NfctMsgNew:
+		flags, group = syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, conntrack.NF_NETLINK_CONNTRACK_NEW
+	case conntrack.NfctMsgDestroy:
+		typ, group = conntrack.IpctnlMsgCtDelete, conntrack.NF_NETLINK_CONNTRACK_DESTROY
+	}
+	msg := conntrackMessage(typ, flags, conn)
+	for _, s := range k.sockets {
+		if s.groups&group == 0 {
+			continue
+		}
+		b := msg
+		if s.filter != nil {
+			keep := runBPF(s.filter, b)
+			if keep == 0 {
+				continue
+			}
+			if keep < uint32(len(b)) {
+				b = b[:keep]
+			}
+		}
+		if s.bufferSize > 0 && s.queued+len(b) > s.bufferSize {
+			s.overflowed = true
+			continue
+		}
+		s.queue = append(s.queue, b)
+		s.queued += len(b)
+	}
+}
+
+// handle answers the request req of s.
+func (k *FakeKernel) handle(s *fakeSocket, req syscall.NetlinkMessage) {
+	if n := len(k.requestErrors); n > 0 {
+		errno := k.requestErrors[0]
+		k.requestErrors = k.requestErrors[1:]
+		s.reply(errorMessage(req, errno))
+		return
+	}
+	if len(req.Data) < sizeofGenmsg {
+		s.reply(errorMessage(req, syscall.EINVAL))
+		return
+	}
+	attrs, err := parseAttrs(req.Data[sizeofGenmsg:])
+	if err != nil {
+		s.reply(errorMessage(req, syscall.EINVAL))
+		return
+	}
+	family := req.Data[0]
+	dump := req.Header.Flags&syscall.NLM_F_DUMP == syscall.NLM_F_DUMP
+	subsys, typ := uint8(req.Header.Type>>8), uint8(req.Header.Type)
+	ct, exp := conntrack.CntlMsgTypes(typ), conntrack.CntlExpMsgTypes(typ)
+	get := ct == conntrack.IpctnlMsgCtGet || ct == conntrack.IpctnlMsgCtGetCtrzero
+	var errno syscall.Errno
+	switch {
+	case subsys == conntrack.NFNL_SUBSYS_CTNETLINK && dump && get:
+		errno = k.dump(s, family, attrs, ct == conntrack.IpctnlMsgCtGetCtrzero)
+	case subsys == conntrack.NFNL_SUBSYS_CTNETLINK && get:
+		errno = k.lookup(s, attrs, ct == conntrack.IpctnlMsgCtGetCtrzero)
+	case subsys == conntrack.NFNL_SUBSYS_CTNETLINK && ct == conntrack.IpctnlMsgCtDelete:
+		errno = k.delete(attrs)
+	case subsys == conntrack.NFNL_SUBSYS_CTNETLINK && ct == conntrack.IpctnlMsgCtGetStats:
+		var e encoder
+		e.uint32(uint16(conntrack.CtaStatsGlobalEntries), uint32(len(k.table)))
+		e.uint32(uint16(conntrack.CtaStatsGlobalMaxEntries), k.maxEntries)
+		s.reply(nfnlMessage(conntrack.NFNL_SUBSYS_CTNETLINK, typ, 0, syscall.AF_UNSPEC, e.b))
+	case subsys == conntrack.NFNL_SUBSYS_CTNETLINK_EXP && dump && exp == conntrack.IpctnlMsgExpGet:
+		k.dumpExpectations(s, family)
+	case subsys == conntrack.NFNL_SUBSYS_CTNETLINK && dump && ct == conntrack.IpctnlMsgCtGetStatsCpu:
+		s.reply(doneMessage(0))
+	default:
+		errno = syscall.EOPNOTSUPP
+	}
+	if errno != 0 || !dump && req.Header.Flags&syscall.NLM_F_ACK != 0 {
+		s.reply(errorMessage(req, errno))
+	}
+}
+
+// dump answers a dump request of the entries of family matching the filter attributes attrs,
+// resetting their counters if zero.
+func (k *FakeKernel) dump(s *fakeSocket, family uint8, attrs []attr, zero bool) syscall.Errno {
+	var mark, markMask uint32
+	var zone uint16
+	var proto int
+	for _, a := range attrs {
+		var err error
+		switch conntrack.CtattrType(a.typ) {
+		case conntrack.CtaMark:
+			mark, err = a.uint32()
+		case conntrack.CtaMarkMask:
+			markMask, err = a.uint32()
+		case conntrack.CtaZone:
+			zone, err = a.uint16()
+		case conntrack.CtaTupleOrig:
+			proto, _, err = parseTuple(a.data)
+		}
+		if err != nil {
+			return syscall.EINVAL
+		}
+	}
+	fault := dumpFault{entries: -1}
+	if len(k.dumpFaults) > 0 {
+		fault = k.dumpFaults[0]
+		k.dumpFaults = k.dumpFaults[1:]
+	}
+	var flags uint16 = syscall.NLM_F_MULTI
+	if fault.interrupt {
+		flags |= conntrack.NLM_F_DUMP_INTR
+	}
+
+	var datagram []byte
+	dumped := 0
+	for i := range k.table {
+		conn := &k.table[i]
+		switch {
+		case family != syscall.AF_UNSPEC && tupleFamily(conn.Orig) != family,
+			markMask != 0 && conn.Mark&markMask != mark,
+			zone != 0 && conn.Zone != zone,
+			proto != 0 && conn.Proto != proto:
+			continue
+		}
+		if dumped == fault.entries {
+			break
+		}
+		dumped++
+		msg := conntrackMessage(conntrack.IpctnlMsgCtNew, flags, *conn)
+		if len(datagram)+len(msg) > datagramLen {
+			s.reply(datagram)
+			datagram = nil
+		}
+		datagram = append(datagram, msg...)
+		if zero {
+			conn.OrigCounters, conn.ReplyCounters = conntrack.Counters{}, conntrack.Counters{}
+		}
+	}
+	s.reply(append(datagram, doneMessage(flags&conntrack.NLM_F_DUMP_INTR)...))
+	return 0
+}
+
+// dumpExpectations answers a dump request of the expectations of family.
+func (k *FakeKernel) dumpExpectations(s *fakeSocket, family uint8) {
+	var datagram []byte
+	for _, e := range k.expectations {
+		if family != syscall.AF_UNSPEC && tupleFamily(e.Tuple) != family {
+			continue
+		}
+		msg := expectationMessage(conntrack.IpctnlMsgExpNew, syscall.NLM_F_MULTI, e)
+		if len(datagram)+len(msg) > datagramLen {
+			s.reply(datagram)
+			datagram = nil
+		}
+		datagram = append(datagram, msg...)
+	}
+	s.reply(append(datagram, doneMessage(0)...))
+}
+
+// lookup answers a lookup by the tuple in attrs, resetting the counters of the connection found if
+// zero.
+func (k *FakeKernel) lookup(s *fakeSocket, attrs []attr, zero bool) syscall.Errno {
+	i, errno := k.findRequested(attrs)
+	if errno != 0 {
+		return errno
+	}
+	s.reply(conntrackMessage(conntrack.IpctnlMsgCtNew, 0, k.table[i]))
+	if zero {
+		k.table[i].OrigCounters, k.table[i].ReplyCounters = conntrack.Counters{}, conntrack.Counters{}
+	}
+	return 0
+}
+
+// delete removes the connection with the tuple in attrs, and sends its destroy event.
+func (k *FakeKernel) delete(attrs []attr) syscall.Errno {
+	i, errno := k.findRequested(attrs)
+	if errno != 0 {
+		return errno
+	}
+	conn := k.table[i]
+	k.remove(i)
+	conn.MsgType = conntrack.NfctMsgDestroy
+	if conn.StartTimestamp != 0 && conn.StopTimestamp == 0 {
+		conn.StopTimestamp = uint64(k.now.UnixNano())
+	}
+	k.send(conn)
+	return 0
+}
+
+// findRequested returns the index of the connection of the tuple, zone and id of the attributes of
+// a request, ENOENT if there is none.
+func (k *FakeKernel) findRequested(attrs []attr) (int, syscall.Errno) {
+	direction := conntrack.CtaTupleOrig
+	var proto int
+	var tuple conntrack.Tuple
+	var zone uint16
+	var id uint32
+	var found bool
+	for _, a := range attrs {
+		var err error
+		switch typ := conntrack.CtattrType(a.typ); typ {
+		case conntrack.CtaTupleOrig, conntrack.CtaTupleReply:
+			direction, found = typ, true
+			proto, tuple, err = parseTuple(a.data)
+		case conntrack.CtaZone:
+			zone, err = a.uint16()
+		case conntrack.CtaId:
+			id, err = a.uint32()
+		}
+		if err != nil {
+			return -1, syscall.EINVAL
+		}
+	}
+	if !found {
+		return -1, syscall.EINVAL
+	}
+	i := k.find(direction, proto, tuple, zone)
+	if i < 0 || id != 0 && k.table[i].Id != id {
+		return -1, syscall.ENOENT
+	}
+	return i, 0
+}
+
+// fakeSocket is a Socket of a FakeKernel. Its fields are protected by the mutex of the kernel.
+type fakeSocket struct {
+	k      *FakeKernel
+	groups uint32
+	// The datagrams not read yet, and their size in bytes.
+	queue  [][]byte
+	queued int
+	// bufferSize is the size of the queue events overflow, unlimited if 0.
+	bufferSize int
+	timeout    time.Duration
+	filter     []syscall.SockFilter
+	// overflowed is set when events were lost, until the next Receive.
+	overflowed bool
+	// waiting is set while Receive waits for a message.
+	waiting bool
+	closed  bool
+}
+
+// reply queues a message the kernel answers a request with.
+func (s *fakeSocket) reply(b []byte) {
+	s.queue = append(s.queue, b)
+	s.queued += len(b)
+}
+
+func (s *fakeSocket) Send(p []byte) error {
+	k := s.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if s.closed {
+		return syscall.EBADF
+	}
+	msgs, err := syscall.ParseNetlinkMessage(p)
+	if err != nil {
+		return syscall.EINVAL
+	}
+	for _, msg := range msgs {
+		k.handle(s, msg)
+	}
+	k.changed.Broadcast()
+	return nil
+}
+
+// Receive truncates datagrams longer than b, like the kernel. Its timeout runs on the wall clock,
+// not the clock of the kernel: it only tells how often a reader wakes up.
+func (s *fakeSocket) Receive(b []byte) (int, error) {
+	k := s.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var deadline time.Time
+	if s.timeout > 0 {
+		deadline = time.Now().Add(s.timeout)
+		timer := time.AfterFunc(s.timeout, func() {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			k.changed.Broadcast()
+		})
+		defer timer.Stop()
+	}
+	for {
+		switch {
+		case s.closed:
+			return 0, syscall.EBADF
+		case s.overflowed:
+			s.overflowed = false
+			return 0, syscall.ENOBUFS
+		case len(s.queue) > 0:
+			d := s.queue[0]
+			s.queue = s.queue[1:]
+			s.queued -= len(d)
+			return copy(b, d), nil
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			return 0, syscall.EAGAIN
+		}
+		s.waiting = true
+		k.changed.Broadcast()
+		k.changed.Wait()
+		s.waiting = false
+	}
+}
+
+// SetReceiveBufferSize limits the bytes of the events queued, unlike the kernel, which counts
+// the memory they take.
+func (s *fakeSocket) SetReceiveBufferSize(size int) error {
+	s.k.mu.Lock()
+	defer s.k.mu.Unlock()
+	s.bufferSize = size
+	return nil
+}
+
+func (s *fakeSocket) SetReceiveTimeout(d time.Duration) error {
+	s.k.mu.Lock()
+	defer s.k.mu.Unlock()
+	s.timeout = d
+	return nil
+}
+
+func (s *fakeSocket) AttachFilter(prog []syscall.SockFilter) error {
+	if err := checkBPF(prog); err != nil {
+		return syscall.EINVAL
+	}
+	s.k.mu.Lock()
+	defer s.k.mu.Unlock()
+	s.filter = append([]syscall.SockFilter(nil), prog...)
+	return nil
+}
+
+func (s *fakeSocket) Close() {
+	k := s.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for i, other := range k.sockets {
+		if other == s {
+			k.sockets = append(k.sockets[:i], k.sockets[i+1:]...)
+			break
+		}
+	}
+	k.changed.Broadcast()
+}
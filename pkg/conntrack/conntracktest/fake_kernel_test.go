@@ -0,0 +1,534 @@
+package conntracktest
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+var start = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// tcpConn returns a TCP connection from 10.0.0.5:port to 10.0.0.6:6379, in state.
+func tcpConn(msgType conntrack.NfConntrackEventType, port uint16, state conntrack.TCPState) conntrack.ConntrackInfo {
+	return conntrack.ConntrackInfo{
+		MsgType:  msgType,
+		Proto:    syscall.IPPROTO_TCP,
+		Orig:     conntrack.Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: port, Dst: net.IP{10, 0, 0, 6}, DstPort: 6379},
+		Reply:    conntrack.Tuple{Src: net.IP{10, 0, 0, 6}, SrcPort: 6379, Dst: net.IP{10, 0, 0, 5}, DstPort: port},
+		Status:   conntrack.IpsSeenReply | conntrack.IpsAssured | conntrack.IpsConfirmed,
+		TCPState: state,
+	}
+}
+
+// ports returns the sorted source ports of conns.
+func ports(conns []conntrack.ConntrackInfo) []int {
+	ports := []int{}
+	for _, conn := range conns {
+		ports = append(ports, int(conn.Orig.SrcPort))
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// newConnTrack returns a ConnTrack of k following its events, whose first ConnectionEvents,
+// the dump of the table, was taken.
+func newConnTrack(t *testing.T, k *FakeKernel, config conntrack.Config) *conntrack.ConnTrack {
+	if config.FilterFunc == nil {
+		config.FilterFunc = conntrack.DefaultFilter
+	}
+	config.Dialer = k
+	c, err := conntrack.NewWithConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.ConnectionEvents()
+	return c
+}
+
+func TestFakeKernelDump(t *testing.T) {
+	k := NewFakeKernel(start)
+	udp := tcpConn(0, 53, 0)
+	udp.Proto = syscall.IPPROTO_UDP
+	udp.Status = conntrack.IpsConfirmed
+	marked := tcpConn(0, 1002, conntrack.TCPState_ESTABLISHED)
+	marked.Mark = 0x4000
+	v6 := tcpConn(0, 1003, conntrack.TCPState_ESTABLISHED)
+	v6.Orig.Src, v6.Orig.Dst = net.ParseIP("fd00::5"), net.ParseIP("fd00::6")
+	v6.Reply.Src, v6.Reply.Dst = v6.Orig.Dst, v6.Orig.Src
+	k.Add(tcpConn(0, 1001, conntrack.TCPState_ESTABLISHED), tcpConn(0, 1004, conntrack.TCPState_TIME_WAIT), udp, marked, v6)
+	c := newConnTrack(t, k, conntrack.Config{})
+	defer c.Close()
+
+	tests := []struct {
+		Filter   *conntrack.DumpFilter
+		Expected []int
+	}{
+		{Expected: []int{1001, 1002, 1003}},
+		{Filter: &conntrack.DumpFilter{Family: syscall.AF_INET6}, Expected: []int{1003}},
+		{Filter: &conntrack.DumpFilter{Mark: 0x4000, MarkMask: 0xc000}, Expected: []int{1002}},
+		{Filter: &conntrack.DumpFilter{L4Proto: syscall.IPPROTO_UDP}, Expected: []int{}},
+		// Both families are dumped.
+		{Filter: &conntrack.DumpFilter{L4Proto: syscall.IPPROTO_TCP}, Expected: []int{1001, 1002, 1003}},
+		{Filter: &conntrack.DumpFilter{Family: syscall.AF_INET, L4Proto: syscall.IPPROTO_TCP}, Expected: []int{1001, 1002}},
+	}
+	for _, test := range tests {
+		conns, err := c.ListFilteredConntrackInfos(test.Filter)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.Filter, err)
+			continue
+		}
+		if got := ports(conns); !reflect.DeepEqual(got, test.Expected) {
+			t.Errorf("%+v: expected %v, got %v", test.Filter, test.Expected, got)
+		}
+	}
+
+	// The unreplied UDP and the closing TCP connections aren't established.
+	conns, err := c.ListAllConntrackInfos()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, expected := ports(conns), []int{53, 1001, 1002, 1003, 1004}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestFakeKernelDumpFaults(t *testing.T) {
+	k := NewFakeKernel(start)
+	k.Add(tcpConn(0, 1001, conntrack.TCPState_ESTABLISHED), tcpConn(0, 1002, conntrack.TCPState_ESTABLISHED))
+	c := newConnTrack(t, k, conntrack.Config{})
+	defer c.Close()
+
+	// Interrupted dumps are retried.
+	k.InterruptDump()
+	conns, err := c.ListConntrackInfos()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, expected := ports(conns), []int{1001, 1002}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Streamed ones aren't.
+	k.InterruptDump()
+	var streamed []conntrack.ConntrackInfo
+	err = c.DumpConntrackInfos(nil, func(conn conntrack.ConntrackInfo) error {
+		streamed = append(streamed, conn)
+		return nil
+	})
+	if err != conntrack.ErrDumpInterrupted {
+		t.Errorf("expected %v, got %v", conntrack.ErrDumpInterrupted, err)
+	}
+	if len(streamed) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(streamed))
+	}
+
+	k.EndDumpAfter(1)
+	if conns, err = c.ListConntrackInfos(); err != nil || len(conns) != 1 {
+		t.Errorf("expected 1 entry, got %d, %v", len(conns), err)
+	}
+
+	k.FailRequest(syscall.EPERM)
+	_, err = c.ListConntrackInfos()
+	var netlinkErr *conntrack.NetlinkError
+	if !errors.As(err, &netlinkErr) || netlinkErr.Errno != syscall.EPERM {
+		t.Errorf("expected %v, got %v", syscall.EPERM, err)
+	}
+	// The socket is still in use.
+	if conns, err = c.ListConntrackInfos(); err != nil || len(conns) != 2 {
+		t.Errorf("expected 2 entries, got %d, %v", len(conns), err)
+	}
+}
+
+func TestFakeKernelDumpCallbackError(t *testing.T) {
+	k := NewFakeKernel(start)
+	// Enough entries for the dump to take several datagrams.
+	for port := 1; port <= 1000; port++ {
+		k.Add(tcpConn(0, uint16(port), conntrack.TCPState_ESTABLISHED))
+	}
+	c := newConnTrack(t, k, conntrack.Config{})
+	defer c.Close()
+
+	// The callback fails with the error of a request of its own, in the middle of the dump.
+	gone := tcpConn(0, 2000, conntrack.TCPState_ESTABLISHED)
+	err := c.DumpConntrackInfos(nil, func(conntrack.ConntrackInfo) error {
+		_, err := c.Lookup(gone.Proto, gone.Orig, 0)
+		return err
+	})
+	var netlinkErr *conntrack.NetlinkError
+	if !errors.As(err, &netlinkErr) || netlinkErr.Errno != syscall.ENOENT {
+		t.Errorf("expected %v, got %v", syscall.ENOENT, err)
+	}
+	// The rest of that dump doesn't end up in the next one.
+	for i := 0; i < 3; i++ {
+		if conns, err := c.ListConntrackInfos(); err != nil || len(conns) != 1000 {
+			t.Errorf("expected 1000 entries, got %d, %v", len(conns), err)
+		}
+	}
+}
+
+func TestFakeKernelLookupDelete(t *testing.T) {
+	k := NewFakeKernel(start)
+	conn := tcpConn(0, 1001, conntrack.TCPState_ESTABLISHED)
+	conn.Id = 7
+	conn.StartTimestamp = uint64(k.Now().Add(-time.Minute).UnixNano())
+	k.Add(conn, tcpConn(0, 1002, conntrack.TCPState_ESTABLISHED))
+	c := newConnTrack(t, k, conntrack.Config{ZeroCounters: true})
+	defer c.Close()
+
+	if entries, maxEntries, err := c.TableSize(); err != nil || entries != 2 || maxEntries != MaxEntries {
+		t.Errorf("expected 2 entries of %d, got %d of %d, %v", MaxEntries, entries, maxEntries, err)
+	}
+
+	found, err := c.LookupReply(syscall.IPPROTO_TCP, conn.Reply, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if found.Id != conn.Id || !tupleEqual(found.Orig, conn.Orig) {
+		t.Errorf("expected %s, got %s", conn, found)
+	}
+	if _, err := c.Lookup(syscall.IPPROTO_TCP, conn.Orig, 1); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("expected %v, got %v", syscall.ENOENT, err)
+	}
+
+	// A newer connection with the same tuple isn't deleted.
+	stale := conn
+	stale.Id = 6
+	if err := c.Delete(stale); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := len(k.Table()); n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+	k.Advance(time.Second)
+	if err := c.Delete(conn); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, expected := ports(k.Table()), []int{1002}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// The deletion is an event, stopped on the clock of the kernel.
+	k.WaitEventsRead()
+	c.ConnectionEvents()
+	conns, err := c.ListAndZeroConntrackInfos()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var destroyed []conntrack.ConntrackInfo
+	for _, conn := range conns {
+		if conn.MsgType == conntrack.NfctMsgDestroy {
+			destroyed = append(destroyed, conn)
+		}
+	}
+	if len(destroyed) != 1 || destroyed[0].Id != conn.Id || destroyed[0].Duration() != time.Minute+time.Second {
+		t.Errorf("expected the destroy event of %s, got %v", conn, destroyed)
+	}
+}
+
+func TestFakeKernelEvents(t *testing.T) {
+	k := NewFakeKernel(start)
+	k.Add(tcpConn(0, 1001, conntrack.TCPState_ESTABLISHED))
+	c, err := conntrack.NewWithConfig(conntrack.Config{FilterFunc: conntrack.DefaultFilter, Dialer: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	// The dump of the table when it started.
+	if got, expected := ports(c.ConnectionEvents()), []int{1001}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	k.Event(tcpConn(conntrack.NfctMsgNew, 1002, conntrack.TCPState_SYN_SENT),
+		tcpConn(conntrack.NfctMsgUpdate, 1002, conntrack.TCPState_ESTABLISHED),
+		tcpConn(conntrack.NfctMsgUpdate, 1003, conntrack.TCPState_ESTABLISHED),
+		tcpConn(conntrack.NfctMsgUpdate, 1003, conntrack.TCPState_FIN_WAIT))
+	k.WaitEventsRead()
+	if got, expected := ports(c.ConnectionEvents()), []int{1002, 1003}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got, expected := ports(k.Table()), []int{1001, 1002, 1003}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected table %v, got %v", expected, got)
+	}
+
+	k.Event(tcpConn(conntrack.NfctMsgDestroy, 1003, conntrack.TCPState_CLOSE))
+	if got, expected := ports(k.Table()), []int{1001, 1002}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected table %v, got %v", expected, got)
+	}
+
+	// Lost events are made up for by a dump.
+	k.Overflow(tcpConn(conntrack.NfctMsgUpdate, 1004, conntrack.TCPState_ESTABLISHED))
+	for c.EventStats().Resyncs == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := c.EventStats(); stats.Overflows != 1 || stats.Resyncs != 1 {
+		t.Errorf("expected 1 overflow and resync, got %+v", stats)
+	}
+	if got, expected := ports(c.ConnectionEvents()), []int{1001, 1002, 1004}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// With ZeroCounters, destroy events skip the checks of DefaultFilter, not those of the user.
+func TestFakeKernelDestroyFilter(t *testing.T) {
+	k := NewFakeKernel(start)
+	protoFilter := conntrack.ProtocolFilter(syscall.IPPROTO_TCP)
+	c := newConnTrack(t, k, conntrack.Config{
+		FilterFunc:        conntrack.AllOf(protoFilter, conntrack.DefaultFilter),
+		ZeroCounters:      true,
+		DestroyFilterFunc: protoFilter,
+	})
+	defer c.Close()
+
+	udp := tcpConn(conntrack.NfctMsgDestroy, 53, 0)
+	udp.Proto = syscall.IPPROTO_UDP
+	k.Event(tcpConn(conntrack.NfctMsgDestroy, 1001, conntrack.TCPState_CLOSE), udp)
+	k.WaitEventsRead()
+	c.ConnectionEvents()
+	conns, err := c.ListAndZeroConntrackInfos()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, expected := ports(conns), []int{1001}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestFakeKernelEventFilter(t *testing.T) {
+	k := NewFakeKernel(start)
+	c := newConnTrack(t, k, conntrack.Config{
+		FilterFunc: func(conntrack.ConntrackInfo) bool { return true },
+		EventFilter: &conntrack.EventFilter{
+			Events:    conntrack.NfctMsgUpdate,
+			TCPStates: []conntrack.TCPState{conntrack.TCPState_ESTABLISHED},
+		},
+		// Room for one event only.
+		ReceiveBufferSize: 200,
+	})
+	defer c.Close()
+
+	k.Event(tcpConn(conntrack.NfctMsgNew, 1001, conntrack.TCPState_ESTABLISHED),
+		tcpConn(conntrack.NfctMsgUpdate, 1002, conntrack.TCPState_CLOSE_WAIT),
+		tcpConn(conntrack.NfctMsgUpdate, 1003, conntrack.TCPState_ESTABLISHED))
+	k.WaitEventsRead()
+	if got, expected := ports(c.ConnectionEvents()), []int{1003}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if stats := c.EventStats(); stats.Overflows != 0 {
+		t.Errorf("expected no overflow, got %+v", stats)
+	}
+
+	k.Event(tcpConn(conntrack.NfctMsgUpdate, 1004, conntrack.TCPState_ESTABLISHED),
+		tcpConn(conntrack.NfctMsgUpdate, 1005, conntrack.TCPState_ESTABLISHED))
+	k.WaitEventsRead()
+	if stats := c.EventStats(); stats.Overflows != 1 {
+		t.Errorf("expected 1 overflow, got %+v", stats)
+	}
+}
+
+func TestFakeKernelClock(t *testing.T) {
+	k := NewFakeKernel(start)
+	c := newConnTrack(t, k, conntrack.Config{})
+	defer c.Close()
+	k.Advance(time.Minute)
+	if now := c.Now(); !now.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected %s, got %s", start.Add(time.Minute), now)
+	}
+}
+
+// The messages of the fake kernel are parsed back into what they were built from.
+func TestFakeKernelMessages(t *testing.T) {
+	master := conntrack.Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: 41000, Dst: net.IP{10, 0, 0, 6}, DstPort: 21}
+	conns := []conntrack.ConntrackInfo{
+		{
+			Proto:          syscall.IPPROTO_TCP,
+			Orig:           conntrack.Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: 38318, Dst: net.IP{10, 96, 0, 10}, DstPort: 6379},
+			Reply:          conntrack.Tuple{Src: net.IP{10, 0, 0, 6}, SrcPort: 6379, Dst: net.IP{10, 0, 0, 5}, DstPort: 38318},
+			OrigCounters:   conntrack.Counters{Packets: 4, Bytes: 400},
+			ReplyCounters:  conntrack.Counters{Packets: 3, Bytes: 3000},
+			StartTimestamp: 1792307624000000000,
+			TCPState:       conntrack.TCPState_ESTABLISHED,
+			Status:         conntrack.IpsSeenReply | conntrack.IpsAssured | conntrack.IpsConfirmed | conntrack.IpsDstNat,
+			Mark:           0x4000,
+			Zone:           2,
+			Id:             0xdeadbeef,
+			Timeout:        431999,
+			Use:            1,
+			Labels:         []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			Proto:          syscall.IPPROTO_TCP,
+			Orig:           conntrack.Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: 41001, Dst: net.IP{10, 0, 0, 6}, DstPort: 20000},
+			Reply:          conntrack.Tuple{Src: net.IP{10, 0, 0, 6}, SrcPort: 20000, Dst: net.IP{10, 0, 0, 5}, DstPort: 41001},
+			StartTimestamp: 1792307624000000000,
+			StopTimestamp:  1792307625000000000,
+			Status:         conntrack.IpsSeenReply | conntrack.IpsConfirmed | conntrack.IpsExpected,
+			Master:         &master,
+			MasterProto:    syscall.IPPROTO_TCP,
+		},
+		{
+			Proto:  syscall.IPPROTO_ICMPV6,
+			Orig:   conntrack.Tuple{Src: net.ParseIP("fd00::3"), Dst: net.ParseIP("fd00::5"), IcmpId: 7, IcmpType: 128},
+			Reply:  conntrack.Tuple{Src: net.ParseIP("fd00::5"), Dst: net.ParseIP("fd00::3"), IcmpId: 7, IcmpType: 129},
+			Status: conntrack.IpsConfirmed,
+		},
+	}
+	k := NewFakeKernel(start)
+	k.Add(conns...)
+	c := newConnTrack(t, k, conntrack.Config{})
+	defer c.Close()
+
+	dumped, err := c.ListAllConntrackInfos()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(dumped) != len(conns) {
+		t.Fatalf("expected %d entries, got %d", len(conns), len(dumped))
+	}
+	for i, conn := range conns {
+		// Dumped entries are updates.
+		conn.MsgType = conntrack.NfctMsgUpdate
+		if !reflect.DeepEqual(dumped[i], conn) {
+			t.Errorf("expected %+v, got %+v", conn, dumped[i])
+		}
+	}
+}
+
+// The masters of expectations are found in a single dump, by protocol, tuple and zone.
+func TestFakeKernelExpectationMasters(t *testing.T) {
+	control := tcpConn(0, 38318, conntrack.TCPState_ESTABLISHED)
+	control.Orig.DstPort, control.Reply.SrcPort = 21, 21
+	// The same tuple in another zone.
+	zoned := control
+	zoned.Zone = 3
+	k := NewFakeKernel(start)
+	k.Add(tcpConn(0, 1001, conntrack.TCPState_ESTABLISHED), control, zoned)
+	c := newConnTrack(t, k, conntrack.Config{})
+	defer c.Close()
+
+	expect := func(master conntrack.Tuple, zone uint16) conntrack.Expectation {
+		return conntrack.Expectation{
+			Master:      master,
+			MasterProto: syscall.IPPROTO_TCP,
+			Tuple:       conntrack.Tuple{Src: master.Src, Dst: master.Dst, DstPort: 50000},
+			Proto:       syscall.IPPROTO_TCP,
+			Helper:      "ftp",
+			Zone:        zone,
+		}
+	}
+	gone := control.Orig
+	gone.SrcPort = 38319
+	exps := []conntrack.Expectation{
+		expect(control.Orig, 0),
+		expect(gone, 0),
+		expect(control.Orig, 3),
+		// A second expectation of the same master.
+		expect(control.Orig, 0),
+	}
+	k.InterruptDump()
+	masters, err := c.ExpectationMasters(exps)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(masters) != len(exps) {
+		t.Fatalf("expected %d masters, got %d", len(exps), len(masters))
+	}
+	for i, expected := range []*conntrack.ConntrackInfo{&control, nil, &zoned, &control} {
+		switch {
+		case expected == nil && masters[i] != nil:
+			t.Errorf("%d: expected no master, got %+v", i, masters[i])
+		case expected != nil && (masters[i] == nil || masters[i].Key() != expected.Key()):
+			t.Errorf("%d: expected the master %s, got %+v", i, expected.Key(), masters[i])
+		}
+	}
+}
+
+// ftpExpectation returns the expectation of an FTP data connection to 10.0.0.5:port, made by the
+// control connection from 10.0.0.5:38318.
+func ftpExpectation(msgType conntrack.NfConntrackEventType, port uint16) conntrack.Expectation {
+	return conntrack.Expectation{
+		MsgType:     msgType,
+		Master:      conntrack.Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: 38318, Dst: net.IP{10, 0, 0, 6}, DstPort: 21},
+		MasterProto: syscall.IPPROTO_TCP,
+		Tuple:       conntrack.Tuple{Src: net.IP{10, 0, 0, 6}, Dst: net.IP{10, 0, 0, 5}, DstPort: port},
+		Proto:       syscall.IPPROTO_TCP,
+		Mask:        conntrack.Tuple{Src: net.IP{255, 255, 255, 255}, Dst: net.IP{255, 255, 255, 255}, DstPort: 0xffff},
+		Timeout:     300,
+		Helper:      "ftp",
+	}
+}
+
+// expectedPorts returns the sorted destination ports of the expected tuples of exps.
+func expectedPorts(exps []conntrack.Expectation) []int {
+	ports := []int{}
+	for _, e := range exps {
+		ports = append(ports, int(e.Tuple.DstPort))
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func TestFakeKernelFollowExpectations(t *testing.T) {
+	k := NewFakeKernel(start)
+	k.AddExpectations(ftpExpectation(0, 50001))
+	c := newConnTrack(t, k, conntrack.Config{})
+	defer c.Close()
+
+	exps, err := c.ListExpectations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, expected := expectedPorts(exps), []int{50001}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if len(exps) == 1 && (exps[0].Helper != "ftp" || exps[0].Timeout != 300 || exps[0].Master.DstPort != 21) {
+		t.Errorf("expected %+v, got %+v", ftpExpectation(conntrack.NfctMsgUpdate, 50001), exps[0])
+	}
+
+	events, stop, err := c.FollowExpectations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	next := func() conntrack.ExpectationEvent {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("expected an event, the channel is closed")
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected an event")
+		}
+		return conntrack.ExpectationEvent{}
+	}
+
+	k.ExpectationEvent(ftpExpectation(conntrack.NfctMsgNew, 50002), ftpExpectation(conntrack.NfctMsgDestroy, 50001))
+	for _, expected := range []conntrack.Expectation{ftpExpectation(conntrack.NfctMsgNew, 50002), ftpExpectation(conntrack.NfctMsgDestroy, 50001)} {
+		event := next()
+		if e := event.Expectation; e == nil || e.MsgType != expected.MsgType || e.Tuple.DstPort != expected.Tuple.DstPort {
+			t.Errorf("expected %+v, got %+v", expected, event)
+		}
+	}
+
+	// Lost events are made up for by a dump of the expectation table.
+	k.ExpectationOverflow(ftpExpectation(conntrack.NfctMsgNew, 50003), ftpExpectation(conntrack.NfctMsgDestroy, 50002))
+	if event := next(); event.Expectation != nil || !reflect.DeepEqual(expectedPorts(event.Table), []int{50003}) {
+		t.Errorf("expected a resync with 50003, got %+v", event)
+	}
+	// An overflow of the connection events doesn't make one.
+	k.Overflow()
+	k.ExpectationEvent(ftpExpectation(conntrack.NfctMsgDestroy, 50003))
+	if event := next(); event.Expectation == nil || event.Expectation.MsgType != conntrack.NfctMsgDestroy {
+		t.Errorf("expected the destroy event of 50003, got %+v", event)
+	}
+
+	stop()
+	for range events {
+	}
+}
@@ -0,0 +1,332 @@
+package conntracktest
+
+// The messages of the fake kernel. They are built and parsed here rather than by the conntrack
+// package, so that its parser is tested against an encoder of its own.
+// Netlink headers, attribute headers included, are in host byte order, ctnetlink attribute
+// payloads in network byte order.
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+const (
+	attrHdrLength = 4
+	sizeofGenmsg  = 4
+)
+
+func align(l int) int {
+	return (l + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+}
+
+// encoder appends netlink attributes to a buffer.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) data(typ uint16, data []byte) {
+	var hdr [attrHdrLength]byte
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(attrHdrLength+len(data)))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	e.b = append(e.b, hdr[:]...)
+	e.b = append(e.b, data...)
+	for len(e.b)%syscall.NLA_ALIGNTO != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *encoder) uint8(typ uint16, v uint8) {
+	e.data(typ, []byte{v})
+}
+
+func (e *encoder) uint16(typ uint16, v uint16) {
+	e.data(typ, binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (e *encoder) uint32(typ uint16, v uint32) {
+	e.data(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (e *encoder) uint64(typ uint16, v uint64) {
+	e.data(typ, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (e *encoder) nested(typ uint16, f func(e *encoder)) {
+	var inner encoder
+	f(&inner)
+	e.data(typ|conntrack.NLA_F_NESTED, inner.b)
+}
+
+func (e *encoder) tuple(proto int, t conntrack.Tuple) {
+	e.nested(uint16(conntrack.CtaTupleIp), func(e *encoder) {
+		if tupleFamily(t) == syscall.AF_INET {
+			e.data(uint16(conntrack.CtaIpV4Src), t.Src.To4())
+			e.data(uint16(conntrack.CtaIpV4Dst), t.Dst.To4())
+		} else {
+			e.data(uint16(conntrack.CtaIpV6Src), t.Src.To16())
+			e.data(uint16(conntrack.CtaIpV6Dst), t.Dst.To16())
+		}
+	})
+	e.nested(uint16(conntrack.CtaTupleProto), func(e *encoder) {
+		e.uint8(uint16(conntrack.CtaProtoNum), uint8(proto))
+		switch proto {
+		case syscall.IPPROTO_ICMP:
+			e.uint16(uint16(conntrack.CtaProtoIcmpId), t.IcmpId)
+			e.uint8(uint16(conntrack.CtaProtoIcmpType), t.IcmpType)
+			e.uint8(uint16(conntrack.CtaProtoIcmpCode), t.IcmpCode)
+		case syscall.IPPROTO_ICMPV6:
+			e.uint16(uint16(conntrack.CtaProtoIcmpv6Id), t.IcmpId)
+			e.uint8(uint16(conntrack.CtaProtoIcmpv6Type), t.IcmpType)
+			e.uint8(uint16(conntrack.CtaProtoIcmpv6Code), t.IcmpCode)
+		default:
+			e.uint16(uint16(conntrack.CtaProtoSrcPort), t.SrcPort)
+			e.uint16(uint16(conntrack.CtaProtoDstPort), t.DstPort)
+		}
+	})
+}
+
+// conntrackInfo appends the attributes of a connection the way the kernel sends them, see
+// ctnetlink_fill_info. The fields that are zero are left out, but the tuples and the status.
+func (e *encoder) conntrackInfo(c conntrack.ConntrackInfo) {
+	e.nested(uint16(conntrack.CtaTupleOrig), func(e *encoder) { e.tuple(c.Proto, c.Orig) })
+	e.nested(uint16(conntrack.CtaTupleReply), func(e *encoder) { e.tuple(c.Proto, c.Reply) })
+	if c.Zone != 0 {
+		e.uint16(uint16(conntrack.CtaZone), c.Zone)
+	}
+	e.uint32(uint16(conntrack.CtaStatus), uint32(c.Status))
+	if c.Timeout != 0 {
+		e.uint32(uint16(conntrack.CtaTimeout), c.Timeout)
+	}
+	counters := func(typ conntrack.CtattrType, counters conntrack.Counters) {
+		if counters != (conntrack.Counters{}) {
+			e.nested(uint16(typ), func(e *encoder) {
+				e.uint64(uint16(conntrack.CtaCountersPackets), counters.Packets)
+				e.uint64(uint16(conntrack.CtaCountersBytes), counters.Bytes)
+			})
+		}
+	}
+	counters(conntrack.CtaCountersOrig, c.OrigCounters)
+	counters(conntrack.CtaCountersReply, c.ReplyCounters)
+	if c.StartTimestamp != 0 || c.StopTimestamp != 0 {
+		e.nested(uint16(conntrack.CtaTimestamp), func(e *encoder) {
+			if c.StartTimestamp != 0 {
+				e.uint64(uint16(conntrack.CtaTimestampStart), c.StartTimestamp)
+			}
+			if c.StopTimestamp != 0 {
+				e.uint64(uint16(conntrack.CtaTimestampStop), c.StopTimestamp)
+			}
+		})
+	}
+	switch {
+	case c.Proto == syscall.IPPROTO_TCP && c.TCPState != 0:
+		e.nested(uint16(conntrack.CtaProtoinfo), func(e *encoder) {
+			e.nested(uint16(conntrack.CtaProtoinfoTcp), func(e *encoder) {
+				e.uint8(uint16(conntrack.CtaProtoinfoTcpState), uint8(c.TCPState))
+			})
+		})
+	case c.Proto == syscall.IPPROTO_SCTP && c.SCTPState != 0:
+		e.nested(uint16(conntrack.CtaProtoinfo), func(e *encoder) {
+			e.nested(uint16(conntrack.CtaProtoinfoSctp), func(e *encoder) {
+				e.uint8(uint16(conntrack.CtaProtoinfoSctpState), uint8(c.SCTPState))
+			})
+		})
+	}
+	if c.Mark != 0 {
+		e.uint32(uint16(conntrack.CtaMark), c.Mark)
+	}
+	if len(c.Labels) > 0 {
+		e.data(uint16(conntrack.CtaLabels), c.Labels)
+	}
+	if c.Master != nil {
+		e.nested(uint16(conntrack.CtaTupleMaster), func(e *encoder) { e.tuple(c.MasterProto, *c.Master) })
+	}
+	if c.Id != 0 {
+		e.uint32(uint16(conntrack.CtaId), c.Id)
+	}
+	if c.Use != 0 {
+		e.uint32(uint16(conntrack.CtaUse), c.Use)
+	}
+}
+
+// expectation appends the attributes of an expectation the way the kernel sends them, see
+// ctnetlink_exp_dump_expect. The mask has the protocol of the expected tuple.
+func (e *encoder) expectation(exp conntrack.Expectation) {
+	e.nested(uint16(conntrack.CtaExpectMaster), func(e *encoder) { e.tuple(exp.MasterProto, exp.Master) })
+	e.nested(uint16(conntrack.CtaExpectTuple), func(e *encoder) { e.tuple(exp.Proto, exp.Tuple) })
+	e.nested(uint16(conntrack.CtaExpectMask), func(e *encoder) { e.tuple(exp.Proto, exp.Mask) })
+	if exp.Zone != 0 {
+		e.uint16(uint16(conntrack.CtaExpectZone), exp.Zone)
+	}
+	e.uint32(uint16(conntrack.CtaExpectTimeout), exp.Timeout)
+	e.uint32(uint16(conntrack.CtaExpectId), exp.Id)
+	e.uint32(uint16(conntrack.CtaExpectFlags), exp.Flags)
+	e.uint32(uint16(conntrack.CtaExpectClass), exp.Class)
+	if exp.Helper != "" {
+		e.data(uint16(conntrack.CtaExpectHelpName), append([]byte(exp.Helper), 0))
+	}
+	if exp.Fn != "" {
+		e.data(uint16(conntrack.CtaExpectFn), append([]byte(exp.Fn), 0))
+	}
+}
+
+// tupleFamily returns the address family of a tuple.
+func tupleFamily(t conntrack.Tuple) uint8 {
+	if t.Src.To4() == nil {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
+// nfnlMessage returns a message of the kernel, of type msgType of the subsystem subsys.
+func nfnlMessage(subsys, msgType uint8, flags uint16, family uint8, attrs []byte) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN+sizeofGenmsg, syscall.NLMSG_HDRLEN+sizeofGenmsg+len(attrs))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(cap(b)))
+	binary.NativeEndian.PutUint16(b[4:6], uint16(subsys)<<8|uint16(msgType))
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	b[syscall.NLMSG_HDRLEN] = family
+	b[syscall.NLMSG_HDRLEN+1] = conntrack.NFNETLINK_V0
+	return append(b, attrs...)
+}
+
+// conntrackMessage returns the ctnetlink message of type typ about conn.
+func conntrackMessage(typ conntrack.CntlMsgTypes, flags uint16, conn conntrack.ConntrackInfo) []byte {
+	var e encoder
+	e.conntrackInfo(conn)
+	return nfnlMessage(conntrack.NFNL_SUBSYS_CTNETLINK, uint8(typ), flags, tupleFamily(conn.Orig), e.b)
+}
+
+// expectationMessage returns the ctnetlink expectation message of type typ about exp.
+func expectationMessage(typ conntrack.CntlExpMsgTypes, flags uint16, exp conntrack.Expectation) []byte {
+	var e encoder
+	e.expectation(exp)
+	return nfnlMessage(conntrack.NFNL_SUBSYS_CTNETLINK_EXP, uint8(typ), flags, tupleFamily(exp.Tuple), e.b)
+}
+
+// errorMessage returns the NLMSG_ERROR answering req with errno, an acknowledgement if 0.
+func errorMessage(req syscall.NetlinkMessage, errno syscall.Errno) []byte {
+	b := make([]byte, 2*syscall.NLMSG_HDRLEN+4)
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], syscall.NLMSG_ERROR)
+	binary.NativeEndian.PutUint32(b[syscall.NLMSG_HDRLEN:], uint32(-int32(errno)))
+	h := b[syscall.NLMSG_HDRLEN+4:]
+	binary.NativeEndian.PutUint32(h[0:4], req.Header.Len)
+	binary.NativeEndian.PutUint16(h[4:6], req.Header.Type)
+	binary.NativeEndian.PutUint16(h[6:8], req.Header.Flags)
+	binary.NativeEndian.PutUint32(h[8:12], req.Header.Seq)
+	binary.NativeEndian.PutUint32(h[12:16], req.Header.Pid)
+	return b
+}
+
+// doneMessage returns the NLMSG_DONE ending a dump.
+func doneMessage(flags uint16) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN+4)
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], syscall.NLMSG_DONE)
+	binary.NativeEndian.PutUint16(b[6:8], syscall.NLM_F_MULTI|flags)
+	return b
+}
+
+var errMalformed = errors.New("malformed attributes")
+
+// attr is a parsed netlink attribute.
+type attr struct {
+	typ  uint16
+	data []byte
+}
+
+func (a attr) uint8() (uint8, error) {
+	if len(a.data) != 1 {
+		return 0, errMalformed
+	}
+	return a.data[0], nil
+}
+
+func (a attr) uint16() (uint16, error) {
+	if len(a.data) != 2 {
+		return 0, errMalformed
+	}
+	return binary.BigEndian.Uint16(a.data), nil
+}
+
+func (a attr) uint32() (uint32, error) {
+	if len(a.data) != 4 {
+		return 0, errMalformed
+	}
+	return binary.BigEndian.Uint32(a.data), nil
+}
+
+// parseAttrs splits b into its attributes.
+func parseAttrs(b []byte) ([]attr, error) {
+	var attrs []attr
+	for len(b) > 0 {
+		if len(b) < attrHdrLength {
+			return nil, errMalformed
+		}
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < attrHdrLength || l > len(b) {
+			return nil, errMalformed
+		}
+		typ := binary.NativeEndian.Uint16(b[2:4]) & conntrack.NLA_TYPE_MASK
+		attrs = append(attrs, attr{typ: typ, data: b[attrHdrLength:l]})
+		if align(l) >= len(b) {
+			break
+		}
+		b = b[align(l):]
+	}
+	return attrs, nil
+}
+
+// parseTuple parses the attributes of a tuple, as sent in requests.
+func parseTuple(b []byte) (proto int, t conntrack.Tuple, err error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return 0, t, err
+	}
+	for _, a := range attrs {
+		inner, err := parseAttrs(a.data)
+		if err != nil {
+			return 0, t, err
+		}
+		for _, i := range inner {
+			switch {
+			case a.typ == uint16(conntrack.CtaTupleIp):
+				switch conntrack.CtattrIp(i.typ) {
+				case conntrack.CtaIpV4Src, conntrack.CtaIpV6Src:
+					t.Src = net.IP(append([]byte(nil), i.data...))
+				case conntrack.CtaIpV4Dst, conntrack.CtaIpV6Dst:
+					t.Dst = net.IP(append([]byte(nil), i.data...))
+				}
+			case a.typ == uint16(conntrack.CtaTupleProto):
+				switch conntrack.CtattrL4proto(i.typ) {
+				case conntrack.CtaProtoNum:
+					var v uint8
+					v, err = i.uint8()
+					proto = int(v)
+				case conntrack.CtaProtoSrcPort:
+					t.SrcPort, err = i.uint16()
+				case conntrack.CtaProtoDstPort:
+					t.DstPort, err = i.uint16()
+				case conntrack.CtaProtoIcmpId, conntrack.CtaProtoIcmpv6Id:
+					t.IcmpId, err = i.uint16()
+				case conntrack.CtaProtoIcmpType, conntrack.CtaProtoIcmpv6Type:
+					t.IcmpType, err = i.uint8()
+				case conntrack.CtaProtoIcmpCode, conntrack.CtaProtoIcmpv6Code:
+					t.IcmpCode, err = i.uint8()
+				}
+				if err != nil {
+					return 0, t, err
+				}
+			}
+		}
+	}
+	return proto, t, nil
+}
+
+func tupleEqual(a, b conntrack.Tuple) bool {
+	return a.Src.Equal(b.Src) && a.Dst.Equal(b.Dst) && a.SrcPort == b.SrcPort && a.DstPort == b.DstPort &&
+		a.IcmpId == b.IcmpId && a.IcmpType == b.IcmpType && a.IcmpCode == b.IcmpCode
+}
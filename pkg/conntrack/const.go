@@ -1,15 +1,27 @@
 package conntrack
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
 const (
 	// #defined in libnfnetlink/include/libnfnetlink/linux_nfnetlink.h
-	NFNL_SUBSYS_CTNETLINK = 1
-	NFNETLINK_V0          = 0
+	NFNL_SUBSYS_CTNETLINK     = 1
+	NFNL_SUBSYS_CTNETLINK_EXP = 2
+	NFNETLINK_V0              = 0
 
 	// #defined in libnfnetlink/include/libnfnetlink/linux_nfnetlink_compat.h
 	NF_NETLINK_CONNTRACK_NEW     = 0x00000001
 	NF_NETLINK_CONNTRACK_UPDATE  = 0x00000002
 	NF_NETLINK_CONNTRACK_DESTROY = 0x00000004
 
+	NF_NETLINK_CONNTRACK_EXP_NEW     = 0x00000008
+	NF_NETLINK_CONNTRACK_EXP_UPDATE  = 0x00000010
+	NF_NETLINK_CONNTRACK_EXP_DESTROY = 0x00000020
+
 	// #defined in libnfnetlink/include/libnfnetlink/libnfnetlink.h
 	NLA_F_NESTED        = uint16(1 << 15)
 	NLA_F_NET_BYTEORDER = uint16(1 << 14)
@@ -44,6 +56,183 @@ const (
 	TCPState_IGNORE      TCPState = 11
 )
 
+var tcpStateNames = map[TCPState]string{
+	TCPState_NONE:        "NONE",
+	TCPState_SYN_SENT:    "SYN_SENT",
+	TCPState_SYN_RECV:    "SYN_RECV",
+	TCPState_ESTABLISHED: "ESTABLISHED",
+	TCPState_FIN_WAIT:    "FIN_WAIT",
+	TCPState_CLOSE_WAIT:  "CLOSE_WAIT",
+	TCPState_LAST_ACK:    "LAST_ACK",
+	TCPState_TIME_WAIT:   "TIME_WAIT",
+	TCPState_CLOSE:       "CLOSE",
+	TCPState_LISTEN:      "LISTEN",
+	TCPState_MAX:         "MAX",
+	TCPState_IGNORE:      "IGNORE",
+}
+
+func (s TCPState) String() string {
+	if name, ok := tcpStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(s))
+}
+
+type SCTPState uint8
+
+// taken from linux/netfilter/nf_conntrack_sctp.h
+const (
+	SCTPState_NONE              SCTPState = 0
+	SCTPState_CLOSED            SCTPState = 1
+	SCTPState_COOKIE_WAIT       SCTPState = 2
+	SCTPState_COOKIE_ECHOED     SCTPState = 3
+	SCTPState_ESTABLISHED       SCTPState = 4
+	SCTPState_SHUTDOWN_SENT     SCTPState = 5
+	SCTPState_SHUTDOWN_RECD     SCTPState = 6
+	SCTPState_SHUTDOWN_ACK_SENT SCTPState = 7
+	SCTPState_HEARTBEAT_SENT    SCTPState = 8
+	SCTPState_HEARTBEAT_ACKED   SCTPState = 9
+)
+
+var sctpStateNames = map[SCTPState]string{
+	SCTPState_NONE:              "NONE",
+	SCTPState_CLOSED:            "CLOSED",
+	SCTPState_COOKIE_WAIT:       "COOKIE_WAIT",
+	SCTPState_COOKIE_ECHOED:     "COOKIE_ECHOED",
+	SCTPState_ESTABLISHED:       "ESTABLISHED",
+	SCTPState_SHUTDOWN_SENT:     "SHUTDOWN_SENT",
+	SCTPState_SHUTDOWN_RECD:     "SHUTDOWN_RECD",
+	SCTPState_SHUTDOWN_ACK_SENT: "SHUTDOWN_ACK_SENT",
+	SCTPState_HEARTBEAT_SENT:    "HEARTBEAT_SENT",
+	SCTPState_HEARTBEAT_ACKED:   "HEARTBEAT_ACKED",
+}
+
+func (s SCTPState) String() string {
+	if name, ok := sctpStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(s))
+}
+
+// Connection status bits, taken from linux/netfilter/nf_conntrack_common.h.
+type ConntrackStatus uint32
+
+const (
+	// It's an expected connection: bit 0 set. This bit never changed.
+	IpsExpected ConntrackStatus = 1 << 0
+	// The reply direction has seen a packet.
+	IpsSeenReply ConntrackStatus = 1 << 1
+	// The connection is not going to be early-dropped; set once traffic has
+	// been seen in both directions long enough (TCP handshake done, UDP stream).
+	IpsAssured ConntrackStatus = 1 << 2
+	// The connection is in the hash table, i.e. its first packet was accepted.
+	IpsConfirmed ConntrackStatus = 1 << 3
+	// The connection needs source NAT in the original direction.
+	IpsSrcNat ConntrackStatus = 1 << 4
+	// The connection needs destination NAT in the original direction.
+	IpsDstNat ConntrackStatus = 1 << 5
+	// The connection needs TCP sequence adjustment.
+	IpsSeqAdjust ConntrackStatus = 1 << 6
+	// NAT initialization bits.
+	IpsSrcNatDone ConntrackStatus = 1 << 7
+	IpsDstNatDone ConntrackStatus = 1 << 8
+	// The connection is dying, i.e. being removed from the table.
+	IpsDying ConntrackStatus = 1 << 9
+	// The connection has a fixed timeout.
+	IpsFixedTimeout ConntrackStatus = 1 << 10
+	// The entry is a template, not a real connection.
+	IpsTemplate ConntrackStatus = 1 << 11
+	// The connection is not tracked. Obsolete since Linux 4.14.
+	IpsUntracked ConntrackStatus = 1 << 12
+	// The connection has a helper attached.
+	IpsHelper ConntrackStatus = 1 << 13
+	// The connection is offloaded to the flow table.
+	IpsOffload ConntrackStatus = 1 << 14
+	// The connection is offloaded to hardware.
+	IpsHwOffload ConntrackStatus = 1 << 15
+)
+
+var conntrackStatusNames = []struct {
+	flag ConntrackStatus
+	name string
+}{
+	{IpsExpected, "EXPECTED"},
+	{IpsSeenReply, "SEEN_REPLY"},
+	{IpsAssured, "ASSURED"},
+	{IpsConfirmed, "CONFIRMED"},
+	{IpsSrcNat, "SRC_NAT"},
+	{IpsDstNat, "DST_NAT"},
+	{IpsSeqAdjust, "SEQ_ADJUST"},
+	{IpsSrcNatDone, "SRC_NAT_DONE"},
+	{IpsDstNatDone, "DST_NAT_DONE"},
+	{IpsDying, "DYING"},
+	{IpsFixedTimeout, "FIXED_TIMEOUT"},
+	{IpsTemplate, "TEMPLATE"},
+	{IpsUntracked, "UNTRACKED"},
+	{IpsHelper, "HELPER"},
+	{IpsOffload, "OFFLOAD"},
+	{IpsHwOffload, "HW_OFFLOAD"},
+}
+
+// Has returns true if all bits of flags are set.
+func (s ConntrackStatus) Has(flags ConntrackStatus) bool {
+	return s&flags == flags
+}
+
+// String returns the names of the bits set, e.g. SEEN_REPLY|ASSURED|CONFIRMED.
+func (s ConntrackStatus) String() string {
+	var names []string
+	for _, n := range conntrackStatusNames {
+		if s.Has(n.flag) {
+			names = append(names, n.name)
+			s &^= n.flag
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(s)))
+	}
+	return strings.Join(names, "|")
+}
+
+// ProtocolName returns the lower case name of a layer 4 protocol number, as
+// used by /proc/net/nf_conntrack.
+func ProtocolName(proto int) string {
+	switch proto {
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	case syscall.IPPROTO_SCTP:
+		return "sctp"
+	case syscall.IPPROTO_ICMP:
+		return "icmp"
+	case syscall.IPPROTO_ICMPV6:
+		return "icmpv6"
+	}
+	return strconv.Itoa(proto)
+}
+
+// ProtocolNumber is the reverse of ProtocolName.
+func ProtocolNumber(name string) (int, error) {
+	switch name {
+	case "tcp":
+		return syscall.IPPROTO_TCP, nil
+	case "udp":
+		return syscall.IPPROTO_UDP, nil
+	case "sctp":
+		return syscall.IPPROTO_SCTP, nil
+	case "icmp":
+		return syscall.IPPROTO_ICMP, nil
+	case "icmpv6":
+		return syscall.IPPROTO_ICMPV6, nil
+	}
+	proto, err := strconv.Atoi(name)
+	if err != nil || proto < 0 || proto > 255 {
+		return 0, fmt.Errorf("unknown protocol %q", name)
+	}
+	return proto, nil
+}
+
 type CtattrType int
 
 const (
@@ -71,7 +260,37 @@ const (
 	CtaMarkMask       CtattrType = 21
 	CtaLabels         CtattrType = 22
 	CtaLabelsMask     CtattrType = 23
-	CtaMax            CtattrType = 24
+	CtaSynproxy       CtattrType = 24
+	CtaFilter         CtattrType = 25
+	CtaStatusMask     CtattrType = 26
+	CtaMax            CtattrType = 27
+)
+
+// Attributes nested in CtaFilter, Linux 5.8+.
+type CtattrFilter int
+
+const (
+	CtaFilterUnspec     CtattrFilter = 0
+	CtaFilterOrigFlags  CtattrFilter = 1
+	CtaFilterReplyFlags CtattrFilter = 2
+	CtaFilterMax        CtattrFilter = 3
+)
+
+// Flags of CtaFilterOrigFlags and CtaFilterReplyFlags, telling which attributes of the tuple
+// given along with CtaFilter entries must match.
+const (
+	CtaFilterFlagIpSrc      = 1 << 0
+	CtaFilterFlagIpDst      = 1 << 1
+	CtaFilterFlagTupleZone  = 1 << 2
+	CtaFilterFlagProtoNum   = 1 << 3
+	CtaFilterFlagSrcPort    = 1 << 4
+	CtaFilterFlagDstPort    = 1 << 5
+	CtaFilterFlagIcmpType   = 1 << 6
+	CtaFilterFlagIcmpCode   = 1 << 7
+	CtaFilterFlagIcmpId     = 1 << 8
+	CtaFilterFlagIcmpv6Type = 1 << 9
+	CtaFilterFlagIcmpv6Code = 1 << 10
+	CtaFilterFlagIcmpv6Id   = 1 << 11
 )
 
 type CtattrTuple int
@@ -132,6 +351,16 @@ const (
 	CtaProtoinfoTcpMax            CtattrProtoinfoTcp = 6
 )
 
+type CtattrProtoinfoSctp int
+
+const (
+	CtaProtoinfoSctpUnspec       CtattrProtoinfoSctp = 0
+	CtaProtoinfoSctpState        CtattrProtoinfoSctp = 1
+	CtaProtoinfoSctpVtagOriginal CtattrProtoinfoSctp = 2
+	CtaProtoinfoSctpVtagReply    CtattrProtoinfoSctp = 3
+	CtaProtoinfoSctpMax          CtattrProtoinfoSctp = 4
+)
+
 type CtattrCounters int
 
 const (
@@ -202,3 +431,73 @@ const (
 	IpctnlMsgCtGetUnconfirmed CntlMsgTypes = 7
 	IpctnlMsgMax              CntlMsgTypes = 8
 )
+
+// Attributes of the IpctnlMsgCtGetStatsCpu replies, one per CPU.
+type CtattrStatsCpu int
+
+const (
+	CtaStatsUnspec        CtattrStatsCpu = 0
+	CtaStatsSearched      CtattrStatsCpu = 1 // no longer used
+	CtaStatsFound         CtattrStatsCpu = 2
+	CtaStatsNew           CtattrStatsCpu = 3 // no longer used
+	CtaStatsInvalid       CtattrStatsCpu = 4
+	CtaStatsIgnore        CtattrStatsCpu = 5 // no longer used
+	CtaStatsDelete        CtattrStatsCpu = 6 // no longer used
+	CtaStatsDeleteList    CtattrStatsCpu = 7 // no longer used
+	CtaStatsInsert        CtattrStatsCpu = 8
+	CtaStatsInsertFailed  CtattrStatsCpu = 9
+	CtaStatsDrop          CtattrStatsCpu = 10
+	CtaStatsEarlyDrop     CtattrStatsCpu = 11
+	CtaStatsError         CtattrStatsCpu = 12
+	CtaStatsSearchRestart CtattrStatsCpu = 13
+	CtaStatsClashResolve  CtattrStatsCpu = 14
+	CtaStatsChainTooLong  CtattrStatsCpu = 15
+	CtaStatsMax           CtattrStatsCpu = 16
+)
+
+// Attributes of the IpctnlMsgCtGetStats reply.
+type CtattrStatsGlobal int
+
+const (
+	CtaStatsGlobalUnspec     CtattrStatsGlobal = 0
+	CtaStatsGlobalEntries    CtattrStatsGlobal = 1
+	CtaStatsGlobalMaxEntries CtattrStatsGlobal = 2 // Linux 5.2+
+	CtaStatsGlobalMax        CtattrStatsGlobal = 3
+)
+
+// Messages of the expectation subsystem, NFNL_SUBSYS_CTNETLINK_EXP.
+type CntlExpMsgTypes int
+
+const (
+	IpctnlMsgExpNew         CntlExpMsgTypes = 0
+	IpctnlMsgExpGet         CntlExpMsgTypes = 1
+	IpctnlMsgExpDelete      CntlExpMsgTypes = 2
+	IpctnlMsgExpGetStatsCpu CntlExpMsgTypes = 3
+	IpctnlMsgExpMax         CntlExpMsgTypes = 4
+)
+
+// Attributes of an expectation.
+type CtattrExpect int
+
+const (
+	CtaExpectUnspec   CtattrExpect = 0
+	CtaExpectMaster   CtattrExpect = 1
+	CtaExpectTuple    CtattrExpect = 2
+	CtaExpectMask     CtattrExpect = 3
+	CtaExpectTimeout  CtattrExpect = 4
+	CtaExpectId       CtattrExpect = 5
+	CtaExpectHelpName CtattrExpect = 6
+	CtaExpectZone     CtattrExpect = 7
+	CtaExpectFlags    CtattrExpect = 8
+	CtaExpectClass    CtattrExpect = 9
+	CtaExpectNat      CtattrExpect = 10
+	CtaExpectFn       CtattrExpect = 11
+	CtaExpectMax      CtattrExpect = 12
+)
+
+// Flags of an expectation.
+const (
+	NfCtExpectPermanent = 1 << 0
+	NfCtExpectInactive  = 1 << 1
+	NfCtExpectUserspace = 1 << 2
+)
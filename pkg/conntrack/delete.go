@@ -0,0 +1,78 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Delete removes a connection from the table, identified by its original tuple, zone and id.
+// Traffic of the connection has to go through the conntrack code again, e.g. a stale NAT mapping
+// gets replaced by one to a live endpoint. Deleting a connection that is already gone isn't an error.
+func (c *ConnTrack) Delete(info ConntrackInfo) error {
+	request := buildRequest(IpctnlMsgCtDelete, syscall.NLM_F_ACK, tupleFamily(info.Orig), deleteAttrs(info))
+	err := c.requests.request(request, NFNL_SUBSYS_CTNETLINK, func(syscall.NetlinkMessage) error { return nil })
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error deleting %s: %v", info, err)
+	}
+	return nil
+}
+
+// DeleteMatching dumps the whole table and deletes the connections for which match returns true.
+// It returns how many were deleted.
+func (c *ConnTrack) DeleteMatching(match FilterFunc) (int, error) {
+	conns, err := c.dump(dumpOther, nil, match)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, conn := range conns {
+		if err := c.Delete(conn); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// DeleteIP deletes the connections to or from ip, before or after NAT. It returns how many
+// were deleted.
+func (c *ConnTrack) DeleteIP(ip net.IP) (int, error) {
+	return c.DeleteMatching(IPFilter(ip))
+}
+
+// IPFilter returns a FilterFunc passing connections that have ip as an address of either
+// tuple, so before or after NAT.
+func IPFilter(ip net.IP) FilterFunc {
+	return func(c ConntrackInfo) bool {
+		return ip.Equal(c.Orig.Src) || ip.Equal(c.Orig.Dst) || ip.Equal(c.Reply.Src) || ip.Equal(c.Reply.Dst)
+	}
+}
+
+// deleteAttrs encodes the attributes identifying info in a delete request, see ctnetlink_del_conntrack.
+func deleteAttrs(info ConntrackInfo) []byte {
+	var e attrEncoder
+	e.nested(uint16(CtaTupleOrig), func(e *attrEncoder) {
+		e.tuple(info.Proto, info.Orig)
+	})
+	if info.Zone != 0 {
+		e.uint16(uint16(CtaZone), info.Zone)
+	}
+	if info.Id != 0 {
+		// Don't delete a newer connection that reuses the tuple.
+		e.uint32(uint16(CtaId), info.Id)
+	}
+	return e.bytes()
+}
+
+// tupleFamily returns the address family of a tuple.
+func tupleFamily(t Tuple) uint8 {
+	if t.Src.To4() == nil {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
@@ -0,0 +1,65 @@
+package conntrack
+
+import (
+	"syscall"
+)
+
+// DumpFilter selects the entries the kernel returns in a dump, so that unwanted ones are not
+// copied to user space at all. Zero fields don't filter.
+// Kernels that don't know a filter attribute ignore it and return everything, so a FilterFunc
+// should still check whatever matters.
+type DumpFilter struct {
+	// Family is the layer 3 protocol, syscall.AF_INET or syscall.AF_INET6.
+	// AF_UNSPEC returns both.
+	Family uint8
+
+	// Only entries whose mark, masked with MarkMask, equals Mark.
+	// Ignored when MarkMask is 0.
+	Mark     uint32
+	MarkMask uint32
+
+	// L4Proto only returns entries of that layer 4 protocol, e.g. syscall.IPPROTO_TCP.
+	// Needs Linux 5.8+. 0 returns all protocols. The kernel matches a single protocol, several
+	// have to be left to a FilterFunc.
+	L4Proto uint8
+
+	// Zone only returns entries of that conntrack zone. Needs Linux 6.5+, kernels before ignore it.
+	// 0 returns all zones, so the default zone can only be selected with ZoneFilter.
+	Zone uint16
+}
+
+// families returns the address families to dump. The kernel only filters on the layer 4
+// protocol within one family, so AF_UNSPEC is split in that case.
+func (f *DumpFilter) families() []uint8 {
+	if f == nil {
+		return []uint8{syscall.AF_UNSPEC}
+	}
+	if f.Family == syscall.AF_UNSPEC && f.L4Proto != 0 {
+		return []uint8{syscall.AF_INET, syscall.AF_INET6}
+	}
+	return []uint8{f.Family}
+}
+
+// attrs encodes the filter as the attributes of a dump request, see ctnetlink_alloc_filter.
+func (f *DumpFilter) attrs() []byte {
+	var e attrEncoder
+	if f.MarkMask != 0 {
+		e.uint32(uint16(CtaMark), f.Mark)
+		e.uint32(uint16(CtaMarkMask), f.MarkMask)
+	}
+	if f.L4Proto != 0 {
+		e.nested(uint16(CtaTupleOrig), func(e *attrEncoder) {
+			e.nested(uint16(CtaTupleProto), func(e *attrEncoder) {
+				e.uint8(uint16(CtaProtoNum), f.L4Proto)
+			})
+		})
+		e.nested(uint16(CtaFilter), func(e *attrEncoder) {
+			e.hostUint32(uint16(CtaFilterOrigFlags), CtaFilterFlagProtoNum)
+			e.hostUint32(uint16(CtaFilterReplyFlags), 0)
+		})
+	}
+	if f.Zone != 0 {
+		e.uint16(uint16(CtaZone), f.Zone)
+	}
+	return e.bytes()
+}
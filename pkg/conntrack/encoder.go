@@ -0,0 +1,141 @@
+package conntrack
+
+// Netlink message building, the reverse of parser.go.
+// Netlink headers, attribute headers included, are in host byte order, ctnetlink attribute
+// payloads in network byte order.
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+type nfgenmsg struct {
+	Family  uint8  /* AF_xxx */
+	Version uint8  /* nfnetlink version */
+	ResID   uint16 /* resource id, big endian */
+}
+
+const sizeofGenmsg = 4
+
+// nfnlRequest is a request to an nfnetlink subsystem.
+type nfnlRequest struct {
+	Header syscall.NlMsghdr
+	Body   nfgenmsg
+	// Attributes following the body, already encoded.
+	Attrs []byte
+}
+
+// toWireFormat encodes the request, setting the length of its header.
+func (r *nfnlRequest) toWireFormat() []byte {
+	r.Header.Len = uint32(syscall.NLMSG_HDRLEN + sizeofGenmsg + len(r.Attrs))
+	b := make([]byte, r.Header.Len)
+	binary.NativeEndian.PutUint32(b[0:4], r.Header.Len)
+	binary.NativeEndian.PutUint16(b[4:6], r.Header.Type)
+	binary.NativeEndian.PutUint16(b[6:8], r.Header.Flags)
+	binary.NativeEndian.PutUint32(b[8:12], r.Header.Seq)
+	binary.NativeEndian.PutUint32(b[12:16], r.Header.Pid)
+	b[16] = r.Body.Family
+	b[17] = r.Body.Version
+	binary.BigEndian.PutUint16(b[18:20], r.Body.ResID)
+	copy(b[syscall.NLMSG_HDRLEN+sizeofGenmsg:], r.Attrs)
+	return b
+}
+
+// attrEncoder appends netlink attributes to a buffer, each padded to the attribute alignment.
+// The zero value is an empty buffer.
+type attrEncoder struct {
+	b []byte
+}
+
+// bytes returns the attributes encoded so far.
+func (e *attrEncoder) bytes() []byte {
+	return e.b
+}
+
+// header appends the header of an attribute of type typ with a payload of length l.
+func (e *attrEncoder) header(typ uint16, l int) {
+	var hdr [attrHdrLength]byte
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(attrHdrLength+l))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	e.b = append(e.b, hdr[:]...)
+}
+
+func (e *attrEncoder) pad() {
+	for len(e.b)%syscall.RTA_ALIGNTO != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+// data appends an attribute holding data as is.
+func (e *attrEncoder) data(typ uint16, data []byte) {
+	e.header(typ, len(data))
+	e.b = append(e.b, data...)
+	e.pad()
+}
+
+func (e *attrEncoder) uint8(typ uint16, v uint8) {
+	e.data(typ, []byte{v})
+}
+
+func (e *attrEncoder) uint16(typ uint16, v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.data(typ, b[:])
+}
+
+func (e *attrEncoder) uint32(typ uint16, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.data(typ, b[:])
+}
+
+func (e *attrEncoder) uint64(typ uint16, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.data(typ, b[:])
+}
+
+// hostUint32 is for the few attributes in host byte order, like the CTA_FILTER flags.
+func (e *attrEncoder) hostUint32(typ uint16, v uint32) {
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], v)
+	e.data(typ, b[:])
+}
+
+// nested appends an attribute of type typ whose payload are the attributes f appends.
+func (e *attrEncoder) nested(typ uint16, f func(e *attrEncoder)) {
+	start := len(e.b)
+	e.header(typ|NLA_F_NESTED, 0)
+	f(e)
+	// The nested attributes are already padded, so is the whole.
+	binary.NativeEndian.PutUint16(e.b[start:start+2], uint16(len(e.b)-start))
+}
+
+// tuple appends the attributes of a tuple of a connection of protocol proto.
+func (e *attrEncoder) tuple(proto int, t Tuple) {
+	e.nested(uint16(CtaTupleIp), func(e *attrEncoder) {
+		if src4, dst4 := t.Src.To4(), t.Dst.To4(); src4 != nil && dst4 != nil {
+			e.data(uint16(CtaIpV4Src), src4)
+			e.data(uint16(CtaIpV4Dst), dst4)
+		} else {
+			e.data(uint16(CtaIpV6Src), t.Src.To16())
+			e.data(uint16(CtaIpV6Dst), t.Dst.To16())
+		}
+	})
+	e.nested(uint16(CtaTupleProto), func(e *attrEncoder) {
+		e.uint8(uint16(CtaProtoNum), uint8(proto))
+		switch proto {
+		case syscall.IPPROTO_ICMP:
+			e.uint16(uint16(CtaProtoIcmpId), t.IcmpId)
+			e.uint8(uint16(CtaProtoIcmpType), t.IcmpType)
+			e.uint8(uint16(CtaProtoIcmpCode), t.IcmpCode)
+		case syscall.IPPROTO_ICMPV6:
+			e.uint16(uint16(CtaProtoIcmpv6Id), t.IcmpId)
+			e.uint8(uint16(CtaProtoIcmpv6Type), t.IcmpType)
+			e.uint8(uint16(CtaProtoIcmpv6Code), t.IcmpCode)
+		default:
+			e.uint16(uint16(CtaProtoSrcPort), t.SrcPort)
+			e.uint16(uint16(CtaProtoDstPort), t.DstPort)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func tuplesEqual(a, b Tuple) bool {
+	return a.Src.Equal(b.Src) && a.Dst.Equal(b.Dst) && a.SrcPort == b.SrcPort && a.DstPort == b.DstPort &&
+		a.IcmpId == b.IcmpId && a.IcmpType == b.IcmpType && a.IcmpCode == b.IcmpCode
+}
+
+func TestEncodeAttrs(t *testing.T) {
+	var e attrEncoder
+	e.uint8(1, 0x11)
+	e.nested(2, func(e *attrEncoder) {
+		e.uint16(3, 0x2233)
+		e.hostUint32(4, 0x44556677)
+	})
+	e.uint64(5, 0x8899aabbccddeeff)
+
+	expected := []byte{5, 0, 1, 0, 0x11, 0, 0, 0}
+	nested := []byte{20, 0, 2, 0x80}
+	nested = append(nested, 6, 0, 3, 0, 0x22, 0x33, 0, 0)
+	nested = append(nested, 8, 0, 4, 0)
+	nested = binary.NativeEndian.AppendUint32(nested, 0x44556677)
+	expected = append(expected, nested...)
+	expected = append(expected, 12, 0, 5, 0, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff)
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		// Attribute headers are in host byte order.
+		for _, i := range []int{0, 2, 8, 10, 12, 14, 20, 22, 28, 30} {
+			expected[i], expected[i+1] = expected[i+1], expected[i]
+		}
+	}
+	if !bytes.Equal(e.bytes(), expected) {
+		t.Errorf("expected % x, got % x", expected, e.bytes())
+	}
+}
+
+func TestEncodeTuple(t *testing.T) {
+	tests := []struct {
+		Proto int
+		Tuple Tuple
+	}{
+		{
+			Proto: syscall.IPPROTO_TCP,
+			Tuple: Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: 38318, Dst: net.ParseIP("10.96.0.10"), DstPort: 6379},
+		},
+		{
+			Proto: syscall.IPPROTO_UDP,
+			Tuple: Tuple{Src: net.ParseIP("fd00::3"), SrcPort: 53, Dst: net.ParseIP("fd00::5"), DstPort: 41000},
+		},
+		{
+			Proto: syscall.IPPROTO_ICMP,
+			Tuple: Tuple{Src: net.ParseIP("10.0.0.5"), Dst: net.ParseIP("10.0.0.6"), IcmpId: 1234, IcmpType: 8},
+		},
+		{
+			Proto: syscall.IPPROTO_ICMPV6,
+			Tuple: Tuple{Src: net.ParseIP("fd00::3"), Dst: net.ParseIP("fd00::5"), IcmpId: 77, IcmpType: 128},
+		},
+	}
+	for _, test := range tests {
+		var e attrEncoder
+		e.nested(uint16(CtaTupleReply), func(e *attrEncoder) {
+			e.tuple(test.Proto, test.Tuple)
+		})
+		conn := &ConntrackInfo{}
+		err := parsePayload(e.bytes(), conn)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.Tuple, err)
+			continue
+		}
+		if conn.Proto != test.Proto {
+			t.Errorf("%+v: expected protocol %d, got %d", test.Tuple, test.Proto, conn.Proto)
+		}
+		if !tuplesEqual(conn.Reply, test.Tuple) {
+			t.Errorf("expected %+v, got %+v", test.Tuple, conn.Reply)
+		}
+	}
+}
+
+func TestEncodeRequest(t *testing.T) {
+	info := ConntrackInfo{
+		Proto: syscall.IPPROTO_TCP,
+		Orig:  Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: 38318, Dst: net.ParseIP("10.96.0.10"), DstPort: 6379},
+		Zone:  2,
+		Id:    0xdeadbeef,
+	}
+	b := buildRequest(IpctnlMsgCtDelete, syscall.NLM_F_ACK, syscall.AF_INET, deleteAttrs(info))
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Error parsing request: %d messages, %v", len(msgs), err)
+	}
+	msg := msgs[0]
+	if int(msg.Header.Len) != len(b) {
+		t.Errorf("expected length %d, got %d", len(b), msg.Header.Len)
+	}
+	if msg.Header.Type != NFNL_SUBSYS_CTNETLINK<<8|uint16(IpctnlMsgCtDelete) {
+		t.Errorf("unexpected type %#x", msg.Header.Type)
+	}
+	if msg.Header.Flags != syscall.NLM_F_REQUEST|syscall.NLM_F_ACK {
+		t.Errorf("unexpected flags %#x", msg.Header.Flags)
+	}
+	if msg.Data[0] != syscall.AF_INET || msg.Data[1] != NFNETLINK_V0 {
+		t.Errorf("unexpected nfgenmsg % x", msg.Data[:sizeofGenmsg])
+	}
+
+	conn, err := parseMessage(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn.MsgType != NfctMsgDestroy {
+		t.Errorf("expected a destroy message, got %d", conn.MsgType)
+	}
+	if conn.Proto != info.Proto || !tuplesEqual(conn.Orig, info.Orig) || conn.Zone != info.Zone || conn.Id != info.Id {
+		t.Errorf("expected %s zone %d id %d, got %s zone %d id %d", info, info.Zone, info.Id, conn, conn.Zone, conn.Id)
+	}
+}
+
+func TestEncodeDumpFilter(t *testing.T) {
+	f := DumpFilter{Mark: 0x4000, MarkMask: 0xc000, L4Proto: syscall.IPPROTO_UDP, Zone: 3}
+	attrs, err := parseAttrs(f.attrs())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := make(map[CtattrType]Attr)
+	for _, attr := range attrs {
+		got[CtattrType(attr.Typ)] = attr
+	}
+
+	if mark, _ := got[CtaMark].uint32(); mark != f.Mark {
+		t.Errorf("expected mark %#x, got %#x", f.Mark, mark)
+	}
+	if mask, _ := got[CtaMarkMask].uint32(); mask != f.MarkMask {
+		t.Errorf("expected mark mask %#x, got %#x", f.MarkMask, mask)
+	}
+	if zone, _ := got[CtaZone].uint16(); zone != f.Zone {
+		t.Errorf("expected zone %d, got %d", f.Zone, zone)
+	}
+	var proto int
+	if err := parseTuple(got[CtaTupleOrig].Msg, &proto, &Tuple{}); err != nil || proto != syscall.IPPROTO_UDP {
+		t.Errorf("expected protocol %d, got %d, %v", syscall.IPPROTO_UDP, proto, err)
+	}
+	if !got[CtaFilter].IsNested {
+		t.Errorf("expected a nested filter attr")
+	}
+	filter, err := parseAttrs(got[CtaFilter].Msg)
+	if err != nil || len(filter) != 2 {
+		t.Fatalf("unexpected filter attrs %v, %v", filter, err)
+	}
+	if flags := binary.NativeEndian.Uint32(filter[0].Msg); CtattrFilter(filter[0].Typ) != CtaFilterOrigFlags || flags != CtaFilterFlagProtoNum {
+		t.Errorf("unexpected orig flags attr %d: %#x", filter[0].Typ, flags)
+	}
+}
+
+func TestDumpFilterFamilies(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Filter   *DumpFilter
+		Expected []uint8
+	}{
+		{"no filter", nil, []uint8{syscall.AF_UNSPEC}},
+		{"mark", &DumpFilter{Mark: 1, MarkMask: 1}, []uint8{syscall.AF_UNSPEC}},
+		{"family", &DumpFilter{Family: syscall.AF_INET6}, []uint8{syscall.AF_INET6}},
+		{"protocol", &DumpFilter{L4Proto: syscall.IPPROTO_TCP}, []uint8{syscall.AF_INET, syscall.AF_INET6}},
+		{"protocol of a family", &DumpFilter{Family: syscall.AF_INET, L4Proto: syscall.IPPROTO_TCP}, []uint8{syscall.AF_INET}},
+	}
+	for _, test := range tests {
+		if got := test.Filter.families(); !bytes.Equal(got, test.Expected) {
+			t.Errorf("%s: expected %v, got %v", test.Name, test.Expected, got)
+		}
+	}
+}
+
+func TestBuildConntrackListRequest(t *testing.T) {
+	filter := &DumpFilter{L4Proto: syscall.IPPROTO_TCP}
+	tests := []struct {
+		Name          string
+		MsgType       CntlMsgTypes
+		Family        uint8
+		Filter        *DumpFilter
+		ExpectedAttrs []byte
+	}{
+		{"whole table", IpctnlMsgCtGet, syscall.AF_UNSPEC, nil, nil},
+		{"filtered", IpctnlMsgCtGet, syscall.AF_INET6, filter, filter.attrs()},
+		{"zeroing", IpctnlMsgCtGetCtrzero, syscall.AF_INET, nil, nil},
+	}
+	for _, test := range tests {
+		msgs, err := syscall.ParseNetlinkMessage(buildConntrackListRequest(test.MsgType, test.Family, test.Filter))
+		if err != nil || len(msgs) != 1 {
+			t.Errorf("%s: unexpected %d messages, %v", test.Name, len(msgs), err)
+			continue
+		}
+		msg := msgs[0]
+		if expected := uint16(NFNL_SUBSYS_CTNETLINK)<<8 | uint16(test.MsgType); msg.Header.Type != expected {
+			t.Errorf("%s: expected type %#x, got %#x", test.Name, expected, msg.Header.Type)
+		}
+		if expected := uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP); msg.Header.Flags != expected {
+			t.Errorf("%s: expected flags %#x, got %#x", test.Name, expected, msg.Header.Flags)
+		}
+		if len(msg.Data) < 4 || msg.Data[0] != test.Family {
+			t.Errorf("%s: expected family %d, got %v", test.Name, test.Family, msg.Data)
+			continue
+		}
+		if attrs := msg.Data[4:]; !bytes.Equal(attrs, test.ExpectedAttrs) {
+			t.Errorf("%s: expected attrs %v, got %v", test.Name, test.ExpectedAttrs, attrs)
+		}
+	}
+}
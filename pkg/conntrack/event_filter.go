@@ -0,0 +1,249 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// EventFilter selects the events the kernel delivers to Follow. It is compiled to a classic BPF
+// program attached to the event socket, so the events it drops are neither copied to user space nor
+// take room in the socket buffer. Zero fields don't filter.
+// Like DumpFilter, it should let through at least everything FilterFunc passes.
+type EventFilter struct {
+	// Events only passes events of these types, e.g. NfctMsgUpdate|NfctMsgDestroy.
+	Events NfConntrackEventType
+
+	// L4Protos only passes events of these layer 4 protocols, e.g. syscall.IPPROTO_TCP.
+	L4Protos []uint8
+
+	// Status only passes events of connections that have all these status bits set, e.g.
+	// IpsSeenReply.
+	Status ConntrackStatus
+
+	// TCPStates only passes TCP events whose connection is in one of these states. The kernel only
+	// includes the state in events changing it, so other TCP events are dropped. Events of other
+	// protocols pass.
+	TCPStates []TCPState
+
+	// CIDRs only passes events of connections with an address of either tuple, so before or after
+	// NAT, in one of these networks.
+	CIDRs []*net.IPNet
+}
+
+// CIDRFilter returns a FilterFunc passing connections with an address of either tuple in one of
+// the networks, like EventFilter.CIDRs.
+func CIDRFilter(cidrs ...*net.IPNet) FilterFunc {
+	return func(c ConntrackInfo) bool {
+		for _, cidr := range cidrs {
+			if cidr.Contains(c.Orig.Src) || cidr.Contains(c.Orig.Dst) || cidr.Contains(c.Reply.Src) || cidr.Contains(c.Reply.Dst) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Keep the whole message.
+const bpfAccept = 0xffffffff
+
+// Where the attributes of a conntrack event start, after the netlink header and the nfgenmsg.
+const attrsOffset = syscall.NLMSG_HDRLEN + sizeofGenmsg
+
+// attachEventFilter makes the kernel drop the events f doesn't select before they reach s, passing
+// every destroy event if acceptDestroy.
+func attachEventFilter(s Socket, f *EventFilter, acceptDestroy bool) error {
+	prog, err := f.compile(acceptDestroy)
+	if err != nil {
+		return fmt.Errorf("Error compiling event filter: %v", err)
+	}
+	if err := s.AttachFilter(prog); err != nil {
+		return fmt.Errorf("Error attaching event filter: %v", err)
+	}
+	return nil
+}
+
+// compile returns the BPF program passing the events f selects, and every destroy event if
+// acceptDestroy.
+func (f *EventFilter) compile(acceptDestroy bool) ([]syscall.SockFilter, error) {
+	p := newBPFProgram()
+	// The netlink header is in host byte order, BPF loads are big endian: look at single bytes.
+	typeOffset, subsysOffset, flagsHighOffset := uint32(4), uint32(5), uint32(7)
+	if !isLittleEndian() {
+		typeOffset, subsysOffset, flagsHighOffset = 5, 4, 6
+	}
+
+	// Only conntrack events are filtered.
+	conntrack := p.newLabel()
+	p.stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, subsysOffset)
+	p.jump(syscall.BPF_JEQ, NFNL_SUBSYS_CTNETLINK, conntrack, "")
+	p.ret(bpfAccept)
+	p.label(conntrack)
+
+	// Tell the event type like parseMessage does.
+	checks, isNew, isDestroy := p.newLabel(), p.newLabel(), p.newLabel()
+	p.stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, typeOffset)
+	p.jump(syscall.BPF_JEQ, uint32(IpctnlMsgCtDelete), isDestroy, "")
+	p.stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, flagsHighOffset)
+	p.jump(syscall.BPF_JSET, (syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)>>8, isNew, "")
+	f.events(p, NfctMsgUpdate, checks)
+	p.label(isNew)
+	f.events(p, NfctMsgNew, checks)
+	p.label(isDestroy)
+	if acceptDestroy {
+		p.ret(bpfAccept)
+	} else {
+		f.events(p, NfctMsgDestroy, checks)
+	}
+	p.label(checks)
+
+	if len(f.L4Protos) > 0 {
+		p.check(func(fail string) {
+			pass := p.newLabel()
+			p.loadProto(fail)
+			for _, proto := range f.L4Protos {
+				p.jump(syscall.BPF_JEQ, uint32(proto), pass, "")
+			}
+			p.ja(fail)
+			p.label(pass)
+		})
+	}
+	if f.Status != 0 {
+		p.check(func(fail string) {
+			p.find(fail, uint32(CtaStatus))
+			p.stmt(syscall.BPF_MISC|syscall.BPF_TAX, 0)
+			p.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_IND, attrHdrLength)
+			p.stmt(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, uint32(f.Status))
+			p.jump(syscall.BPF_JEQ, uint32(f.Status), "", fail)
+		})
+	}
+	if len(f.TCPStates) > 0 {
+		p.check(func(fail string) {
+			pass := p.newLabel()
+			p.loadProto(fail)
+			p.jump(syscall.BPF_JEQ, syscall.IPPROTO_TCP, "", pass)
+			p.find(fail, uint32(CtaProtoinfo), uint32(CtaProtoinfoTcp), uint32(CtaProtoinfoTcpState))
+			p.stmt(syscall.BPF_MISC|syscall.BPF_TAX, 0)
+			p.stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_IND, attrHdrLength)
+			for _, state := range f.TCPStates {
+				p.jump(syscall.BPF_JEQ, uint32(state), pass, "")
+			}
+			p.ja(fail)
+			p.label(pass)
+		})
+	}
+	if len(f.CIDRs) > 0 {
+		if err := f.compileCIDRs(p); err != nil {
+			return nil, err
+		}
+	}
+	p.ret(bpfAccept)
+	return p.assemble()
+}
+
+// events passes events of type typ on to the checks, and drops them if f doesn't want them.
+func (f *EventFilter) events(p *bpfProgram, typ NfConntrackEventType, checks string) {
+	if f.Events == 0 || f.Events&typ != 0 {
+		p.ja(checks)
+	} else {
+		p.ret(0)
+	}
+}
+
+// compileCIDRs passes events with an address in f.CIDRs. The offsets of the addresses are found
+// once, and kept in the scratch memory.
+func (f *EventFilter) compileCIDRs(p *bpfProgram) error {
+	type address struct {
+		tuple, ip CtattrType
+	}
+	var v4, v6 []uint32
+	var addresses []address
+	for _, tuple := range []CtattrType{CtaTupleOrig, CtaTupleReply} {
+		for _, ip := range []CtattrIp{CtaIpV4Src, CtaIpV4Dst, CtaIpV6Src, CtaIpV6Dst} {
+			slot := uint32(len(addresses))
+			addresses = append(addresses, address{tuple, CtattrType(ip)})
+			if ip == CtaIpV4Src || ip == CtaIpV4Dst {
+				v4 = append(v4, slot)
+			} else {
+				v6 = append(v6, slot)
+			}
+		}
+	}
+
+	p.check(func(fail string) {
+		match := p.newLabel()
+		for slot, a := range addresses {
+			// A is 0 when the address is missing.
+			store := p.newLabel()
+			p.find(store, uint32(a.tuple), uint32(CtaTupleIp), uint32(a.ip))
+			p.label(store)
+			p.stmt(syscall.BPF_ST, uint32(slot))
+		}
+		for _, cidr := range f.CIDRs {
+			ip, slots := cidr.IP.To4(), v4
+			ones, bits := cidr.Mask.Size()
+			if ip == nil || bits != 8*net.IPv4len {
+				ip, slots = cidr.IP.To16(), v6
+			}
+			mask := net.CIDRMask(ones, 8*len(ip))
+			for _, slot := range slots {
+				next := p.newLabel()
+				p.stmt(syscall.BPF_LD|syscall.BPF_MEM, slot)
+				p.jump(syscall.BPF_JEQ, 0, next, "")
+				p.stmt(syscall.BPF_MISC|syscall.BPF_TAX, 0)
+				for i := 0; i < len(ip); i += 4 {
+					m := binary.BigEndian.Uint32(mask[i:])
+					if m == 0 {
+						continue
+					}
+					p.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_IND, uint32(attrHdrLength+i))
+					p.stmt(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, m)
+					p.jump(syscall.BPF_JEQ, binary.BigEndian.Uint32(ip[i:])&m, "", next)
+				}
+				// match may be too far for a conditional jump.
+				p.ja(match)
+				p.label(next)
+			}
+		}
+		p.ja(fail)
+		p.label(match)
+	})
+	if len(p.insns) > syscall.BPF_MAXINSNS {
+		return fmt.Errorf("too many CIDRs to filter events on: %d", len(f.CIDRs))
+	}
+	return nil
+}
+
+// check drops the message unless the check of body holds. body jumps to fail when it doesn't, and
+// falls through when it does.
+func (p *bpfProgram) check(body func(fail string)) {
+	fail, next := p.newLabel(), p.newLabel()
+	body(fail)
+	p.ja(next)
+	p.label(fail)
+	p.ret(0)
+	p.label(next)
+}
+
+// find sets A to the offset of the attribute at path, each attribute nested in the previous one.
+// It jumps to missing, with A 0, if there is none.
+func (p *bpfProgram) find(missing string, path ...uint32) {
+	p.stmt(syscall.BPF_LD|syscall.BPF_IMM, attrsOffset)
+	for i, typ := range path {
+		ext := int32(skfAdOff + skfAdNlattr)
+		if i > 0 {
+			ext = skfAdOff + skfAdNlattrNest
+		}
+		p.stmt(syscall.BPF_LDX|syscall.BPF_IMM, typ)
+		p.stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, uint32(ext))
+		p.jump(syscall.BPF_JEQ, 0, missing, "")
+	}
+}
+
+// loadProto sets A to the layer 4 protocol, and jumps to missing if there is none.
+func (p *bpfProgram) loadProto(missing string) {
+	p.find(missing, uint32(CtaTupleOrig), uint32(CtaTupleProto), uint32(CtaProtoNum))
+	p.stmt(syscall.BPF_MISC|syscall.BPF_TAX, 0)
+	p.stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_IND, attrHdrLength)
+}
@@ -0,0 +1,281 @@
+package conntrack
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testEvent describes a conntrack event to build.
+type testEvent struct {
+	Type     CntlMsgTypes
+	Flags    uint16
+	Proto    int
+	Orig     Tuple
+	Reply    Tuple
+	Status   ConntrackStatus
+	TCPState TCPState // not included if 0
+	// Not included if 0 either.
+	OrigCounters, ReplyCounters Counters
+	Start                       uint64
+}
+
+func (e testEvent) bytes() []byte {
+	family := uint8(syscall.AF_INET)
+	if e.Orig.Src.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	var a attrEncoder
+	a.nested(uint16(CtaTupleOrig), func(a *attrEncoder) { a.tuple(e.Proto, e.Orig) })
+	a.nested(uint16(CtaTupleReply), func(a *attrEncoder) { a.tuple(e.Proto, e.Reply) })
+	a.uint32(uint16(CtaStatus), uint32(e.Status))
+	counters := func(typ CtattrType, c Counters) {
+		if c != (Counters{}) {
+			a.nested(uint16(typ), func(a *attrEncoder) {
+				a.uint64(uint16(CtaCountersPackets), c.Packets)
+				a.uint64(uint16(CtaCountersBytes), c.Bytes)
+			})
+		}
+	}
+	counters(CtaCountersOrig, e.OrigCounters)
+	counters(CtaCountersReply, e.ReplyCounters)
+	if e.Start != 0 {
+		a.nested(uint16(CtaTimestamp), func(a *attrEncoder) { a.uint64(uint16(CtaTimestampStart), e.Start) })
+	}
+	if e.TCPState != 0 {
+		a.nested(uint16(CtaProtoinfo), func(a *attrEncoder) {
+			a.nested(uint16(CtaProtoinfoTcp), func(a *attrEncoder) {
+				a.uint8(uint16(CtaProtoinfoTcpState), uint8(e.TCPState))
+			})
+		})
+	}
+	return buildRequest(e.Type, e.Flags, family, a.bytes())
+}
+
+// filterSocket returns a socket pair whose receiving end, the second, runs prog.
+func filterSocket(t *testing.T, prog []syscall.SockFilter) [2]int {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("Error creating socket pair: %v", err)
+	}
+	if err := syscall.AttachLsf(fds[1], prog); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		t.Fatalf("Error attaching filter: %v", err)
+	}
+	return fds
+}
+
+// passes tells if msg gets through the filter of the socket pair fds.
+func passes(t *testing.T, fds [2]int, msg []byte) bool {
+	if _, err := syscall.Write(fds[0], msg); err != nil {
+		t.Fatalf("Error writing message: %v", err)
+	}
+	b := make([]byte, len(msg)+1)
+	n, _, err := syscall.Recvfrom(fds[1], b, syscall.MSG_DONTWAIT)
+	if err == syscall.EAGAIN {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("Error reading message: %v", err)
+	}
+	if n != len(msg) {
+		t.Errorf("expected the whole message of %d bytes, got %d", len(msg), n)
+	}
+	return true
+}
+
+func TestEventFilter(t *testing.T) {
+	tcp := testEvent{
+		Type:     IpctnlMsgCtNew,
+		Proto:    syscall.IPPROTO_TCP,
+		Orig:     Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: 38318, Dst: net.ParseIP("10.96.0.10"), DstPort: 6379},
+		Reply:    Tuple{Src: net.ParseIP("10.1.2.3"), SrcPort: 6379, Dst: net.ParseIP("10.0.0.5"), DstPort: 38318},
+		Status:   IpsSeenReply | IpsAssured | IpsConfirmed,
+		TCPState: TCPState_ESTABLISHED,
+	}
+	newTCP := tcp
+	newTCP.Flags = syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	newTCP.Status = IpsConfirmed
+	newTCP.TCPState = TCPState_SYN_SENT
+	destroyTCP := tcp
+	destroyTCP.Type = IpctnlMsgCtDelete
+	destroyTCP.TCPState = 0
+	synRecv := tcp
+	synRecv.TCPState = TCPState_SYN_RECV
+	noState := tcp
+	noState.TCPState = 0
+	udp := testEvent{
+		Type:   IpctnlMsgCtNew,
+		Proto:  syscall.IPPROTO_UDP,
+		Orig:   Tuple{Src: net.ParseIP("fd00::3"), SrcPort: 53, Dst: net.ParseIP("fd00:1::5"), DstPort: 41000},
+		Reply:  Tuple{Src: net.ParseIP("fd00:1::5"), SrcPort: 41000, Dst: net.ParseIP("fd00::3"), DstPort: 53},
+		Status: IpsSeenReply | IpsConfirmed,
+	}
+	unreplied := udp
+	unreplied.Status = IpsConfirmed
+
+	msgs := map[string][]byte{
+		"tcp":        tcp.bytes(),
+		"newTCP":     newTCP.bytes(),
+		"destroyTCP": destroyTCP.bytes(),
+		"synRecv":    synRecv.bytes(),
+		"noState":    noState.bytes(),
+		"udp":        udp.bytes(),
+		"unreplied":  unreplied.bytes(),
+	}
+	// Captured events, and an expectation, which isn't filtered.
+	for _, name := range []string{"new_event", "destroy_event", "expectation"} {
+		msgs[name] = messageBytes(readMessage(t, filepath.Join("testdata", name+".nl")))
+	}
+
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		Name          string
+		Filter        EventFilter
+		AcceptDestroy bool
+		Pass          []string
+	}{
+		{
+			Name: "empty",
+			Pass: []string{"tcp", "newTCP", "destroyTCP", "synRecv", "noState", "udp", "unreplied", "new_event", "destroy_event", "expectation"},
+		},
+		{
+			Name:   "updates",
+			Filter: EventFilter{Events: NfctMsgUpdate},
+			Pass:   []string{"tcp", "synRecv", "noState", "udp", "unreplied", "expectation"},
+		},
+		{
+			Name:   "new and destroy",
+			Filter: EventFilter{Events: NfctMsgNew | NfctMsgDestroy},
+			Pass:   []string{"newTCP", "destroyTCP", "new_event", "destroy_event", "expectation"},
+		},
+		{
+			Name:          "accept destroy",
+			Filter:        EventFilter{Events: NfctMsgUpdate, L4Protos: []uint8{syscall.IPPROTO_UDP}},
+			AcceptDestroy: true,
+			Pass:          []string{"destroyTCP", "destroy_event", "udp", "unreplied", "expectation"},
+		},
+		{
+			Name:   "protocols",
+			Filter: EventFilter{L4Protos: []uint8{syscall.IPPROTO_UDP, syscall.IPPROTO_ICMP}},
+			Pass:   []string{"udp", "unreplied", "destroy_event", "expectation"},
+		},
+		{
+			Name:   "status",
+			Filter: EventFilter{Status: IpsSeenReply | IpsConfirmed},
+			Pass:   []string{"tcp", "destroyTCP", "synRecv", "noState", "udp", "destroy_event", "expectation"},
+		},
+		{
+			Name:   "TCP states",
+			Filter: EventFilter{TCPStates: []TCPState{TCPState_ESTABLISHED, TCPState_SYN_SENT}},
+			Pass:   []string{"tcp", "newTCP", "udp", "unreplied", "new_event", "destroy_event", "expectation"},
+		},
+		{
+			Name:   "IPv4 CIDR of the original destination",
+			Filter: EventFilter{CIDRs: []*net.IPNet{mustParseCIDR("10.96.0.0/12")}},
+			Pass:   []string{"tcp", "newTCP", "destroyTCP", "synRecv", "noState", "expectation"},
+		},
+		{
+			Name:   "IPv4 CIDR of the reply source",
+			Filter: EventFilter{CIDRs: []*net.IPNet{mustParseCIDR("10.1.2.3/32")}},
+			Pass:   []string{"tcp", "newTCP", "destroyTCP", "synRecv", "noState", "expectation"},
+		},
+		{
+			Name:   "IPv6 CIDRs",
+			Filter: EventFilter{CIDRs: []*net.IPNet{mustParseCIDR("192.168.0.0/16"), mustParseCIDR("fd00:1::/64")}},
+			Pass:   []string{"udp", "unreplied", "expectation"},
+		},
+		{
+			Name:   "every IPv4 address",
+			Filter: EventFilter{CIDRs: []*net.IPNet{mustParseCIDR("0.0.0.0/0")}},
+			Pass:   []string{"tcp", "newTCP", "destroyTCP", "synRecv", "noState", "new_event", "expectation"},
+		},
+		{
+			Name: "all",
+			Filter: EventFilter{
+				Events:    NfctMsgUpdate,
+				L4Protos:  []uint8{syscall.IPPROTO_TCP, syscall.IPPROTO_UDP},
+				TCPStates: []TCPState{TCPState_ESTABLISHED},
+				Status:    IpsSeenReply,
+				CIDRs:     []*net.IPNet{mustParseCIDR("10.96.0.0/12"), mustParseCIDR("fd00::/16")},
+			},
+			Pass: []string{"tcp", "udp", "expectation"},
+		},
+	}
+	for _, test := range tests {
+		prog, err := test.Filter.compile(test.AcceptDestroy)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.Name, err)
+			continue
+		}
+		fds := filterSocket(t, prog)
+		pass := make(map[string]bool)
+		for _, name := range test.Pass {
+			pass[name] = true
+		}
+		for name, msg := range msgs {
+			if got := passes(t, fds, msg); got != pass[name] {
+				t.Errorf("%s: expected %s to pass %v, got %v", test.Name, name, pass[name], got)
+			}
+		}
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+	}
+}
+
+func TestEventFilterTooManyCIDRs(t *testing.T) {
+	var f EventFilter
+	for i := 0; i < 256; i++ {
+		f.CIDRs = append(f.CIDRs, &net.IPNet{IP: net.IPv4(10, byte(i), 0, 0), Mask: net.CIDRMask(16, 32)})
+	}
+	if _, err := f.compile(false); err == nil || !strings.Contains(err.Error(), "too many CIDRs") {
+		t.Errorf("expected too many CIDRs, got %v", err)
+	}
+}
+
+func TestBPFAssemble(t *testing.T) {
+	p := newBPFProgram()
+	done := p.newLabel()
+	p.jump(syscall.BPF_JEQ, 1, done, "")
+	p.ja(done)
+	p.ret(1)
+	p.label(done)
+	p.ret(2)
+	insns, err := p.assemble()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if insns[0].Jt != 2 || insns[0].Jf != 0 || insns[1].K != 1 {
+		t.Errorf("unexpected jumps %+v", insns)
+	}
+
+	p = newBPFProgram()
+	far := p.newLabel()
+	p.jump(syscall.BPF_JEQ, 1, far, "")
+	for i := 0; i < 256; i++ {
+		p.ret(0)
+	}
+	p.label(far)
+	p.ret(1)
+	if _, err := p.assemble(); err == nil {
+		t.Errorf("expected an error for a jump over 256 instructions")
+	}
+
+	p = newBPFProgram()
+	back := p.newLabel()
+	p.label(back)
+	p.ja(back)
+	if _, err := p.assemble(); err == nil {
+		t.Errorf("expected an error for a backward jump")
+	}
+}
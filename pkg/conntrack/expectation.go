@@ -0,0 +1,254 @@
+package conntrack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// Expectation is a connection a conntrack helper (FTP, SIP, TFTP...) expects because of what it
+// saw in another one, the master. When it comes, it is tracked as related to the master.
+type Expectation struct {
+	MsgType NfConntrackEventType
+	// Master is the original tuple of the connection that created the expectation, e.g. the FTP
+	// control connection, and MasterProto its protocol.
+	Master      Tuple
+	MasterProto int
+	// Tuple is the expected connection, with the fields of Mask that aren't set being wildcards,
+	// e.g. the source port of an FTP data connection.
+	Tuple Tuple
+	Proto int
+	Mask  Tuple
+	// Timeout is the number of seconds left before the expectation expires.
+	Timeout uint32
+	Id      uint32
+	// Helper is the name of the helper that created the expectation, e.g. "ftp".
+	Helper string
+	Zone   uint16
+	Flags  uint32
+	Class  uint32
+	// Fn is what the kernel does with the expected connection when it comes, e.g. "nat-follow-master".
+	Fn string
+}
+
+func (e Expectation) String() string {
+	return fmt.Sprintf("%s expected=%s %s, master=%s %s, timeout=%d, zone=%d",
+		e.Helper, ProtocolName(e.Proto), e.Tuple.format(isICMP(e.Proto)),
+		ProtocolName(e.MasterProto), e.Master.format(isICMP(e.MasterProto)), e.Timeout, e.Zone)
+}
+
+// parseExpectation parses an expectation message of the ctnetlink expectation subsystem.
+func parseExpectation(msg syscall.NetlinkMessage) (*Expectation, error) {
+	payload, err := genmsgPayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	e := &Expectation{}
+	defer copyAddrs(&e.Master, &e.Tuple, &e.Mask)
+	attrs, err := parseAttrs(payload)
+	if err != nil {
+		return e, err
+	}
+	var maskProto int
+	for _, attr := range attrs {
+		switch CtattrExpect(attr.Typ) {
+		case CtaExpectMaster:
+			err = parseTuple(attr.Msg, &e.MasterProto, &e.Master)
+		case CtaExpectTuple:
+			err = parseTuple(attr.Msg, &e.Proto, &e.Tuple)
+		case CtaExpectMask:
+			err = parseTuple(attr.Msg, &maskProto, &e.Mask)
+		case CtaExpectTimeout:
+			e.Timeout, err = attr.uint32()
+		case CtaExpectId:
+			e.Id, err = attr.uint32()
+		case CtaExpectHelpName:
+			e.Helper = nulString(attr.Msg)
+		case CtaExpectZone:
+			e.Zone, err = attr.uint16()
+		case CtaExpectFlags:
+			e.Flags, err = attr.uint32()
+		case CtaExpectClass:
+			e.Class, err = attr.uint32()
+		case CtaExpectFn:
+			e.Fn = nulString(attr.Msg)
+		}
+		if err != nil {
+			return e, err
+		}
+	}
+
+	switch CntlExpMsgTypes(nflnMsgType(msg.Header.Type)) {
+	case IpctnlMsgExpNew:
+		e.MsgType = NfctMsgUpdate
+		if msg.Header.Flags&(syscall.NLM_F_CREATE|syscall.NLM_F_EXCL) > 0 {
+			e.MsgType = NfctMsgNew
+		}
+	case IpctnlMsgExpDelete:
+		e.MsgType = NfctMsgDestroy
+	}
+	return e, nil
+}
+
+// nulString returns the NUL terminated string at the start of b.
+func nulString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// expectationMessages returns a callback for readNetlinkMessages parsing expectations and passing
+// them to callback. Malformed messages are logged and skipped.
+func expectationMessages(callback func(Expectation)) func(syscall.NetlinkMessage) error {
+	return func(msg syscall.NetlinkMessage) error {
+		e, err := parseExpectation(msg)
+		if err != nil {
+			glog.Errorf("Error parsing expectation, skipping message: %v", err)
+			return nil
+		}
+		callback(*e)
+		return nil
+	}
+}
+
+// ListExpectations dumps the expectation table.
+func (c *ConnTrack) ListExpectations() ([]Expectation, error) {
+	var err error
+	for i := 0; i <= maxDumpRetries; i++ {
+		var exps []Expectation
+		if exps, err = listExpectations(c.requests); err != ErrDumpInterrupted {
+			return exps, err
+		}
+		glog.V(3).Infof("Expectation dump was interrupted, retrying")
+	}
+	return nil, err
+}
+
+func listExpectations(requests *requestSockets) ([]Expectation, error) {
+	request := buildSubsysRequest(NFNL_SUBSYS_CTNETLINK_EXP, uint8(IpctnlMsgExpGet), syscall.NLM_F_DUMP, syscall.AF_UNSPEC, nil)
+	var exps []Expectation
+	err := requests.request(request, NFNL_SUBSYS_CTNETLINK_EXP, expectationMessages(func(e Expectation) {
+		exps = append(exps, e)
+	}))
+	return exps, err
+}
+
+// ExpectationEvent is passed by FollowExpectations: an expectation created, updated or destroyed,
+// or, once events were lost, the expectation table dumped again.
+type ExpectationEvent struct {
+	// Expectation is the one that changed, see its MsgType. Nil for a resync.
+	Expectation *Expectation
+	// Table is the expectation table of a resync. It replaces the expectations known so far.
+	Table []Expectation
+}
+
+// FollowExpectations returns a channel with the expectations as they are created, updated and
+// destroyed, and a function to stop following. The channel is closed once stopped or on error.
+// When the socket overflows, the lost events are replaced by a dump of the expectation table, like
+// the ConnTrack does for connections.
+func (c *ConnTrack) FollowExpectations() (<-chan ExpectationEvent, func(), error) {
+	s, err := c.requests.dial(NF_NETLINK_CONNTRACK_EXP_NEW | NF_NETLINK_CONNTRACK_EXP_UPDATE | NF_NETLINK_CONNTRACK_EXP_DESTROY)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if c.config.ReceiveBufferSize > 0 {
+		if err := s.SetReceiveBufferSize(c.config.ReceiveBufferSize); err != nil {
+			s.Close()
+			return nil, func() {}, err
+		}
+	}
+	// Closing the socket doesn't wake up a blocked read, so wake up regularly to see if we stopped.
+	if err := s.SetReceiveTimeout(followWakeUp); err != nil {
+		s.Close()
+		return nil, func() {}, err
+	}
+	// Only the reader closes s, once it sees stopped, like follow.
+	var once sync.Once
+	stopped := make(chan struct{})
+	stop := func() {
+		once.Do(func() {
+			close(stopped)
+		})
+	}
+
+	res := make(chan ExpectationEvent, 1)
+	send := func(event ExpectationEvent) {
+		select {
+		case res <- event:
+		case <-stopped:
+		}
+	}
+	go func() {
+		defer close(res)
+		defer s.Close()
+		for {
+			err := readNetlinkMessages(s, NFNL_SUBSYS_CTNETLINK_EXP, expectationMessages(func(e Expectation) {
+				send(ExpectationEvent{Expectation: &e})
+			}))
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			if errors.Is(err, syscall.EAGAIN) {
+				continue
+			}
+			if errors.Is(err, syscall.ENOBUFS) {
+				glog.Warningf("Expectation events were lost, dumping the expectation table")
+				exps, err := c.ListExpectations()
+				if err != nil {
+					glog.Errorf("Error dumping expectations after events were lost: %v", err)
+					return
+				}
+				send(ExpectationEvent{Table: exps})
+				continue
+			}
+			if err != nil {
+				glog.Errorf("Error reading expectations from Netfilter: %v", err)
+				return
+			}
+		}
+	}()
+	return res, stop, nil
+}
+
+// MasterKey is the Key of the master connection.
+func (e Expectation) MasterKey() string {
+	return connKey(e.MasterProto, e.Master, e.Zone)
+}
+
+// ExpectationMasters returns the master connections of exps, found in a single dump of the table:
+// the master of exps[i] is masters[i], nil if it is gone.
+func (c *ConnTrack) ExpectationMasters(exps []Expectation) ([]*ConntrackInfo, error) {
+	found := make(map[string]*ConntrackInfo, len(exps))
+	for _, e := range exps {
+		found[e.MasterKey()] = nil
+	}
+	var err error
+	for i := 0; i <= maxDumpRetries; i++ {
+		err = c.DumpAllConntrackInfos(func(info ConntrackInfo) error {
+			key := info.Key()
+			if master, wanted := found[key]; wanted && master == nil {
+				found[key] = &info
+			}
+			return nil
+		})
+		if err != ErrDumpInterrupted {
+			break
+		}
+		glog.V(3).Infof("Conntrack dump was interrupted, retrying")
+	}
+	if err != nil {
+		return nil, err
+	}
+	masters := make([]*ConntrackInfo, len(exps))
+	for i, e := range exps {
+		masters[i] = found[e.MasterKey()]
+	}
+	return masters, nil
+}
@@ -0,0 +1,42 @@
+package conntrack
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Lookup asks the kernel for the connection of protocol proto whose original tuple is orig, in zone.
+// If there is none, the error wraps syscall.ENOENT.
+func (c *ConnTrack) Lookup(proto int, orig Tuple, zone uint16) (*ConntrackInfo, error) {
+	return lookup(c.requests, CtaTupleOrig, proto, orig, zone)
+}
+
+// LookupReply is Lookup by the reply tuple, e.g. to find a connection from the addresses seen by the
+// pod behind a service.
+func (c *ConnTrack) LookupReply(proto int, reply Tuple, zone uint16) (*ConntrackInfo, error) {
+	return lookup(c.requests, CtaTupleReply, proto, reply, zone)
+}
+
+func lookup(requests *requestSockets, direction CtattrType, proto int, t Tuple, zone uint16) (*ConntrackInfo, error) {
+	var e attrEncoder
+	e.nested(uint16(direction), func(e *attrEncoder) {
+		e.tuple(proto, t)
+	})
+	if zone != 0 {
+		e.uint16(uint16(CtaZone), zone)
+	}
+	request := buildRequest(IpctnlMsgCtGet, syscall.NLM_F_ACK, tupleFamily(t), e.bytes())
+	var info *ConntrackInfo
+	err := requests.request(request, NFNL_SUBSYS_CTNETLINK, conntrackMessages(func(conntrackInfo ConntrackInfo) error {
+		info = &conntrackInfo
+		return nil
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("Error looking up %s: %w", ProtocolName(proto), err)
+	}
+	if info == nil {
+		// Connections of protocols we can't parse are dropped.
+		return nil, fmt.Errorf("Error looking up %s: %w", ProtocolName(proto), syscall.ENOENT)
+	}
+	return info, nil
+}
@@ -1,7 +1,9 @@
 package conntrack
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"syscall"
 )
 
@@ -15,13 +17,50 @@ func nfnlSubsysID(x uint16) uint8 {
 	return uint8((x & 0xff00) >> 8)
 }
 
+// NLM_F_DUMP_INTR is set on the messages of a dump when the table changed while it was being
+// dumped, so the dump may be inconsistent. #defined in linux/netlink.h.
+const NLM_F_DUMP_INTR = 0x10
+
+var (
+	// errDone marks the end of a multipart message, i.e. a complete dump.
+	errDone = errors.New("done")
+
+	// ErrDumpInterrupted is returned when a dump kept being interrupted by table changes.
+	ErrDumpInterrupted = errors.New("conntrack dump was interrupted")
+)
+
+// NetlinkError is an error the kernel reported in a NLMSG_ERROR message.
+type NetlinkError struct {
+	Errno syscall.Errno
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("netlink error: %s (errno %d)", e.Errno.Error(), int(e.Errno))
+}
+
+// Unwrap lets callers compare with errors.Is(err, syscall.ENOENT).
+func (e *NetlinkError) Unwrap() error {
+	return e.Errno
+}
+
 // from src/libnfnetlink.c
-func nfnlIsError(hdr syscall.NlMsghdr) error {
-	if hdr.Type == syscall.NLMSG_ERROR {
-		return errors.New("NLMSG_ERROR")
-	}
-	if hdr.Type == syscall.NLMSG_DONE && hdr.Flags&syscall.NLM_F_MULTI > 0 {
-		return errors.New("Done!")
+// nfnlIsError returns errDone at the end of a dump and for acknowledgements, and a *NetlinkError for
+// errors.
+func nfnlIsError(msg syscall.NetlinkMessage) error {
+	switch msg.Header.Type {
+	case syscall.NLMSG_DONE:
+		return errDone
+	case syscall.NLMSG_ERROR:
+		// struct nlmsgerr starts with a negative errno, followed by the header of the request.
+		if len(msg.Data) < 4 {
+			return fmt.Errorf("truncated NLMSG_ERROR message")
+		}
+		errno := -int32(binary.NativeEndian.Uint32(msg.Data[0:4]))
+		if errno == 0 {
+			// An acknowledgement.
+			return errDone
+		}
+		return &NetlinkError{Errno: syscall.Errno(errno)}
 	}
 	return nil
 }
@@ -31,3 +70,10 @@ func nfnlIsError(hdr syscall.NlMsghdr) error {
 func rtaAlignOf(attrlen int) int {
 	return (attrlen + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
 }
+
+// isLittleEndian tells the byte order of the netlink messages of this host.
+func isLittleEndian() bool {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], 1)
+	return b[0] == 1
+}
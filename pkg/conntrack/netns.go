@@ -0,0 +1,61 @@
+package conntrack
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// inNetNS runs f in the network namespace at path, e.g. /proc/<pid>/ns/net. An empty path runs f
+// in our own namespace.
+// Sockets stay in the namespace they were created in, so the ones f opens can be used from any
+// thread once it returns.
+func inNetNS(path string, f func() error) error {
+	if path == "" {
+		return f()
+	}
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening network namespace: %v", err)
+	}
+	defer target.Close()
+
+	// setns only moves the calling thread, so f gets a thread of its own.
+	res := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		own, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			res <- fmt.Errorf("Error opening own network namespace: %v", err)
+			return
+		}
+		defer own.Close()
+		if err := setns(target.Fd()); err != nil {
+			runtime.UnlockOSThread()
+			res <- fmt.Errorf("Error entering network namespace %s: %v", path, err)
+			return
+		}
+		err = f()
+		if restoreErr := setns(own.Fd()); restoreErr != nil {
+			// Leave the thread locked, it exits with the goroutine instead of running others in
+			// the wrong namespace.
+			glog.Errorf("Error leaving network namespace %s: %v", path, restoreErr)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		res <- err
+	}()
+	return <-res
+}
+
+func setns(fd uintptr) error {
+	if _, _, errno := syscall.RawSyscall(unix.SYS_SETNS, fd, syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -1,182 +1,285 @@
 package conntrack
 
 // Netlink attr parsing.
+// Every length comes from the kernel and is checked before use: a malformed message is an error,
+// never a panic.
 
 import (
 	"encoding/binary"
 	"fmt"
 	"net"
-	"time"
+	"syscall"
 
 	"errors"
 )
 
-func parsePayload(b []byte) (*ConntrackInfo, error) {
-	// Most of this comes from libnetfilter_conntrack/src/conntrack/parse_mnl.c
+// parseMessage parses a ctnetlink message about a connection: a dump entry, an event or the reply
+// to a lookup.
+func parseMessage(msg syscall.NetlinkMessage) (*ConntrackInfo, error) {
 	conn := &ConntrackInfo{}
-	// glog.V(4).Infof("Before parse Attrs %++v", b)
-	attrs, err := parseAttrs(b)
+	if err := parseMessageInto(msg, conn); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// parseMessageInto is parseMessage into a zeroed conn, so readers can reuse one for every message.
+func parseMessageInto(msg syscall.NetlinkMessage, conn *ConntrackInfo) error {
+	payload, err := genmsgPayload(msg)
 	if err != nil {
-		return conn, err
+		return err
+	}
+	if err := parsePayload(payload, conn); err != nil {
+		return err
 	}
-	for _, attr := range attrs {
-		// glog.V(4).Infof("Parse each Attrs %++v", attr)
 
+	// Set connection type: Taken from conntrack/parse.c:__parse_message_type.
+	switch CntlMsgTypes(nflnMsgType(msg.Header.Type)) {
+	case IpctnlMsgCtNew:
+		conn.MsgType = NfctMsgUpdate
+		if msg.Header.Flags&(syscall.NLM_F_CREATE|syscall.NLM_F_EXCL) > 0 {
+			conn.MsgType = NfctMsgNew
+		}
+	case IpctnlMsgCtDelete:
+		conn.MsgType = NfctMsgDestroy
+	}
+	return nil
+}
+
+// genmsgPayload returns the attributes following the nfgenmsg of an nfnetlink message.
+func genmsgPayload(msg syscall.NetlinkMessage) ([]byte, error) {
+	if len(msg.Data) < sizeofGenmsg {
+		return nil, fmt.Errorf("message of %d bytes is too short for its nfgenmsg", len(msg.Data))
+	}
+	return msg.Data[sizeofGenmsg:], nil
+}
+
+func parsePayload(b []byte, conn *ConntrackInfo) error {
+	// Most of this comes from libnetfilter_conntrack/src/conntrack/parse_mnl.c
+	err := forEachAttr(b, func(attr Attr) error {
+		var err error
 		switch CtattrType(attr.Typ) {
 		case CtaTupleOrig: //1
+			err = parseTuple(attr.Msg, &conn.Proto, &conn.Orig)
 		case CtaTupleReply: //2
-			// fmt.Printf("It's a reply\n")
-			parseTuple(attr.Msg, conn)
+			err = parseTuple(attr.Msg, &conn.Proto, &conn.Reply)
 		case CtaStatus: //3
 			// These are ip_conntrack_status
-			// status := binary.BigEndian.Uint32(attr.Msg)
-			// fmt.Printf("It's status %d\n", status)
+			var status uint32
+			status, err = attr.uint32()
+			conn.Status = ConntrackStatus(status)
 		case CtaProtoinfo: //4
-			parseProtoinfo(attr.Msg, conn)
+			err = parseProtoinfo(attr.Msg, conn)
+		case CtaTimeout: //7
+			conn.Timeout, err = attr.uint32()
+		case CtaMark: //8
+			conn.Mark, err = attr.uint32()
 		case CtaCountersOrig: // 9
-			// parseCounters(attr.Msg, conn)
+			err = parseCounters(attr.Msg, &conn.OrigCounters)
 		case CtaCountersReply: //10
-			parseCounters(attr.Msg, conn)
+			err = parseCounters(attr.Msg, &conn.ReplyCounters)
+		case CtaUse: //11
+			conn.Use, err = attr.uint32()
+		case CtaId: //12
+			conn.Id, err = attr.uint32()
+		case CtaZone: //18
+			conn.Zone, err = attr.uint16()
+		case CtaTupleMaster: //14
+			conn.Master = &Tuple{}
+			err = parseTuple(attr.Msg, &conn.MasterProto, conn.Master)
 		case CtaTimestamp: // 20
-			parseTimestamp(attr.Msg, conn)
+			err = parseTimestamp(attr.Msg, conn)
+		case CtaLabels: //22
+			conn.Labels = make([]byte, len(attr.Msg))
+			copy(conn.Labels, attr.Msg)
 		}
-	}
-	return conn, nil
+		return err
+	})
+	copyAddrs(&conn.Orig, &conn.Reply, conn.Master)
+	return err
 }
 
-func parseTuple(b []byte, conn *ConntrackInfo) error {
-	attrs, err := parseAttrs(b)
-	if err != nil {
-		return fmt.Errorf("invalid tuple attr: %s", err)
-	}
-	for _, attr := range attrs {
-		// fmt.Printf("pl: %d, type: %d, multi: %t, bigend: %t\n", len(attr.Msg), attr.Typ, attr.IsNested, attr.IsNetByteorder)
+// parseTuple parses a tuple into tuple, and its layer 4 protocol into proto.
+func parseTuple(b []byte, proto *int, tuple *Tuple) error {
+	err := forEachAttr(b, func(attr Attr) error {
 		switch CtattrTuple(attr.Typ) {
 		case CtaTupleUnspec: //0
-			// fmt.Printf("It's a tuple unspec\n")
 		case CtaTupleIp: //1
-			// fmt.Printf("It's a tuple IP\n")
-			if err := parseIP(attr.Msg, conn); err != nil {
-				return err
-			}
+			return parseIP(attr.Msg, tuple)
 		case CtaTupleProto: //2
-			// fmt.Printf("It's a tuple proto\n")
-			parseProto(attr.Msg, conn)
+			return parseProto(attr.Msg, proto, tuple)
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid tuple attr: %v", err)
 	}
 	return nil
 }
 
-func parseIP(b []byte, conn *ConntrackInfo) error {
-	attrs, err := parseAttrs(b)
-	if err != nil {
-		return fmt.Errorf("invalid tuple attr: %s", err)
-	}
-	for _, attr := range attrs {
+// parseIP leaves the addresses pointing into b, see copyAddrs.
+func parseIP(b []byte, tuple *Tuple) error {
+	return forEachAttr(b, func(attr Attr) error {
+		var ip *net.IP
+		size := net.IPv4len
 		switch CtattrIp(attr.Typ) {
 		case CtaIpV4Src:
-			conn.Src = net.IP(attr.Msg) // TODO: copy so we can reuse the buffer?
+			ip = &tuple.Src
 		case CtaIpV4Dst:
-			conn.Dst = net.IP(attr.Msg) // TODO: copy so we can reuse the buffer?
+			ip = &tuple.Dst
 		case CtaIpV6Src:
-			// TODO
+			ip, size = &tuple.Src, net.IPv6len
 		case CtaIpV6Dst:
-			// TODO
+			ip, size = &tuple.Dst, net.IPv6len
+		default:
+			return nil
 		}
-	}
-	return nil
+		if len(attr.Msg) != size {
+			return attr.sizeError(size)
+		}
+		*ip = net.IP(attr.Msg)
+		return nil
+	})
 }
 
-func parseProto(b []byte, conn *ConntrackInfo) error {
-	attrs, err := parseAttrs(b)
-	if err != nil {
-		return fmt.Errorf("invalid tuple attr: %s", err)
+// copyAddrs copies the addresses of the parsed tuples out of the receive buffer, so the buffer can
+// be reused. They are copied to a single allocation rather than one per address, as a dump of a
+// large table otherwise allocates mostly addresses. Nil tuples are skipped.
+func copyAddrs(tuples ...*Tuple) {
+	n := 0
+	for _, t := range tuples {
+		if t != nil {
+			n += len(t.Src) + len(t.Dst)
+		}
+	}
+	if n == 0 {
+		return
+	}
+	buf := make([]byte, 0, n)
+	copyAddr := func(ip net.IP) net.IP {
+		if ip == nil {
+			return nil
+		}
+		start := len(buf)
+		buf = append(buf, ip...)
+		// Capped, so that appending to an address doesn't overwrite the next.
+		return net.IP(buf[start:len(buf):len(buf)])
 	}
-	for _, attr := range attrs {
+	for _, t := range tuples {
+		if t != nil {
+			t.Src = copyAddr(t.Src)
+			t.Dst = copyAddr(t.Dst)
+		}
+	}
+}
+
+func parseProto(b []byte, proto *int, tuple *Tuple) error {
+	return forEachAttr(b, func(attr Attr) error {
+		var err error
 		switch CtattrL4proto(attr.Typ) {
 		case CtaProtoNum: //0
-			conn.Proto = int(uint8(attr.Msg[0]))
+			var num uint8
+			num, err = attr.uint8()
+			*proto = int(num)
 		case CtaProtoSrcPort: //1
-			conn.SrcPort = binary.BigEndian.Uint16(attr.Msg)
+			tuple.SrcPort, err = attr.uint16()
 		case CtaProtoDstPort: //2
-			conn.DstPort = binary.BigEndian.Uint16(attr.Msg)
+			tuple.DstPort, err = attr.uint16()
+		case CtaProtoIcmpId, CtaProtoIcmpv6Id:
+			tuple.IcmpId, err = attr.uint16()
+		case CtaProtoIcmpType, CtaProtoIcmpv6Type:
+			tuple.IcmpType, err = attr.uint8()
+		case CtaProtoIcmpCode, CtaProtoIcmpv6Code:
+			tuple.IcmpCode, err = attr.uint8()
 		}
-	}
-	return nil
+		return err
+	})
 }
 
 func parseProtoinfo(b []byte, conn *ConntrackInfo) error {
-	attrs, err := parseAttrs(b)
-	if err != nil {
-		return fmt.Errorf("invalid tuple attr: %s", err)
-	}
-	for _, attr := range attrs {
+	err := forEachAttr(b, func(attr Attr) error {
 		switch CtattrProtoinfo(attr.Typ) {
 		case CtaProtoinfoTcp:
-			if err := parseProtoinfoTCP(attr.Msg, conn); err != nil {
-				return err
-			}
+			return parseProtoinfoTCP(attr.Msg, conn)
+		case CtaProtoinfoSctp:
+			return parseProtoinfoSCTP(attr.Msg, conn)
 		default:
 			// we're not interested in other protocols
+			return nil
 		}
+	})
+	if err != nil {
+		return fmt.Errorf("invalid protoinfo attr: %v", err)
 	}
 	return nil
 }
 
 func parseProtoinfoTCP(b []byte, conn *ConntrackInfo) error {
-	attrs, err := parseAttrs(b)
-	if err != nil {
-		return fmt.Errorf("invalid tuple attr: %s", err)
-	}
-	for _, attr := range attrs {
+	return forEachAttr(b, func(attr Attr) error {
 		switch CtattrProtoinfoTcp(attr.Typ) {
 		case CtaProtoinfoTcpState: //1
-			conn.TCPState = TCPState(uint8(attr.Msg[0]))
+			state, err := attr.uint8()
+			conn.TCPState = TCPState(state)
+			return err
 		default:
 			// not interested
+			return nil
 		}
-	}
-	return nil
+	})
 }
 
-func parseCounters(b []byte, conn *ConntrackInfo) error {
-	attrs, err := parseAttrs(b)
-	if err != nil {
-		return fmt.Errorf("invalid counters attr: %s", err)
-	}
-	for _, attr := range attrs {
-		// fmt.Printf("pl: %d, type: %d, multi: %t, bigend: %t\n", len(attr.Msg), attr.Typ, attr.IsNested, attr.IsNetByteorder)
+func parseProtoinfoSCTP(b []byte, conn *ConntrackInfo) error {
+	return forEachAttr(b, func(attr Attr) error {
+		switch CtattrProtoinfoSctp(attr.Typ) {
+		case CtaProtoinfoSctpState: //1
+			state, err := attr.uint8()
+			conn.SCTPState = SCTPState(state)
+			return err
+		default:
+			// not interested in the verification tags
+			return nil
+		}
+	})
+}
+
+func parseCounters(b []byte, counters *Counters) error {
+	err := forEachAttr(b, func(attr Attr) error {
+		var err error
+		var v32 uint32
 		switch CtattrCounters(attr.Typ) {
 		case CtaCountersPackets: //1
-			packet := binary.BigEndian.Uint64(attr.Msg)
-			// glog.V(4).Infof("packets = %d", packet)
-			conn.Packets = packet
+			counters.Packets, err = attr.uint64()
 		case CtaCountersBytes: //2
-			bytes := binary.BigEndian.Uint64(attr.Msg)
-			// glog.V(4).Infof("bytes = %d", bytes)
-			conn.Bytes = bytes
+			counters.Bytes, err = attr.uint64()
+		case CtaCounters32Packets: //3
+			v32, err = attr.uint32()
+			counters.Packets = uint64(v32)
+		case CtaCoutners32Bytes: //4
+			v32, err = attr.uint32()
+			counters.Bytes = uint64(v32)
 		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("invalid counters attr: %v", err)
 	}
 	return nil
 }
 
 func parseTimestamp(b []byte, conn *ConntrackInfo) error {
-	attrs, err := parseAttrs(b)
-	if err != nil {
-		return fmt.Errorf("invalid timestamp attr: %s", err)
-	}
-	for _, attr := range attrs {
-		// fmt.Printf("pl: %d, type: %d, multi: %t, bigend: %t\n", len(attr.Msg), attr.Typ, attr.IsNested, attr.IsNetByteorder)
+	err := forEachAttr(b, func(attr Attr) error {
+		var err error
+		// Both are CLOCK_REALTIME nanoseconds.
 		switch CtattrTimestamp(attr.Typ) {
 		case CtaTimestampStart: //1
-			startTime := binary.BigEndian.Uint64(attr.Msg)
-			// startTime returned here is in nanoseconds; convert it to seconds
-			conn.StartTimestamp = startTime / 1E9
-			// fmt.Println(time.Now().Unix())
-			conn.DeltaTime = uint64(time.Now().Unix()) - conn.StartTimestamp
+			conn.StartTimestamp, err = attr.uint64()
 		case CtaTimestampStop: //2
-			// Don't care stop time right now.
+			conn.StopTimestamp, err = attr.uint64()
 		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("invalid timestamp attr: %v", err)
 	}
 	return nil
 }
@@ -190,31 +293,94 @@ type Attr struct {
 	IsNetByteorder bool
 }
 
+// Attribute payloads are in network byte order. Longer payloads are accepted, in case the kernel
+// widens one.
+
+func (a Attr) uint8() (uint8, error) {
+	if len(a.Msg) < 1 {
+		return 0, a.sizeError(1)
+	}
+	return a.Msg[0], nil
+}
+
+func (a Attr) uint16() (uint16, error) {
+	if len(a.Msg) < 2 {
+		return 0, a.sizeError(2)
+	}
+	return binary.BigEndian.Uint16(a.Msg), nil
+}
+
+func (a Attr) uint32() (uint32, error) {
+	if len(a.Msg) < 4 {
+		return 0, a.sizeError(4)
+	}
+	return binary.BigEndian.Uint32(a.Msg), nil
+}
+
+func (a Attr) uint64() (uint64, error) {
+	if len(a.Msg) < 8 {
+		return 0, a.sizeError(8)
+	}
+	return binary.BigEndian.Uint64(a.Msg), nil
+}
+
+func (a Attr) sizeError(expected int) error {
+	return fmt.Errorf("attr %d has %d bytes, expected %d", a.Typ, len(a.Msg), expected)
+}
+
 func parseAttrs(b []byte) ([]Attr, error) {
 	var attrs []Attr
+	err := forEachAttr(b, func(attr Attr) error {
+		attrs = append(attrs, attr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// forEachAttr passes the attributes in b to f, in order, and stops at the first error f returns.
+// Unlike parseAttrs it allocates nothing, the attributes being slices of b, which is what the
+// parsers of dump entries use.
+func forEachAttr(b []byte, f func(Attr) error) error {
 	for len(b) >= attrHdrLength {
 		var attr Attr
-		attr, b = parseAttr(b)
-		attrs = append(attrs, attr)
+		var err error
+		attr, b, err = parseAttr(b)
+		if err != nil {
+			return err
+		}
+		if err := f(attr); err != nil {
+			return err
+		}
 	}
 	if len(b) != 0 {
-		return nil, errors.New("leftover attr bytes")
+		return errors.New("leftover attr bytes")
 	}
-	return attrs, nil
+	return nil
 }
 
-func parseAttr(b []byte) (Attr, []byte) {
-	l := binary.LittleEndian.Uint16(b[0:2])
+// parseAttr parses the attribute at the start of b, which must hold at least its header, and
+// returns it with the bytes following it.
+func parseAttr(b []byte) (Attr, []byte, error) {
 	// length is header + payload
-	l -= uint16(attrHdrLength)
+	l := int(binary.NativeEndian.Uint16(b[0:2]))
+	if l < attrHdrLength || l > len(b) {
+		return Attr{}, nil, fmt.Errorf("attr length %d out of bounds, %d bytes left", l, len(b))
+	}
 
-	typ := binary.LittleEndian.Uint16(b[2:4])
+	typ := binary.NativeEndian.Uint16(b[2:4])
 	attr := Attr{
-		Msg:            b[attrHdrLength : attrHdrLength+int(l)],
+		Msg:            b[attrHdrLength:l],
 		Typ:            int(typ & NLA_TYPE_MASK),
 		IsNested:       typ&NLA_F_NESTED > 0,
 		IsNetByteorder: typ&NLA_F_NET_BYTEORDER > 0,
 	}
-	// glog.V(4).Infof("Attr is %++v", attr)
-	return attr, b[rtaAlignOf(attrHdrLength+int(l)):]
+	next := rtaAlignOf(l)
+	if next > len(b) {
+		// The padding of the last attribute may be left out.
+		next = len(b)
+	}
+	return attr, b[next:], nil
 }
@@ -0,0 +1,506 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math/bits"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the .golden files of testdata")
+
+// The .nl files of testdata are netlink messages received from the kernel, header included,
+// written by TestCapture. Their .golden files are what they are parsed into, written with -update.
+
+func readMessage(t testing.TB, path string) syscall.NetlinkMessage {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading %s: %v", path, err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Error parsing %s: %d messages, %v", path, len(msgs), err)
+	}
+	return msgs[0]
+}
+
+// parseAny parses msg as a connection or an expectation, depending on its subsystem.
+func parseAny(msg syscall.NetlinkMessage) (interface{}, error) {
+	if msg.Header.Type>>8 == NFNL_SUBSYS_CTNETLINK_EXP {
+		return parseExpectation(msg)
+	}
+	return parseMessage(msg)
+}
+
+func TestParseGolden(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.nl"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("Error listing testdata: %v", err)
+	}
+	for _, path := range paths {
+		parsed, err := parseAny(readMessage(t, path))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", path, err)
+			continue
+		}
+		got, err := json.MarshalIndent(parsed, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, '\n')
+
+		golden := strings.TrimSuffix(path, ".nl") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", golden, err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", path, expected, got)
+		}
+	}
+}
+
+// attr encodes an attribute with the given payload, padded to 4 bytes.
+func attr(typ uint16, payload ...byte) []byte {
+	b := make([]byte, rtaAlignOf(attrHdrLength+len(payload)))
+	binary.LittleEndian.PutUint16(b[0:2], uint16(attrHdrLength+len(payload)))
+	binary.LittleEndian.PutUint16(b[2:4], typ)
+	copy(b[attrHdrLength:], payload)
+	return b
+}
+
+func nested(typ uint16, attrs ...[]byte) []byte {
+	return attr(typ|NLA_F_NESTED, bytes.Join(attrs, nil)...)
+}
+
+func TestParsePayloadMalformed(t *testing.T) {
+	tuple := func(ip []byte) []byte {
+		return nested(uint16(CtaTupleOrig),
+			nested(uint16(CtaTupleIp), attr(uint16(CtaIpV4Src), ip...)),
+		)
+	}
+	tests := []struct {
+		Name    string
+		Payload []byte
+	}{
+		{
+			Name:    "length below header",
+			Payload: []byte{2, 0, 3, 0},
+		},
+		{
+			Name:    "length beyond payload",
+			Payload: []byte{12, 0, 3, 0, 0, 0, 0, 1},
+		},
+		{
+			Name:    "leftover bytes",
+			Payload: append(attr(uint16(CtaMark), 0, 0, 0, 1), 8, 0),
+		},
+		{
+			Name:    "short status",
+			Payload: attr(uint16(CtaStatus), 0, 1),
+		},
+		{
+			Name:    "short zone",
+			Payload: attr(uint16(CtaZone), 1),
+		},
+		{
+			Name:    "short timestamp",
+			Payload: nested(uint16(CtaTimestamp), attr(uint16(CtaTimestampStart), 0, 0, 0, 1)),
+		},
+		{
+			Name:    "short counter",
+			Payload: nested(uint16(CtaCountersOrig), attr(uint16(CtaCountersPackets), 0, 0, 0, 1)),
+		},
+		{
+			Name:    "short IPv4 address",
+			Payload: tuple([]byte{10, 0, 0}),
+		},
+		{
+			Name:    "IPv4 address of IPv6 length",
+			Payload: tuple(make([]byte, 16)),
+		},
+		{
+			Name: "short port",
+			Payload: nested(uint16(CtaTupleOrig),
+				nested(uint16(CtaTupleProto), attr(uint16(CtaProtoNum), syscall.IPPROTO_TCP), attr(uint16(CtaProtoSrcPort), 80)),
+			),
+		},
+		{
+			Name: "missing protocol number",
+			Payload: nested(uint16(CtaTupleOrig),
+				nested(uint16(CtaTupleProto), attr(uint16(CtaProtoNum))),
+			),
+		},
+		{
+			Name: "truncated nested attr",
+			Payload: nested(uint16(CtaProtoinfo),
+				[]byte{8, 0, uint8(CtaProtoinfoTcp), 0x80, 5, 0},
+			),
+		},
+	}
+	for _, test := range tests {
+		if err := parsePayload(test.Payload, &ConntrackInfo{}); err == nil {
+			t.Errorf("%s: expected an error", test.Name)
+		}
+	}
+}
+
+func TestParseMessageShortGenmsg(t *testing.T) {
+	msg := syscall.NetlinkMessage{Data: []byte{syscall.AF_INET, 0}}
+	if _, err := parseMessage(msg); err == nil {
+		t.Errorf("expected an error for a message without nfgenmsg")
+	}
+	if _, err := parseExpectation(msg); err == nil {
+		t.Errorf("expected an error for an expectation without nfgenmsg")
+	}
+}
+
+// Every truncation of a valid message must fail cleanly rather than panic.
+func TestParseTruncated(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.nl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		msg := readMessage(t, path)
+		data := msg.Data
+		for i := 0; i < len(data); i++ {
+			msg.Data = data[:i]
+			parseAny(msg)
+		}
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.nl"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msgs, err := syscall.ParseNetlinkMessage(b)
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			parseMessage(msg)
+			parseExpectation(msg)
+		}
+	})
+}
+
+// The receive buffer is reused, so nothing parsed may point into it.
+func TestParseCopiesAddrs(t *testing.T) {
+	for _, name := range []string{"tcp_related.nl", "udp6_zone.nl", "expectation.nl"} {
+		msg := readMessage(t, filepath.Join("testdata", name))
+		parsed, err := parseAny(msg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		expected, _ := json.Marshal(parsed)
+		for i := range msg.Data {
+			msg.Data[i] = 0xff
+		}
+		if got, _ := json.Marshal(parsed); !bytes.Equal(got, expected) {
+			t.Errorf("%s: changed with the buffer:\n%s\n%s", name, expected, got)
+		}
+	}
+}
+
+func TestParseExpectation(t *testing.T) {
+	be16 := func(v uint16) []byte {
+		return []byte{byte(v >> 8), byte(v)}
+	}
+	be32 := func(v uint32) []byte {
+		return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	tuple := func(typ CtattrExpect, src, dst net.IP, sport, dport uint16) []byte {
+		return nested(uint16(typ),
+			nested(uint16(CtaTupleIp), attr(uint16(CtaIpV4Src), src.To4()...), attr(uint16(CtaIpV4Dst), dst.To4()...)),
+			nested(uint16(CtaTupleProto), attr(uint16(CtaProtoNum), syscall.IPPROTO_TCP),
+				attr(uint16(CtaProtoSrcPort), be16(sport)...), attr(uint16(CtaProtoDstPort), be16(dport)...)),
+		)
+	}
+	client, server := net.IP{10, 0, 0, 5}, net.IP{10, 0, 0, 6}
+	// An FTP server announced a passive data connection to port 50000 on its control connection.
+	payload := bytes.Join([][]byte{
+		tuple(CtaExpectMaster, client, server, 38318, 21),
+		tuple(CtaExpectTuple, client, server, 0, 50000),
+		tuple(CtaExpectMask, net.IP{255, 255, 255, 255}, net.IP{255, 255, 255, 255}, 0, 0xffff),
+		attr(uint16(CtaExpectTimeout), be32(299)...),
+		attr(uint16(CtaExpectId), be32(0xdeadbeef)...),
+		attr(uint16(CtaExpectHelpName), 'f', 't', 'p', 0),
+		attr(uint16(CtaExpectZone), be16(3)...),
+		attr(uint16(CtaExpectFlags), be32(1)...),
+		attr(uint16(CtaExpectClass), be32(0)...),
+	}, nil)
+	expected := Expectation{
+		Master:      Tuple{Src: client, SrcPort: 38318, Dst: server, DstPort: 21},
+		MasterProto: syscall.IPPROTO_TCP,
+		Tuple:       Tuple{Src: client, Dst: server, DstPort: 50000},
+		Proto:       syscall.IPPROTO_TCP,
+		Mask:        Tuple{Src: net.IP{255, 255, 255, 255}, Dst: net.IP{255, 255, 255, 255}, DstPort: 0xffff},
+		Timeout:     299,
+		Id:          0xdeadbeef,
+		Helper:      "ftp",
+		Zone:        3,
+		Flags:       1,
+	}
+
+	tests := []struct {
+		Type            CntlExpMsgTypes
+		Flags           uint16
+		ExpectedMsgType NfConntrackEventType
+	}{
+		{IpctnlMsgExpNew, syscall.NLM_F_CREATE | syscall.NLM_F_EXCL, NfctMsgNew},
+		// Dumped.
+		{IpctnlMsgExpNew, syscall.NLM_F_MULTI, NfctMsgUpdate},
+		{IpctnlMsgExpDelete, 0, NfctMsgDestroy},
+	}
+	for _, test := range tests {
+		msg := syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(NFNL_SUBSYS_CTNETLINK_EXP)<<8 | uint16(test.Type), Flags: test.Flags},
+			Data:   append([]byte{syscall.AF_INET, 0, 0, 0}, payload...),
+		}
+		e, err := parseExpectation(msg)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", test.Type, err)
+			continue
+		}
+		expected.MsgType = test.ExpectedMsgType
+		if !reflect.DeepEqual(*e, expected) {
+			t.Errorf("%d: expected %++v, got %++v", test.Type, expected, *e)
+		}
+		if key, expectedKey := e.MasterKey(), "tcp 10.0.0.5:38318->10.0.0.6:21 zone=3"; key != expectedKey {
+			t.Errorf("%d: expected master key %q, got %q", test.Type, expectedKey, key)
+		}
+	}
+}
+
+func TestParsePayloadProtocols(t *testing.T) {
+	ip := func(typ CtattrIp, addr string) []byte {
+		parsed := net.ParseIP(addr)
+		if v4 := parsed.To4(); v4 != nil {
+			parsed = v4
+		}
+		return attr(uint16(typ), parsed...)
+	}
+	tuple := func(typ CtattrType, src, dst []byte, proto uint8, l4 ...[]byte) []byte {
+		return nested(uint16(typ),
+			nested(uint16(CtaTupleIp), src, dst),
+			nested(uint16(CtaTupleProto), append([][]byte{attr(uint16(CtaProtoNum), proto)}, l4...)...),
+		)
+	}
+	port := func(typ CtattrL4proto, port uint16) []byte {
+		return attr(uint16(typ), byte(port>>8), byte(port))
+	}
+	tests := []struct {
+		Name                string
+		Payload             []byte
+		Expected            ConntrackInfo
+		ExpectedEstablished bool
+	}{
+		{
+			Name: "ICMP echo",
+			Payload: bytes.Join([][]byte{
+				tuple(CtaTupleOrig, ip(CtaIpV4Src, "10.0.0.5"), ip(CtaIpV4Dst, "10.0.0.6"), syscall.IPPROTO_ICMP,
+					port(CtaProtoIcmpId, 7), attr(uint16(CtaProtoIcmpType), 8), attr(uint16(CtaProtoIcmpCode), 0)),
+				tuple(CtaTupleReply, ip(CtaIpV4Src, "10.0.0.6"), ip(CtaIpV4Dst, "10.0.0.5"), syscall.IPPROTO_ICMP,
+					port(CtaProtoIcmpId, 7), attr(uint16(CtaProtoIcmpType), 0), attr(uint16(CtaProtoIcmpCode), 0)),
+			}, nil),
+			Expected: ConntrackInfo{
+				Proto: syscall.IPPROTO_ICMP,
+				Orig:  Tuple{Src: net.IP{10, 0, 0, 5}, Dst: net.IP{10, 0, 0, 6}, IcmpId: 7, IcmpType: 8},
+				Reply: Tuple{Src: net.IP{10, 0, 0, 6}, Dst: net.IP{10, 0, 0, 5}, IcmpId: 7},
+			},
+		},
+		{
+			Name: "ICMPv6 echo replied",
+			Payload: bytes.Join([][]byte{
+				tuple(CtaTupleOrig, ip(CtaIpV6Src, "fd00::3"), ip(CtaIpV6Dst, "fd00::5"), syscall.IPPROTO_ICMPV6,
+					port(CtaProtoIcmpv6Id, 9), attr(uint16(CtaProtoIcmpv6Type), 128), attr(uint16(CtaProtoIcmpv6Code), 0)),
+				tuple(CtaTupleReply, ip(CtaIpV6Src, "fd00::5"), ip(CtaIpV6Dst, "fd00::3"), syscall.IPPROTO_ICMPV6,
+					port(CtaProtoIcmpv6Id, 9), attr(uint16(CtaProtoIcmpv6Type), 129), attr(uint16(CtaProtoIcmpv6Code), 0)),
+				attr(uint16(CtaStatus), 0, 0, 0, byte(IpsSeenReply)),
+			}, nil),
+			Expected: ConntrackInfo{
+				Proto:  syscall.IPPROTO_ICMPV6,
+				Orig:   Tuple{Src: net.ParseIP("fd00::3"), Dst: net.ParseIP("fd00::5"), IcmpId: 9, IcmpType: 128},
+				Reply:  Tuple{Src: net.ParseIP("fd00::5"), Dst: net.ParseIP("fd00::3"), IcmpId: 9, IcmpType: 129},
+				Status: IpsSeenReply,
+			},
+			ExpectedEstablished: true,
+		},
+		{
+			Name: "SCTP established",
+			Payload: bytes.Join([][]byte{
+				tuple(CtaTupleOrig, ip(CtaIpV4Src, "10.0.0.5"), ip(CtaIpV4Dst, "10.0.0.6"), syscall.IPPROTO_SCTP,
+					port(CtaProtoSrcPort, 40000), port(CtaProtoDstPort, 3868)),
+				tuple(CtaTupleReply, ip(CtaIpV4Src, "10.0.0.6"), ip(CtaIpV4Dst, "10.0.0.5"), syscall.IPPROTO_SCTP,
+					port(CtaProtoSrcPort, 3868), port(CtaProtoDstPort, 40000)),
+				nested(uint16(CtaProtoinfo), nested(uint16(CtaProtoinfoSctp),
+					attr(uint16(CtaProtoinfoSctpState), byte(SCTPState_ESTABLISHED)),
+					// The verification tags are skipped.
+					attr(uint16(CtaProtoinfoSctpState)+1, 0x12, 0x34, 0x56, 0x78),
+				)),
+			}, nil),
+			Expected: ConntrackInfo{
+				Proto:     syscall.IPPROTO_SCTP,
+				Orig:      Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: 40000, Dst: net.IP{10, 0, 0, 6}, DstPort: 3868},
+				Reply:     Tuple{Src: net.IP{10, 0, 0, 6}, SrcPort: 3868, Dst: net.IP{10, 0, 0, 5}, DstPort: 40000},
+				SCTPState: SCTPState_ESTABLISHED,
+			},
+			ExpectedEstablished: true,
+		},
+		{
+			Name: "SCTP cookie wait",
+			Payload: bytes.Join([][]byte{
+				tuple(CtaTupleOrig, ip(CtaIpV4Src, "10.0.0.5"), ip(CtaIpV4Dst, "10.0.0.6"), syscall.IPPROTO_SCTP,
+					port(CtaProtoSrcPort, 40000), port(CtaProtoDstPort, 3868)),
+				nested(uint16(CtaProtoinfo), nested(uint16(CtaProtoinfoSctp),
+					attr(uint16(CtaProtoinfoSctpState), byte(SCTPState_COOKIE_WAIT)),
+				)),
+			}, nil),
+			Expected: ConntrackInfo{
+				Proto:     syscall.IPPROTO_SCTP,
+				Orig:      Tuple{Src: net.IP{10, 0, 0, 5}, SrcPort: 40000, Dst: net.IP{10, 0, 0, 6}, DstPort: 3868},
+				SCTPState: SCTPState_COOKIE_WAIT,
+			},
+		},
+	}
+	for _, test := range tests {
+		var conn ConntrackInfo
+		if err := parsePayload(test.Payload, &conn); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(conn, test.Expected) {
+			t.Errorf("%s: expected %++v, got %++v", test.Name, test.Expected, conn)
+		}
+		if conn.Established() != test.ExpectedEstablished {
+			t.Errorf("%s: expected established %v", test.Name, test.ExpectedEstablished)
+		}
+	}
+}
+
+func TestParsePayloadAttrs(t *testing.T) {
+	be32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	// The labels are unsigned longs in host byte order, label 1 and label 70 set.
+	labels := make([]byte, 2*8)
+	binary.NativeEndian.PutUint64(labels, 1<<1)
+	binary.NativeEndian.PutUint64(labels[8:], 1<<6)
+	payload := bytes.Join([][]byte{
+		attr(uint16(CtaStatus), be32(uint32(IpsSeenReply|IpsAssured|IpsConfirmed|IpsDstNat))...),
+		attr(uint16(CtaTimeout), be32(431999)...),
+		attr(uint16(CtaMark), be32(0xbeef)...),
+		attr(uint16(CtaUse), be32(1)...),
+		attr(uint16(CtaId), be32(0x9abcdef0)...),
+		attr(uint16(CtaZone), 0, 7),
+		attr(uint16(CtaLabels), labels...),
+	}, nil)
+	var conn ConntrackInfo
+	if err := parsePayload(payload, &conn); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := ConntrackInfo{
+		Status:  IpsSeenReply | IpsAssured | IpsConfirmed | IpsDstNat,
+		Timeout: 431999,
+		Mark:    0xbeef,
+		Use:     1,
+		Id:      0x9abcdef0,
+		Zone:    7,
+		Labels:  labels,
+	}
+	if !reflect.DeepEqual(conn, expected) {
+		t.Errorf("Expected %++v, got %++v", expected, conn)
+	}
+	for _, bit := range []int{1, 70} {
+		if !conn.HasLabel(bit) {
+			t.Errorf("Expected label %d", bit)
+		}
+	}
+	for _, bit := range []int{0, 6, 64, 128} {
+		if conn.HasLabel(bit) {
+			t.Errorf("Unexpected label %d", bit)
+		}
+	}
+}
+
+func TestHasLabel(t *testing.T) {
+	// words returns a bitmap of host order unsigned longs, as the kernel sends it.
+	words := func(ws ...uint64) []byte {
+		var b []byte
+		for _, w := range ws {
+			if bits.UintSize == 64 {
+				b = binary.NativeEndian.AppendUint64(b, w)
+			} else {
+				b = binary.NativeEndian.AppendUint32(b, uint32(w))
+			}
+		}
+		return b
+	}
+	tests := []struct {
+		Name     string
+		Labels   []byte
+		Bit      int
+		Expected bool
+	}{
+		{"bit 0", words(1), 0, true},
+		{"bit 9", words(1 << 9), 9, true},
+		{"bit 9 unset", words(1 << 8), 9, false},
+		{"last bit of the first word", words(1 << (bits.UintSize - 1)), bits.UintSize - 1, true},
+		{"first bit of the second word", words(0, 1), bits.UintSize, true},
+		{"second word not first", words(1, 0), bits.UintSize, false},
+		{"negative", words(^uint64(0)), -1, false},
+		{"out of range", words(^uint64(0)), bits.UintSize, false},
+		{"truncated word", words(^uint64(0), ^uint64(0))[:bits.UintSize/8+1], bits.UintSize, false},
+		{"no labels", nil, 0, false},
+	}
+	for _, test := range tests {
+		conn := ConntrackInfo{Labels: test.Labels}
+		if got := conn.HasLabel(test.Bit); got != test.Expected {
+			t.Errorf("%s: expected %v, got %v", test.Name, test.Expected, got)
+		}
+	}
+}
+
+func TestConntrackStatusString(t *testing.T) {
+	tests := []struct {
+		Status   ConntrackStatus
+		Expected string
+	}{
+		{0, ""},
+		{IpsSeenReply | IpsAssured | IpsConfirmed, "SEEN_REPLY|ASSURED|CONFIRMED"},
+		{IpsDstNat | IpsDstNatDone, "DST_NAT|DST_NAT_DONE"},
+		{IpsAssured | 1<<30, "ASSURED|0x40000000"},
+	}
+	for _, test := range tests {
+		if got := test.Status.String(); got != test.Expected {
+			t.Errorf("Status %#x: expected %q, got %q", uint32(test.Status), test.Expected, got)
+		}
+	}
+}
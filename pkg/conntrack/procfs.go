@@ -0,0 +1,296 @@
+package conntrack
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// procfsConntrackPath lists the entries of the table, one per line. /proc/net is the namespace of
+// the process, thread-self/net the one of the thread opening it, which inNetNS moved.
+const procfsConntrackPath = "/proc/thread-self/net/nf_conntrack"
+
+// The status bits /proc/net/nf_conntrack shows. It only lists confirmed entries.
+const procfsStatus = IpsSeenReply | IpsAssured | IpsConfirmed | IpsOffload | IpsHwOffload
+
+// errProcfsZero is returned by dumps of the procfs source asked to reset the counters.
+var errProcfsZero = errors.New("the procfs conntrack source can't reset counters")
+
+// procfsSource is the Source of SourceProcfs. It doesn't see the ids, labels and masters of the
+// entries, nor the status bits but procfsStatus, and StartTimestamp is only precise to the second.
+type procfsSource struct {
+	netns string
+	path  string
+	now   func() time.Time
+}
+
+func newProcfsSource(netns string) *procfsSource {
+	return &procfsSource{netns: netns, path: procfsConntrackPath, now: time.Now}
+}
+
+func (s *procfsSource) Name() string {
+	return SourceProcfs
+}
+
+// Dump applies filter itself. The kernel doesn't tell when the table changed while it was read.
+func (s *procfsSource) Dump(filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	if zero {
+		return errProcfsZero
+	}
+	var f *os.File
+	// The file shows the namespace it was opened in.
+	err := inNetNS(s.netns, func() error {
+		var err error
+		f, err = os.Open(s.path)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v", s.path, err)
+	}
+	defer f.Close()
+	return readProcfsConntrack(f, s.now(), func(conn ConntrackInfo) error {
+		if !filter.matches(conn) {
+			return nil
+		}
+		return callback(conn)
+	})
+}
+
+func (s *procfsSource) Follow(*EventFilter, bool, int) (EventReader, error) {
+	return nil, ErrNoEvents
+}
+
+func (s *procfsSource) Close() {}
+
+// readProcfsConntrack parses the entries of r, in the format of /proc/net/nf_conntrack, and passes
+// those of supported protocols to callback until it returns an error. now is when r was read.
+// Malformed lines are errors: unlike netlink messages, there is no telling where the next entry
+// starts if the format changed.
+func readProcfsConntrack(r io.Reader, now time.Time, callback func(ConntrackInfo) error) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var conn ConntrackInfo
+		ok, err := parseProcfsLine(scanner.Text(), now, &conn)
+		if err != nil {
+			return fmt.Errorf("Error parsing line %d of %s: %v", line, procfsConntrackPath, err)
+		}
+		if !ok {
+			continue
+		}
+		if err := callback(conn); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseProcfsLine parses an entry of /proc/net/nf_conntrack, as printed by ct_seq_show, into conn.
+// It returns false for entries of unsupported protocols, which are left unparsed.
+//
+//	ipv4     2 tcp      6 299 ESTABLISHED src=10.0.0.5 dst=10.0.0.6 sport=38318 dport=6379 packets=3 bytes=180 src=10.0.0.6 dst=10.0.0.5 sport=6379 dport=38318 packets=2 bytes=112 [ASSURED] mark=0 zone=0 delta-time=12 use=2
+func parseProcfsLine(line string, now time.Time, conn *ConntrackInfo) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return false, fmt.Errorf("too few fields in %q", line)
+	}
+	family, err := strconv.Atoi(fields[1])
+	if err != nil || family != syscall.AF_INET && family != syscall.AF_INET6 {
+		return false, fmt.Errorf("invalid family %q", fields[1])
+	}
+	proto, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return false, fmt.Errorf("invalid protocol %q", fields[3])
+	}
+	if !supportedProtocols[proto] {
+		return false, nil
+	}
+	// Entries in a dump are reported like updates.
+	conn.MsgType = NfctMsgUpdate
+	conn.Proto = proto
+	conn.Status = IpsConfirmed | IpsSeenReply
+	fields = fields[4:]
+
+	// Offloaded entries have no timeout.
+	if len(fields) > 0 && !strings.ContainsAny(fields[0], "=[") {
+		if timeout, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+			conn.Timeout = uint32(timeout)
+			fields = fields[1:]
+		}
+	}
+	// Then the state, of the protocols having one.
+	if len(fields) > 0 && !strings.ContainsAny(fields[0], "=[") {
+		if err := parseProcfsState(fields[0], conn); err != nil {
+			return false, err
+		}
+		fields = fields[1:]
+	}
+
+	// The fields of the original direction come first, those of the reply start at its src.
+	tuple, counters := &conn.Orig, &conn.OrigCounters
+	var tuples int
+	for _, field := range fields {
+		switch field {
+		case "[UNREPLIED]":
+			conn.Status &^= IpsSeenReply
+			continue
+		case "[ASSURED]":
+			conn.Status |= IpsAssured
+			continue
+		case "[OFFLOAD]":
+			// Shown instead of [ASSURED].
+			conn.Status |= IpsOffload
+			continue
+		case "[HW_OFFLOAD]":
+			conn.Status |= IpsHwOffload | IpsOffload
+			continue
+		}
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return false, fmt.Errorf("unexpected field %q", field)
+		}
+		key, value := field[:i], field[i+1:]
+		if key == "src" {
+			if tuples++; tuples == 2 {
+				tuple, counters = &conn.Reply, &conn.ReplyCounters
+			} else if tuples > 2 {
+				return false, fmt.Errorf("more than two tuples in %q", line)
+			}
+		}
+		if err := parseProcfsField(key, value, family, now, conn, tuple, counters); err != nil {
+			return false, fmt.Errorf("invalid field %q: %v", field, err)
+		}
+	}
+	if tuples != 2 || conn.Orig.Dst == nil || conn.Reply.Dst == nil {
+		return false, fmt.Errorf("incomplete tuples in %q", line)
+	}
+	return true, nil
+}
+
+// parseProcfsField parses a key=value field of an entry into conn, tuple and counters being those
+// of the direction the field is in.
+func parseProcfsField(key, value string, family int, now time.Time, conn *ConntrackInfo, tuple *Tuple, counters *Counters) error {
+	var err error
+	switch key {
+	case "src":
+		tuple.Src, err = parseProcfsIP(value, family)
+	case "dst":
+		tuple.Dst, err = parseProcfsIP(value, family)
+	case "sport":
+		tuple.SrcPort, err = parseProcfsUint16(value)
+	case "dport":
+		tuple.DstPort, err = parseProcfsUint16(value)
+	case "type":
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 8)
+		tuple.IcmpType = uint8(v)
+	case "code":
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 8)
+		tuple.IcmpCode = uint8(v)
+	case "id":
+		tuple.IcmpId, err = parseProcfsUint16(value)
+	case "packets":
+		counters.Packets, err = strconv.ParseUint(value, 10, 64)
+	case "bytes":
+		counters.Bytes, err = strconv.ParseUint(value, 10, 64)
+	case "mark":
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 32)
+		conn.Mark = uint32(v)
+	case "zone":
+		conn.Zone, err = parseProcfsUint16(value)
+	case "use":
+		var v uint64
+		if v, err = strconv.ParseUint(value, 10, 32); err == nil && v > 0 {
+			// Counting the reference taken to print the entry, which netlink doesn't.
+			conn.Use = uint32(v - 1)
+		}
+	case "delta-time":
+		// Seconds since the entry was created, with nf_conntrack_timestamp.
+		var v uint64
+		if v, err = strconv.ParseUint(value, 10, 64); err == nil {
+			conn.StartTimestamp = uint64(now.Add(-time.Duration(v) * time.Second).UnixNano())
+		}
+	}
+	// Others, e.g. secctx or the zones of a single direction, aren't kept by the netlink parser
+	// either.
+	return err
+}
+
+func parseProcfsIP(s string, family int) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if family == syscall.AF_INET {
+		// Like the netlink parser, which gets 4 bytes.
+		ip = ip.To4()
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP of family %d", family)
+	}
+	return ip, nil
+}
+
+func parseProcfsUint16(s string) (uint16, error) {
+	v, err := strconv.ParseUint(s, 10, 16)
+	return uint16(v), err
+}
+
+// parseProcfsState sets the state of conn from its name.
+func parseProcfsState(name string, conn *ConntrackInfo) error {
+	switch conn.Proto {
+	case syscall.IPPROTO_TCP:
+		if name == "SYN_SENT2" {
+			// The kernel's name of state 9, LISTEN for libnetfilter_conntrack.
+			conn.TCPState = TCPState_LISTEN
+			return nil
+		}
+		for state, n := range tcpStateNames {
+			if n == name {
+				conn.TCPState = state
+				return nil
+			}
+		}
+	case syscall.IPPROTO_SCTP:
+		for state, n := range sctpStateNames {
+			if n == name {
+				conn.SCTPState = state
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unknown %s state %q", ProtocolName(conn.Proto), name)
+}
+
+// matches tells if the kernel would dump conn with filter f, see ctnetlink_filter_match. A nil
+// filter matches everything.
+func (f *DumpFilter) matches(conn ConntrackInfo) bool {
+	if f == nil {
+		return true
+	}
+	switch f.Family {
+	case syscall.AF_INET:
+		if conn.Orig.Src.To4() == nil {
+			return false
+		}
+	case syscall.AF_INET6:
+		if conn.Orig.Src.To4() != nil {
+			return false
+		}
+	}
+	if f.MarkMask != 0 && conn.Mark&f.MarkMask != f.Mark {
+		return false
+	}
+	if f.L4Proto != 0 && conn.Proto != int(f.L4Proto) {
+		return false
+	}
+	if f.Zone != 0 && conn.Zone != f.Zone {
+		return false
+	}
+	return true
+}
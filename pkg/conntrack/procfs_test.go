@@ -0,0 +1,152 @@
+package conntrack
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// procfsView clears the fields of conn /proc/net/nf_conntrack doesn't show.
+func procfsView(conn ConntrackInfo) ConntrackInfo {
+	conn.Id = 0
+	conn.StartTimestamp = 0
+	conn.Labels = nil
+	conn.Master = nil
+	conn.MasterProto = 0
+	conn.Status &= procfsStatus
+	return conn
+}
+
+func readProcfsTestdata(t *testing.T, now time.Time) []ConntrackInfo {
+	s := &procfsSource{path: filepath.Join("testdata", "nf_conntrack"), now: func() time.Time { return now }}
+	var conns []ConntrackInfo
+	err := s.Dump(nil, false, func(conn ConntrackInfo) error {
+		conns = append(conns, conn)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return conns
+}
+
+func TestProcfsMatchesNetlink(t *testing.T) {
+	now := time.Unix(1792307624, 0)
+	conns := readProcfsTestdata(t, now)
+	// testdata/nf_conntrack was read right after the dump of the captured entries, in the same
+	// order. The GRE one isn't supported.
+	captured := []string{"tcp_established", "udp6_zone", "ftp_control", "sctp_established", "tcp_related", "icmp_echo", "icmpv6_echo"}
+	if len(conns) != len(captured) {
+		t.Fatalf("expected %d entries, got %d", len(captured), len(conns))
+	}
+	for i, name := range captured {
+		expected, err := parseMessage(readMessage(t, filepath.Join("testdata", name+".nl")))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if got := procfsView(conns[i]); !reflect.DeepEqual(got, procfsView(*expected)) {
+			t.Errorf("%s: expected\n%+v\ngot\n%+v", name, procfsView(*expected), got)
+		}
+	}
+
+	if start := conns[0].Start(); !start.Equal(now.Add(-17 * time.Second)) {
+		t.Errorf("expected the start 17s before %v, got %v", now, start)
+	}
+	// The capture was made with nf_conntrack_acct and nf_conntrack_timestamp on, and the default
+	// nf_conntrack_icmp_timeout of 30s.
+	for _, conn := range conns {
+		if conn.OrigCounters.Packets == 0 || conn.ReplyCounters.Packets == 0 || conn.StartTimestamp == 0 {
+			t.Errorf("%s: expected counters and a start, got %+v", conn, conn)
+		}
+		if conn.IsICMP() && conn.Timeout > 30 {
+			t.Errorf("%s: expected an ICMP timeout of at most 30s, got %d", conn, conn.Timeout)
+		}
+	}
+}
+
+func TestParseProcfsLineOffload(t *testing.T) {
+	// Offloaded entries show no timeout, and [OFFLOAD] instead of [ASSURED].
+	line := "ipv4     2 sctp     132 ESTABLISHED src=10.0.0.5 dst=10.0.0.6 sport=5000 dport=36412 packets=2 bytes=96 src=10.0.0.6 dst=10.0.0.5 sport=36412 dport=5000 packets=2 bytes=100 [OFFLOAD] mark=0 zone=0 use=2"
+	var conn ConntrackInfo
+	if ok, err := parseProcfsLine(line, time.Now(), &conn); !ok || err != nil {
+		t.Fatalf("unexpected %v, %v", ok, err)
+	}
+	if conn.SCTPState != SCTPState_ESTABLISHED || conn.Status != IpsSeenReply|IpsConfirmed|IpsOffload || conn.Timeout != 0 {
+		t.Errorf("unexpected SCTP entry %s, state %s, status %s, timeout %d", conn, conn.SCTPState, conn.Status, conn.Timeout)
+	}
+}
+
+// Without events, ConnectionEvents gets the connections established since the previous call.
+func TestProcfsConnectionEvents(t *testing.T) {
+	s := &procfsSource{path: filepath.Join("testdata", "nf_conntrack"), now: time.Now}
+	c, err := NewWithSource(Config{FilterFunc: DefaultFilter}, s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+	if conns := c.ConnectionEvents(); len(conns) == 0 {
+		t.Errorf("expected the established connections, got none")
+	}
+	if conns := c.ConnectionEvents(); len(conns) != 0 {
+		t.Errorf("expected no new connection, got %v", conns)
+	}
+}
+
+func TestProcfsDumpFilter(t *testing.T) {
+	tests := []struct {
+		Filter   *DumpFilter
+		Expected int
+	}{
+		{Filter: &DumpFilter{}, Expected: 7},
+		{Filter: &DumpFilter{Family: syscall.AF_INET6}, Expected: 2},
+		{Filter: &DumpFilter{Family: syscall.AF_INET, L4Proto: syscall.IPPROTO_TCP}, Expected: 3},
+		{Filter: &DumpFilter{Mark: 0x4000, MarkMask: 0xc000}, Expected: 1},
+		{Filter: &DumpFilter{Zone: 3}, Expected: 1},
+	}
+	s := &procfsSource{path: filepath.Join("testdata", "nf_conntrack"), now: time.Now}
+	for _, test := range tests {
+		var n int
+		err := s.Dump(test.Filter, false, func(ConntrackInfo) error {
+			n++
+			return nil
+		})
+		if err != nil || n != test.Expected {
+			t.Errorf("%+v: expected %d entries, got %d, %v", *test.Filter, test.Expected, n, err)
+		}
+	}
+
+	if err := s.Dump(nil, true, func(ConntrackInfo) error { return nil }); err != errProcfsZero {
+		t.Errorf("expected %v, got %v", errProcfsZero, err)
+	}
+	if _, err := s.Follow(nil, false, 0); err != ErrNoEvents {
+		t.Errorf("expected %v, got %v", ErrNoEvents, err)
+	}
+}
+
+func TestParseProcfsLineMalformed(t *testing.T) {
+	tests := []struct {
+		Line  string
+		Error string
+	}{
+		{Line: "ipv4 2 tcp", Error: "too few fields"},
+		{Line: "ipv4 x tcp 6 299 ESTABLISHED", Error: "invalid family"},
+		{Line: "ipv4 2 tcp x 299", Error: "invalid protocol"},
+		{Line: "ipv4 2 tcp 6 299 OPEN src=10.0.0.5", Error: "unknown tcp state"},
+		{Line: "ipv4 2 udp 17 29 src=10.0.0.5 dst=10.0.0.6 sport=1 dport=2 [UNREPLIED] src=10.0.0.6 dst=10.0.0.5 sport=2 dport=1 nonsense", Error: "unexpected field"},
+		{Line: "ipv4 2 udp 17 29 src=fd00::1 dst=10.0.0.6 sport=1 dport=2 src=10.0.0.6 dst=10.0.0.5 sport=2 dport=1", Error: "not an IP of family 2"},
+		{Line: "ipv4 2 udp 17 29 src=10.0.0.5 dst=10.0.0.6 sport=65536 dport=2 src=10.0.0.6 dst=10.0.0.5 sport=2 dport=1", Error: "invalid field \"sport=65536\""},
+		{Line: "ipv4 2 udp 17 29 src=10.0.0.5 dst=10.0.0.6 sport=1 dport=2", Error: "incomplete tuples"},
+		{Line: "ipv4 2 udp 17 29 src=10.0.0.5 sport=1 dport=2 src=10.0.0.6 sport=2 dport=1", Error: "incomplete tuples"},
+		{Line: "ipv4 2 udp 17 29 src=10.0.0.5 dst=10.0.0.6 src=10.0.0.6 dst=10.0.0.5 src=10.0.0.7", Error: "more than two tuples"},
+	}
+	for _, test := range tests {
+		var conn ConntrackInfo
+		_, err := parseProcfsLine(test.Line, time.Now(), &conn)
+		if err == nil || !strings.Contains(err.Error(), test.Error) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.Line, test.Error, err)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A recording starts with recordingMagic, then holds records: a type byte, the time of the record
+// in nanoseconds since the epoch, the length of the payload, all big endian, and the payload.
+// The netlink messages in payloads are as read, in the byte order of the recording host.
+const recordingMagic = "K8SCTREC"
+
+const recordingVersion = 1
+
+type recordType uint8
+
+const (
+	// The recordingHeader, in JSON.
+	recordHeader recordType = iota + 1
+	// A dump starts: its id, uint32, what it is for, a dumpOrigin, and whether it zeroes counters.
+	recordDumpStart
+	// A message of a dump: the id of the dump, then the message.
+	recordDumpMessage
+	// A dump ended: its id, then the error it returned, empty if none.
+	recordDumpEnd
+	// An event message.
+	recordEvent
+	// Events were lost.
+	recordOverflow
+	// ConnectionEvents was called.
+	recordConnectionEvents
+	// Recorder.Call started: the length of the name, a byte, the name, then the payload.
+	recordCallStart
+	// Recorder.Call returned: the name.
+	recordCallEnd
+	// Recorder.Note: the length of the name, a byte, the name, then the payload.
+	recordNote
+)
+
+// The length of the frame of a record, before its payload.
+const recordFrameLen = 1 + 8 + 4
+
+// maxCallRecordLen is the longest payload of the records of calls and notes, e.g. the endpoints of
+// a cluster.
+const maxCallRecordLen = 64 << 20
+
+// maxRecordLen returns the longest payload of a record of type typ. A netlink message is read from
+// a single datagram, so a corrupt length doesn't make a replay allocate gigabytes.
+func maxRecordLen(typ recordType) int {
+	switch typ {
+	case recordDumpMessage:
+		return 4 + receiveBufferLen
+	case recordEvent:
+		return receiveBufferLen
+	}
+	return maxCallRecordLen
+}
+
+// recordingHeader describes a recording.
+type recordingHeader struct {
+	Version int `json:"version"`
+	// LittleEndian is the byte order of the host, and of the netlink headers.
+	LittleEndian bool `json:"littleEndian"`
+	// ZeroCounters is Config.ZeroCounters of the ConnTrack recorded.
+	ZeroCounters bool   `json:"zeroCounters"`
+	NetNS        string `json:"netns,omitempty"`
+}
+
+// dumpOrigin tells what a dump was for, so that a replay hands it to the same caller.
+type dumpOrigin uint8
+
+const (
+	// Dumps of other ConnTrack methods, which aren't replayed.
+	dumpOther dumpOrigin = iota
+	// The dumps of the established connections ConnectionEvents returns.
+	dumpTrack
+	// ListConntrackInfos.
+	dumpList
+	// ListAndZeroConntrackInfos.
+	dumpZero
+)
+
+// originSource is implemented by the sources telling dumps apart by what they are for.
+type originSource interface {
+	dumpFor(origin dumpOrigin, filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error
+}
+
+// connectionEventsSource is implemented by the sources that have to know when ConnectionEvents is
+// called. connectionEvents returns what call, which gets the connections, does.
+type connectionEventsSource interface {
+	connectionEvents(call func() []ConntrackInfo) []ConntrackInfo
+}
+
+// How often recorded events are flushed to the writer at most. Dumps, calls and notes are flushed
+// as they end.
+const recordFlushInterval = time.Second
+
+// Recorder writes the ctnetlink messages of the dumps and events a ConnTrack reads to a file, with
+// the time they were read at, so that they can be read again by a ReplaySource. Set it in
+// Config.Recorder; only the netlink source can be recorded.
+// A Recorder records a single ConnTrack. If writing fails, the error is logged and recording
+// stops.
+type Recorder struct {
+	// Protects the fields below.
+	mu        sync.Mutex
+	w         *bufio.Writer
+	err       error
+	started   bool
+	lastDump  uint32
+	lastFlush time.Time
+	// now returns the time of records, time.Now but in tests.
+	now func() time.Time
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: bufio.NewWriter(w), now: time.Now}
+}
+
+// start writes the beginning of a recording of a ConnTrack set up by config.
+func (r *Recorder) start(config Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return errors.New("Error recording conntrack: the recorder is in use")
+	}
+	r.started = true
+	header, err := json.Marshal(recordingHeader{
+		Version:      recordingVersion,
+		LittleEndian: isLittleEndian(),
+		ZeroCounters: config.ZeroCounters,
+		NetNS:        config.NetNS,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := r.w.WriteString(recordingMagic); err != nil {
+		return fmt.Errorf("Error recording conntrack: %v", err)
+	}
+	r.write(recordHeader, true, header)
+	return r.err
+}
+
+// write appends a record of type typ holding the concatenation of payload, flushing the writer if
+// flush or if it wasn't for a while. r.mu must be held.
+func (r *Recorder) write(typ recordType, flush bool, payload ...[]byte) {
+	if r.err != nil {
+		return
+	}
+	now := r.now()
+	var l int
+	for _, p := range payload {
+		l += len(p)
+	}
+	if l > maxRecordLen(typ) {
+		r.err = fmt.Errorf("record of type %d is %d bytes long, more than %d", typ, l, maxRecordLen(typ))
+		glog.Errorf("Error recording conntrack, recording stopped: %v", r.err)
+		return
+	}
+	var frame [recordFrameLen]byte
+	frame[0] = byte(typ)
+	binary.BigEndian.PutUint64(frame[1:9], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(frame[9:13], uint32(l))
+	_, err := r.w.Write(frame[:])
+	for _, p := range payload {
+		if err != nil {
+			break
+		}
+		_, err = r.w.Write(p)
+	}
+	if err == nil && (flush || now.Sub(r.lastFlush) >= recordFlushInterval) {
+		err = r.w.Flush()
+		r.lastFlush = now
+	}
+	if err != nil {
+		glog.Errorf("Error recording conntrack, recording stopped: %v", err)
+		r.err = err
+	}
+}
+
+// Flush writes the records buffered so far.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.w.Flush()
+}
+
+// Call records that call was made with payload, e.g. the endpoints handed to the collectors, makes
+// it and records that it returned. A replay makes call again and hands it the dumps and
+// ConnectionEvents calls recorded meanwhile, see ReplayHandler, so no others should be made
+// meanwhile but those the ConnTrack makes on its own.
+func (r *Recorder) Call(name string, payload []byte, call func()) {
+	r.mu.Lock()
+	r.write(recordCallStart, false, namePrefix(name), payload)
+	r.mu.Unlock()
+
+	call()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(recordCallEnd, true, []byte(name))
+}
+
+// Note records name and payload, e.g. to mark a point of the recording.
+func (r *Recorder) Note(name string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(recordNote, true, namePrefix(name), payload)
+}
+
+// namePrefix returns name preceded by its length, truncated to 255 bytes.
+func namePrefix(name string) []byte {
+	if len(name) > 0xff {
+		name = name[:0xff]
+	}
+	return append([]byte{byte(len(name))}, name...)
+}
+
+// dumpStart records the start of a dump and returns its id.
+func (r *Recorder) dumpStart(origin dumpOrigin, zero bool) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastDump++
+	var b [6]byte
+	binary.BigEndian.PutUint32(b[0:4], r.lastDump)
+	b[4] = byte(origin)
+	if zero {
+		b[5] = 1
+	}
+	r.write(recordDumpStart, false, b[:])
+	return r.lastDump
+}
+
+func (r *Recorder) dumpMessage(id uint32, msg syscall.NetlinkMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	r.write(recordDumpMessage, false, b[:], netlinkHeaderBytes(msg.Header), msg.Data)
+}
+
+func (r *Recorder) dumpEnd(id uint32, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	var text []byte
+	if err != nil {
+		text = []byte(err.Error())
+	}
+	r.write(recordDumpEnd, true, b[:], text)
+}
+
+func (r *Recorder) event(msg syscall.NetlinkMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(recordEvent, false, netlinkHeaderBytes(msg.Header), msg.Data)
+}
+
+func (r *Recorder) overflow() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(recordOverflow, false)
+}
+
+func (r *Recorder) connectionEvents() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(recordConnectionEvents, false)
+}
+
+// netlinkHeaderBytes returns h as read from a socket.
+func netlinkHeaderBytes(h syscall.NlMsghdr) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN)
+	binary.NativeEndian.PutUint32(b[0:4], h.Len)
+	binary.NativeEndian.PutUint16(b[4:6], h.Type)
+	binary.NativeEndian.PutUint16(b[6:8], h.Flags)
+	binary.NativeEndian.PutUint32(b[8:12], h.Seq)
+	binary.NativeEndian.PutUint32(b[12:16], h.Pid)
+	return b
+}
+
+// recordingSource is a netlink source recording what it reads.
+type recordingSource struct {
+	*netlinkSource
+	recorder *Recorder
+}
+
+func (s *recordingSource) Dump(filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	return s.dumpFor(dumpOther, filter, zero, callback)
+}
+
+func (s *recordingSource) dumpFor(origin dumpOrigin, filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	msgType := IpctnlMsgCtGet
+	if zero {
+		msgType = IpctnlMsgCtGetCtrzero
+	}
+	id := s.recorder.dumpStart(origin, zero)
+	parse := conntrackMessages(callback)
+	err := dumpConntrackMessages(s.requests, msgType, filter, func(msg syscall.NetlinkMessage) error {
+		s.recorder.dumpMessage(id, msg)
+		return parse(msg)
+	})
+	s.recorder.dumpEnd(id, err)
+	return err
+}
+
+func (s *recordingSource) Follow(filter *EventFilter, acceptDestroy bool, receiveBufferSize int) (EventReader, error) {
+	events, err := s.netlinkSource.Follow(filter, acceptDestroy, receiveBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingEvents{netlinkEvents: events.(netlinkEvents), recorder: s.recorder}, nil
+}
+
+func (s *recordingSource) connectionEvents(call func() []ConntrackInfo) []ConntrackInfo {
+	s.recorder.connectionEvents()
+	return call()
+}
+
+// recordingEvents reads events like netlinkEvents, recording them.
+type recordingEvents struct {
+	netlinkEvents
+	recorder *Recorder
+}
+
+func (e *recordingEvents) Read(callback func(ConntrackInfo) error) error {
+	parse := conntrackMessages(callback)
+	err := readNetlinkMessages(e.Socket, NFNL_SUBSYS_CTNETLINK, func(msg syscall.NetlinkMessage) error {
+		e.recorder.event(msg)
+		return parse(msg)
+	})
+	if errors.Is(err, syscall.ENOBUFS) {
+		e.recorder.overflow()
+	}
+	return err
+}
@@ -0,0 +1,353 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testRecording writes a recording whose records are at the times given.
+type testRecording struct {
+	t     *testing.T
+	buf   bytes.Buffer
+	r     *Recorder
+	start time.Time
+	now   time.Time
+}
+
+func newTestRecording(t *testing.T, config Config) *testRecording {
+	rec := &testRecording{t: t, start: time.Unix(1792307624, 0)}
+	rec.now = rec.start
+	rec.r = NewRecorder(&rec.buf)
+	rec.r.now = func() time.Time { return rec.now }
+	if err := rec.r.start(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return rec
+}
+
+// at returns the Recorder, recording at d after the start.
+func (rec *testRecording) at(d time.Duration) *Recorder {
+	rec.now = rec.start.Add(d)
+	return rec.r
+}
+
+func (rec *testRecording) message(b []byte) syscall.NetlinkMessage {
+	msg, err := parseRecordedMessage(b)
+	if err != nil {
+		rec.t.Fatalf("unexpected error: %v", err)
+	}
+	return *msg
+}
+
+// dump records a dump for origin of msgs at d, ending with err.
+func (rec *testRecording) dump(d time.Duration, origin dumpOrigin, err error, msgs ...[]byte) {
+	id := rec.at(d).dumpStart(origin, origin == dumpZero)
+	for _, msg := range msgs {
+		rec.r.dumpMessage(id, rec.message(msg))
+	}
+	rec.r.dumpEnd(id, err)
+}
+
+func (rec *testRecording) source() *ReplaySource {
+	if err := rec.r.Flush(); err != nil {
+		rec.t.Fatalf("unexpected error: %v", err)
+	}
+	s, err := NewReplaySource(bytes.NewReader(rec.buf.Bytes()))
+	if err != nil {
+		rec.t.Fatalf("unexpected error: %v", err)
+	}
+	return s
+}
+
+// established returns an established TCP connection from port.
+func established(port uint16) []byte {
+	return testEvent{
+		Type:     IpctnlMsgCtNew,
+		Proto:    syscall.IPPROTO_TCP,
+		Orig:     Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: port, Dst: net.ParseIP("10.0.0.6"), DstPort: 6379},
+		Reply:    Tuple{Src: net.ParseIP("10.0.0.6"), SrcPort: 6379, Dst: net.ParseIP("10.0.0.5"), DstPort: port},
+		Status:   IpsSeenReply | IpsAssured | IpsConfirmed,
+		TCPState: TCPState_ESTABLISHED,
+	}.bytes()
+}
+
+// testReplayHandler keeps what the calls it replays returned.
+type testReplayHandler struct {
+	c *ConnTrack
+	// The source ports of the connections of every call, and when they returned.
+	lists, events [][]int
+	listTimes     []time.Time
+	notes         []string
+	noteTimes     []time.Time
+}
+
+func ports(conns []ConntrackInfo) []int {
+	ports := []int{}
+	for _, conn := range conns {
+		ports = append(ports, int(conn.Orig.SrcPort))
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func (h *testReplayHandler) List() {
+	conns, err := h.c.ListConntrackInfos()
+	if err != nil {
+		h.lists = append(h.lists, nil)
+		return
+	}
+	h.lists = append(h.lists, ports(conns))
+	h.listTimes = append(h.listTimes, h.c.Now())
+}
+
+func (h *testReplayHandler) ConnectionEvents() {
+	h.events = append(h.events, ports(h.c.ConnectionEvents()))
+}
+
+func (h *testReplayHandler) Call(name string, payload []byte) {
+	h.notes = append(h.notes, "call "+name+" "+string(payload))
+	h.ConnectionEvents()
+}
+
+func (h *testReplayHandler) Note(name string, payload []byte) {
+	h.notes = append(h.notes, name+" "+string(payload))
+	h.noteTimes = append(h.noteTimes, h.c.Now())
+}
+
+func TestReplay(t *testing.T) {
+	rec := newTestRecording(t, Config{})
+	// The ConnTrack dumps the table as it starts, then follows it.
+	rec.dump(0, dumpTrack, nil, established(1001))
+	rec.at(time.Second).event(rec.message(established(1002)))
+	rec.at(2 * time.Second).connectionEvents()
+	// Events were lost and the table dumped again, with events read meanwhile.
+	rec.at(3 * time.Second).event(rec.message(established(1003)))
+	rec.at(3 * time.Second).overflow()
+	id := rec.at(3*time.Second).dumpStart(dumpTrack, false)
+	rec.r.event(rec.message(established(1004)))
+	rec.r.dumpMessage(id, rec.message(established(1005)))
+	rec.at(4*time.Second).dumpEnd(id, nil)
+	rec.at(5 * time.Second).connectionEvents()
+	// An interrupted dump, retried.
+	rec.dump(6*time.Second, dumpList, ErrDumpInterrupted, established(1001))
+	rec.dump(7*time.Second, dumpList, nil, established(1001), established(1005))
+	// A dump of something else, which isn't replayed.
+	rec.dump(8*time.Second, dumpOther, nil, established(1006))
+	rec.dump(9*time.Second, dumpList, nil, established(1005))
+	rec.at(10*time.Second).Call("call", []byte("payload"), func() {
+		rec.r.connectionEvents()
+	})
+	rec.at(11*time.Second).Note("note", []byte("payload"))
+
+	// Replays go the same way.
+	for i := 0; i < 10; i++ {
+		s := rec.source()
+		c, err := NewWithSource(Config{FilterFunc: DefaultFilter}, s)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		h := &testReplayHandler{c: c}
+		if err := s.Play(h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c.Close()
+
+		if expected := [][]int{{1001, 1002}, {1003, 1004, 1005}, {}}; !reflect.DeepEqual(h.events, expected) {
+			t.Errorf("expected the connection events %v, got %v", expected, h.events)
+		}
+		if expected := [][]int{{1001, 1005}, {1005}}; !reflect.DeepEqual(h.lists, expected) {
+			t.Errorf("expected the lists %v, got %v", expected, h.lists)
+		}
+		if expected := []time.Time{rec.start.Add(7 * time.Second), rec.start.Add(9 * time.Second)}; !reflect.DeepEqual(h.listTimes, expected) {
+			t.Errorf("expected the lists at %v, got %v", expected, h.listTimes)
+		}
+		if expected := []string{"call call payload", "note payload"}; !reflect.DeepEqual(h.notes, expected) {
+			t.Errorf("expected the calls and notes %q, got %q", expected, h.notes)
+		}
+		if expected := []time.Time{rec.start.Add(11 * time.Second)}; !reflect.DeepEqual(h.noteTimes, expected) {
+			t.Errorf("expected the note at %v, got %v", expected, h.noteTimes)
+		}
+		if stats := c.EventStats(); stats.Overflows != 1 || stats.Resyncs != 1 {
+			t.Errorf("expected an overflow and a resync, got %+v", stats)
+		}
+	}
+}
+
+// Every loss of events is followed by a dump of its own, when recording and when replaying.
+func TestReplayOverflows(t *testing.T) {
+	rec := newTestRecording(t, Config{})
+	rec.dump(0, dumpTrack, nil, established(1001))
+	rec.at(time.Second).overflow()
+	rec.r.overflow()
+	rec.dump(time.Second, dumpTrack, nil, established(1002))
+	rec.dump(2*time.Second, dumpTrack, nil, established(1003))
+	rec.at(3 * time.Second).connectionEvents()
+
+	for i := 0; i < 10; i++ {
+		s := rec.source()
+		c, err := NewWithSource(Config{FilterFunc: DefaultFilter}, s)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		h := &testReplayHandler{c: c}
+		if err := s.Play(h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c.Close()
+
+		if expected := [][]int{{1001, 1002, 1003}}; !reflect.DeepEqual(h.events, expected) {
+			t.Errorf("expected the connection events %v, got %v", expected, h.events)
+		}
+		if stats := c.EventStats(); stats.Overflows != 2 || stats.Resyncs != 2 {
+			t.Errorf("expected 2 overflows and resyncs, got %+v", stats)
+		}
+	}
+}
+
+func TestRecordNetlinkSource(t *testing.T) {
+	rec := newTestRecording(t, Config{})
+	r, closeFake := fakeRequestSockets(t, newFakeDump(dumpEntry(t), 3))
+	defer closeFake()
+	s := &recordingSource{netlinkSource: &netlinkSource{requests: r}, recorder: rec.r}
+
+	// The ConnTrack dumps the table as it starts.
+	if err := s.dumpFor(dumpTrack, nil, false, func(ConntrackInfo) error { return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var dumped []ConntrackInfo
+	err := s.dumpFor(dumpList, nil, false, func(conn ConntrackInfo) error {
+		dumped = append(dumped, conn)
+		return nil
+	})
+	if err != nil || len(dumped) != 3 {
+		t.Fatalf("expected 3 entries, got %d, %v", len(dumped), err)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("Error creating socket pair: %v", err)
+	}
+	defer syscall.Close(fds[0])
+	tv := syscall.NsecToTimeval(int64(10 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fds[1], syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := &recordingEvents{netlinkEvents: netlinkEvents{netlinkSocket(fds[1])}, recorder: rec.r}
+	defer events.Close()
+	if _, err := syscall.Write(fds[0], messageBytes(readMessage(t, filepath.Join("testdata", "new_event.nl")))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var followed []ConntrackInfo
+	err = events.Read(func(conn ConntrackInfo) error {
+		followed = append(followed, conn)
+		return nil
+	})
+	if !errors.Is(err, syscall.EAGAIN) || len(followed) != 1 {
+		t.Fatalf("expected an event then EAGAIN, got %d, %v", len(followed), err)
+	}
+	rec.at(time.Second).connectionEvents()
+
+	// The replay parses the same messages.
+	replay := rec.source()
+	c, err := NewWithSource(Config{FilterFunc: func(ConntrackInfo) bool { return true }}, replay)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+	var listed []ConntrackInfo
+	var replayed []ConntrackInfo
+	err = replay.Play(replayFuncs{
+		list:             func() { listed, _ = c.ListConntrackInfos() },
+		connectionEvents: func() { replayed = c.ConnectionEvents() },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(listed, dumped) {
+		t.Errorf("expected the dump\n%v\ngot\n%v", dumped, listed)
+	}
+	// The entries of the dump are the same connection, the new one isn't established yet.
+	if len(replayed) != 1 || !reflect.DeepEqual(replayed[0], dumped[0]) {
+		t.Errorf("expected the connection dumped, got %v", replayed)
+	}
+}
+
+// replayFuncs is a ReplayHandler made of functions.
+type replayFuncs struct {
+	list, connectionEvents func()
+}
+
+func (f replayFuncs) List()               { f.list() }
+func (f replayFuncs) ConnectionEvents()   { f.connectionEvents() }
+func (f replayFuncs) Call(string, []byte) {}
+func (f replayFuncs) Note(string, []byte) {}
+
+func TestReplaySourceMalformed(t *testing.T) {
+	if _, err := NewReplaySource(bytes.NewReader([]byte("not a recording"))); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// A recording cut in the middle of a record ends before it.
+	rec := newTestRecording(t, Config{ZeroCounters: true})
+	rec.at(time.Second).Note("note", nil)
+	rec.at(2*time.Second).Note("cut", []byte("short"))
+	rec.r.Flush()
+	b := rec.buf.Bytes()
+	s, err := NewReplaySource(bytes.NewReader(b[:len(b)-2]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !s.ZeroCounters() {
+		t.Errorf("expected the recorded ZeroCounters")
+	}
+	var notes []string
+	err = s.Play(noteFunc(func(name string) { notes = append(notes, name) }))
+	if err != nil || !reflect.DeepEqual(notes, []string{"note"}) {
+		t.Errorf("expected the first note, got %v, %v", notes, err)
+	}
+
+	// Records of unknown types are errors.
+	rec = newTestRecording(t, Config{})
+	rec.r.write(recordType(0xff), true)
+	if err := rec.source().Play(noteFunc(func(string) {})); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// So are lengths longer than a record of its type can be, which aren't allocated.
+	for _, l := range []uint32{receiveBufferLen + 1, 0xffffffff} {
+		rec = newTestRecording(t, Config{})
+		rec.r.Flush()
+		var frame [recordFrameLen]byte
+		frame[0] = byte(recordEvent)
+		binary.BigEndian.PutUint32(frame[9:13], l)
+		rec.buf.Write(frame[:])
+		rec.buf.Write(make([]byte, receiveBufferLen+1))
+		if err := rec.source().Play(noteFunc(func(string) {})); err == nil || !strings.Contains(err.Error(), "bytes long") {
+			t.Errorf("length %d: expected an error, got %v", l, err)
+		}
+	}
+
+	// The Recorder doesn't write them.
+	rec = newTestRecording(t, Config{})
+	rec.r.write(recordEvent, true, make([]byte, receiveBufferLen+1))
+	if err := rec.r.Flush(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// noteFunc is a ReplayHandler for recordings of notes only.
+type noteFunc func(name string)
+
+func (f noteFunc) List()                      {}
+func (f noteFunc) ConnectionEvents()          {}
+func (f noteFunc) Call(string, []byte)        {}
+func (f noteFunc) Note(name string, _ []byte) { f(name) }
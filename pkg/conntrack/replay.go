@@ -0,0 +1,632 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// SourceReplay is the name of a ReplaySource. It can't be set in Config.Source, see NewWithSource.
+const SourceReplay = "replay"
+
+// errNotRecorded is returned by the replayed dumps the recording doesn't have.
+var errNotRecorded = errors.New("dump not in the conntrack recording")
+
+// ReplayHandler makes again the calls of the ConnTrack a ReplaySource replays. Its methods are
+// called one at a time, and may wait for Play to get to the dumps they make.
+type ReplayHandler interface {
+	// List calls ListConntrackInfos, or ListAndZeroConntrackInfos with Config.ZeroCounters, like the
+	// caller of the recorded dump did, e.g. FlowCollector.TrackFlow.
+	List()
+	// ConnectionEvents calls ConnectionEvents, like the caller that was recorded.
+	ConnectionEvents()
+	// Call makes the call Recorder.Call recorded, given its name and payload.
+	Call(name string, payload []byte)
+	// Note is given the name and payload of a Recorder.Note once the calls before it returned. It
+	// mustn't dump the table or call ConnectionEvents.
+	Note(name string, payload []byte)
+}
+
+// ReplaySource is a Source reading a recording of a Recorder, for a ConnTrack made with
+// NewWithSource. Play feeds the recorded events to the ConnTrack and has a ReplayHandler make the
+// recorded calls of ListConntrackInfos, ListAndZeroConntrackInfos and ConnectionEvents again, in
+// the order of the recording: each gets the dumps and the events recorded for it, and Now returns
+// the time of the recording. Other dumps fail.
+type ReplaySource struct {
+	r      *bufio.Reader
+	header recordingHeader
+
+	// Dumps and ConnectionEvents calls waiting to be played.
+	dumps chan *replayDump
+	polls chan *replayPoll
+
+	events *replayEvents
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Protects time.
+	mu   sync.Mutex
+	time time.Time
+}
+
+// NewReplaySource returns a ReplaySource reading the recording in r.
+func NewReplaySource(r io.Reader) (*ReplaySource, error) {
+	s := &ReplaySource{
+		r:      bufio.NewReader(r),
+		dumps:  make(chan *replayDump),
+		polls:  make(chan *replayPoll),
+		events: newReplayEvents(),
+		closed: make(chan struct{}),
+	}
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(s.r, magic); err != nil || string(magic) != recordingMagic {
+		return nil, errors.New("Error reading conntrack recording: not a recording")
+	}
+	typ, t, payload, err := s.next()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading conntrack recording: %v", err)
+	}
+	if typ != recordHeader {
+		return nil, errors.New("Error reading conntrack recording: no header")
+	}
+	if err := json.Unmarshal(payload, &s.header); err != nil {
+		return nil, fmt.Errorf("Error reading conntrack recording header: %v", err)
+	}
+	if s.header.Version != recordingVersion {
+		return nil, fmt.Errorf("Error reading conntrack recording: unknown version %d", s.header.Version)
+	}
+	if s.header.LittleEndian != isLittleEndian() {
+		return nil, errors.New("Error reading conntrack recording: recorded on a host of another byte order")
+	}
+	s.time = t
+	return s, nil
+}
+
+// ZeroCounters is Config.ZeroCounters of the ConnTrack recorded, which the one replaying should
+// have.
+func (s *ReplaySource) ZeroCounters() bool {
+	return s.header.ZeroCounters
+}
+
+func (s *ReplaySource) Name() string {
+	return SourceReplay
+}
+
+func (s *ReplaySource) Dump(filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	return s.dumpFor(dumpOther, filter, zero, callback)
+}
+
+// dumpFor waits for Play to get to a dump for origin. The filter was applied when recording.
+func (s *ReplaySource) dumpFor(origin dumpOrigin, filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	if origin == dumpOther {
+		return errNotRecorded
+	}
+	d := &replayDump{origin: origin, items: make(chan replayItem)}
+	select {
+	case s.dumps <- d:
+	case <-s.closed:
+		return errClosed
+	}
+	parse := conntrackMessages(callback)
+	var err error
+	for {
+		select {
+		case item := <-d.items:
+			if item.msg == nil {
+				if err != nil {
+					return err
+				}
+				return item.err
+			}
+			// The rest of the dump is still played, and ignored.
+			if err == nil {
+				err = parse(*item.msg)
+			}
+		case <-s.closed:
+			return errClosed
+		}
+	}
+}
+
+// Follow returns the recorded events. They went through the filter of the recording already.
+func (s *ReplaySource) Follow(*EventFilter, bool, int) (EventReader, error) {
+	return s.events, nil
+}
+
+// connectionEvents waits for Play to get to a ConnectionEvents call to make call.
+func (s *ReplaySource) connectionEvents(call func() []ConntrackInfo) []ConntrackInfo {
+	p := &replayPoll{played: make(chan struct{}), returned: make(chan struct{})}
+	defer close(p.returned)
+	select {
+	case s.polls <- p:
+	case <-s.closed:
+		return nil
+	}
+	select {
+	case <-p.played:
+	case <-s.closed:
+		return nil
+	}
+	return call()
+}
+
+func (s *ReplaySource) now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.time
+}
+
+func (s *ReplaySource) setTime(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.time = t
+}
+
+// Close makes the dumps and calls waiting for Play fail.
+func (s *ReplaySource) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.events.Close()
+	})
+}
+
+// next reads the next record.
+func (s *ReplaySource) next() (recordType, time.Time, []byte, error) {
+	var frame [recordFrameLen]byte
+	if _, err := io.ReadFull(s.r, frame[:]); err != nil {
+		return 0, time.Time{}, nil, err
+	}
+	typ, l := recordType(frame[0]), binary.BigEndian.Uint32(frame[9:13])
+	if l > uint32(maxRecordLen(typ)) {
+		return 0, time.Time{}, nil, fmt.Errorf("record of type %d is %d bytes long, more than %d", typ, l, maxRecordLen(typ))
+	}
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, time.Time{}, nil, err
+	}
+	return typ, time.Unix(0, int64(binary.BigEndian.Uint64(frame[1:9]))), payload, nil
+}
+
+// Play replays the recording to its end, making the recorded calls with h. It returns once they
+// returned. A recording cut short, e.g. by a crash of its recorder, ends with its last complete
+// record.
+func (s *ReplaySource) Play(h ReplayHandler) error {
+	p := &replayer{source: s, handler: h, dumps: make(map[uint32]*replayDump)}
+	defer p.finishCall()
+	for {
+		typ, t, payload, err := s.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			glog.Warningf("Conntrack recording ends with a truncated record")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading conntrack recording: %v", err)
+		}
+		if err := p.play(typ, t, payload); err != nil {
+			return fmt.Errorf("Error replaying conntrack recording: %v", err)
+		}
+	}
+}
+
+// replayDump is a dump waiting for Play, which passes it the messages recorded, then an item
+// without message.
+type replayDump struct {
+	origin dumpOrigin
+	items  chan replayItem
+}
+
+// replayPoll is a ConnectionEvents call waiting for Play.
+type replayPoll struct {
+	// played is closed when the call can go on.
+	played chan struct{}
+	// returned is closed once it did.
+	returned chan struct{}
+}
+
+type replayItem struct {
+	msg *syscall.NetlinkMessage
+	// err is the error the dump returned.
+	err error
+}
+
+// replayCall is a call of the ReplayHandler.
+type replayCall struct {
+	done chan struct{}
+	// recorded is set for the calls of Recorder.Call, which make the dumps and ConnectionEvents
+	// calls recorded until they returned.
+	recorded bool
+}
+
+// replayer plays the records of a ReplaySource.
+type replayer struct {
+	source  *ReplaySource
+	handler ReplayHandler
+
+	// call is the last call made, until it returned.
+	call *replayCall
+	// The dumps being played by id, nil for those no one waited for.
+	dumps map[uint32]*replayDump
+	// Dumps and ConnectionEvents calls that came while waiting for others.
+	pendingDumps []*replayDump
+	pendingPolls []*replayPoll
+}
+
+func (p *replayer) play(typ recordType, t time.Time, payload []byte) error {
+	switch typ {
+	case recordDumpStart:
+		if len(payload) != 6 {
+			return errors.New("malformed dump start")
+		}
+		id, origin := binary.BigEndian.Uint32(payload[0:4]), dumpOrigin(payload[4])
+		var d *replayDump
+		switch origin {
+		case dumpTrack:
+			// The ConnTrack dumps as it starts, and once for every loss of events played.
+			d = p.waitDump(dumpTrack, nil)
+		case dumpList, dumpZero:
+			d = p.dumpOfCall(origin)
+		}
+		p.dumps[id] = d
+
+	case recordDumpMessage:
+		if len(payload) < 4 {
+			return errors.New("malformed dump message")
+		}
+		d := p.dumps[binary.BigEndian.Uint32(payload[0:4])]
+		if d == nil {
+			return nil
+		}
+		msg, err := parseRecordedMessage(payload[4:])
+		if err != nil {
+			return err
+		}
+		p.send(d, replayItem{msg: msg})
+
+	case recordDumpEnd:
+		if len(payload) < 4 {
+			return errors.New("malformed dump end")
+		}
+		id := binary.BigEndian.Uint32(payload[0:4])
+		d := p.dumps[id]
+		delete(p.dumps, id)
+		if d == nil {
+			return nil
+		}
+		var err error
+		switch text := string(payload[4:]); text {
+		case "":
+		case ErrDumpInterrupted.Error():
+			err = ErrDumpInterrupted
+		default:
+			err = errors.New(text)
+		}
+		if d.origin != dumpTrack {
+			// The time the caller reads once the dump returned.
+			p.source.setTime(t)
+		}
+		p.send(d, replayItem{err: err})
+
+	case recordEvent:
+		msg, err := parseRecordedMessage(payload)
+		if err != nil {
+			return err
+		}
+		p.source.events.push(msg)
+
+	case recordOverflow:
+		p.source.events.push(nil)
+
+	case recordConnectionEvents:
+		poll := p.pollOfCall()
+		if poll == nil {
+			return nil
+		}
+		p.waitEventsRead()
+		close(poll.played)
+		p.waitPolled(poll)
+
+	case recordCallStart, recordNote:
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return errors.New("malformed call")
+		}
+		name, payload := string(payload[1:1+payload[0]]), payload[1+payload[0]:]
+		p.finishCall()
+		p.source.setTime(t)
+		if typ == recordNote {
+			p.handler.Note(name, payload)
+			return nil
+		}
+		p.startCall(true, func() { p.handler.Call(name, payload) })
+
+	case recordCallEnd:
+		p.finishCall()
+
+	default:
+		return fmt.Errorf("unknown record type %d", typ)
+	}
+	return nil
+}
+
+// parseRecordedMessage parses a recorded netlink message.
+func parseRecordedMessage(b []byte) (*syscall.NetlinkMessage, error) {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil || len(msgs) != 1 {
+		return nil, fmt.Errorf("malformed netlink message: %v", err)
+	}
+	return &msgs[0], nil
+}
+
+// send passes item to d, unless the source is closed.
+func (p *replayer) send(d *replayDump, item replayItem) {
+	select {
+	case d.items <- item:
+	case <-p.source.closed:
+	}
+}
+
+// startCall calls f in its own goroutine.
+func (p *replayer) startCall(recorded bool, f func()) {
+	call := &replayCall{done: make(chan struct{}), recorded: recorded}
+	p.call = call
+	go func() {
+		defer close(call.done)
+		f()
+	}()
+}
+
+// finishCall waits for the last call to return. The dumps and ConnectionEvents calls it makes
+// meanwhile aren't in the recording: they fail, or get the events read so far.
+func (p *replayer) finishCall() {
+	if p.call == nil {
+		return
+	}
+	var track []*replayDump
+	for _, d := range p.pendingDumps {
+		if d.origin == dumpTrack {
+			track = append(track, d)
+		} else {
+			p.send(d, replayItem{err: errNotRecorded})
+		}
+	}
+	p.pendingDumps = track
+	for _, poll := range p.pendingPolls {
+		close(poll.played)
+	}
+	p.pendingPolls = nil
+	for {
+		select {
+		case <-p.call.done:
+			p.call = nil
+			return
+		case d := <-p.source.dumps:
+			if d.origin == dumpTrack {
+				p.pendingDumps = append(p.pendingDumps, d)
+			} else {
+				p.send(d, replayItem{err: errNotRecorded})
+			}
+		case poll := <-p.source.polls:
+			close(poll.played)
+		case <-p.source.closed:
+			return
+		}
+	}
+}
+
+// dumpOfCall returns the dump for origin of the running call, or of a new List call. It returns nil
+// if the recorded call making the dump didn't.
+func (p *replayer) dumpOfCall(origin dumpOrigin) *replayDump {
+	if p.call != nil {
+		// A dump retried, or one of a recorded call.
+		if d := p.waitDump(origin, p.call.done); d != nil || p.call.recorded {
+			return d
+		}
+		p.finishCall()
+	}
+	p.startCall(false, p.handler.List)
+	return p.waitDump(origin, p.call.done)
+}
+
+// pollOfCall is dumpOfCall for a ConnectionEvents call.
+func (p *replayer) pollOfCall() *replayPoll {
+	if p.call != nil {
+		if poll := p.waitPoll(p.call.done); poll != nil || p.call.recorded {
+			return poll
+		}
+		p.finishCall()
+	}
+	p.startCall(false, p.handler.ConnectionEvents)
+	return p.waitPoll(p.call.done)
+}
+
+// waitDump waits for a dump for origin until done is closed. It returns nil if none came.
+func (p *replayer) waitDump(origin dumpOrigin, done <-chan struct{}) *replayDump {
+	for i, d := range p.pendingDumps {
+		if d.origin == origin {
+			p.pendingDumps = append(p.pendingDumps[:i], p.pendingDumps[i+1:]...)
+			return d
+		}
+	}
+	for {
+		select {
+		case d := <-p.source.dumps:
+			if d.origin == origin {
+				return d
+			}
+			p.pendingDumps = append(p.pendingDumps, d)
+		case poll := <-p.source.polls:
+			p.pendingPolls = append(p.pendingPolls, poll)
+		case <-done:
+			return nil
+		case <-p.source.closed:
+			return nil
+		}
+	}
+}
+
+// waitPoll waits for a ConnectionEvents call until done is closed. It returns nil if none came.
+func (p *replayer) waitPoll(done <-chan struct{}) *replayPoll {
+	if len(p.pendingPolls) > 0 {
+		poll := p.pendingPolls[0]
+		p.pendingPolls = p.pendingPolls[1:]
+		return poll
+	}
+	for {
+		select {
+		case poll := <-p.source.polls:
+			return poll
+		case d := <-p.source.dumps:
+			p.pendingDumps = append(p.pendingDumps, d)
+		case <-done:
+			return nil
+		case <-p.source.closed:
+			return nil
+		}
+	}
+}
+
+// trackDumpPending tells if the ConnTrack waits for a dump, during which it doesn't read events
+// nor answer ConnectionEvents, like the one recorded didn't.
+func (p *replayer) trackDumpPending() bool {
+	for _, d := range p.pendingDumps {
+		if d.origin == dumpTrack {
+			return true
+		}
+	}
+	return false
+}
+
+// waitEventsRead waits for the events played so far to be read, so that a ConnectionEvents call
+// gets them, unless the ConnTrack waits for a dump.
+func (p *replayer) waitEventsRead() {
+	for {
+		if p.trackDumpPending() {
+			return
+		}
+		if p.source.events.allRead() {
+			return
+		}
+		select {
+		case <-p.source.events.read:
+		case d := <-p.source.dumps:
+			p.pendingDumps = append(p.pendingDumps, d)
+		case poll := <-p.source.polls:
+			p.pendingPolls = append(p.pendingPolls, poll)
+		case <-p.source.closed:
+			return
+		}
+	}
+}
+
+// waitPolled waits for the ConnectionEvents call poll to return, so that it doesn't get the events
+// played afterwards, unless the ConnTrack waits for a dump.
+func (p *replayer) waitPolled(poll *replayPoll) {
+	for !p.trackDumpPending() {
+		select {
+		case <-poll.returned:
+			return
+		case d := <-p.source.dumps:
+			p.pendingDumps = append(p.pendingDumps, d)
+		case poll := <-p.source.polls:
+			p.pendingPolls = append(p.pendingPolls, poll)
+		case <-p.source.closed:
+			return
+		}
+	}
+}
+
+// replayEvents is the EventReader of a ReplaySource: a queue of the events played, nil for a loss
+// of events.
+type replayEvents struct {
+	// Protects the fields below.
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*syscall.NetlinkMessage
+	unread int
+	closed bool
+	// read is signalled when all the events were read.
+	read chan struct{}
+}
+
+func newReplayEvents() *replayEvents {
+	e := &replayEvents{read: make(chan struct{}, 1)}
+	e.cond = sync.NewCond(&e.mu)
+	return e
+}
+
+func (e *replayEvents) push(msg *syscall.NetlinkMessage) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queue = append(e.queue, msg)
+	e.unread++
+	e.cond.Signal()
+}
+
+// allRead tells if every event pushed was passed to a callback.
+func (e *replayEvents) allRead() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.unread == 0
+}
+
+// Read passes the next event to callback once it is played. Like the sockets it returns EAGAIN if
+// none was for followWakeUp.
+func (e *replayEvents) Read(callback func(ConntrackInfo) error) error {
+	e.mu.Lock()
+	expired := false
+	timer := time.AfterFunc(followWakeUp, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		expired = true
+		e.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for len(e.queue) == 0 && !e.closed && !expired {
+		e.cond.Wait()
+	}
+	if e.closed || len(e.queue) == 0 {
+		e.mu.Unlock()
+		return fmt.Errorf("Error reading replayed events: %w", syscall.EAGAIN)
+	}
+	msg := e.queue[0]
+	e.queue = e.queue[1:]
+	e.mu.Unlock()
+
+	var err error
+	if msg == nil {
+		err = fmt.Errorf("Error reading replayed events: %w", syscall.ENOBUFS)
+	} else {
+		err = conntrackMessages(callback)(*msg)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.unread--; e.unread == 0 {
+		select {
+		case e.read <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+func (e *replayEvents) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.cond.Broadcast()
+}
@@ -0,0 +1,152 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Socket is a netfilter netlink socket, whose peer is the kernel, or a fake one in tests, see
+// package conntracktest.
+type Socket interface {
+	// Send sends a request to the kernel.
+	Send(p []byte) error
+	// Receive reads a datagram into b and returns its length. It returns an error wrapping
+	// syscall.EAGAIN when none came within the receive timeout, and one wrapping syscall.ENOBUFS
+	// when messages were lost because the receive buffer was full.
+	Receive(b []byte) (int, error)
+	// SetReceiveBufferSize sets the size in bytes of the buffer of the messages not read yet.
+	SetReceiveBufferSize(size int) error
+	// SetReceiveTimeout sets how long Receive waits, forever if 0.
+	SetReceiveTimeout(d time.Duration) error
+	// AttachFilter has prog, a classic BPF socket filter, drop messages before they are queued.
+	AttachFilter(prog []syscall.SockFilter) error
+	Close()
+}
+
+// Dialer opens the sockets of a ConnTrack.
+type Dialer interface {
+	// Dial opens a socket in the network namespace at netns, our own if empty, subscribed to the
+	// multicast groups, e.g. NF_NETLINK_CONNTRACK_NEW.
+	Dial(netns string, groups uint32) (Socket, error)
+}
+
+// Clock is implemented by the Dialers with a time of their own, like fake kernels, see ConnTrack.Now.
+type Clock interface {
+	Now() time.Time
+}
+
+// receiveBufferLen is the size of the buffers netlink messages are read into. The kernel fills
+// each dump reply up to the size of the buffer the reader last offered, at most 32KiB, so a
+// bigger buffer than a page means fewer reads for large tables.
+const receiveBufferLen = 32 * 1024
+
+// receiveBuffers are reused across reads, so following events and dumping large tables don't
+// allocate a buffer for every read. Parsers copy what they keep out of them.
+var receiveBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, receiveBufferLen)
+		return &b
+	},
+}
+
+// How many sockets a requestSockets keeps open while unused.
+const maxIdleRequestSockets = 2
+
+// errClosed is returned by requests made after the ConnTrack was closed.
+var errClosed = errors.New("conntrack is closed")
+
+// requestSockets are the netlink sockets requests to the kernel are sent on, in a network
+// namespace. Sockets are kept open once their reply was read completely, so that dumping every
+// second doesn't open a socket, nor enter the namespace, every time. Requests made concurrently
+// get sockets of their own.
+type requestSockets struct {
+	netns  string
+	dialer Dialer
+
+	// Protects idle and closed.
+	mu     sync.Mutex
+	idle   []Socket
+	closed bool
+}
+
+// newRequestSockets returns the requestSockets of the network namespace at netns, opened by dialer,
+// the kernel's if nil.
+func newRequestSockets(netns string, dialer Dialer) *requestSockets {
+	if dialer == nil {
+		dialer = kernelDialer{}
+	}
+	return &requestSockets{netns: netns, dialer: dialer}
+}
+
+// dial opens another socket in the network namespace of the requests, subscribed to groups.
+func (r *requestSockets) dial(groups uint32) (Socket, error) {
+	return r.dialer.Dial(r.netns, groups)
+}
+
+// request sends p, a request built by buildSubsysRequest, and passes the replies, which must come
+// from subsystem subsys, to callback. It returns like readNetlinkMessages.
+func (r *requestSockets) request(p []byte, subsys uint8, callback func(syscall.NetlinkMessage) error) error {
+	s, err := r.get()
+	if err != nil {
+		return err
+	}
+	if err := s.Send(p); err != nil {
+		s.Close()
+		return err
+	}
+	ended, err := readReply(s, subsys, callback)
+	if ended {
+		// Nothing of the reply is left to confuse the next request.
+		r.put(s)
+	} else {
+		s.Close()
+	}
+	return err
+}
+
+// get returns an idle socket, or a new one.
+func (r *requestSockets) get() (Socket, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, errClosed
+	}
+	if n := len(r.idle); n > 0 {
+		s := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return s, nil
+	}
+	r.mu.Unlock()
+
+	s, err := r.dial(0)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting Netfilter: %s", err)
+	}
+	return s, nil
+}
+
+// put keeps s for the next request, or closes it if enough sockets are kept already.
+func (r *requestSockets) put(s Socket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || len(r.idle) >= maxIdleRequestSockets {
+		s.Close()
+		return
+	}
+	r.idle = append(r.idle, s)
+}
+
+// close closes the idle sockets, and those in use once their request is done.
+func (r *requestSockets) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, s := range r.idle {
+		s.Close()
+	}
+	r.idle = nil
+}
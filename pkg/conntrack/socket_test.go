@@ -0,0 +1,181 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fakeDump answers every request read from its socket with a dump of entries copies of entry, in
+// datagrams of at most receiveBufferLen bytes, the way the kernel does. Built once, so that
+// serving doesn't count in the allocations of benchmarks.
+type fakeDump struct {
+	// batch is a full datagram of entries.
+	batch []byte
+	// batches is how many full datagrams come before last.
+	batches int
+	// last holds the remaining entries and the NLMSG_DONE.
+	last []byte
+}
+
+func newFakeDump(entry []byte, entries int) *fakeDump {
+	perBatch := receiveBufferLen / len(entry)
+	d := &fakeDump{batches: entries / perBatch}
+	for i := 0; i < perBatch; i++ {
+		d.batch = append(d.batch, entry...)
+	}
+	for i := 0; i < entries%perBatch; i++ {
+		d.last = append(d.last, entry...)
+	}
+	d.last = append(d.last, doneMessage()...)
+	return d
+}
+
+func doneMessage() []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN+4)
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], syscall.NLMSG_DONE)
+	binary.NativeEndian.PutUint16(b[6:8], syscall.NLM_F_MULTI)
+	return b
+}
+
+// serve answers requests on s until it is closed.
+func (d *fakeDump) serve(s int) {
+	req := make([]byte, 4096)
+	for {
+		if n, err := syscall.Read(s, req); err != nil || n == 0 {
+			return
+		}
+		for i := 0; i < d.batches; i++ {
+			if _, err := syscall.Write(s, d.batch); err != nil {
+				return
+			}
+		}
+		if _, err := syscall.Write(s, d.last); err != nil {
+			return
+		}
+	}
+}
+
+// dumpEntry returns a captured dump entry, a TCP connection.
+func dumpEntry(t testing.TB) []byte {
+	msg := readMessage(t, filepath.Join("testdata", "tcp_established.nl"))
+	msg.Header.Flags |= syscall.NLM_F_MULTI
+	return messageBytes(msg)
+}
+
+// messageBytes returns msg as read from a socket.
+func messageBytes(msg syscall.NetlinkMessage) []byte {
+	return append(netlinkHeaderBytes(msg.Header), msg.Data...)
+}
+
+// fakeConnTrack returns a ConnTrack dumping from r.
+func fakeConnTrack(r *requestSockets) *ConnTrack {
+	return &ConnTrack{filterFunc: all, requests: r, source: &netlinkSource{requests: r}}
+}
+
+// fakeRequestSockets returns requestSockets whose only socket is answered by d, and a function
+// closing the other end.
+func fakeRequestSockets(t testing.TB, d *fakeDump) (*requestSockets, func()) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Error creating socket pair: %v", err)
+	}
+	go d.serve(fds[1])
+	r := newRequestSockets("", nil)
+	r.idle = []Socket{netlinkSocket(fds[0])}
+	return r, func() {
+		r.close()
+		syscall.Close(fds[1])
+	}
+}
+
+func all(ConntrackInfo) bool { return true }
+
+func TestRequestSockets(t *testing.T) {
+	r, closeFake := fakeRequestSockets(t, newFakeDump(dumpEntry(t), 1000))
+	defer closeFake()
+	c := fakeConnTrack(r)
+
+	for i := 0; i < 3; i++ {
+		conns, err := c.list(dumpOther, nil, false, all)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(conns) != 1000 {
+			t.Errorf("expected 1000 entries, got %d", len(conns))
+		}
+		if conns[999].Orig.DstPort != 6379 || conns[999].Mark != 16384 {
+			t.Errorf("unexpected entry %s", conns[999])
+		}
+		if len(r.idle) != 1 {
+			t.Errorf("expected the socket to be kept after a complete dump, %d are idle", len(r.idle))
+		}
+	}
+
+	// Stopping halfway leaves the rest of the dump in the socket, which can't be reused.
+	stop := errors.New("stop")
+	var seen int
+	err := c.DumpAllConntrackInfos(func(ConntrackInfo) error {
+		if seen++; seen == 10 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("expected the error of the callback, got %v", err)
+	}
+	if seen != 10 {
+		t.Errorf("expected the dump to stop after 10 entries, got %d", seen)
+	}
+	if len(r.idle) != 0 {
+		t.Errorf("expected the socket to be closed after an incomplete dump, %d are idle", len(r.idle))
+	}
+}
+
+func TestRequestSocketsClosed(t *testing.T) {
+	r, closeFake := fakeRequestSockets(t, newFakeDump(dumpEntry(t), 1))
+	closeFake()
+	if _, err := fakeConnTrack(r).list(dumpOther, nil, false, all); err != errClosed {
+		t.Errorf("expected %v, got %v", errClosed, err)
+	}
+}
+
+func BenchmarkDump(b *testing.B) {
+	entry := dumpEntry(b)
+	for _, entries := range []int{100000, 1000000} {
+		d := newFakeDump(entry, entries)
+		b.Run(fmt.Sprintf("%d/list", entries), func(b *testing.B) {
+			r, closeFake := fakeRequestSockets(b, d)
+			defer closeFake()
+			c := fakeConnTrack(r)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.list(dumpOther, nil, false, all); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d/stream", entries), func(b *testing.B) {
+			r, closeFake := fakeRequestSockets(b, d)
+			defer closeFake()
+			c := fakeConnTrack(r)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var n int
+				err := c.DumpAllConntrackInfos(func(ConntrackInfo) error {
+					n++
+					return nil
+				})
+				if err != nil || n != entries {
+					b.Fatalf("dumped %d entries: %v", n, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Names of the sources of Config.Source.
+const (
+	// SourceNetlink reads the table and its events through ctnetlink sockets.
+	SourceNetlink = "netlink"
+	// SourceProcfs reads the table from /proc/net/nf_conntrack, for nodes denying netfilter
+	// netlink sockets. It has no events, and can't reset counters.
+	SourceProcfs = "procfs"
+	// SourceAuto is SourceNetlink if netlink requests go through, SourceProcfs otherwise.
+	SourceAuto = "auto"
+)
+
+// ErrNoEvents is returned by Follow when the source of the ConnTrack doesn't report the changes of
+// the table.
+var ErrNoEvents = errors.New("conntrack source has no events")
+
+// Source is where a ConnTrack reads the conntrack table from. Sources return the same
+// ConntrackInfo for an entry, as far as they see its fields.
+// Deleting and looking up entries, expectations and the per CPU stats need netlink whatever the
+// source.
+type Source interface {
+	// Name is the name of the source, e.g. SourceNetlink.
+	Name() string
+
+	// Dump passes the entries matching filter to callback as they are read, and stops at the first
+	// error callback returns. A nil filter dumps the whole table. With zero, the counters of the
+	// dumped entries are reset.
+	// If the table changed too much meanwhile for every entry to be seen once, the dump is read to
+	// the end and ErrDumpInterrupted returned.
+	Dump(filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error
+
+	// Follow subscribes to the changes of the table. Only the events filter selects are read, and
+	// every destroy event if acceptDestroy; a nil filter selects them all. receiveBufferSize is the
+	// size in bytes of the buffer of the events not read yet, 0 keeps the default.
+	// It returns ErrNoEvents if the source has none.
+	Follow(filter *EventFilter, acceptDestroy bool, receiveBufferSize int) (EventReader, error)
+
+	// Close releases the resources of the source. Requests made afterwards fail.
+	Close()
+}
+
+// How often the readers of events check if they were stopped while none comes.
+const followWakeUp = time.Second
+
+// EventReader reads the events a Source follows.
+type EventReader interface {
+	// Read waits for events and passes them to callback. It returns an error wrapping
+	// syscall.EAGAIN when none came for a while, so that readers can check if they should stop,
+	// and one wrapping syscall.ENOBUFS when events were lost.
+	Read(callback func(ConntrackInfo) error) error
+	Close()
+}
+
+// newSource returns the source called name, reading the table of the network namespace at netns.
+// The netlink source makes its requests on requests.
+func newSource(name, netns string, requests *requestSockets) (Source, error) {
+	switch name {
+	case "", SourceNetlink:
+		return &netlinkSource{requests: requests}, nil
+	case SourceProcfs:
+		return newProcfsSource(netns), nil
+	case SourceAuto:
+		// Netlink shows more of the entries, and has events.
+		err := getGlobalStats(requests, &KernelStats{})
+		if err == nil {
+			return &netlinkSource{requests: requests}, nil
+		}
+		procfs := newProcfsSource(netns)
+		if procfsErr := procfs.Dump(nil, false, func(ConntrackInfo) error { return errDone }); procfsErr != nil && procfsErr != errDone {
+			return nil, fmt.Errorf("Error finding a conntrack source: netlink: %v, procfs: %v", err, procfsErr)
+		}
+		glog.Warningf("Reading conntrack from %s, netlink isn't available: %v", procfsConntrackPath, err)
+		return procfs, nil
+	}
+	return nil, fmt.Errorf("unknown conntrack source %q", name)
+}
+
+// netlinkSource is the Source of SourceNetlink. Its sockets are opened by the dialer of its
+// requests.
+type netlinkSource struct {
+	requests *requestSockets
+}
+
+func (s *netlinkSource) Name() string {
+	return SourceNetlink
+}
+
+func (s *netlinkSource) Dump(filter *DumpFilter, zero bool, callback func(ConntrackInfo) error) error {
+	msgType := IpctnlMsgCtGet
+	if zero {
+		msgType = IpctnlMsgCtGetCtrzero
+	}
+	return dumpConntrackInfos(s.requests, msgType, filter, callback)
+}
+
+func (s *netlinkSource) Follow(filter *EventFilter, acceptDestroy bool, receiveBufferSize int) (EventReader, error) {
+	sock, err := s.requests.dial(NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_UPDATE | NF_NETLINK_CONNTRACK_DESTROY)
+	if err != nil {
+		return nil, err
+	}
+	if receiveBufferSize > 0 {
+		if err := sock.SetReceiveBufferSize(receiveBufferSize); err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	if filter != nil {
+		if err := attachEventFilter(sock, filter, acceptDestroy); err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	// Closing the socket doesn't wake up a blocked read, so wake up regularly to see if we stopped.
+	// Otherwise following a namespace without traffic would never end.
+	if err := sock.SetReceiveTimeout(followWakeUp); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return netlinkEvents{sock}, nil
+}
+
+// The requests sockets are closed by the ConnTrack, which makes other requests on them.
+func (s *netlinkSource) Close() {}
+
+// netlinkEvents is a socket subscribed to conntrack events.
+type netlinkEvents struct {
+	Socket
+}
+
+func (e netlinkEvents) Read(callback func(ConntrackInfo) error) error {
+	return readMessagesFromNetfilter(e.Socket, callback)
+}
@@ -0,0 +1,222 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Where the size of the table is read from if the kernel doesn't report it, and the number of
+// entries without netlink.
+const (
+	conntrackMaxPath   = "/proc/sys/net/netfilter/nf_conntrack_max"
+	conntrackCountPath = "/proc/sys/net/netfilter/nf_conntrack_count"
+)
+
+// KernelCounters are the counters the conntrack code of the kernel keeps, as shown by
+// conntrack -S. Packets the conntrack code drops are counted in InsertFailed, Drop and EarlyDrop.
+type KernelCounters struct {
+	// Packets of a known connection.
+	Found uint32 `json:"found"`
+	// Packets that couldn't be tracked, e.g. malformed or out of the TCP window.
+	Invalid uint32 `json:"invalid"`
+	// Connections added to the table.
+	Insert uint32 `json:"insert"`
+	// Connections that couldn't be added to the table, usually because of a race with another CPU.
+	InsertFailed uint32 `json:"insertFailed"`
+	// Packets dropped because a new connection couldn't be tracked, e.g. the table was full.
+	Drop uint32 `json:"drop"`
+	// Connections evicted to make room for new ones when the table was full.
+	EarlyDrop uint32 `json:"earlyDrop"`
+	// ICMP errors that couldn't be matched to a connection.
+	Error uint32 `json:"error"`
+	// Lookups restarted because the table was resized meanwhile.
+	SearchRestart uint32 `json:"searchRestart"`
+	// Insertion races resolved by merging with the existing connection, Linux 5.11+.
+	ClashResolve uint32 `json:"clashResolve"`
+	// Connections dropped because their hash chain was too long, Linux 5.14+.
+	ChainTooLong uint32 `json:"chainTooLong"`
+}
+
+func (k *KernelCounters) add(o KernelCounters) {
+	k.Found += o.Found
+	k.Invalid += o.Invalid
+	k.Insert += o.Insert
+	k.InsertFailed += o.InsertFailed
+	k.Drop += o.Drop
+	k.EarlyDrop += o.EarlyDrop
+	k.Error += o.Error
+	k.SearchRestart += o.SearchRestart
+	k.ClashResolve += o.ClashResolve
+	k.ChainTooLong += o.ChainTooLong
+}
+
+// CPUStats are the counters of a single CPU.
+type CPUStats struct {
+	CPU int `json:"cpu"`
+	KernelCounters
+}
+
+// KernelStats tells how full the conntrack table is and what the conntrack code did with packets.
+type KernelStats struct {
+	// Entries is the number of connections in the table, MaxEntries its size.
+	Entries    uint32 `json:"entries"`
+	MaxEntries uint32 `json:"maxEntries"`
+	// Total sums the counters of all CPUs.
+	Total KernelCounters `json:"total"`
+	CPUs  []CPUStats     `json:"cpus"`
+}
+
+// KernelStats queries the kernel for the table size and the per CPU counters.
+func (c *ConnTrack) KernelStats() (*KernelStats, error) {
+	entries, maxEntries, err := c.TableSize()
+	if err != nil {
+		return nil, err
+	}
+	stats := &KernelStats{Entries: entries, MaxEntries: maxEntries}
+
+	cpus, err := getCPUStats(c.requests)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting per CPU conntrack stats: %v", err)
+	}
+	stats.CPUs = cpus
+	for _, cpu := range cpus {
+		stats.Total.add(cpu.KernelCounters)
+	}
+	return stats, nil
+}
+
+// TableSize returns the number of entries in the table and how many it can hold.
+func (c *ConnTrack) TableSize() (entries, maxEntries uint32, err error) {
+	if c.source.Name() == SourceProcfs {
+		// Netlink is denied, the sysctls tell the same.
+		if entries, err = readConntrackSysctl(c.config.NetNS, conntrackCountPath); err != nil {
+			return 0, 0, err
+		}
+		if maxEntries, err = readConntrackSysctl(c.config.NetNS, conntrackMaxPath); err != nil {
+			return 0, 0, err
+		}
+		return entries, maxEntries, nil
+	}
+	stats := &KernelStats{}
+	if err := getGlobalStats(c.requests, stats); err != nil {
+		return 0, 0, fmt.Errorf("Error getting global conntrack stats: %v", err)
+	}
+	if stats.MaxEntries == 0 {
+		// Kernels before 5.2 don't report it.
+		max, err := readConntrackSysctl(c.config.NetNS, conntrackMaxPath)
+		if err != nil {
+			return 0, 0, err
+		}
+		stats.MaxEntries = max
+	}
+	return stats.Entries, stats.MaxEntries, nil
+}
+
+func getGlobalStats(requests *requestSockets, stats *KernelStats) error {
+	request := buildRequest(IpctnlMsgCtGetStats, syscall.NLM_F_ACK, syscall.AF_UNSPEC, nil)
+	return requests.request(request, NFNL_SUBSYS_CTNETLINK, func(msg syscall.NetlinkMessage) error {
+		return parseGlobalStats(msg, stats)
+	})
+}
+
+func parseGlobalStats(msg syscall.NetlinkMessage, stats *KernelStats) error {
+	payload, err := genmsgPayload(msg)
+	if err != nil {
+		return err
+	}
+	attrs, err := parseAttrs(payload)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch CtattrStatsGlobal(attr.Typ) {
+		case CtaStatsGlobalEntries:
+			stats.Entries, err = attr.uint32()
+		case CtaStatsGlobalMaxEntries:
+			stats.MaxEntries, err = attr.uint32()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getCPUStats(requests *requestSockets) ([]CPUStats, error) {
+	request := buildRequest(IpctnlMsgCtGetStatsCpu, syscall.NLM_F_DUMP, syscall.AF_UNSPEC, nil)
+	var cpus []CPUStats
+	err := requests.request(request, NFNL_SUBSYS_CTNETLINK, func(msg syscall.NetlinkMessage) error {
+		cpu, err := parseCPUStats(msg)
+		if err != nil {
+			return err
+		}
+		cpus = append(cpus, cpu)
+		return nil
+	})
+	return cpus, err
+}
+
+func parseCPUStats(msg syscall.NetlinkMessage) (CPUStats, error) {
+	payload, err := genmsgPayload(msg)
+	if err != nil {
+		return CPUStats{}, err
+	}
+	// The CPU is the resource id of the nfgenmsg.
+	cpu := CPUStats{CPU: int(binary.BigEndian.Uint16(msg.Data[2:4]))}
+	attrs, err := parseAttrs(payload)
+	if err != nil {
+		return CPUStats{}, err
+	}
+	for _, attr := range attrs {
+		v, err := attr.uint32()
+		if err != nil {
+			return CPUStats{}, err
+		}
+		switch CtattrStatsCpu(attr.Typ) {
+		case CtaStatsFound:
+			cpu.Found = v
+		case CtaStatsInvalid:
+			cpu.Invalid = v
+		case CtaStatsInsert:
+			cpu.Insert = v
+		case CtaStatsInsertFailed:
+			cpu.InsertFailed = v
+		case CtaStatsDrop:
+			cpu.Drop = v
+		case CtaStatsEarlyDrop:
+			cpu.EarlyDrop = v
+		case CtaStatsError:
+			cpu.Error = v
+		case CtaStatsSearchRestart:
+			cpu.SearchRestart = v
+		case CtaStatsClashResolve:
+			cpu.ClashResolve = v
+		case CtaStatsChainTooLong:
+			cpu.ChainTooLong = v
+		}
+	}
+	return cpu, nil
+}
+
+// readConntrackSysctl reads the conntrack sysctl at path of the network namespace at netns.
+func readConntrackSysctl(netns, path string) (uint32, error) {
+	var b []byte
+	// /proc/sys/net shows the namespace of whoever opens it.
+	err := inNetNS(netns, func() error {
+		var err error
+		b, err = ioutil.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,83 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// statsMessage returns a stats message of cpu with attrs, each a type and its payload.
+func statsMessage(cpu uint16, attrs ...interface{}) syscall.NetlinkMessage {
+	b := []byte{syscall.AF_UNSPEC, 0, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], cpu)
+	for i := 0; i < len(attrs); i += 2 {
+		payload := attrs[i+1].([]byte)
+		hdr := make([]byte, attrHdrLength)
+		binary.LittleEndian.PutUint16(hdr[0:2], uint16(attrHdrLength+len(payload)))
+		binary.LittleEndian.PutUint16(hdr[2:4], uint16(attrs[i].(int)))
+		b = append(b, hdr...)
+		b = append(b, payload...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	return syscall.NetlinkMessage{Data: b}
+}
+
+func counter(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func TestParseCPUStats(t *testing.T) {
+	tests := []struct {
+		Msg      syscall.NetlinkMessage
+		Expected CPUStats
+		Err      bool
+	}{
+		{
+			Msg: statsMessage(3, int(CtaStatsFound), counter(10), int(CtaStatsDrop), counter(2),
+				int(CtaStatsChainTooLong), counter(1)),
+			Expected: CPUStats{CPU: 3, KernelCounters: KernelCounters{Found: 10, Drop: 2, ChainTooLong: 1}},
+		},
+		// A counter this kernel doesn't know of is skipped.
+		{
+			Msg:      statsMessage(0, 100, counter(5), int(CtaStatsInsert), counter(4)),
+			Expected: CPUStats{KernelCounters: KernelCounters{Insert: 4}},
+		},
+		{Msg: statsMessage(0, int(CtaStatsFound), []byte{0, 1}), Err: true},
+		{Msg: syscall.NetlinkMessage{Data: []byte{syscall.AF_UNSPEC, 0}}, Err: true},
+	}
+	for i, test := range tests {
+		cpu, err := parseCPUStats(test.Msg)
+		if test.Err {
+			if err == nil {
+				t.Errorf("%d: expected an error, got %+v", i, cpu)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(cpu, test.Expected) {
+			t.Errorf("%d: expected %+v, got %+v", i, test.Expected, cpu)
+		}
+	}
+}
+
+func TestParseGlobalStats(t *testing.T) {
+	var stats KernelStats
+	msg := statsMessage(0, int(CtaStatsGlobalEntries), counter(120), int(CtaStatsGlobalMaxEntries), counter(65536))
+	if err := parseGlobalStats(msg, &stats); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Entries != 120 || stats.MaxEntries != 65536 {
+		t.Errorf("expected 120 entries of 65536, got %d of %d", stats.Entries, stats.MaxEntries)
+	}
+	if err := parseGlobalStats(statsMessage(0, int(CtaStatsGlobalEntries), []byte{}), &stats); err == nil {
+		t.Errorf("expected an error for an empty counter")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"k8s.io/kubernetes/pkg/api"
 
 	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/util"
 
 	"github.com/golang/glog"
 )
@@ -25,8 +26,11 @@ type FlowCollector struct {
 	endpointsSet map[string]bool
 
 	// A map keeps track of ConntrackInfo
-	// TODO: For POC: key is src:srcPort->dest:destPort#startTimestamp
+	// TODO: For POC: key is the reply tuple src:srcPort->dest:destPort/protocol#startTimestamp,
+	// with @zone before the # outside of the default zone.
 	conntrackInfoMap map[string]*conntrack.ConntrackInfo
+	// When the dump in conntrackInfoMap was taken.
+	lastSyncTime time.Time
 
 	// flows is a map, key is flow UID, value is Flow instance.
 	flows []*Flow
@@ -60,7 +64,7 @@ func (this *FlowCollector) OnEndpointsUpdate(allEndpoints []api.Endpoints) {
 			ss := &endpoints.Subsets[j]
 			for k := range ss.Addresses {
 				addr := &ss.Addresses[k]
-				this.endpointsSet[addr.IP] = true
+				this.endpointsSet[util.CanonicalIP(addr.IP)] = true
 			}
 		}
 	}
@@ -72,8 +76,29 @@ func keyFunc(info *conntrack.ConntrackInfo) string {
 	if info == nil {
 		return ""
 	}
-	return fmt.Sprintf("%s:%d->%s:%d#%d",
-		info.Src, info.SrcPort, info.Dst, info.DstPort, info.StartTimestamp)
+	// The same tuples can be in use in several zones at once.
+	var zone string
+	if info.Zone != 0 {
+		zone = fmt.Sprintf("@%d", info.Zone)
+	}
+	if info.IsICMP() {
+		// ICMP has no ports, the echo id tells different pings apart.
+		return fmt.Sprintf("%s->%s/%s:%d%s#%d",
+			info.Reply.Src, info.Reply.Dst, conntrack.ProtocolName(info.Proto), info.Reply.IcmpId, zone, info.StartTimestamp)
+	}
+	return fmt.Sprintf("%s->%s/%s%s#%d",
+		conntrack.HostPort(info.Reply.Src, info.Reply.SrcPort), conntrack.HostPort(info.Reply.Dst, info.Reply.DstPort),
+		conntrack.ProtocolName(info.Proto), zone, info.StartTimestamp)
+}
+
+// flowUIDs maps the Key of the connections of a dump to the UID of their flow, so that related
+// connections find the flow of their master.
+func flowUIDs(infos []conntrack.ConntrackInfo) map[string]string {
+	uids := make(map[string]string, len(infos))
+	for i := range infos {
+		uids[infos[i].Key()] = keyFunc(&infos[i])
+	}
+	return uids
 }
 
 func (this *FlowCollector) TrackFlow() {
@@ -85,16 +110,25 @@ func (this *FlowCollector) TrackFlow() {
 
 // Get valid ConntrackInfo from Conntrack and build Flow Objects.
 func (this *FlowCollector) syncConntrackInfo() {
+	if this.conntrack.ZeroCounters() {
+		this.syncZeroedConntrackInfo()
+		return
+	}
+
 	// Track flow
 	infos, err := this.conntrack.ListConntrackInfos()
 	if err != nil {
-		panic(err)
+		glog.Errorf("Error listing conntrack entries: %v", err)
+		return
 	}
+	// The whole dump is taken as read at the same time.
+	now := this.conntrack.Now()
 	if len(infos) < 1 {
 		glog.Infof("No Data")
 		return
 	}
 
+	masters := flowUIDs(infos)
 	// build flow based on connections
 	var currConntrackInfos map[string]*conntrack.ConntrackInfo = make(map[string]*conntrack.ConntrackInfo)
 	for _, i := range infos {
@@ -106,45 +140,169 @@ func (this *FlowCollector) syncConntrackInfo() {
 		info := i
 		key := keyFunc(&info)
 		currConntrackInfos[key] = &info
-		if prevInfo, exist := this.conntrackInfoMap[key]; exist {
-			bytesDiff := info.Bytes - prevInfo.Bytes
-			timeDiff := info.DeltaTime - prevInfo.DeltaTime
-			if timeDiff == 0 {
-				continue
-			}
-
-			flowValue := bytesDiff / timeDiff
-			flow := &Flow{
-				UID:                  key,
-				Src:                  info.Src,
-				Dst:                  info.Dst,
-				Value:                flowValue,
-				LastUpdatedTimestamp: uint64(time.Now().Unix()),
-			}
-			glog.V(4).Infof("Flow (UID: %s) between %s and %s is %d",
-				flow.UID, flow.Src, flow.Dst, flow.Value)
-			this.flows = append(this.flows, flow)
+		flow := buildFlow(key, &info, this.conntrackInfoMap[key], this.lastSyncTime, now)
+		if flow == nil {
+			continue
 		}
+		flow.Master = masters[info.MasterKey()]
+		glog.V(4).Infof("Flow (UID: %s) between %s and %s is %d (request %d, response %d)",
+			flow.UID, flow.Src, flow.Dst, flow.Value, flow.RequestValue, flow.ResponseValue)
+		this.flows = append(this.flows, flow)
 	}
 	this.conntrackInfoMap = currConntrackInfos
+	this.lastSyncTime = now
+}
+
+// syncZeroedConntrackInfo builds the flows from counters the kernel resets at every dump, so they
+// hold the traffic since the previous dump as they are. Connections destroyed in between come with
+// their final counters, so short ones are accounted for too.
+func (this *FlowCollector) syncZeroedConntrackInfo() {
+	infos, err := this.conntrack.ListAndZeroConntrackInfos()
+	if err != nil {
+		glog.Errorf("Error listing and zeroing conntrack entries: %v", err)
+		return
+	}
+	now := this.conntrack.Now()
+	defer func() {
+		this.lastSyncTime = now
+	}()
+	if len(infos) < 1 {
+		glog.Infof("No Data")
+		return
+	}
+
+	masters := flowUIDs(infos)
+	// A connection can be seen twice, e.g. by an interrupted dump or when destroyed right after it
+	// was dumped. Its traffic adds up.
+	var keys []string
+	deltas := make(map[string]*conntrack.ConntrackInfo)
+	for _, i := range infos {
+		if passed := this.flowConnectionFilterFunc(i); !passed {
+			continue
+		}
+
+		info := i
+		key := keyFunc(&info)
+		if d, exists := deltas[key]; exists {
+			d.OrigCounters.Packets += info.OrigCounters.Packets
+			d.OrigCounters.Bytes += info.OrigCounters.Bytes
+			d.ReplyCounters.Packets += info.ReplyCounters.Packets
+			d.ReplyCounters.Bytes += info.ReplyCounters.Bytes
+			continue
+		}
+		deltas[key] = &info
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		flow := buildDeltaFlow(key, deltas[key], this.lastSyncTime, now)
+		if flow == nil {
+			continue
+		}
+		flow.Master = masters[deltas[key].MasterKey()]
+		glog.V(4).Infof("Flow (UID: %s) between %s and %s is %d (request %d, response %d)",
+			flow.UID, flow.Src, flow.Dst, flow.Value, flow.RequestValue, flow.ResponseValue)
+		this.flows = append(this.flows, flow)
+	}
+}
+
+// buildFlow computes the throughput of a connection between the previous dump, taken at lastSync,
+// and the current one, taken at now. prev is the connection as seen in the previous dump, nil if it
+// wasn't there. A connection that started after the previous dump is measured from its kernel
+// start timestamp, not from lastSync.
+// It returns nil if the interval is unknown.
+func buildFlow(key string, info, prev *conntrack.ConntrackInfo, lastSync, now time.Time) *Flow {
+	requestBytes := info.OrigCounters.Bytes
+	responseBytes := info.ReplyCounters.Bytes
+	var elapsed time.Duration
+	switch {
+	case prev != nil:
+		elapsed = now.Sub(lastSync)
+		requestBytes = counterDelta(requestBytes, prev.OrigCounters.Bytes)
+		responseBytes = counterDelta(responseBytes, prev.ReplyCounters.Bytes)
+	case !lastSync.IsZero() && info.Start().After(lastSync):
+		// The connection is new since the previous dump, all its traffic belongs to this interval.
+		elapsed = info.Age(now)
+	}
+	return newFlow(key, info, requestBytes, responseBytes, elapsed, now)
+}
+
+// counterDelta returns how much a counter grew from prev to cur. A counter that went down was reset
+// since, e.g. zeroed by another process, and cur is what was counted after the reset.
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// buildDeltaFlow computes the throughput of a connection whose counters were zeroed by the previous
+// dump, taken at lastSync. The interval runs from lastSync, or the start of the connection if it is
+// younger, to now, or the end of the connection if it was destroyed since.
+// Before the first dump the counters hold the whole life of the connection.
+// It returns nil if the interval is unknown.
+func buildDeltaFlow(key string, info *conntrack.ConntrackInfo, lastSync, now time.Time) *Flow {
+	from, to := lastSync, now
+	if info.StartTimestamp != 0 {
+		if start := info.Start(); from.IsZero() || start.After(from) {
+			from = start
+		}
+		if info.StopTimestamp != 0 {
+			to = time.Unix(0, int64(info.StopTimestamp))
+		}
+	}
+	if from.IsZero() {
+		return nil
+	}
+	return newFlow(key, info, info.OrigCounters.Bytes, info.ReplyCounters.Bytes, to.Sub(from), now)
+}
+
+// newFlow returns the flow of a connection that transferred requestBytes and responseBytes
+// in elapsed, nil if elapsed isn't positive.
+func newFlow(key string, info *conntrack.ConntrackInfo, requestBytes, responseBytes uint64, elapsed time.Duration, now time.Time) *Flow {
+	if elapsed <= 0 {
+		return nil
+	}
+
+	requestValue := uint64(float64(requestBytes) / elapsed.Seconds())
+	responseValue := uint64(float64(responseBytes) / elapsed.Seconds())
+	return &Flow{
+		UID:                  key,
+		Src:                  info.Server(),
+		Dst:                  info.Client(),
+		Protocol:             conntrack.ProtocolName(info.Proto),
+		Zone:                 info.Zone,
+		Value:                requestValue + responseValue,
+		RequestValue:         requestValue,
+		ResponseValue:        responseValue,
+		LastUpdatedTimestamp: uint64(now.Unix()),
+	}
 }
 
 func (this *FlowCollector) flowConnectionFilterFunc(c conntrack.ConntrackInfo) bool {
+	switch {
+	case c.MsgType == conntrack.NfctMsgDestroy:
+		// Only returned when counters are zeroed, with the traffic since the last dump. A closed
+		// connection isn't ESTABLISHED anymore, it only has to have been replied.
+		if !c.Status.Has(conntrack.IpsSeenReply) {
+			return false
+		}
+
 	// Here we only care about updated info
-	if c.MsgType != conntrack.NfctMsgUpdate {
+	case c.MsgType != conntrack.NfctMsgUpdate:
 		glog.V(4).Infof("Message isn't an update: %d\n", c.MsgType)
 		return false
-	}
 
-	// As for updated info, we only care about ESTABLISHED for now.
-	if c.TCPState != conntrack.TCPState_ESTABLISHED {
+	// As for updated info, we only care about ESTABLISHED tcp/sctp and replied udp/icmp for now.
+	case !c.Established():
 		return false
 	}
 
 	// Additional filtering step.
 	{
-		src := c.Src.String()
-		dst := c.Dst.String()
+		// Use the real addresses of both pods, the ones before SNAT and after DNAT.
+		src := c.Server().String()
+		dst := c.Client().String()
 		_, srcPodLocal := this.endpointsSet[src]
 		_, dstPodLocal := this.endpointsSet[dst]
 
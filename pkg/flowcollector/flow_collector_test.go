@@ -2,23 +2,33 @@ package flowcollector
 
 import (
 	"net"
+	"syscall"
 	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
 
 	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack/conntracktest"
 )
 
+// FakeConnInfoBuilder builds ConntrackInfo. Src and Dst describe the reply tuple; unless WithOrig is
+// used the original tuple is its mirror image, i.e. the connection is not NATed.
 type FakeConnInfoBuilder struct {
 	MsgType        conntrack.NfConntrackEventType
 	Proto          int
+	Orig           *conntrack.Tuple
 	Src            net.IP
 	SrcPort        uint16
 	Dst            net.IP
 	DstPort        uint16
-	Packets        uint64
-	Bytes          uint64
+	OrigCounters   conntrack.Counters
+	ReplyCounters  conntrack.Counters
 	StartTimestamp uint64
-	DeltaTime      uint64
+	StopTimestamp  uint64
 	TCPState       conntrack.TCPState
+	Status         conntrack.ConntrackStatus
+	Zone           uint16
 }
 
 func NewFakeConnInfoBuilder() *FakeConnInfoBuilder {
@@ -35,6 +45,11 @@ func (this *FakeConnInfoBuilder) WithProto(p int) *FakeConnInfoBuilder {
 	return this
 }
 
+func (this *FakeConnInfoBuilder) WithOrig(orig conntrack.Tuple) *FakeConnInfoBuilder {
+	this.Orig = &orig
+	return this
+}
+
 func (this *FakeConnInfoBuilder) WithSrc(src net.IP) *FakeConnInfoBuilder {
 	this.Src = src
 	return this
@@ -55,13 +70,13 @@ func (this *FakeConnInfoBuilder) WithDstPort(dstPort uint16) *FakeConnInfoBuilde
 	return this
 }
 
-func (this *FakeConnInfoBuilder) WithPackets(p uint64) *FakeConnInfoBuilder {
-	this.Packets = p
+func (this *FakeConnInfoBuilder) WithOrigCounters(packets, bytes uint64) *FakeConnInfoBuilder {
+	this.OrigCounters = conntrack.Counters{Packets: packets, Bytes: bytes}
 	return this
 }
 
-func (this *FakeConnInfoBuilder) WithBytes(b uint64) *FakeConnInfoBuilder {
-	this.Bytes = b
+func (this *FakeConnInfoBuilder) WithReplyCounters(packets, bytes uint64) *FakeConnInfoBuilder {
+	this.ReplyCounters = conntrack.Counters{Packets: packets, Bytes: bytes}
 	return this
 }
 
@@ -75,24 +90,49 @@ func (this *FakeConnInfoBuilder) WithTCPState(state conntrack.TCPState) *FakeCon
 	return this
 }
 
-func (this *FakeConnInfoBuilder) WithDeltaTime(dtime uint64) *FakeConnInfoBuilder {
-	this.DeltaTime = dtime
+func (this *FakeConnInfoBuilder) WithStatus(status conntrack.ConntrackStatus) *FakeConnInfoBuilder {
+	this.Status = status
+	return this
+}
+
+func (this *FakeConnInfoBuilder) WithStopTimestamp(ts uint64) *FakeConnInfoBuilder {
+	this.StopTimestamp = ts
+	return this
+}
+
+func (this *FakeConnInfoBuilder) WithZone(zone uint16) *FakeConnInfoBuilder {
+	this.Zone = zone
 	return this
 }
 
 func (this *FakeConnInfoBuilder) Build() *conntrack.ConntrackInfo {
+	reply := conntrack.Tuple{
+		Src:     this.Src,
+		SrcPort: this.SrcPort,
+		Dst:     this.Dst,
+		DstPort: this.DstPort,
+	}
+	orig := conntrack.Tuple{
+		Src:     this.Dst,
+		SrcPort: this.DstPort,
+		Dst:     this.Src,
+		DstPort: this.SrcPort,
+	}
+	if this.Orig != nil {
+		orig = *this.Orig
+	}
 	return &conntrack.ConntrackInfo{
 		MsgType:        this.MsgType,
 		Proto:          this.Proto,
-		Src:            this.Src,
-		SrcPort:        this.SrcPort,
-		Dst:            this.Dst,
-		DstPort:        this.DstPort,
-		Packets:        this.Packets,
-		Bytes:          this.Bytes,
+		Orig:           orig,
+		Reply:          reply,
+		OrigCounters:   this.OrigCounters,
+		ReplyCounters:  this.ReplyCounters,
 		StartTimestamp: this.StartTimestamp,
-		DeltaTime:      this.DeltaTime,
+		StopTimestamp:  this.StopTimestamp,
 		TCPState:       this.TCPState,
+		Status:         this.Status,
+		Zone:           this.Zone,
 	}
 }
 
@@ -104,6 +144,7 @@ func TestKeyFunc(t *testing.T) {
 		DstIP       string
 		DstPort     uint16
 		Timestamp   uint64
+		Zone        uint16
 		ExpectedKey string
 	}{
 		{
@@ -112,8 +153,28 @@ func TestKeyFunc(t *testing.T) {
 			SrcPort:     10,
 			DstIP:       "183.123.12.2",
 			DstPort:     8080,
-			Timestamp:   1471017354,
-			ExpectedKey: "10.2.3.123:10->183.123.12.2:8080#1471017354",
+			Timestamp:   1471017354123456789,
+			ExpectedKey: "10.2.3.123:10->183.123.12.2:8080/tcp#1471017354123456789",
+		},
+		{
+			HasData:     true,
+			SrcIP:       "fd00:10:2::7b",
+			SrcPort:     10,
+			DstIP:       "fd00:183::2",
+			DstPort:     8080,
+			Timestamp:   1471017354123456789,
+			ExpectedKey: "[fd00:10:2::7b]:10->[fd00:183::2]:8080/tcp#1471017354123456789",
+		},
+		{
+			// The same tuples in another zone are another connection.
+			HasData:     true,
+			SrcIP:       "10.2.3.123",
+			SrcPort:     10,
+			DstIP:       "183.123.12.2",
+			DstPort:     8080,
+			Timestamp:   1471017354123456789,
+			Zone:        3,
+			ExpectedKey: "10.2.3.123:10->183.123.12.2:8080/tcp@3#1471017354123456789",
 		},
 		{
 			HasData:     false,
@@ -126,7 +187,7 @@ func TestKeyFunc(t *testing.T) {
 		if test.HasData {
 			srcIP := net.ParseIP(test.SrcIP)
 			dstIP := net.ParseIP(test.DstIP)
-			connInfo = NewFakeConnInfoBuilder().WithSrc(srcIP).WithSrcPort(test.SrcPort).WithDst(dstIP).WithDstPort(test.DstPort).WithStartTimestamp(test.Timestamp).Build()
+			connInfo = NewFakeConnInfoBuilder().WithProto(syscall.IPPROTO_TCP).WithSrc(srcIP).WithSrcPort(test.SrcPort).WithDst(dstIP).WithDstPort(test.DstPort).WithStartTimestamp(test.Timestamp).WithZone(test.Zone).Build()
 		}
 		key := keyFunc(connInfo)
 		if test.ExpectedKey != key {
@@ -138,15 +199,18 @@ func TestKeyFunc(t *testing.T) {
 func TestFlowConnectionFilterFunc(t *testing.T) {
 	tests := []struct {
 		MsgType              conntrack.NfConntrackEventType
+		Proto                int
 		SrcIP                net.IP
 		IncludeSrcIP         bool
 		DstIP                net.IP
 		IncludeDstIP         bool
 		TCPState             conntrack.TCPState
+		Status               conntrack.ConntrackStatus
 		ExpectedFilterResult bool
 	}{
 		{
 			MsgType:              conntrack.NfctMsgUpdate,
+			Proto:                syscall.IPPROTO_TCP,
 			SrcIP:                net.ParseIP("10.0.0.3"),
 			IncludeSrcIP:         true,
 			DstIP:                net.ParseIP("10.0.0.6"),
@@ -156,6 +220,7 @@ func TestFlowConnectionFilterFunc(t *testing.T) {
 		},
 		{
 			MsgType:              conntrack.NfctMsgUnknown,
+			Proto:                syscall.IPPROTO_TCP,
 			SrcIP:                net.ParseIP("10.0.0.3"),
 			IncludeSrcIP:         true,
 			DstIP:                net.ParseIP("10.0.0.6"),
@@ -165,6 +230,7 @@ func TestFlowConnectionFilterFunc(t *testing.T) {
 		},
 		{
 			MsgType:              conntrack.NfctMsgUpdate,
+			Proto:                syscall.IPPROTO_TCP,
 			SrcIP:                net.ParseIP("10.0.0.3"),
 			IncludeSrcIP:         false,
 			DstIP:                net.ParseIP("10.0.0.6"),
@@ -174,6 +240,7 @@ func TestFlowConnectionFilterFunc(t *testing.T) {
 		},
 		{
 			MsgType:              conntrack.NfctMsgUpdate,
+			Proto:                syscall.IPPROTO_TCP,
 			SrcIP:                net.ParseIP("10.0.0.3"),
 			IncludeSrcIP:         true,
 			DstIP:                net.ParseIP("10.0.0.6"),
@@ -183,6 +250,7 @@ func TestFlowConnectionFilterFunc(t *testing.T) {
 		},
 		{
 			MsgType:              conntrack.NfctMsgUpdate,
+			Proto:                syscall.IPPROTO_TCP,
 			SrcIP:                net.ParseIP("10.0.0.3"),
 			IncludeSrcIP:         true,
 			DstIP:                net.ParseIP("10.0.0.6"),
@@ -190,11 +258,51 @@ func TestFlowConnectionFilterFunc(t *testing.T) {
 			TCPState:             conntrack.TCPState_NONE,
 			ExpectedFilterResult: false,
 		},
+		{
+			MsgType:              conntrack.NfctMsgUpdate,
+			Proto:                syscall.IPPROTO_UDP,
+			SrcIP:                net.ParseIP("10.0.0.3"),
+			IncludeSrcIP:         true,
+			DstIP:                net.ParseIP("10.0.0.6"),
+			IncludeDstIP:         true,
+			Status:               conntrack.IpsSeenReply,
+			ExpectedFilterResult: true,
+		},
+		{
+			MsgType:              conntrack.NfctMsgUpdate,
+			Proto:                syscall.IPPROTO_UDP,
+			SrcIP:                net.ParseIP("10.0.0.3"),
+			IncludeSrcIP:         true,
+			DstIP:                net.ParseIP("10.0.0.6"),
+			IncludeDstIP:         true,
+			ExpectedFilterResult: false,
+		},
+		{
+			MsgType:              conntrack.NfctMsgDestroy,
+			Proto:                syscall.IPPROTO_TCP,
+			SrcIP:                net.ParseIP("10.0.0.3"),
+			IncludeSrcIP:         true,
+			DstIP:                net.ParseIP("10.0.0.6"),
+			IncludeDstIP:         true,
+			TCPState:             conntrack.TCPState_TIME_WAIT,
+			Status:               conntrack.IpsSeenReply | conntrack.IpsAssured,
+			ExpectedFilterResult: true,
+		},
+		{
+			MsgType:              conntrack.NfctMsgDestroy,
+			Proto:                syscall.IPPROTO_TCP,
+			SrcIP:                net.ParseIP("10.0.0.3"),
+			IncludeSrcIP:         true,
+			DstIP:                net.ParseIP("10.0.0.6"),
+			IncludeDstIP:         true,
+			TCPState:             conntrack.TCPState_SYN_SENT,
+			ExpectedFilterResult: false,
+		},
 	}
 
 	for _, test := range tests {
 		flowCollector := NewFlowCollector(nil)
-		connInfo := NewFakeConnInfoBuilder().WithMsgType(test.MsgType).WithSrc(test.SrcIP).WithDst(test.DstIP).WithTCPState(test.TCPState).Build()
+		connInfo := NewFakeConnInfoBuilder().WithMsgType(test.MsgType).WithProto(test.Proto).WithSrc(test.SrcIP).WithDst(test.DstIP).WithTCPState(test.TCPState).WithStatus(test.Status).Build()
 		if test.IncludeSrcIP {
 			flowCollector.endpointsSet[test.SrcIP.String()] = true
 		}
@@ -207,3 +315,295 @@ func TestFlowConnectionFilterFunc(t *testing.T) {
 		}
 	}
 }
+
+func TestFlowConnectionFilterFuncWithNAT(t *testing.T) {
+	podA := net.ParseIP("10.0.0.3")
+	podB := net.ParseIP("10.0.0.6")
+	clusterIP := net.ParseIP("10.96.0.10")
+	nodeIP := net.ParseIP("192.168.1.5")
+
+	tests := []struct {
+		Orig                 conntrack.Tuple
+		ReplySrc             net.IP
+		ReplyDst             net.IP
+		ExpectedFilterResult bool
+	}{
+		{
+			// podA dials a ClusterIP served by podB.
+			Orig:                 conntrack.Tuple{Src: podA, SrcPort: 40000, Dst: clusterIP, DstPort: 80},
+			ReplySrc:             podB,
+			ReplyDst:             podA,
+			ExpectedFilterResult: true,
+		},
+		{
+			// Same, but podA is masqueraded to the node address.
+			Orig:                 conntrack.Tuple{Src: podA, SrcPort: 40000, Dst: clusterIP, DstPort: 80},
+			ReplySrc:             podB,
+			ReplyDst:             nodeIP,
+			ExpectedFilterResult: true,
+		},
+		{
+			// The node itself dials podB.
+			Orig:                 conntrack.Tuple{Src: nodeIP, SrcPort: 40000, Dst: clusterIP, DstPort: 80},
+			ReplySrc:             podB,
+			ReplyDst:             nodeIP,
+			ExpectedFilterResult: false,
+		},
+	}
+
+	for _, test := range tests {
+		flowCollector := NewFlowCollector(nil)
+		flowCollector.endpointsSet[podA.String()] = true
+		flowCollector.endpointsSet[podB.String()] = true
+		connInfo := NewFakeConnInfoBuilder().WithMsgType(conntrack.NfctMsgUpdate).WithProto(syscall.IPPROTO_TCP).
+			WithOrig(test.Orig).WithSrc(test.ReplySrc).WithSrcPort(80).WithDst(test.ReplyDst).WithDstPort(40000).
+			WithTCPState(conntrack.TCPState_ESTABLISHED).Build()
+		filterResult := flowCollector.flowConnectionFilterFunc(*connInfo)
+		if filterResult != test.ExpectedFilterResult {
+			t.Errorf("Expected filterFunc result %t for %s, got %t", test.ExpectedFilterResult, connInfo, filterResult)
+		}
+	}
+}
+
+func TestBuildFlow(t *testing.T) {
+	lastSync := time.Unix(1471017300, 0)
+	now := lastSync.Add(2 * time.Second)
+	ns := func(t time.Time) uint64 { return uint64(t.UnixNano()) }
+
+	tests := []struct {
+		Info                  *conntrack.ConntrackInfo
+		Prev                  *conntrack.ConntrackInfo
+		ExpectFlow            bool
+		ExpectedRequestValue  uint64
+		ExpectedResponseValue uint64
+	}{
+		{
+			// Seen in both dumps.
+			Info:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Minute))).WithOrigCounters(10, 3000).WithReplyCounters(10, 5000).Build(),
+			Prev:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Minute))).WithOrigCounters(5, 1000).WithReplyCounters(5, 1000).Build(),
+			ExpectFlow:            true,
+			ExpectedRequestValue:  1000,
+			ExpectedResponseValue: 2000,
+		},
+		{
+			// Started half a second before the current dump.
+			Info:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(now.Add(-500*time.Millisecond))).WithOrigCounters(1, 100).WithReplyCounters(1, 400).Build(),
+			ExpectFlow:            true,
+			ExpectedRequestValue:  200,
+			ExpectedResponseValue: 800,
+		},
+		{
+			// Started before the previous dump but not seen in it, e.g. filtered out.
+			Info:       NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Second))).WithOrigCounters(1, 100).Build(),
+			ExpectFlow: false,
+		},
+		{
+			// No timestamps, fall back to the time between dumps.
+			Info:                  NewFakeConnInfoBuilder().WithOrigCounters(2, 600).WithReplyCounters(2, 600).Build(),
+			Prev:                  NewFakeConnInfoBuilder().WithOrigCounters(1, 200).WithReplyCounters(1, 200).Build(),
+			ExpectFlow:            true,
+			ExpectedRequestValue:  200,
+			ExpectedResponseValue: 200,
+		},
+		{
+			// The counters were zeroed since the previous dump, what they hold now is new.
+			Info:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Minute))).WithOrigCounters(1, 400).WithReplyCounters(5, 3000).Build(),
+			Prev:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Minute))).WithOrigCounters(5, 1000).WithReplyCounters(5, 1000).Build(),
+			ExpectFlow:            true,
+			ExpectedRequestValue:  200,
+			ExpectedResponseValue: 1000,
+		},
+		{
+			// Stopped between the dumps.
+			Info:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Minute))).WithStopTimestamp(ns(now.Add(-time.Second))).WithOrigCounters(10, 3000).WithReplyCounters(10, 3000).Build(),
+			Prev:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Minute))).WithOrigCounters(5, 1000).WithReplyCounters(5, 1000).Build(),
+			ExpectFlow:            true,
+			ExpectedRequestValue:  1000,
+			ExpectedResponseValue: 1000,
+		},
+	}
+
+	for i, test := range tests {
+		flow := buildFlow("key", test.Info, test.Prev, lastSync, now)
+		if (flow != nil) != test.ExpectFlow {
+			t.Errorf("Test %d: expected flow %t, got %++v", i, test.ExpectFlow, flow)
+			continue
+		}
+		if flow == nil {
+			continue
+		}
+		if flow.RequestValue != test.ExpectedRequestValue || flow.ResponseValue != test.ExpectedResponseValue {
+			t.Errorf("Test %d: expected request/response %d/%d, got %d/%d", i,
+				test.ExpectedRequestValue, test.ExpectedResponseValue, flow.RequestValue, flow.ResponseValue)
+		}
+		if flow.Value != flow.RequestValue+flow.ResponseValue {
+			t.Errorf("Test %d: expected value %d, got %d", i, flow.RequestValue+flow.ResponseValue, flow.Value)
+		}
+	}
+}
+
+func TestBuildDeltaFlow(t *testing.T) {
+	lastSync := time.Unix(1471017300, 0)
+	now := lastSync.Add(2 * time.Second)
+	ns := func(t time.Time) uint64 { return uint64(t.UnixNano()) }
+
+	tests := []struct {
+		Info                  *conntrack.ConntrackInfo
+		LastSync              time.Time
+		ExpectFlow            bool
+		ExpectedRequestValue  uint64
+		ExpectedResponseValue uint64
+	}{
+		{
+			// Zeroed by the previous dump.
+			Info:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(lastSync.Add(-time.Minute))).WithOrigCounters(5, 2000).WithReplyCounters(5, 4000).Build(),
+			LastSync:              lastSync,
+			ExpectFlow:            true,
+			ExpectedRequestValue:  1000,
+			ExpectedResponseValue: 2000,
+		},
+		{
+			// Started and destroyed between the dumps.
+			Info:                  NewFakeConnInfoBuilder().WithMsgType(conntrack.NfctMsgDestroy).WithStartTimestamp(ns(lastSync.Add(500*time.Millisecond))).WithStopTimestamp(ns(lastSync.Add(time.Second))).WithOrigCounters(1, 100).WithReplyCounters(1, 300).Build(),
+			LastSync:              lastSync,
+			ExpectFlow:            true,
+			ExpectedRequestValue:  200,
+			ExpectedResponseValue: 600,
+		},
+		{
+			// First dump, the counters cover the whole connection.
+			Info:                  NewFakeConnInfoBuilder().WithStartTimestamp(ns(now.Add(-4*time.Second))).WithOrigCounters(4, 400).Build(),
+			ExpectFlow:            true,
+			ExpectedRequestValue:  100,
+			ExpectedResponseValue: 0,
+		},
+		{
+			// No timestamps, fall back to the time between dumps.
+			Info:                  NewFakeConnInfoBuilder().WithOrigCounters(2, 600).WithReplyCounters(2, 200).Build(),
+			LastSync:              lastSync,
+			ExpectFlow:            true,
+			ExpectedRequestValue:  300,
+			ExpectedResponseValue: 100,
+		},
+		{
+			// No timestamps and no previous dump, the interval is unknown.
+			Info:       NewFakeConnInfoBuilder().WithOrigCounters(2, 600).Build(),
+			ExpectFlow: false,
+		},
+	}
+
+	for i, test := range tests {
+		flow := buildDeltaFlow("key", test.Info, test.LastSync, now)
+		if (flow != nil) != test.ExpectFlow {
+			t.Errorf("Test %d: expected flow %t, got %++v", i, test.ExpectFlow, flow)
+			continue
+		}
+		if flow == nil {
+			continue
+		}
+		if flow.RequestValue != test.ExpectedRequestValue || flow.ResponseValue != test.ExpectedResponseValue {
+			t.Errorf("Test %d: expected request/response %d/%d, got %d/%d", i,
+				test.ExpectedRequestValue, test.ExpectedResponseValue, flow.RequestValue, flow.ResponseValue)
+		}
+	}
+}
+
+func TestSyncConntrackInfo(t *testing.T) {
+	k := conntracktest.NewFakeKernel(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	start := uint64(k.Now().Add(-time.Minute).UnixNano())
+	conn := func(port uint16, server string, requestBytes, responseBytes uint64) conntrack.ConntrackInfo {
+		return *NewFakeConnInfoBuilder().WithProto(syscall.IPPROTO_TCP).
+			WithSrc(net.ParseIP(server)).WithSrcPort(6379).WithDst(net.ParseIP("10.0.0.5")).WithDstPort(port).
+			WithOrigCounters(10, requestBytes).WithReplyCounters(10, responseBytes).WithStartTimestamp(start).
+			WithTCPState(conntrack.TCPState_ESTABLISHED).WithStatus(conntrack.IpsSeenReply | conntrack.IpsAssured).Build()
+	}
+	// The second one isn't between endpoints.
+	k.Add(conn(1001, "10.0.0.6", 1000, 1000), conn(1002, "10.0.0.9", 1000, 1000))
+	c, err := conntrack.NewWithConfig(conntrack.Config{FilterFunc: conntrack.DefaultFilter, Dialer: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	flowCollector := NewFlowCollector(c)
+	// The first dump only sets the counters flows are measured from.
+	flowCollector.OnEndpointsUpdate([]api.Endpoints{{
+		Subsets: []api.EndpointSubset{{Addresses: []api.EndpointAddress{{IP: "10.0.0.5"}, {IP: "10.0.0.6"}, {IP: "10.0.0.7"}}}},
+	}})
+	if flows := flowCollector.GetAllFlows(); len(flows) != 0 {
+		t.Errorf("expected no flow, got %++v", flows)
+	}
+
+	k.Advance(10 * time.Second)
+	k.Add(conn(1001, "10.0.0.6", 2000, 3000), conn(1002, "10.0.0.9", 2000, 3000), conn(1003, "10.0.0.7", 500, 500))
+	flowCollector.TrackFlow()
+	flows := flowCollector.GetAllFlows()
+	if len(flows) != 1 {
+		t.Fatalf("expected 1 flow, got %++v", flows)
+	}
+	flow := flows[0]
+	if expected := keyFunc(&k.Table()[0]); flow.UID != expected {
+		t.Errorf("expected flow %s, got %s", expected, flow.UID)
+	}
+	if !flow.Src.Equal(net.ParseIP("10.0.0.6")) || !flow.Dst.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("expected a flow from 10.0.0.6 to 10.0.0.5, got %s to %s", flow.Src, flow.Dst)
+	}
+	// 1000 and 2000 bytes in the 10 seconds between the dumps.
+	if flow.RequestValue != 100 || flow.ResponseValue != 200 {
+		t.Errorf("expected request/response 100/200, got %d/%d", flow.RequestValue, flow.ResponseValue)
+	}
+
+	// 1003 started before the previous dump, which has it now.
+	flowCollector.Reset()
+	k.Advance(10 * time.Second)
+	flowCollector.TrackFlow()
+	if flows := flowCollector.GetAllFlows(); len(flows) != 2 || flows[0].Value != 0 || flows[1].Value != 0 {
+		t.Errorf("expected 2 idle flows, got %++v", flows)
+	}
+}
+
+// The flow of a connection expected by a helper, e.g. FTP data, is linked to the flow of its master.
+func TestSyncConntrackInfoMaster(t *testing.T) {
+	k := conntracktest.NewFakeKernel(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	start := uint64(k.Now().Add(-time.Minute).UnixNano())
+	conn := func(port, serverPort uint16, bytes uint64) conntrack.ConntrackInfo {
+		return *NewFakeConnInfoBuilder().WithProto(syscall.IPPROTO_TCP).
+			WithSrc(net.ParseIP("10.0.0.6")).WithSrcPort(serverPort).WithDst(net.ParseIP("10.0.0.5")).WithDstPort(port).
+			WithOrigCounters(10, bytes).WithReplyCounters(10, bytes).WithStartTimestamp(start).
+			WithTCPState(conntrack.TCPState_ESTABLISHED).WithStatus(conntrack.IpsSeenReply | conntrack.IpsAssured).Build()
+	}
+	control := conn(38318, 21, 100)
+	data := conn(41001, 50000, 1000)
+	data.Master, data.MasterProto = &control.Orig, syscall.IPPROTO_TCP
+	// Its master is gone.
+	orphan := conn(41002, 50001, 1000)
+	orphan.Master, orphan.MasterProto = &conntrack.Tuple{Src: control.Orig.Src, SrcPort: 38319, Dst: control.Orig.Dst, DstPort: 21}, syscall.IPPROTO_TCP
+	k.Add(control, data, orphan)
+	c, err := conntrack.NewWithConfig(conntrack.Config{FilterFunc: conntrack.DefaultFilter, Dialer: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	flowCollector := NewFlowCollector(c)
+	flowCollector.OnEndpointsUpdate([]api.Endpoints{{
+		Subsets: []api.EndpointSubset{{Addresses: []api.EndpointAddress{{IP: "10.0.0.5"}, {IP: "10.0.0.6"}}}},
+	}})
+	k.Advance(10 * time.Second)
+	flowCollector.TrackFlow()
+
+	expected := map[string]string{
+		keyFunc(&control): "",
+		keyFunc(&data):    keyFunc(&control),
+		keyFunc(&orphan):  "",
+	}
+	flows := flowCollector.GetAllFlows()
+	if len(flows) != len(expected) {
+		t.Fatalf("expected %d flows, got %++v", len(expected), flows)
+	}
+	for _, flow := range flows {
+		if master, ok := expected[flow.UID]; !ok || flow.Master != master {
+			t.Errorf("flow %s: expected master %q, got %q", flow.UID, master, flow.Master)
+		}
+	}
+}
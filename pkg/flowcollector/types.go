@@ -4,11 +4,21 @@ import (
 	"net"
 )
 
-// Network flow between two endpoints. Value is in bytes/s
+// Network flow between two endpoints. Values are in bytes/s.
+// Src is the endpoint serving the connection and Dst the client that opened it.
+// RequestValue is the traffic from Dst to Src, ResponseValue the traffic from Src to Dst
+// and Value the sum of both.
+// Master is the UID of the flow of the connection this one was expected by, e.g. the FTP control
+// connection of a data connection, empty if there is none or it is gone.
 type Flow struct {
 	UID                  string `json:"uid,omitempty"`
 	Src                  net.IP `json:"source,omitempty"`
 	Dst                  net.IP `json:"destination,omitempty"`
+	Protocol             string `json:"protocol,omitempty"`
+	Zone                 uint16 `json:"zone,omitempty"`
 	Value                uint64 `json:"value,omitempty"`
+	RequestValue         uint64 `json:"requestValue,omitempty"`
+	ResponseValue        uint64 `json:"responseValue,omitempty"`
 	LastUpdatedTimestamp uint64 `json:"timestamp,omitempty"`
+	Master               string `json:"master,omitempty"`
 }
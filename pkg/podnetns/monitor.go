@@ -0,0 +1,190 @@
+package podnetns
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+
+	"github.com/golang/glog"
+)
+
+// PodFunc returns the namespace and name of the pod with the given UID.
+type PodFunc func(uid string) (namespace, name string, err error)
+
+// podConntrack monitors the conntrack table of the network namespace of a pod.
+type podConntrack struct {
+	pod       Pod
+	conntrack *conntrack.ConnTrack
+	// Keeps the namespace from going away, or its path pointing to another one, while monitored.
+	netns *os.File
+}
+
+// Monitor monitors the conntrack tables of the network namespaces of the pods on the node, where
+// some CNIs track pod to pod traffic instead of the namespace of the node.
+// A connection between two pods of the node is in the tables of both, so their connections are
+// listed with the pod they were found in, not merged into the counts of the collectors.
+type Monitor struct {
+	procDir string
+	config  conntrack.Config
+	podFunc PodFunc
+
+	// Protects pods.
+	mu sync.Mutex
+	// key is the inode of the network namespace.
+	pods map[uint64]*podConntrack
+}
+
+// NewMonitor returns a Monitor finding pods through the processes under procDir, the /proc of the
+// node. Their tables are monitored with config, whose NetNS is ignored.
+func NewMonitor(procDir string, config conntrack.Config, podFunc PodFunc) *Monitor {
+	return &Monitor{
+		procDir: procDir,
+		config:  config,
+		podFunc: podFunc,
+
+		pods: make(map[uint64]*podConntrack),
+	}
+}
+
+// Sync starts monitoring the namespaces of new pods and stops monitoring the namespaces that are gone.
+func (this *Monitor) Sync() error {
+	namespaces, err := ListNamespaces(this.procDir)
+	if err != nil {
+		return fmt.Errorf("Error listing pod network namespaces: %v", err)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	current := make(map[uint64]bool, len(namespaces))
+	for _, ns := range namespaces {
+		current[ns.Inode] = true
+		if _, exists := this.pods[ns.Inode]; exists {
+			continue
+		}
+		p, err := this.monitor(ns)
+		if err != nil {
+			// Tried again at the next sync.
+			glog.Warningf("Error monitoring network namespace of pod %s: %v", ns.PodUID, err)
+			continue
+		}
+		glog.V(3).Infof("Monitoring conntrack of pod %s/%s", p.pod.Namespace, p.pod.Name)
+		this.pods[ns.Inode] = p
+	}
+	for inode, p := range this.pods {
+		if !current[inode] {
+			glog.V(3).Infof("Stopped monitoring conntrack of pod %s/%s", p.pod.Namespace, p.pod.Name)
+			p.close()
+			delete(this.pods, inode)
+		}
+	}
+	return nil
+}
+
+func (this *Monitor) monitor(ns Namespace) (*podConntrack, error) {
+	namespace, name, err := this.podFunc(ns.PodUID)
+	if err != nil {
+		return nil, err
+	}
+	netns, err := os.Open(ns.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := netns.Stat()
+	if err != nil {
+		netns.Close()
+		return nil, err
+	}
+	if fileInode(info) != ns.Inode {
+		// The process was replaced since the namespaces were listed.
+		netns.Close()
+		return nil, fmt.Errorf("%s changed namespace", ns.Path)
+	}
+	config := this.config
+	config.NetNS = fmt.Sprintf("/proc/self/fd/%d", netns.Fd())
+	c, err := conntrack.NewWithConfig(config)
+	if err != nil {
+		netns.Close()
+		return nil, err
+	}
+	return &podConntrack{
+		pod:       Pod{UID: ns.PodUID, Namespace: namespace, Name: name},
+		conntrack: c,
+		netns:     netns,
+	}, nil
+}
+
+func (p *podConntrack) close() {
+	p.conntrack.Close()
+	p.netns.Close()
+}
+
+// Pods returns the pods whose namespaces are monitored, sorted by namespace and name.
+func (this *Monitor) Pods() []Pod {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	pods := make([]Pod, 0, len(this.pods))
+	for _, p := range this.pods {
+		pods = append(pods, p.pod)
+	}
+	sort.Sort(byName(pods))
+	return pods
+}
+
+// ListConnections dumps the tables of all the monitored namespaces and returns the entries passing
+// the filters, with the pod they were found in. Namespaces that can't be dumped are skipped.
+func (this *Monitor) ListConnections() []Connection {
+	// Held throughout, so that Sync doesn't close a namespace while it is read.
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var conns []Connection
+	for _, p := range this.pods {
+		infos, err := p.conntrack.ListConntrackInfos()
+		if err != nil {
+			glog.Errorf("Error listing conntrack of pod %s/%s: %v", p.pod.Namespace, p.pod.Name, err)
+			continue
+		}
+		for _, info := range infos {
+			conns = append(conns, Connection{p.pod, info})
+		}
+	}
+	return conns
+}
+
+// ConnectionEvents returns the connections established in the monitored namespaces since the
+// last call, with the pod they were found in.
+func (this *Monitor) ConnectionEvents() []Connection {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var conns []Connection
+	for _, p := range this.pods {
+		for _, info := range p.conntrack.ConnectionEvents() {
+			conns = append(conns, Connection{p.pod, info})
+		}
+	}
+	return conns
+}
+
+// Close stops monitoring all the namespaces.
+func (this *Monitor) Close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for inode, p := range this.pods {
+		p.close()
+		delete(this.pods, inode)
+	}
+}
+
+type byName []Pod
+
+func (p byName) Len() int      { return len(p) }
+func (p byName) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byName) Less(i, j int) bool {
+	if p[i].Namespace != p[j].Namespace {
+		return p[i].Namespace < p[j].Namespace
+	}
+	return p[i].Name < p[j].Name
+}
@@ -0,0 +1,82 @@
+package podnetns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The pod cgroups of the kubelet are named after the pod UID, e.g. /kubepods/burstable/pod<uid>/<container>
+// with the cgroupfs driver and kubepods-burstable-pod<uid>.slice, with underscores, with the systemd one.
+var podUIDRegexp = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// ListNamespaces returns the network namespaces of the pods running on the node, found through the
+// processes under procDir, the /proc of the node. Namespaces without any process of a pod, like the
+// one of the node, which host network pods share, are left out.
+func ListNamespaces(procDir string) ([]Namespace, error) {
+	host, err := netNSInode("/proc/self/ns/net")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading own network namespace: %v", err)
+	}
+	dirs, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[uint64]bool{host: true}
+	var namespaces []Namespace
+	for _, dir := range dirs {
+		if _, err := strconv.Atoi(dir.Name()); err != nil {
+			continue
+		}
+		path := filepath.Join(procDir, dir.Name(), "ns", "net")
+		inode, err := netNSInode(path)
+		if err != nil || seen[inode] {
+			// The process is gone, or its namespace was already found.
+			continue
+		}
+		cgroup, err := ioutil.ReadFile(filepath.Join(procDir, dir.Name(), "cgroup"))
+		if err != nil {
+			continue
+		}
+		uid := podUID(string(cgroup))
+		if uid == "" {
+			// Other processes of the namespace may still be in a pod.
+			continue
+		}
+		seen[inode] = true
+		namespaces = append(namespaces, Namespace{Inode: inode, Path: path, PodUID: uid})
+	}
+	return namespaces, nil
+}
+
+// NetNSPath returns the path of the network namespace of process pid under procDir.
+func NetNSPath(procDir string, pid int) string {
+	return filepath.Join(procDir, strconv.Itoa(pid), "ns", "net")
+}
+
+// podUID returns the UID of the pod of the cgroup listed in cgroup, the content of /proc/<pid>/cgroup,
+// empty if the process isn't in a pod.
+func podUID(cgroup string) string {
+	m := podUIDRegexp.FindStringSubmatch(cgroup)
+	if m == nil {
+		return ""
+	}
+	return strings.Replace(m[1], "_", "-", -1)
+}
+
+func netNSInode(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fileInode(info), nil
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	return info.Sys().(*syscall.Stat_t).Ino
+}
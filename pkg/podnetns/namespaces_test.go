@@ -0,0 +1,34 @@
+package podnetns
+
+import (
+	"testing"
+)
+
+func TestPodUID(t *testing.T) {
+	tests := []struct {
+		name   string
+		cgroup string
+		uid    string
+	}{
+		{
+			name:   "cgroupfs driver",
+			cgroup: "12:memory:/kubepods/burstable/pod0f6b8c1e-5a4d-11e6-8b77-86f30ca893d3/4f2c1b\n11:cpu,cpuacct:/kubepods/burstable/pod0f6b8c1e-5a4d-11e6-8b77-86f30ca893d3/4f2c1b\n",
+			uid:    "0f6b8c1e-5a4d-11e6-8b77-86f30ca893d3",
+		},
+		{
+			name:   "systemd driver",
+			cgroup: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod0f6b8c1e_5a4d_11e6_8b77_86f30ca893d3.slice/cri-containerd-4f2c1b.scope\n",
+			uid:    "0f6b8c1e-5a4d-11e6-8b77-86f30ca893d3",
+		},
+		{
+			name:   "not a pod",
+			cgroup: "0::/system.slice/docker.service\n",
+			uid:    "",
+		},
+	}
+	for _, test := range tests {
+		if uid := podUID(test.cgroup); uid != test.uid {
+			t.Errorf("%s: expected %q, got %q", test.name, test.uid, uid)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package podnetns
+
+import (
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+// Namespace is the network namespace of a pod running on the node.
+type Namespace struct {
+	// Inode identifies the namespace.
+	Inode uint64
+	// Path is the namespace file of one of the processes in it, e.g. /proc/<pid>/ns/net.
+	Path string
+	// PodUID is the UID of the pod, found in the cgroup of the process.
+	PodUID string
+}
+
+// Pod identifies the pod a network namespace belongs to.
+type Pod struct {
+	UID       string `json:"uid"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Connection is a conntrack entry of the network namespace of a pod.
+type Connection struct {
+	Pod Pod
+	conntrack.ConntrackInfo
+}
@@ -0,0 +1,109 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/flowcollector"
+	"github.com/dongyiyang/k8sconnection/pkg/transactioncounter"
+
+	"github.com/golang/glog"
+)
+
+// Player replays a recording of a Recorder through a TransactionCounter and a FlowCollector, which
+// get the endpoints, dumps and events recorded in the same order, and measure the intervals of the
+// recording. Replaying a recording twice gives the same transactions and flows.
+type Player struct {
+	source             *conntrack.ReplaySource
+	conntrack          *conntrack.ConnTrack
+	transactionCounter *transactioncounter.TransactionCounter
+	flowCollector      *flowcollector.FlowCollector
+}
+
+// NewPlayer returns a Player of the recording in r. filterFunc and destroyFilterFunc are the
+// FilterFunc and DestroyFilterFunc of the ConnTrack of the collectors; the kernel side filters were
+// applied when recording.
+func NewPlayer(r io.Reader, filterFunc, destroyFilterFunc conntrack.FilterFunc) (*Player, error) {
+	source, err := conntrack.NewReplaySource(r)
+	if err != nil {
+		return nil, err
+	}
+	c, err := conntrack.NewWithSource(conntrack.Config{
+		FilterFunc:        filterFunc,
+		ZeroCounters:      source.ZeroCounters(),
+		DestroyFilterFunc: destroyFilterFunc,
+	}, source)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	return &Player{
+		source:             source,
+		conntrack:          c,
+		transactionCounter: transactioncounter.NewTransactionCounter(c),
+		flowCollector:      flowcollector.NewFlowCollector(c),
+	}, nil
+}
+
+func (this *Player) TransactionCounter() *transactioncounter.TransactionCounter {
+	return this.transactionCounter
+}
+
+func (this *Player) FlowCollector() *flowcollector.FlowCollector {
+	return this.flowCollector
+}
+
+// Now returns the time of the recording the replay got to.
+func (this *Player) Now() time.Time {
+	return this.conntrack.Now()
+}
+
+// Play replays the recording, calling round, if not nil, at the end of every recorded round of
+// polls of the collectors, e.g. to read what they measured in it.
+func (this *Player) Play(round func()) error {
+	return this.source.Play(&playerHandler{Player: this, round: round})
+}
+
+// Close releases the ConnTrack of the collectors.
+func (this *Player) Close() {
+	this.conntrack.Close()
+}
+
+// playerHandler makes the recorded calls of the collectors.
+type playerHandler struct {
+	*Player
+	round func()
+}
+
+func (this *playerHandler) List() {
+	this.flowCollector.TrackFlow()
+}
+
+func (this *playerHandler) ConnectionEvents() {
+	this.transactionCounter.ProcessConntrackConnections()
+}
+
+func (this *playerHandler) Call(name string, payload []byte) {
+	if name != endpointsCall {
+		glog.Warningf("Skipping recorded call %q", name)
+		return
+	}
+	var allEndpoints []api.Endpoints
+	if err := json.Unmarshal(payload, &allEndpoints); err != nil {
+		glog.Errorf("Error replaying endpoints: %v", err)
+		return
+	}
+	// In the order of the handlers of the agent.
+	this.transactionCounter.OnEndpointsUpdate(allEndpoints)
+	this.flowCollector.OnEndpointsUpdate(allEndpoints)
+}
+
+func (this *playerHandler) Note(name string, payload []byte) {
+	if name == roundNote && this.round != nil {
+		this.round()
+	}
+}
@@ -0,0 +1,84 @@
+package replay
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+// testdata/collectors.rec records the collectors of an agent getting the endpoints of a service,
+// 10.0.0.5 and 10.0.0.6, at 0.5s and polled at 1s and 2s. A connection between them was open
+// before the agent started, another one opens at 0.8s and a third one at 1.4s.
+func TestPlayer(t *testing.T) {
+	start := time.Unix(1792307624, 0)
+	expected := []struct {
+		at           time.Time
+		transactions []string
+		flows        []string
+	}{
+		{
+			// The counter needs a previous poll for a rate.
+			at: start.Add(time.Second),
+			flows: []string{
+				"10.0.0.6:6379->10.0.0.5:1001/tcp#1792307614000000000 4000 8000 1792307625",
+				"10.0.0.6:6379->10.0.0.5:1002/tcp#1792307624800000000 2500 2500 1792307625",
+			},
+		},
+		{
+			at:           start.Add(2 * time.Second),
+			transactions: []string{"default/redis tcp map[10.0.0.5:1 10.0.0.6:1]"},
+			flows:        []string{"10.0.0.6:6379->10.0.0.5:1001/tcp#1792307614000000000 2000 4000 1792307626"},
+		},
+	}
+
+	// Replays go the same way.
+	for i := 0; i < 3; i++ {
+		f, err := os.Open("testdata/collectors.rec")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		p, err := NewPlayer(f, conntrack.DefaultFilter, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		round := 0
+		err = p.Play(func() {
+			defer func() { round++ }()
+			var transactions, flows []string
+			for _, transaction := range p.TransactionCounter().GetAllTransactions() {
+				transactions = append(transactions, fmt.Sprintf("%s %s %v", transaction.ServiceId, transaction.Protocol, transaction.EndpointsCounterMap))
+			}
+			p.TransactionCounter().Reset()
+			for _, flow := range p.FlowCollector().GetAllFlows() {
+				flows = append(flows, fmt.Sprintf("%s %d %d %d", flow.UID, flow.RequestValue, flow.ResponseValue, flow.LastUpdatedTimestamp))
+			}
+			p.FlowCollector().Reset()
+
+			if round >= len(expected) {
+				t.Errorf("unexpected round %d", round)
+				return
+			}
+			if !p.Now().Equal(expected[round].at) {
+				t.Errorf("round %d: expected the time %v, got %v", round, expected[round].at, p.Now())
+			}
+			if !reflect.DeepEqual(transactions, expected[round].transactions) {
+				t.Errorf("round %d: expected the transactions %q, got %q", round, expected[round].transactions, transactions)
+			}
+			if !reflect.DeepEqual(flows, expected[round].flows) {
+				t.Errorf("round %d: expected the flows %q, got %q", round, expected[round].flows, flows)
+			}
+		})
+		p.Close()
+		f.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if round != len(expected) {
+			t.Errorf("expected %d rounds, got %d", len(expected), round)
+		}
+	}
+}
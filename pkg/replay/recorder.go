@@ -0,0 +1,66 @@
+package replay
+
+import (
+	"encoding/json"
+	"sync"
+
+	"k8s.io/kubernetes/pkg/api"
+	proxyconfig "k8s.io/kubernetes/pkg/proxy/config"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+
+	"github.com/golang/glog"
+)
+
+// The names of the calls and notes of the recordings.
+const (
+	// The endpoints handed to the handlers, in JSON.
+	endpointsCall = "endpoints"
+	// A round of polls of the collectors ended.
+	roundNote = "round"
+)
+
+// Recorder records the endpoints handed to the collectors and the rounds in which they are polled,
+// along with the dumps and events of the ConnTrack they read, so that a Player can replay them.
+type Recorder struct {
+	// Endpoints updates and rounds are recorded one at a time, so that a replay can tell which dumps
+	// they made.
+	mu sync.Mutex
+
+	recorder *conntrack.Recorder
+	handlers []proxyconfig.EndpointsConfigHandler
+}
+
+// NewRecorder returns a Recorder recording with recorder, the Config.Recorder of the ConnTrack of
+// the collectors. It hands the endpoints to handlers, in order.
+func NewRecorder(recorder *conntrack.Recorder, handlers ...proxyconfig.EndpointsConfigHandler) *Recorder {
+	return &Recorder{recorder: recorder, handlers: handlers}
+}
+
+// Implement k8s.io/pkg/proxy/config/EndpointsConfigHandler Interface.
+func (this *Recorder) OnEndpointsUpdate(allEndpoints []api.Endpoints) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	update := func() {
+		for _, handler := range this.handlers {
+			handler.OnEndpointsUpdate(allEndpoints)
+		}
+	}
+	payload, err := json.Marshal(allEndpoints)
+	if err != nil {
+		glog.Errorf("Error recording endpoints: %v", err)
+		update()
+		return
+	}
+	this.recorder.Call(endpointsCall, payload, update)
+}
+
+// Round calls round, which polls the collectors, and records that it did.
+func (this *Recorder) Round(round func()) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	round()
+	this.recorder.Note(roundNote, nil)
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/podnetns"
+)
+
+// lookupQuery is a connection to look up, as given in the parameters of /conntrack/lookup.
+type lookupQuery struct {
+	proto int
+	tuple conntrack.Tuple
+	zone  uint16
+	// The tuple is the reply tuple rather than the original one.
+	reply bool
+}
+
+// parseLookupQuery reads proto, src, dst, sport, dport, or id, type and code for ICMP, zone and
+// direction (orig or reply).
+func parseLookupQuery(v url.Values) (*lookupQuery, error) {
+	q := &lookupQuery{}
+	var err error
+	if q.proto, err = conntrack.ProtocolNumber(v.Get("proto")); err != nil {
+		return nil, err
+	}
+	if q.tuple.Src = net.ParseIP(v.Get("src")); q.tuple.Src == nil {
+		return nil, fmt.Errorf("Invalid src %q", v.Get("src"))
+	}
+	if q.tuple.Dst = net.ParseIP(v.Get("dst")); q.tuple.Dst == nil {
+		return nil, fmt.Errorf("Invalid dst %q", v.Get("dst"))
+	}
+	if (q.tuple.Src.To4() == nil) != (q.tuple.Dst.To4() == nil) {
+		return nil, fmt.Errorf("src and dst are of different address families")
+	}
+
+	// parseUint parses an optional parameter of the given bit size.
+	parseUint := func(name string, bitSize int) uint64 {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return 0
+		}
+		var n uint64
+		if n, err = strconv.ParseUint(s, 10, bitSize); err != nil {
+			err = fmt.Errorf("Invalid %s %q", name, s)
+		}
+		return n
+	}
+	switch q.proto {
+	case syscall.IPPROTO_ICMP, syscall.IPPROTO_ICMPV6:
+		q.tuple.IcmpId = uint16(parseUint("id", 16))
+		q.tuple.IcmpType = uint8(parseUint("type", 8))
+		q.tuple.IcmpCode = uint8(parseUint("code", 8))
+	default:
+		q.tuple.SrcPort = uint16(parseUint("sport", 16))
+		q.tuple.DstPort = uint16(parseUint("dport", 16))
+	}
+	q.zone = uint16(parseUint("zone", 16))
+	if err != nil {
+		return nil, err
+	}
+
+	switch v.Get("direction") {
+	case "", "orig":
+	case "reply":
+		q.reply = true
+	default:
+		return nil, fmt.Errorf("Invalid direction %q, must be orig or reply", v.Get("direction"))
+	}
+	return q, nil
+}
+
+type tupleView struct {
+	Src      net.IP `json:"src"`
+	SrcPort  uint16 `json:"sport,omitempty"`
+	Dst      net.IP `json:"dst"`
+	DstPort  uint16 `json:"dport,omitempty"`
+	IcmpId   uint16 `json:"id,omitempty"`
+	IcmpType uint8  `json:"type,omitempty"`
+	IcmpCode uint8  `json:"code,omitempty"`
+}
+
+type countersView struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// connectionView is how a connection is shown by /conntrack/lookup.
+type connectionView struct {
+	Protocol      string       `json:"protocol"`
+	Orig          tupleView    `json:"orig"`
+	Reply         tupleView    `json:"reply"`
+	OrigCounters  countersView `json:"origCounters"`
+	ReplyCounters countersView `json:"replyCounters"`
+	// The TCP or SCTP state.
+	State  string `json:"state,omitempty"`
+	Status string `json:"status"`
+	// Seconds left before the entry expires.
+	Timeout uint32     `json:"timeout"`
+	Mark    uint32     `json:"mark"`
+	Zone    uint16     `json:"zone"`
+	Id      uint32     `json:"id"`
+	Start   *time.Time `json:"start,omitempty"`
+	// The connection that expected this one, if any, e.g. the FTP control connection.
+	MasterProtocol string     `json:"masterProtocol,omitempty"`
+	Master         *tupleView `json:"master,omitempty"`
+}
+
+func newTupleView(t conntrack.Tuple) tupleView {
+	return tupleView{t.Src, t.SrcPort, t.Dst, t.DstPort, t.IcmpId, t.IcmpType, t.IcmpCode}
+}
+
+func newConnectionView(info *conntrack.ConntrackInfo) *connectionView {
+	v := &connectionView{
+		Protocol:      conntrack.ProtocolName(info.Proto),
+		Orig:          newTupleView(info.Orig),
+		Reply:         newTupleView(info.Reply),
+		OrigCounters:  countersView{info.OrigCounters.Packets, info.OrigCounters.Bytes},
+		ReplyCounters: countersView{info.ReplyCounters.Packets, info.ReplyCounters.Bytes},
+		Status:        info.Status.String(),
+		Timeout:       info.Timeout,
+		Mark:          info.Mark,
+		Zone:          info.Zone,
+		Id:            info.Id,
+	}
+	switch info.Proto {
+	case syscall.IPPROTO_TCP:
+		v.State = info.TCPState.String()
+	case syscall.IPPROTO_SCTP:
+		v.State = info.SCTPState.String()
+	}
+	if info.StartTimestamp != 0 {
+		start := info.Start()
+		v.Start = &start
+	}
+	if info.Master != nil {
+		master := newTupleView(*info.Master)
+		v.MasterProtocol = conntrack.ProtocolName(info.MasterProto)
+		v.Master = &master
+	}
+	return v
+}
+
+// podConnectionView is how a connection of the network namespace of a pod is shown by /conntrack/pods.
+type podConnectionView struct {
+	Pod podnetns.Pod `json:"pod"`
+	*connectionView
+}
+
+// expectationView is how an expectation is shown by /conntrack/expectations.
+type expectationView struct {
+	Helper   string    `json:"helper"`
+	Protocol string    `json:"protocol"`
+	Expected tupleView `json:"expected"`
+	// The fields of expected that must match, the others are wildcards.
+	Mask tupleView `json:"mask"`
+	// Seconds left before the expectation expires.
+	Timeout uint32 `json:"timeout"`
+	Zone    uint16 `json:"zone"`
+	// The connection that created the expectation, nil if it is gone.
+	Master *connectionView `json:"master,omitempty"`
+}
+
+func newExpectationView(e conntrack.Expectation, master *conntrack.ConntrackInfo) *expectationView {
+	v := &expectationView{
+		Helper:   e.Helper,
+		Protocol: conntrack.ProtocolName(e.Proto),
+		Expected: newTupleView(e.Tuple),
+		Mask:     newTupleView(e.Mask),
+		Timeout:  e.Timeout,
+		Zone:     e.Zone,
+	}
+	if master != nil {
+		v.Master = newConnectionView(master)
+	}
+	return v
+}
+
+// expectationEventView is how an ExpectationEvent is shown by /conntrack/expectations/events.
+type expectationEventView struct {
+	// new, update or destroy, with the expectation that changed, or resync, with the whole
+	// expectation table, after events were lost.
+	Event        string             `json:"event"`
+	Expectations []*expectationView `json:"expectations"`
+}
+
+var expectationEventNames = map[conntrack.NfConntrackEventType]string{
+	conntrack.NfctMsgNew:     "new",
+	conntrack.NfctMsgUpdate:  "update",
+	conntrack.NfctMsgDestroy: "destroy",
+}
+
+// lookupStatus is the HTTP status for an error of a lookup.
+func lookupStatus(err error) int {
+	if errors.Is(err, syscall.ENOENT) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+func TestParseLookupQuery(t *testing.T) {
+	tests := []struct {
+		Query         string
+		ExpectedQuery *lookupQuery
+	}{
+		{
+			Query: "proto=tcp&src=10.0.0.5&sport=38318&dst=10.96.0.10&dport=6379",
+			ExpectedQuery: &lookupQuery{
+				proto: syscall.IPPROTO_TCP,
+				tuple: conntrack.Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: 38318, Dst: net.ParseIP("10.96.0.10"), DstPort: 6379},
+			},
+		},
+		{
+			Query: "proto=17&src=fd00::3&sport=53&dst=fd00::5&dport=41000&zone=2&direction=reply",
+			ExpectedQuery: &lookupQuery{
+				proto: syscall.IPPROTO_UDP,
+				tuple: conntrack.Tuple{Src: net.ParseIP("fd00::3"), SrcPort: 53, Dst: net.ParseIP("fd00::5"), DstPort: 41000},
+				zone:  2,
+				reply: true,
+			},
+		},
+		{
+			Query: "proto=icmp&src=10.0.0.5&dst=10.0.0.3&id=7&type=8",
+			ExpectedQuery: &lookupQuery{
+				proto: syscall.IPPROTO_ICMP,
+				tuple: conntrack.Tuple{Src: net.ParseIP("10.0.0.5"), Dst: net.ParseIP("10.0.0.3"), IcmpId: 7, IcmpType: 8},
+			},
+		},
+		{
+			Query: "proto=tcp&src=10.0.0.5&sport=65536&dst=10.0.0.3&dport=80",
+		},
+		{
+			Query: "proto=tcp&src=10.0.0.5&sport=1000&dst=fd00::3&dport=80",
+		},
+		{
+			Query: "proto=tcp&src=10.0.0.5&dst=10.0.0.3&direction=both",
+		},
+		{
+			Query: "proto=gre&src=10.0.0.5&dst=10.0.0.3",
+		},
+	}
+
+	for i, test := range tests {
+		v, err := url.ParseQuery(test.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := parseLookupQuery(v)
+		if test.ExpectedQuery == nil {
+			if err == nil {
+				t.Errorf("Test %d: expected an error, got %++v", i, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, test.ExpectedQuery) {
+			t.Errorf("Test %d: expected %++v, got %++v", i, test.ExpectedQuery, q)
+		}
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 
+	"github.com/dongyiyang/k8sconnection/pkg/cleaner"
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
 	fcollector "github.com/dongyiyang/k8sconnection/pkg/flowcollector"
+	"github.com/dongyiyang/k8sconnection/pkg/podnetns"
+	"github.com/dongyiyang/k8sconnection/pkg/tablemonitor"
 	tcounter "github.com/dongyiyang/k8sconnection/pkg/transactioncounter"
 
 	"github.com/golang/glog"
@@ -14,16 +19,24 @@ import (
 
 // Server is a http.Handler which exposes kubelet functionality over HTTP.
 type Server struct {
+	conntrack     *conntrack.ConnTrack
 	counter       *tcounter.TransactionCounter
 	flowCollector *fcollector.FlowCollector
+	tableMonitor  *tablemonitor.TableMonitor
+	quarantine    *cleaner.Quarantine
+	podMonitor    *podnetns.Monitor
 	mux           *http.ServeMux
 }
 
 // NewServer initializes and configures a kubelet.Server object to handle HTTP requests.
-func NewServer(counter *tcounter.TransactionCounter, flowCollector *fcollector.FlowCollector) Server {
+func NewServer(conntrack *conntrack.ConnTrack, counter *tcounter.TransactionCounter, flowCollector *fcollector.FlowCollector, tableMonitor *tablemonitor.TableMonitor, quarantine *cleaner.Quarantine, podMonitor *podnetns.Monitor) Server {
 	server := Server{
+		conntrack:     conntrack,
 		counter:       counter,
 		flowCollector: flowCollector,
+		tableMonitor:  tableMonitor,
+		quarantine:    quarantine,
+		podMonitor:    podMonitor,
 		mux:           http.NewServeMux(),
 	}
 	server.InstallDefaultHandlers()
@@ -36,6 +49,15 @@ func (s *Server) InstallDefaultHandlers() {
 	s.mux.HandleFunc("/transactions/count", s.getTransactionsCount)
 	s.mux.HandleFunc("/transactions", s.getAllTransactionsAndReset)
 	s.mux.HandleFunc("/flows", s.getAllFlows)
+	s.mux.HandleFunc("/events/stats", s.getEventStats)
+	s.mux.HandleFunc("/conntrack/stats", s.getKernelStats)
+	s.mux.HandleFunc("/conntrack/table", s.getTableStatus)
+	s.mux.HandleFunc("/conntrack/table/owners", s.getTableOwners)
+	s.mux.HandleFunc("/conntrack/quarantine", s.quarantinePod)
+	s.mux.HandleFunc("/conntrack/lookup", s.lookupConnection)
+	s.mux.HandleFunc("/conntrack/expectations", s.getExpectations)
+	s.mux.HandleFunc("/conntrack/expectations/events", s.followExpectations)
+	s.mux.HandleFunc("/conntrack/pods", s.getPodConnections)
 }
 
 // ServeHTTP responds to HTTP requests on the Kubelet.
@@ -88,6 +110,250 @@ func (s *Server) getAllFlows(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+func (s *Server) getEventStats(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(s.conntrack.EventStats(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (s *Server) getKernelStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.conntrack.KernelStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (s *Server) getTableStatus(w http.ResponseWriter, r *http.Request) {
+	if s.tableMonitor == nil {
+		fmt.Fprintf(w, "Table Monitor is disabled.")
+		return
+	}
+	data, err := json.MarshalIndent(s.tableMonitor.Status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (s *Server) getTableOwners(w http.ResponseWriter, r *http.Request) {
+	if s.tableMonitor == nil {
+		fmt.Fprintf(w, "Table Monitor is disabled.")
+		return
+	}
+	attribution, err := s.tableMonitor.Attribute()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.MarshalIndent(attribution, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getPodConnections returns the connections tracked in the network namespaces of the pods.
+func (s *Server) getPodConnections(w http.ResponseWriter, r *http.Request) {
+	if s.podMonitor == nil {
+		fmt.Fprintf(w, "Pod network namespace monitoring is disabled.")
+		return
+	}
+	views := []*podConnectionView{}
+	for _, conn := range s.podMonitor.ListConnections() {
+		info := conn.ConntrackInfo
+		views = append(views, &podConnectionView{conn.Pod, newConnectionView(&info)})
+	}
+	data, err := json.MarshalIndent(views, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// lookupConnection returns a single connection, see parseLookupQuery for the parameters.
+func (s *Server) lookupConnection(w http.ResponseWriter, r *http.Request) {
+	q, err := parseLookupQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var info *conntrack.ConntrackInfo
+	if q.reply {
+		info, err = s.conntrack.LookupReply(q.proto, q.tuple, q.zone)
+	} else {
+		info, err = s.conntrack.Lookup(q.proto, q.tuple, q.zone)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), lookupStatus(err))
+		return
+	}
+	data, err := json.MarshalIndent(newConnectionView(info), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getExpectations returns the expectations with their master connections.
+func (s *Server) getExpectations(w http.ResponseWriter, r *http.Request) {
+	exps, err := s.conntrack.ListExpectations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	masters, err := s.conntrack.ExpectationMasters(exps)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views := []*expectationView{}
+	for i, e := range exps {
+		views = append(views, newExpectationView(e, masters[i]))
+	}
+	data, err := json.MarshalIndent(views, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// followExpectations streams the expectation events with their master connections, one JSON
+// object per line, until the client goes away.
+func (s *Server) followExpectations(w http.ResponseWriter, r *http.Request) {
+	events, stop, err := s.conntrack.FollowExpectations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer stop()
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(s.newExpectationEventView(event)); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// newExpectationEventView returns the view of event, with the master connections of its
+// expectations that are still there.
+func (s *Server) newExpectationEventView(event conntrack.ExpectationEvent) *expectationEventView {
+	if e := event.Expectation; e != nil {
+		master, err := s.conntrack.Lookup(e.MasterProto, e.Master, e.Zone)
+		if err != nil {
+			glog.V(3).Infof("Master of expectation %s not found: %v", e, err)
+		}
+		return &expectationEventView{
+			Event:        expectationEventNames[e.MsgType],
+			Expectations: []*expectationView{newExpectationView(*e, master)},
+		}
+	}
+	masters, err := s.conntrack.ExpectationMasters(event.Table)
+	if err != nil {
+		glog.Errorf("Error finding the masters of the expectations: %v", err)
+		masters = make([]*conntrack.ConntrackInfo, len(event.Table))
+	}
+	v := &expectationEventView{Event: "resync", Expectations: []*expectationView{}}
+	for i, e := range event.Table {
+		v.Expectations = append(v.Expectations, newExpectationView(e, masters[i]))
+	}
+	return v
+}
+
+// quarantinePod deletes all the conntrack entries of the pod given by the namespace and pod
+// parameters. It must be POSTed with the quarantine token as bearer token.
+func (s *Server) quarantinePod(w http.ResponseWriter, r *http.Request) {
+	if s.quarantine == nil {
+		http.Error(w, "Quarantine is disabled.", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Quarantine must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := bearerToken(r.Header.Get("Authorization"))
+	if !ok || !s.quarantine.Authorized(token) {
+		glog.Warningf("Unauthorized quarantine request from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+	namespace := r.FormValue("namespace")
+	pod := r.FormValue("pod")
+	if namespace == "" || pod == "" {
+		http.Error(w, "namespace and pod are required.", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.quarantine.CutPod(namespace, pod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.MarshalIndent(map[string]int{"deleted": deleted}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// bearerToken returns the token of an Authorization header of the Bearer scheme, RFC 6750. The
+// scheme is case insensitive.
+func bearerToken(authorization string) (string, bool) {
+	const scheme = "Bearer "
+	if len(authorization) <= len(scheme) || !strings.EqualFold(authorization[:len(scheme)], scheme) {
+		return "", false
+	}
+	return authorization[len(scheme):], true
+}
+
 func (s *Server) resetCounter() {
 	s.counter.Reset()
 }
@@ -97,13 +363,16 @@ func handler(w http.ResponseWriter, r *http.Request) {
 }
 
 // TODO: For now the address and port number is hardcoded. The actual port number need to be discussed.
-func ListenAndServeProxyServer(bindAddress, bindPort string, counter *tcounter.TransactionCounter, flowCollector *fcollector.FlowCollector) {
+func ListenAndServeProxyServer(bindAddress, bindPort, certFile, keyFile string, conntrack *conntrack.ConnTrack, counter *tcounter.TransactionCounter, flowCollector *fcollector.FlowCollector, tableMonitor *tablemonitor.TableMonitor, quarantine *cleaner.Quarantine, podMonitor *podnetns.Monitor) {
 	glog.V(3).Infof("Start VMT Kube-proxy server")
-	handler := NewServer(counter, flowCollector)
+	handler := NewServer(conntrack, counter, flowCollector, tableMonitor, quarantine, podMonitor)
 	s := &http.Server{
 		Addr:           net.JoinHostPort(bindAddress, bindPort),
 		Handler:        &handler,
 		MaxHeaderBytes: 1 << 20,
 	}
+	if certFile != "" {
+		glog.Fatal(s.ListenAndServeTLS(certFile, keyFile))
+	}
 	glog.Fatal(s.ListenAndServe())
 }
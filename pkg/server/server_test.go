@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/cleaner"
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack/conntracktest"
+)
+
+func TestQuarantinePod(t *testing.T) {
+	conn := conntrack.ConntrackInfo{
+		Proto:    syscall.IPPROTO_TCP,
+		Orig:     conntrack.Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: 38318, Dst: net.ParseIP("10.0.0.6"), DstPort: 6379},
+		Reply:    conntrack.Tuple{Src: net.ParseIP("10.0.0.6"), SrcPort: 6379, Dst: net.ParseIP("10.0.0.5"), DstPort: 38318},
+		Status:   conntrack.IpsSeenReply | conntrack.IpsAssured | conntrack.IpsConfirmed,
+		TCPState: conntrack.TCPState_ESTABLISHED,
+	}
+	tokenFile, err := ioutil.TempFile("", "quarantine-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	if _, err := tokenFile.WriteString("s3cret\n"); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile.Close()
+	podIP := func(namespace, name string) (net.IP, error) {
+		return net.ParseIP("10.0.0.5"), nil
+	}
+
+	tests := []struct {
+		Method         string
+		Authorization  string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{"POST", "", http.StatusUnauthorized, "Unauthorized."},
+		{"POST", "Basic czNjcmV0", http.StatusUnauthorized, "Unauthorized."},
+		// The token without the scheme.
+		{"POST", "s3cret", http.StatusUnauthorized, "Unauthorized."},
+		{"POST", "Bearer s3cre", http.StatusUnauthorized, "Unauthorized."},
+		{"POST", "Bearer ", http.StatusUnauthorized, "Unauthorized."},
+		{"GET", "Bearer s3cret", http.StatusMethodNotAllowed, "Quarantine must be POSTed."},
+		{"POST", "Bearer s3cret", http.StatusOK, `"deleted": 1`},
+		{"POST", "bearer s3cret", http.StatusOK, `"deleted": 0`},
+	}
+
+	k := conntracktest.NewFakeKernel(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	k.Add(conn)
+	c, err := conntrack.NewWithConfig(conntrack.Config{FilterFunc: conntrack.DefaultFilter, Dialer: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+	quarantine, err := cleaner.NewQuarantine(c, podIP, tokenFile.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := NewServer(c, nil, nil, nil, quarantine, nil)
+
+	for i, test := range tests {
+		r := httptest.NewRequest(test.Method, "/conntrack/quarantine?namespace=default&pod=redis", nil)
+		if test.Authorization != "" {
+			r.Header.Set("Authorization", test.Authorization)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.ExpectedStatus {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.ExpectedStatus, w.Code)
+		}
+		if body := w.Body.String(); !strings.Contains(body, test.ExpectedBody) {
+			t.Errorf("Test %d: expected %q in %q", i, test.ExpectedBody, body)
+		}
+		if test.ExpectedStatus == http.StatusUnauthorized && len(k.Table()) != 1 {
+			t.Errorf("Test %d: expected the connection kept, got %v", i, k.Table())
+		}
+	}
+	if table := k.Table(); len(table) != 0 {
+		t.Errorf("expected the connection deleted, got %v", table)
+	}
+}
+
+func TestFollowExpectations(t *testing.T) {
+	control := conntrack.ConntrackInfo{
+		Proto:    syscall.IPPROTO_TCP,
+		Orig:     conntrack.Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: 38318, Dst: net.ParseIP("10.0.0.6"), DstPort: 21},
+		Reply:    conntrack.Tuple{Src: net.ParseIP("10.0.0.6"), SrcPort: 21, Dst: net.ParseIP("10.0.0.5"), DstPort: 38318},
+		Status:   conntrack.IpsSeenReply | conntrack.IpsAssured | conntrack.IpsConfirmed,
+		TCPState: conntrack.TCPState_ESTABLISHED,
+	}
+	expectation := func(msgType conntrack.NfConntrackEventType, port uint16) conntrack.Expectation {
+		return conntrack.Expectation{
+			MsgType:     msgType,
+			Master:      control.Orig,
+			MasterProto: syscall.IPPROTO_TCP,
+			Tuple:       conntrack.Tuple{Src: net.ParseIP("10.0.0.6"), Dst: net.ParseIP("10.0.0.5"), DstPort: port},
+			Proto:       syscall.IPPROTO_TCP,
+			Mask:        conntrack.Tuple{Src: net.ParseIP("255.255.255.255"), Dst: net.ParseIP("255.255.255.255"), DstPort: 0xffff},
+			Helper:      "ftp",
+		}
+	}
+	k := conntracktest.NewFakeKernel(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	k.Add(control)
+	c, err := conntrack.NewWithConfig(conntrack.Config{FilterFunc: conntrack.DefaultFilter, Dialer: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+	s := NewServer(c, nil, nil, nil, nil, nil)
+	server := httptest.NewServer(&s)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/conntrack/expectations/events")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// The expectations are followed once the headers are sent.
+	tests := []struct {
+		Change        func()
+		Event         string
+		ExpectedPorts []uint16
+	}{
+		{func() { k.ExpectationEvent(expectation(conntrack.NfctMsgNew, 50001)) }, "new", []uint16{50001}},
+		{func() { k.ExpectationOverflow(expectation(conntrack.NfctMsgNew, 50002)) }, "resync", []uint16{50001, 50002}},
+	}
+	lines := bufio.NewScanner(resp.Body)
+	for _, test := range tests {
+		test.Change()
+		if !lines.Scan() {
+			t.Fatalf("%s: expected an event, got %v", test.Event, lines.Err())
+		}
+		var v expectationEventView
+		if err := json.Unmarshal(lines.Bytes(), &v); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.Event, err)
+		}
+		if v.Event != test.Event || len(v.Expectations) != len(test.ExpectedPorts) {
+			t.Errorf("expected %s of %v, got %s", test.Event, test.ExpectedPorts, lines.Text())
+			continue
+		}
+		for i, e := range v.Expectations {
+			if e.Expected.DstPort != test.ExpectedPorts[i] || e.Master == nil {
+				t.Errorf("%s: expected %d with its master, got %s", test.Event, test.ExpectedPorts[i], lines.Text())
+			}
+		}
+	}
+}
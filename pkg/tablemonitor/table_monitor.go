@@ -0,0 +1,248 @@
+package tablemonitor
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/transactioncounter"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Warn when the table is fuller than this.
+	fillWarningRatio = 0.9
+	// Warn when the table will be full sooner than this.
+	exhaustionWarning = 10 * time.Minute
+)
+
+// owner is the pod, or the endpoints object, an endpoint address belongs to.
+type owner struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// TableMonitor samples the fill level of the conntrack table to predict when it will be exhausted,
+// and attributes its entries to the pods they belong to.
+type TableMonitor struct {
+	conntrack *conntrack.ConnTrack
+	// Knows the endpoints the entries are attributed to, nil if the counter is disabled.
+	counter *transactioncounter.TransactionCounter
+
+	// Samples older than window are dropped.
+	window time.Duration
+
+	// Protects samples.
+	mu sync.Mutex
+
+	// Oldest first.
+	samples []Sample
+}
+
+// NewTableMonitor returns a TableMonitor predicting exhaustion from the samples of the last window,
+// and attributing entries to the endpoints counter knows. Entries aren't attributed if counter is
+// nil.
+func NewTableMonitor(c *conntrack.ConnTrack, counter *transactioncounter.TransactionCounter, window time.Duration) *TableMonitor {
+	return &TableMonitor{
+		conntrack: c,
+		counter:   counter,
+		window:    window,
+	}
+}
+
+// Sample records the current fill level of the table and warns if it is about to be full.
+func (this *TableMonitor) Sample() {
+	entries, maxEntries, err := this.conntrack.TableSize()
+	if err != nil {
+		glog.Errorf("Error getting conntrack table size: %v", err)
+		return
+	}
+	now := time.Now()
+
+	this.mu.Lock()
+	this.samples = append(this.samples, Sample{now, entries, maxEntries})
+	// Drop the samples that got out of the window.
+	i := 0
+	for i < len(this.samples) && now.Sub(this.samples[i].Time) > this.window {
+		i++
+	}
+	this.samples = this.samples[i:]
+	status := buildStatus(this.samples)
+	this.mu.Unlock()
+
+	if maxEntries > 0 && float64(entries) >= fillWarningRatio*float64(maxEntries) {
+		glog.Warningf("Conntrack table is %d%% full (%d/%d entries)", 100*uint64(entries)/uint64(maxEntries), entries, maxEntries)
+	}
+	if full := time.Duration(status.SecondsUntilFull * float64(time.Second)); full > 0 && full < exhaustionWarning {
+		glog.Warningf("Conntrack table grows by %.1f entries/s and will be full in %v", status.GrowthRate, full)
+	}
+}
+
+// Status returns the current fill level of the table and its history.
+func (this *TableMonitor) Status() *TableStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	status := buildStatus(this.samples)
+	status.History = append([]Sample(nil), this.samples...)
+	return status
+}
+
+// buildStatus works the status out from samples, oldest first.
+func buildStatus(samples []Sample) *TableStatus {
+	status := &TableStatus{}
+	if len(samples) == 0 {
+		return status
+	}
+	last := samples[len(samples)-1]
+	status.Entries = last.Entries
+	status.MaxEntries = last.MaxEntries
+	status.GrowthRate = growthRate(samples)
+	if status.GrowthRate > 0 && last.MaxEntries > last.Entries {
+		status.SecondsUntilFull = float64(last.MaxEntries-last.Entries) / status.GrowthRate
+	}
+	return status
+}
+
+// growthRate fits a line to the number of entries over time by least squares and returns its slope,
+// in entries per second. Unlike the difference between the first and last sample, it isn't thrown
+// off by a single spike.
+func growthRate(samples []Sample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	n := float64(len(samples))
+	var sumX, sumY, sumXX, sumXY float64
+	for _, s := range samples {
+		x := s.Time.Sub(samples[0].Time).Seconds()
+		y := float64(s.Entries)
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	d := n*sumXX - sumX*sumX
+	if d == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / d
+}
+
+// Attribute dumps the whole table and counts the entries of every pod. Entries are counted as they
+// are read, so a nearly full table isn't copied in memory.
+func (this *TableMonitor) Attribute() (*Attribution, error) {
+	if this.counter == nil {
+		return nil, errNoEndpoints
+	}
+	lookup := this.counter.EndpointLookup()
+
+	var err error
+	for i := 0; i <= maxDumpRetries; i++ {
+		a := newAttributor(lookup)
+		err = this.conntrack.DumpAllConntrackInfos(func(info conntrack.ConntrackInfo) error {
+			a.add(info)
+			return nil
+		})
+		if err == nil {
+			return a.attribution(), nil
+		}
+		if err != conntrack.ErrDumpInterrupted {
+			return nil, err
+		}
+		// Counting again from scratch, as entries may have been seen twice.
+	}
+	return nil, err
+}
+
+// How many times an interrupted dump is started again.
+const maxDumpRetries = 3
+
+// errNoEndpoints is returned by Attribute when the endpoints aren't known.
+var errNoEndpoints = errors.New("Attributing conntrack entries needs the connection counter")
+
+func attribute(infos []conntrack.ConntrackInfo, lookup transactioncounter.EndpointLookup) *Attribution {
+	a := newAttributor(lookup)
+	for _, info := range infos {
+		a.add(info)
+	}
+	return a.attribution()
+}
+
+// attributor counts entries as they are dumped.
+type attributor struct {
+	lookup transactioncounter.EndpointLookup
+	a      *Attribution
+	counts map[owner]int
+}
+
+func newAttributor(lookup transactioncounter.EndpointLookup) *attributor {
+	return &attributor{
+		lookup: lookup,
+		a: &Attribution{
+			Namespaces: make(map[string]int),
+			Zones:      make(map[uint16]int),
+		},
+		counts: make(map[owner]int),
+	}
+}
+
+func (this *attributor) add(info conntrack.ConntrackInfo) {
+	a := this.a
+	a.Entries++
+	a.Zones[info.Zone]++
+	// Use the real addresses of both ends, the ones before SNAT and after DNAT.
+	client, clientKnown := this.owner(info.Client().String())
+	server, serverKnown := this.owner(info.Server().String())
+	switch {
+	case !clientKnown && !serverKnown:
+		a.Unattributed++
+		return
+	case clientKnown && serverKnown && client == server:
+		// A pod talking to itself through a service.
+		serverKnown = false
+	}
+	if clientKnown {
+		this.counts[client]++
+		a.Namespaces[client.namespace]++
+	}
+	if serverKnown {
+		this.counts[server]++
+		if !clientKnown || server.namespace != client.namespace {
+			a.Namespaces[server.namespace]++
+		}
+	}
+}
+
+// owner returns the pod with the address ip, or the endpoints object listing it if it isn't a pod.
+func (this *attributor) owner(ip string) (owner, bool) {
+	endpoints, pod, ok := this.lookup(ip)
+	switch {
+	case !ok:
+		return owner{}, false
+	case pod != nil:
+		return owner{pod.Kind, pod.Namespace, pod.Name}, true
+	}
+	return owner{"Endpoints", endpoints.Namespace, endpoints.Name}, true
+}
+
+// attribution returns the counts of the entries added.
+func (this *attributor) attribution() *Attribution {
+	a, counts := this.a, this.counts
+	for o, count := range counts {
+		a.Owners = append(a.Owners, OwnerEntries{o.kind, o.namespace, o.name, count})
+	}
+	sort.Slice(a.Owners, func(i, j int) bool {
+		if a.Owners[i].Entries != a.Owners[j].Entries {
+			return a.Owners[i].Entries > a.Owners[j].Entries
+		}
+		if a.Owners[i].Namespace != a.Owners[j].Namespace {
+			return a.Owners[i].Namespace < a.Owners[j].Namespace
+		}
+		return a.Owners[i].Name < a.Owners[j].Name
+	})
+	return a
+}
@@ -0,0 +1,117 @@
+package tablemonitor
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/types"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+)
+
+func TestBuildStatus(t *testing.T) {
+	start := time.Unix(1471017300, 0)
+	sample := func(sec int, entries uint32) Sample {
+		return Sample{start.Add(time.Duration(sec) * time.Second), entries, 1000}
+	}
+
+	tests := []struct {
+		Samples                  []Sample
+		ExpectedGrowthRate       float64
+		ExpectedSecondsUntilFull float64
+	}{
+		{
+			Samples: nil,
+		},
+		{
+			Samples: []Sample{sample(0, 100)},
+		},
+		{
+			// Steady growth.
+			Samples:                  []Sample{sample(0, 100), sample(10, 200), sample(20, 300)},
+			ExpectedGrowthRate:       10,
+			ExpectedSecondsUntilFull: 70,
+		},
+		{
+			// A spike in the middle doesn't change the trend.
+			Samples:                  []Sample{sample(0, 100), sample(10, 500), sample(20, 300)},
+			ExpectedGrowthRate:       10,
+			ExpectedSecondsUntilFull: 70,
+		},
+		{
+			// Shrinking, the table won't be full.
+			Samples:            []Sample{sample(0, 300), sample(10, 200)},
+			ExpectedGrowthRate: -10,
+		},
+	}
+
+	for i, test := range tests {
+		status := buildStatus(test.Samples)
+		if math.Abs(status.GrowthRate-test.ExpectedGrowthRate) > 1e-9 {
+			t.Errorf("Test %d: expected growth rate %f, got %f", i, test.ExpectedGrowthRate, status.GrowthRate)
+		}
+		if math.Abs(status.SecondsUntilFull-test.ExpectedSecondsUntilFull) > 1e-9 {
+			t.Errorf("Test %d: expected %f seconds until full, got %f", i, test.ExpectedSecondsUntilFull, status.SecondsUntilFull)
+		}
+	}
+}
+
+func TestAttribute(t *testing.T) {
+	pods := map[string]*api.ObjectReference{
+		"10.0.0.3": {Kind: "Pod", Namespace: "default", Name: "redis-master"},
+		"10.0.0.4": {Kind: "Pod", Namespace: "default", Name: "frontend"},
+		"10.0.0.5": {Kind: "Pod", Namespace: "monitoring", Name: "prometheus"},
+	}
+	lookup := func(ip string) (types.NamespacedName, *api.ObjectReference, bool) {
+		switch pod, ok := pods[ip]; {
+		case ok:
+			return types.NamespacedName{Namespace: pod.Namespace, Name: "service"}, pod, true
+		case ip == "10.0.0.6":
+			// An endpoint that isn't a pod.
+			return types.NamespacedName{Namespace: "default", Name: "external-db"}, nil, true
+		}
+		return types.NamespacedName{}, nil, false
+	}
+	// Orig and reply tuples of a connection from client to server, without NAT.
+	conn := func(client, server string) conntrack.ConntrackInfo {
+		c, s := net.ParseIP(client), net.ParseIP(server)
+		return conntrack.ConntrackInfo{
+			Orig:  conntrack.Tuple{Src: c, Dst: s},
+			Reply: conntrack.Tuple{Src: s, Dst: c},
+		}
+	}
+	inZone := func(info conntrack.ConntrackInfo, zone uint16) conntrack.ConntrackInfo {
+		info.Zone = zone
+		return info
+	}
+
+	infos := []conntrack.ConntrackInfo{
+		conn("10.0.0.4", "10.0.0.3"),
+		conn("10.0.0.4", "10.0.0.3"),
+		conn("10.0.0.5", "10.0.0.4"),
+		conn("10.0.0.4", "10.0.0.4"),
+		conn("10.0.0.4", "10.0.0.6"),
+		inZone(conn("192.168.1.1", "192.168.1.2"), 2),
+	}
+	expected := &Attribution{
+		Entries:      6,
+		Unattributed: 1,
+		Namespaces:   map[string]int{"default": 5, "monitoring": 1},
+		Zones:        map[uint16]int{0: 5, 2: 1},
+		Owners: []OwnerEntries{
+			{"Pod", "default", "frontend", 5},
+			{"Pod", "default", "redis-master", 2},
+			{"Endpoints", "default", "external-db", 1},
+			{"Pod", "monitoring", "prometheus", 1},
+		},
+	}
+
+	a := attribute(infos, lookup)
+	if !reflect.DeepEqual(a, expected) {
+		t.Errorf("Expected attribution %++v, got %++v", expected, a)
+	}
+}
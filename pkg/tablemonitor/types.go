@@ -0,0 +1,48 @@
+package tablemonitor
+
+import (
+	"time"
+)
+
+// Sample is how full the conntrack table was at some point.
+type Sample struct {
+	Time       time.Time `json:"time"`
+	Entries    uint32    `json:"entries"`
+	MaxEntries uint32    `json:"maxEntries"`
+}
+
+// TableStatus tells how full the conntrack table is and, if it keeps growing, when it will be full.
+type TableStatus struct {
+	Entries    uint32 `json:"entries"`
+	MaxEntries uint32 `json:"maxEntries"`
+	// GrowthRate is by how many entries per second the table grew over the samples.
+	GrowthRate float64 `json:"growthRate"`
+	// SecondsUntilFull is when the table will be full at GrowthRate, 0 if it isn't growing.
+	SecondsUntilFull float64 `json:"secondsUntilFull,omitempty"`
+	// History is the fill level over time, oldest first.
+	History []Sample `json:"history,omitempty"`
+}
+
+// OwnerEntries is the number of conntrack entries of which a pod is one end. Addresses of
+// endpoints that aren't pods are attributed to the endpoints object instead.
+type OwnerEntries struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+}
+
+// Attribution breaks the entries of the table down by owner and namespace. An entry between two
+// pods counts for both.
+type Attribution struct {
+	// Entries is the number of entries dumped.
+	Entries int `json:"entries"`
+	// Unattributed is the number of entries without any known endpoint, e.g. of the node itself.
+	Unattributed int `json:"unattributed"`
+	// Namespaces is the number of entries per namespace.
+	Namespaces map[string]int `json:"namespaces,omitempty"`
+	// Zones is the number of entries per conntrack zone, attributed or not.
+	Zones map[uint16]int `json:"zones,omitempty"`
+	// Owners, the ones with the most entries first.
+	Owners []OwnerEntries `json:"owners,omitempty"`
+}
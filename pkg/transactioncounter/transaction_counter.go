@@ -8,12 +8,25 @@ import (
 	"k8s.io/kubernetes/pkg/types"
 
 	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/util"
 
 	"github.com/golang/glog"
 )
 
 type endpointsInfo struct {
 	types.NamespacedName
+	// The pod with the address, nil if it isn't one.
+	pod *api.ObjectReference
+}
+
+// EndpointLookup tells what an endpoint address belongs to: the endpoints object listing it, and the
+// pod with the address, nil if it isn't one.
+type EndpointLookup func(ip string) (endpoints types.NamespacedName, pod *api.ObjectReference, ok bool)
+
+// Transactions of a service are counted separately for each protocol.
+type transactionKey struct {
+	serviceName string
+	protocol    string
 }
 
 type TransactionCounter struct {
@@ -23,15 +36,15 @@ type TransactionCounter struct {
 
 	endpointsMap map[string]*endpointsInfo
 
-	// key is service name, value is the transaction related to it.
-	counter map[string]map[string]int
+	// key is service name and protocol, value is the transaction related to it.
+	counter map[transactionKey]map[string]int
 
 	lastPollTimestamp uint64
 }
 
 func NewTransactionCounter(conntrack *conntrack.ConnTrack) *TransactionCounter {
 	return &TransactionCounter{
-		counter:   make(map[string]map[string]int),
+		counter:   make(map[transactionKey]map[string]int),
 		conntrack: conntrack,
 
 		endpointsMap: make(map[string]*endpointsInfo),
@@ -57,7 +70,12 @@ func (this *TransactionCounter) OnEndpointsUpdate(allEndpoints []api.Endpoints)
 			ss := &endpoints.Subsets[j]
 			for k := range ss.Addresses {
 				addr := &ss.Addresses[k]
-				this.endpointsMap[addr.IP] = &endpointsInfo{types.NamespacedName{Namespace: endpoints.Namespace, Name: endpoints.Name}}
+				info := &endpointsInfo{NamespacedName: types.NamespacedName{Namespace: endpoints.Namespace, Name: endpoints.Name}}
+				if ref := addr.TargetRef; ref != nil && ref.Kind == "Pod" {
+					pod := *ref
+					info.pod = &pod
+				}
+				this.endpointsMap[util.CanonicalIP(addr.IP)] = info
 			}
 		}
 	}
@@ -65,27 +83,44 @@ func (this *TransactionCounter) OnEndpointsUpdate(allEndpoints []api.Endpoints)
 	this.syncConntrack()
 }
 
+// EndpointLookup returns the EndpointLookup of the addresses of the last endpoints update. It keeps
+// answering for that update, so it can be used throughout a dump without holding up the counter.
+func (this *TransactionCounter) EndpointLookup() EndpointLookup {
+	this.mu.Lock()
+	// OnEndpointsUpdate replaces the map instead of changing it, so it can be read unlocked.
+	endpointsMap := this.endpointsMap
+	this.mu.Unlock()
+	return func(ip string) (types.NamespacedName, *api.ObjectReference, bool) {
+		info, ok := endpointsMap[ip]
+		if !ok {
+			return types.NamespacedName{}, nil, false
+		}
+		return info.NamespacedName, info.pod, true
+	}
+}
+
 // Clear the transaction counter map.
 func (tc *TransactionCounter) Reset() {
 	glog.V(3).Infof("Inside reset transaction counter")
-	counterMap := make(map[string]map[string]int)
+	counterMap := make(map[transactionKey]map[string]int)
 
 	tc.counter = counterMap
 
 	// As after each poll, the counter map is cleaned, so this is the right place to set the lastPollTimestamp.
-	tc.lastPollTimestamp = uint64(time.Now().Unix())
+	tc.lastPollTimestamp = uint64(tc.conntrack.Now().Unix())
 }
 
 // Increment the transaction count for a single endpoint.
-// Transaction counter map uses serviceName as key and endpoint map as value.
+// Transaction counter map uses serviceName and protocol as key and endpoint map as value.
 // In endpoint map, key is endpoint IP address, value is the number of transaction happened on the endpoint.
 func (tc *TransactionCounter) Count(infos []*countInfo) {
 	for _, info := range infos {
 		serviceName := info.serviceName
 		endpointAddress := info.endpointAddress
-		epMap, ok := tc.counter[serviceName]
+		key := transactionKey{serviceName, info.protocol}
+		epMap, ok := tc.counter[key]
 		if !ok {
-			glog.V(4).Infof("Service %s is not tracked. Now initializing in map", serviceName)
+			glog.V(4).Infof("Service %s (%s) is not tracked. Now initializing in map", serviceName, info.protocol)
 
 			epMap = make(map[string]int)
 		}
@@ -95,7 +130,7 @@ func (tc *TransactionCounter) Count(infos []*countInfo) {
 			count = 0
 		}
 		epMap[endpointAddress] = count + 1
-		tc.counter[serviceName] = epMap
+		tc.counter[key] = epMap
 		glog.V(4).Infof("Transaction count of %s is %d.", endpointAddress, epMap[endpointAddress])
 	}
 }
@@ -109,10 +144,10 @@ func (tc *TransactionCounter) GetAllTransactions() []*Transaction {
 		return transactions
 	}
 	// Get the time difference between two poll.
-	timeDiff := uint64(time.Now().Unix()) - tc.lastPollTimestamp
+	timeDiff := uint64(tc.conntrack.Now().Unix()) - tc.lastPollTimestamp
 	glog.V(4).Infof("Time diff is %d", timeDiff)
 
-	for svcName, epMap := range tc.counter {
+	for key, epMap := range tc.counter {
 		// Before append, change count to count per second.
 		valueMap := make(map[string]float64)
 		countMap := make(map[string]int)
@@ -121,7 +156,8 @@ func (tc *TransactionCounter) GetAllTransactions() []*Transaction {
 			countMap[ep] = count
 		}
 		transaction := &Transaction{
-			ServiceId:           svcName,
+			ServiceId:           key.serviceName,
+			Protocol:            key.protocol,
 			EndpointsCounterMap: valueMap,
 			EpCountAbs:          countMap,
 		}
@@ -132,7 +168,8 @@ func (tc *TransactionCounter) GetAllTransactions() []*Transaction {
 	return transactions
 }
 
-// Get all the current Established TCP connections from conntrack and add count to transaction counter.
+// Get all the current established connections of every tracked protocol (TCP, UDP, SCTP, ICMP...) from
+// conntrack and add count to transaction counter, keyed per protocol.
 func (this *TransactionCounter) ProcessConntrackConnections() {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -154,16 +191,20 @@ func (this *TransactionCounter) syncConntrack() {
 type countInfo struct {
 	serviceName     string
 	endpointAddress string
+	protocol        string
 }
 
 // Filter out connection does not have endpoints address as either Local or Remote Address
 func (this *TransactionCounter) preProcessConnections(c conntrack.ConntrackInfo) []*countInfo {
 	var infos []*countInfo
-	if svcName, exist := this.endpointsMap[c.Src.String()]; exist {
-		infos = append(infos, &countInfo{svcName.String(), c.Src.String()})
+	protocol := conntrack.ProtocolName(c.Proto)
+	server := c.Server().String()
+	client := c.Client().String()
+	if svcName, exist := this.endpointsMap[server]; exist {
+		infos = append(infos, &countInfo{svcName.String(), server, protocol})
 	}
-	if svcName, exist := this.endpointsMap[c.Dst.String()]; exist {
-		infos = append(infos, &countInfo{svcName.String(), c.Dst.String()})
+	if svcName, exist := this.endpointsMap[client]; exist {
+		infos = append(infos, &countInfo{svcName.String(), client, protocol})
 	}
 	return infos
 
@@ -1,50 +1,75 @@
 package transactioncounter
 
 import (
+	"net"
+	"reflect"
+	"syscall"
 	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/types"
+
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack"
+	"github.com/dongyiyang/k8sconnection/pkg/conntrack/conntracktest"
 )
 
 func TestCount(t *testing.T) {
 	tests := []struct {
-		CounterMap      map[string]map[string]int
+		CounterMap      map[transactionKey]map[string]int
 		ServiceName     string
 		EndpointAddress string
+		Protocol        string
 		ExpectedCount   int
 	}{
 		{
-			CounterMap:      map[string]map[string]int{},
+			CounterMap:      map[transactionKey]map[string]int{},
 			ServiceName:     "service1",
 			EndpointAddress: "10.0.0.2",
+			Protocol:        "tcp",
 			ExpectedCount:   1,
 		},
 		{
-			CounterMap: map[string]map[string]int{
-				"service1": map[string]int{
+			CounterMap: map[transactionKey]map[string]int{
+				transactionKey{"service1", "tcp"}: map[string]int{
 					"10.0.1.2": 3,
 				},
 			},
 			ServiceName:     "service1",
 			EndpointAddress: "10.0.0.2",
+			Protocol:        "tcp",
 			ExpectedCount:   1,
 		},
 		{
-			CounterMap: map[string]map[string]int{
-				"service1": map[string]int{
+			CounterMap: map[transactionKey]map[string]int{
+				transactionKey{"service1", "tcp"}: map[string]int{
 					"10.0.0.2": 3,
 				},
 			},
 			ServiceName:     "service1",
 			EndpointAddress: "10.0.0.2",
+			Protocol:        "tcp",
 			ExpectedCount:   4,
 		},
+		{
+			CounterMap: map[transactionKey]map[string]int{
+				transactionKey{"service1", "tcp"}: map[string]int{
+					"10.0.0.2": 3,
+				},
+			},
+			ServiceName:     "service1",
+			EndpointAddress: "10.0.0.2",
+			Protocol:        "udp",
+			ExpectedCount:   1,
+		},
 	}
 
 	for _, test := range tests {
 		transactionCounter := NewTransactionCounter(nil)
 		transactionCounter.counter = test.CounterMap
-		transactionCounter.Count([]*countInfo{&countInfo{test.ServiceName, test.EndpointAddress}})
+		transactionCounter.Count([]*countInfo{&countInfo{test.ServiceName, test.EndpointAddress, test.Protocol}})
 		var c int
-		if epMap, exist := transactionCounter.counter[test.ServiceName]; exist {
+		if epMap, exist := transactionCounter.counter[transactionKey{test.ServiceName, test.Protocol}]; exist {
 			if epCounts, has := epMap[test.EndpointAddress]; has {
 				c = epCounts
 			} else {
@@ -58,3 +83,99 @@ func TestCount(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessConntrackConnections(t *testing.T) {
+	conn := func(msgType conntrack.NfConntrackEventType, port uint16, server string, state conntrack.TCPState) conntrack.ConntrackInfo {
+		return conntrack.ConntrackInfo{
+			MsgType:  msgType,
+			Proto:    syscall.IPPROTO_TCP,
+			Orig:     conntrack.Tuple{Src: net.ParseIP("10.0.0.5"), SrcPort: port, Dst: net.ParseIP("10.96.0.10"), DstPort: 6379},
+			Reply:    conntrack.Tuple{Src: net.ParseIP(server), SrcPort: 6379, Dst: net.ParseIP("10.0.0.5"), DstPort: port},
+			Status:   conntrack.IpsSeenReply | conntrack.IpsAssured | conntrack.IpsConfirmed,
+			TCPState: state,
+		}
+	}
+	k := conntracktest.NewFakeKernel(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	k.Add(conn(0, 1001, "10.0.0.6", conntrack.TCPState_ESTABLISHED))
+	c, err := conntrack.NewWithConfig(conntrack.Config{FilterFunc: conntrack.DefaultFilter, Dialer: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	transactionCounter := NewTransactionCounter(c)
+	// Counts the connections established when the counter started.
+	transactionCounter.OnEndpointsUpdate([]api.Endpoints{{
+		ObjectMeta: api.ObjectMeta{Namespace: "default", Name: "redis"},
+		Subsets:    []api.EndpointSubset{{Addresses: []api.EndpointAddress{{IP: "10.0.0.6"}, {IP: "10.0.0.7"}}}},
+	}})
+
+	k.Event(conn(conntrack.NfctMsgNew, 1002, "10.0.0.7", conntrack.TCPState_SYN_SENT),
+		conn(conntrack.NfctMsgUpdate, 1002, "10.0.0.7", conntrack.TCPState_ESTABLISHED),
+		conn(conntrack.NfctMsgUpdate, 1003, "10.0.0.6", conntrack.TCPState_ESTABLISHED),
+		// Not an endpoint.
+		conn(conntrack.NfctMsgUpdate, 1004, "10.0.0.9", conntrack.TCPState_ESTABLISHED),
+		conn(conntrack.NfctMsgDestroy, 1003, "10.0.0.6", conntrack.TCPState_CLOSE))
+	k.WaitEventsRead()
+	transactionCounter.ProcessConntrackConnections()
+
+	expected := map[transactionKey]map[string]int{
+		transactionKey{"default/redis", "tcp"}: map[string]int{"10.0.0.6": 2, "10.0.0.7": 1},
+	}
+	if !reflect.DeepEqual(transactionCounter.counter, expected) {
+		t.Errorf("expected %v, got %v", expected, transactionCounter.counter)
+	}
+}
+
+func TestEndpointLookup(t *testing.T) {
+	k := conntracktest.NewFakeKernel(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	c, err := conntrack.NewWithConfig(conntrack.Config{FilterFunc: conntrack.DefaultFilter, Dialer: k})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	transactionCounter := NewTransactionCounter(c)
+	transactionCounter.OnEndpointsUpdate([]api.Endpoints{{
+		ObjectMeta: api.ObjectMeta{Namespace: "default", Name: "redis"},
+		Subsets: []api.EndpointSubset{{Addresses: []api.EndpointAddress{
+			{IP: "10.0.0.6", TargetRef: &api.ObjectReference{Kind: "Pod", Namespace: "default", Name: "redis-master"}},
+			{IP: "fd00::0006"},
+		}}},
+	}})
+	lookup := transactionCounter.EndpointLookup()
+	// Later updates don't change the lookup.
+	transactionCounter.OnEndpointsUpdate(nil)
+
+	tests := []struct {
+		IP                string
+		ExpectedEndpoints types.NamespacedName
+		ExpectedPod       *api.ObjectReference
+		ExpectedOk        bool
+	}{
+		{
+			IP:                "10.0.0.6",
+			ExpectedEndpoints: types.NamespacedName{Namespace: "default", Name: "redis"},
+			ExpectedPod:       &api.ObjectReference{Kind: "Pod", Namespace: "default", Name: "redis-master"},
+			ExpectedOk:        true,
+		},
+		{
+			// Looked up in the form of net.IP.String().
+			IP:                "fd00::6",
+			ExpectedEndpoints: types.NamespacedName{Namespace: "default", Name: "redis"},
+			ExpectedOk:        true,
+		},
+		{
+			IP: "10.0.0.7",
+		},
+	}
+	for i, test := range tests {
+		endpoints, pod, ok := lookup(test.IP)
+		if endpoints != test.ExpectedEndpoints || !reflect.DeepEqual(pod, test.ExpectedPod) || ok != test.ExpectedOk {
+			t.Errorf("Test %d: expected %v %++v %v, got %v %++v %v", i, test.ExpectedEndpoints, test.ExpectedPod, test.ExpectedOk, endpoints, pod, ok)
+		}
+	}
+	if _, _, ok := transactionCounter.EndpointLookup()("10.0.0.6"); ok {
+		t.Errorf("expected no endpoint after the endpoints were removed")
+	}
+}
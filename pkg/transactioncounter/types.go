@@ -2,6 +2,7 @@ package transactioncounter
 
 type Transaction struct {
 	ServiceId           string             `json:"serviceID,omitempty"`
+	Protocol            string             `json:"protocol,omitempty"`
 	EndpointsCounterMap map[string]float64 `json:"endpointCounter,omitempty"`
 	EpCountAbs          map[string]int     `json:"endpointAbs,omitempty"`
 }
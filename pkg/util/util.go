@@ -17,12 +17,11 @@ func findIPsOfCurrentNode() (map[string]struct{}, error) {
 				netAddress := network.IP.String()
 				glog.Infof("Find network address %s", netAddress)
 
-				ipAddress := net.ParseIP(netAddress)
-				if ipAddress.To4() == nil {
-					// Only support IPv4 now
+				if network.IP.IsLinkLocalUnicast() {
+					// Link-local addresses are never used by pods or services.
 					continue
 				}
-				glog.Infof("Find valid IPv4 address %s", netAddress)
+				glog.Infof("Find valid IP address %s", netAddress)
 
 				l[netAddress] = struct{}{}
 			}
@@ -33,3 +32,15 @@ func findIPsOfCurrentNode() (map[string]struct{}, error) {
 		return nil, fmt.Errorf("Error finding IP address of current node: %s", err)
 	}
 }
+
+// CanonicalIP returns the canonical text form of an IP address, so that
+// addresses coming from the API server and from conntrack can be compared as
+// strings. IPv6 addresses may be written in several ways, e.g. fd00:0::1 and
+// fd00::1. If ip can't be parsed it is returned unchanged.
+func CanonicalIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	return parsed.String()
+}